@@ -2,8 +2,11 @@ package app
 
 import (
 	"context"
+	"mikhailche/botcomod/config"
 	"mikhailche/botcomod/handlers/middleware"
+	"mikhailche/botcomod/handlers/middleware/outbox"
 	"mikhailche/botcomod/handlers/middleware/ydbctx"
+	"mikhailche/botcomod/lib/http"
 	"mikhailche/botcomod/lib/tracer.v2"
 	"sync"
 
@@ -23,7 +26,10 @@ type App struct {
 	db           *ydb.Driver
 	Bot          *bot.TBot
 	Log          *zap.Logger
-	UpdateLogger *repository.UpdateLogger
+	UpdateLogger repository.UpdateLogStorage
+	// Processed журнал обработки обновлений, защищает от повторной доставки
+	Processed repository.ProcessedUpdateStorage
+	Config    *config.Config
 }
 
 var theApp *App
@@ -49,45 +55,47 @@ func newApp(ctx context.Context) *App {
 		panic(err)
 	}
 	log.Info("Инициализируем новое приложение. Вот и логгер уже готов.")
-	ydbDriver, err := ydbrepodriver.NewYDBDriver(ctx, log)
+	cfg, err := config.Load()
 	if err != nil {
-		log.Fatal("Ошибка инициализации YDB в приложении", zap.Error(err))
+		log.Fatal("Ошибка конфигурации", zap.Error(err))
 	}
-	userRepository, err := repository.NewUserRepository(ctx, ydbDriver, log)
+	log.Info("Конфигурация загружена", zap.Any("config", cfg.Redacted()))
+	var ydbDriver *ydb.Driver
+	var storage *repository.Storage
+	middlewares := []telebot.MiddlewareFunc{middleware.CaptureHandlerError, middleware.TracingMiddleware, outbox.Middleware(log.Named("outbox"))}
+	switch cfg.Storage {
+	case config.StorageYDB:
+		ydbDriver, err = ydbrepodriver.NewYDBDriver(ctx, log, cfg.YDB)
+		if err != nil {
+			log.Fatal("Ошибка инициализации YDB в приложении", zap.Error(err))
+		}
+		storage = repository.NewYDBStorage(ctx, ydbDriver, log, cfg.UpdateLog.SpillFile)
+		middlewares = append(middlewares, ydbctx.WithYdbTxInContext(ydbDriver, log.Named("ydbSessionMiddleware")))
+	case config.StorageMemory:
+		log.Warn("Данные хранятся в памяти и пропадут после остановки")
+		storage = repository.NewMemoryStorage(log)
+	}
+	userRepository, err := repository.NewUserRepository(ctx, storage.Users, log, cfg.Telegram.DeveloperID)
 	if err != nil {
 		log.Fatal("Ошибка инициализации пользовательского репозитория", zap.Error(err))
 	}
 
-	housesRepository := repository.NewHouseRepository(ydbDriver, log)
-	houseService := services.NewHouseService(ctx, housesRepository)
-
-	groupChatRepository := repository.NewGroupChatRepository(ydbDriver, log.Named("groupChatRepository"))
-	groupChatService := services.NewGroupChatService(ctx, groupChatRepository)
-
-	telegramChatUpserter := repository.UpsertTelegramChat(ctx, ydbDriver)
-
-	updateLogRepository := repository.NewUpdateLogger(ydbDriver, log.Named("updateLogger"))
+	houseService := services.NewHouseService(ctx, storage.Houses)
+	groupChatService := services.NewGroupChatService(ctx, storage.GroupChats)
 
 	tBot, err := bot.NewBot(
 		ctx,
 		log,
+		cfg,
 		userRepository,
 		houseService.Houses,
 		groupChatService,
-		updateLogRepository,
-		repository.SelectTelegramChatsByUserID(ydbDriver),
-		[]telebot.MiddlewareFunc{
-			middleware.TracingMiddleware,
-			ydbctx.WithYdbTxInContext(ydbDriver, log.Named("ydbSessionMiddleware")),
-			middleware.UpsertUsernameMiddleware(
-				log.Named("upsertUsernameMiddleware"),
-				userRepository, telegramChatUpserter,
-				repository.UpsertTelegramChatToUserMapping(ydbDriver),
-			),
-			middleware.AutoRespondCallback,
-			middleware.CurrentUserInContext(userRepository),
-			middleware.RecoverMiddleware(log.Named("recoverMiddleware")),
-		},
+		storage.UpdateLog,
+		storage.Processed,
+		storage.TelegramChats.SelectTelegramChatsByUserID,
+		append(middlewares, bot.HandlerMiddlewares(log, cfg, userRepository, storage.TelegramChats)...),
+		// секрет вебхука уходит в setWebhook через этот же клиент
+		http.TracedHttpClient(ctx, log.Named("telegram-http-log"), cfg.Telegram.Token, cfg.Telegram.WebhookSecret),
 	)
 	if err != nil {
 		log.Fatal("Ошибка инициализации бота", zap.Error(err))
@@ -96,6 +104,8 @@ func newApp(ctx context.Context) *App {
 		db:           ydbDriver,
 		Bot:          tBot,
 		Log:          log,
-		UpdateLogger: updateLogRepository,
+		UpdateLogger: storage.UpdateLog,
+		Processed:    storage.Processed,
+		Config:       cfg,
 	}
 }
@@ -0,0 +1,109 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mikhailche/botcomod/lib/redact"
+	"mikhailche/botcomod/lib/tracer.v2"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// timerTriggerEventType тип события, которым облачная функция вызывается по таймеру
+const timerTriggerEventType = "yandex.cloud.events.serverless.triggers.TimerMessage"
+
+// IsTimerTrigger вызов облачной функции по таймеру, а не запрос от телеграма
+func IsTimerTrigger(body []byte) bool {
+	var trigger struct {
+		Messages []struct {
+			EventMetadata struct {
+				EventType string `json:"event_type"`
+			} `json:"event_metadata"`
+		} `json:"messages"`
+	}
+	if err := json.Unmarshal(body, &trigger); err != nil {
+		return false
+	}
+	return len(trigger.Messages) > 0 && trigger.Messages[0].EventMetadata.EventType == timerTriggerEventType
+}
+
+// Задачи по расписанию. Передаются в payload таймера облачной функции, пустой payload - очистка журнала,
+// как было до появления других задач.
+const (
+	TaskPurgeExpired         = "purge_expired"
+	TaskRemindPendingReviews = "remind_pending_reviews"
+)
+
+// TimerPayload payload таймера, по которому вызвана облачная функция
+func TimerPayload(body []byte) string {
+	var trigger struct {
+		Messages []struct {
+			Details struct {
+				Payload string `json:"payload"`
+			} `json:"details"`
+		} `json:"messages"`
+	}
+	if err := json.Unmarshal(body, &trigger); err != nil || len(trigger.Messages) == 0 {
+		return ""
+	}
+	return trigger.Messages[0].Details.Payload
+}
+
+// RunScheduled выполняет задачу по расписанию по её имени из payload таймера
+func (a *App) RunScheduled(ctx context.Context, task string) error {
+	switch task {
+	case "", TaskPurgeExpired:
+		return a.PurgeExpired(ctx)
+	case TaskRemindPendingReviews:
+		return a.RemindPendingReviews(ctx)
+	}
+	return fmt.Errorf("неизвестная задача по расписанию %q", task)
+}
+
+// RemindPendingReviews напоминает регистраторам о заявках, ждущих решения дольше срока
+func (a *App) RemindPendingReviews(ctx context.Context) error {
+	ctx, span := tracer.Open(ctx, tracer.Named("App::RemindPendingReviews"))
+	defer span.Close()
+	return a.Bot.RemindPendingReviews(ctx)
+}
+
+// PurgeExpired удаляет журнал обновлений старше срока хранения из конфигурации
+func (a *App) PurgeExpired(ctx context.Context) error {
+	ctx, span := tracer.Open(ctx, tracer.Named("App::PurgeExpired"))
+	defer span.Close()
+	retention := a.Config.UpdateLog.Retention()
+	if retention == 0 {
+		a.Log.Info("Срок хранения журнала обновлений не ограничен, очистка не нужна")
+		return nil
+	}
+	before := time.Now().Add(-retention)
+	var errs []error
+	updates, err := a.UpdateLogger.PurgeBefore(ctx, before)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	processed, err := a.Processed.PurgeBefore(ctx, before)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	a.Log.Info("Очистили журнал обновлений",
+		zap.Time("before", before), zap.Uint64("updates", updates), zap.Uint64("processed", processed))
+	return errors.Join(errs...)
+}
+
+// RedactUpdate сырое обновление для журнала и логов. Если маскировка выключена, возвращает его как есть.
+// Исходный текст нигде не сохраняется: поиск по тексту и повтор обновлений видят только маску.
+func (a *App) RedactUpdate(raw string) string {
+	if !a.Config.UpdateLog.Redact {
+		return raw
+	}
+	redacted, err := redact.Update([]byte(raw))
+	if err != nil {
+		a.Log.Error("Не удалось замаскировать обновление", zap.Error(err))
+		return fmt.Sprintf("[не удалось замаскировать %d байт]", len(raw))
+	}
+	return string(redacted)
+}
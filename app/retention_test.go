@@ -0,0 +1,19 @@
+package app
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsTimerTrigger(t *testing.T) {
+	assert.True(t, IsTimerTrigger([]byte(`{"messages":[{"event_metadata":{"event_id":"a","event_type":"yandex.cloud.events.serverless.triggers.TimerMessage","created_at":"2023-05-01T00:00:00Z"},"details":{"trigger_id":"t","payload":""}}]}`)))
+	assert.False(t, IsTimerTrigger([]byte(`{"httpMethod":"POST","body":"{\"update_id\":1}"}`)))
+	assert.False(t, IsTimerTrigger([]byte(`not json`)))
+}
+
+func TestTimerPayload(t *testing.T) {
+	assert.Equal(t, TaskRemindPendingReviews, TimerPayload([]byte(`{"messages":[{"event_metadata":{"event_type":"yandex.cloud.events.serverless.triggers.TimerMessage"},"details":{"trigger_id":"t","payload":"remind_pending_reviews"}}]}`)))
+	assert.Equal(t, "", TimerPayload([]byte(`{"messages":[{"details":{"trigger_id":"t","payload":""}}]}`)))
+	assert.Equal(t, "", TimerPayload([]byte(`not json`)))
+}
@@ -0,0 +1,82 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mikhailche/botcomod/handlers/middleware"
+	"mikhailche/botcomod/lib/tracer.v2"
+
+	"github.com/mikhailche/telebot"
+	"go.uber.org/zap"
+)
+
+// HandleUpdate обрабатывает сырое обновление телеграма: пропускает повторную доставку, пишет журнал,
+// прогоняет обновление через бота и до возврата сбрасывает журнал в базу.
+// Ошибка обработчика не возвращается: её ловит [middleware.CaptureHandlerError], она логируется
+// и записывается в журнал обработки со статусом failed. Телеграм на повтор прислал бы то же самое обновление.
+func (a *App) HandleUpdate(ctx context.Context, rawUpdate string) error {
+	ctx, span := tracer.Open(ctx, tracer.Named("App::HandleUpdate"))
+	defer span.Close()
+	var update telebot.Update
+	if err := json.Unmarshal([]byte(rawUpdate), &update); err != nil {
+		return fmt.Errorf("разбор обновления: %w", err)
+	}
+	if update.ID != 0 {
+		isNew, err := a.Processed.BeginUpdate(ctx, uint64(update.ID))
+		if err != nil {
+			// без журнала лучше обработать обновление повторно, чем потерять его
+			a.Log.Error("Не удалось отметить начало обработки обновления", zap.Int("updateID", update.ID), zap.Error(err))
+		} else if !isNew {
+			a.Log.Info("Повторная доставка обновления, пропускаем", zap.Int("updateID", update.ID))
+			return nil
+		}
+	}
+
+	redacted := a.RedactUpdate(rawUpdate)
+	var updateMap map[string]any
+	_ = json.Unmarshal([]byte(redacted), &updateMap)
+	a.UpdateLogger.LogUpdate(ctx, updateMap, redacted)
+	// пишем журнал до ответа: после него среда выполнения может заморозить процесс
+	defer a.FlushUpdateLog(ctx)
+
+	a.Log.Debug("Запускаем процессинг обновления")
+	ctx, handlerErr := middleware.WithHandlerError(ctx)
+	processErr := a.Bot.Bot.ProcessUpdateCtx(ctx, update)
+	if processErr == nil {
+		processErr = handlerErr()
+	}
+	if processErr != nil {
+		a.Log.Error("Error processing update", zap.Error(processErr), zap.Int("updateID", update.ID))
+	}
+	if update.ID != 0 {
+		if err := a.Processed.CompleteUpdate(ctx, uint64(update.ID), processErr); err != nil {
+			a.Log.Error("Не удалось отметить конец обработки обновления", zap.Int("updateID", update.ID), zap.Error(err))
+		}
+	}
+	a.Log.Debug("Завершили процессинг обновления")
+	return nil
+}
+
+// FlushUpdateLog дописывает накопленный журнал обновлений и предупреждает о потерях
+func (a *App) FlushUpdateLog(ctx context.Context) {
+	if err := a.UpdateLogger.Flush(ctx); err != nil {
+		a.Log.Error("Обновления не записаны в журнал", zap.Error(err))
+	}
+	if stats := a.UpdateLogger.Stats(); stats.Dropped > 0 || stats.Failed > 0 {
+		a.Log.Warn("Проблемы с журналом обновлений", zap.Any("stats", stats))
+	}
+}
+
+// Close освобождает ресурсы приложения перед остановкой процесса
+func (a *App) Close(ctx context.Context) error {
+	ctx, span := tracer.Open(ctx, tracer.Named("App::Close"))
+	defer span.Close()
+	a.FlushUpdateLog(ctx)
+	if a.db != nil {
+		if err := a.db.Close(ctx); err != nil {
+			return fmt.Errorf("закрытие YDB: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package app
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// WebhookSecretHeader заголовок, в котором телеграм присылает секрет, заданный при setWebhook
+const WebhookSecretHeader = "X-Telegram-Bot-Api-Secret-Token"
+
+// AuthenticateWebhook сверяет секрет из заголовка запроса с настроенным. Без настроенного секрета пропускает всё.
+// Несовпадение и пропуск без проверки логируются как события безопасности, source и remote помогают найти,
+// откуда пришёл запрос.
+func (a *App) AuthenticateWebhook(secret, source, remote string) bool {
+	expected := a.Config.Telegram.WebhookSecret
+	if expected == "" {
+		a.Log.Named("security").Warn("Событие безопасности: запрос вебхука принят без проверки, секрет вебхука не настроен",
+			zap.String("event", "webhook_unauthenticated"),
+			zap.String("source", source),
+			zap.String("remote", remote),
+		)
+		return true
+	}
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(expected)) == 1 {
+		return true
+	}
+	a.Log.Named("security").Warn("Событие безопасности: запрос вебхука с неверным секретом отклонён",
+		zap.String("event", "webhook_secret_mismatch"),
+		zap.String("source", source),
+		zap.String("remote", remote),
+		zap.Bool("secretPresent", secret != ""),
+	)
+	return false
+}
+
+// HeaderValue значение заголовка без учёта регистра имени. Облачная функция отдаёт заголовки как json объект.
+func HeaderValue(headers map[string]any, name string) string {
+	for key, value := range headers {
+		if strings.EqualFold(key, name) {
+			if s, ok := value.(string); ok {
+				return s
+			}
+		}
+	}
+	return ""
+}
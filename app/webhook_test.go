@@ -0,0 +1,38 @@
+package app
+
+import (
+	"testing"
+
+	"mikhailche/botcomod/config"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestAuthenticateWebhook(t *testing.T) {
+	core, logs := observer.New(zap.WarnLevel)
+	cfg := config.Default()
+	a := &App{Log: zap.New(core), Config: &cfg}
+
+	assert.True(t, a.AuthenticateWebhook("", "test", ""), "без настроенного секрета проверка отключена")
+	assert.Len(t, logs.TakeAll(), 1, "запрос без проверки - событие безопасности")
+
+	cfg.Telegram.WebhookSecret = "s3cret_-"
+	assert.True(t, a.AuthenticateWebhook("s3cret_-", "test", "10.0.0.1"))
+	assert.Equal(t, 0, logs.Len())
+	assert.False(t, a.AuthenticateWebhook("", "test", "10.0.0.1"))
+	assert.False(t, a.AuthenticateWebhook("s3cret", "test", "10.0.0.1"))
+	events := logs.FilterField(zap.String("event", "webhook_secret_mismatch")).All()
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, "10.0.0.1", events[0].ContextMap()["remote"])
+		assert.NotContains(t, events[1].ContextMap(), "secret", "секрет не должен попадать в лог")
+	}
+}
+
+func TestHeaderValue(t *testing.T) {
+	headers := map[string]any{"x-telegram-bot-api-secret-token": "abc", "Content-Length": 12.0}
+	assert.Equal(t, "abc", HeaderValue(headers, WebhookSecretHeader))
+	assert.Equal(t, "", HeaderValue(headers, "Content-Length"))
+	assert.Equal(t, "", HeaderValue(nil, WebhookSecretHeader))
+}
@@ -5,11 +5,13 @@ import (
 	"fmt"
 	"io"
 	"math/rand"
+	"mikhailche/botcomod/config"
+	"mikhailche/botcomod/handlers/middleware/ydbctx"
 	"mikhailche/botcomod/lib/cloud"
 	"mikhailche/botcomod/lib/devbotsender"
 	"mikhailche/botcomod/lib/tracer.v2"
 	"mikhailche/botcomod/lib/vision"
-	"os"
+	nethttp "net/http"
 	"time"
 
 	"mikhailche/botcomod/handlers"
@@ -23,40 +25,55 @@ import (
 )
 
 type TBot struct {
-	Bot *telebot.Bot
+	Bot       *telebot.Bot
+	registrar *telegramRegistrator
+}
+
+// RemindPendingReviews напоминает регистраторам о заявках, ждущих дольше срока из конфигурации
+func (b *TBot) RemindPendingReviews(ctx context.Context) error {
+	return b.registrar.RemindOverdue(ctx, b.Bot)
 }
 
 func NewBot(
 	ctx context.Context,
 	log *zap.Logger,
+	cfg *config.Config,
 	userRepository *repository.UserRepository,
 	houses func() repository.THouses,
 	groupChats *services.GroupChatService,
-	updateLogRepository *repository.UpdateLogger,
+	updateLogRepository repository.UpdateLogStorage,
+	processedUpdates repository.ProcessedUpdateStorage,
 	userGroupsByUserId func(context.Context, int64) ([]int64, error),
 	globalMiddlewares []telebot.MiddlewareFunc,
+	client *nethttp.Client,
 ) (*TBot, error) {
 	var b TBot
 	rand.Seed(time.Now().UnixMicro())
-	b.Init(ctx, log, userRepository, houses, groupChats, updateLogRepository, userGroupsByUserId, globalMiddlewares)
+	b.Init(ctx, log, cfg, userRepository, houses, groupChats, updateLogRepository, processedUpdates, userGroupsByUserId, globalMiddlewares, client)
 	return &b, nil
 }
 
+// Init собирает бота, который ходит в Bot API через client.
+// Для пробного повтора обновлений и тестов вместо телеграма передаётся клиент, который только записывает вызовы.
 func (b *TBot) Init(
 	ctx context.Context,
 	log *zap.Logger,
+	cfg *config.Config,
 	userRepository *repository.UserRepository,
 	houses func() repository.THouses,
 	groupChats *services.GroupChatService,
-	updateLogRepository *repository.UpdateLogger,
+	updateLogRepository repository.UpdateLogStorage,
+	processedUpdates repository.ProcessedUpdateStorage,
 	userGroupsByUserId func(context.Context, int64) ([]int64, error),
 	globalMiddlewares []telebot.MiddlewareFunc,
+	client *nethttp.Client,
 ) {
 	ctx, span := tracer.Open(ctx, tracer.Named("botInit"))
 	defer span.Close()
 	var err error
-	telegramToken := os.Getenv("TELEGRAM_TOKEN")
+	telegramToken := cfg.Telegram.Token
 	pref := telebot.Settings{
+		URL:         cfg.Telegram.APIURL,
 		Token:       telegramToken,
 		Synchronous: true,
 		Verbose:     false,
@@ -64,19 +81,19 @@ func (b *TBot) Init(
 		OnError: func(err error, c telebot.Context) {
 			if c != nil {
 				log.Error("Ошибка внутри бота",
-					zap.Any("update", c.Update()), zap.Error(err),
+					zap.Int("updateID", c.Update().ID), zap.Error(err),
 					zap.Reflect("errorStruct", err), zap.String("errorType", fmt.Sprintf("%T", err)))
 			} else {
 				log.Error("Ошибка внутри бота", zap.Error(err))
 			}
 			if _, err := c.Bot().Send(ctx,
-				&telebot.User{ID: devbotsender.DeveloperID},
+				&telebot.User{ID: cfg.Telegram.DeveloperID},
 				fmt.Sprintf("Ошибка обработчика: %v", err.Error()),
 			); err != nil {
 				log.Error("Не смог логировать в телегу", zap.Error(err))
 			}
 		},
-		Client: http.TracedHttpClient(ctx, log.Named("telegram-http-log"), telegramToken),
+		Client: client,
 	}
 
 	_, telebotNewBotSpan := tracer.Open(ctx, tracer.Named("NewBot"))
@@ -86,40 +103,48 @@ func (b *TBot) Init(
 		log.Fatal("Cannot start bot", zap.Error(err))
 		return
 	}
-	bot.Me.Username = "IzumrudnyBot" // It is not initialized in offline mode, but is needed for processing command in chat groups
+	bot.Me.Username = cfg.Telegram.BotUsername // It is not initialized in offline mode, but is needed for processing command in chat groups
 	b.Bot = bot
 
-	bot.Use(globalMiddlewares...)
+	bot.Use(chain(globalMiddlewares...))
 
-	adminAuthMiddleware := func(hf telebot.HandlerFunc) telebot.HandlerFunc {
-		return func(ctx context.Context, c telebot.Context) error {
-			ctx, span := tracer.Open(ctx, tracer.Named("AdminCommandControllerAuth middleware"))
-			defer span.Close()
-			if userRepository.IsAdmin(ctx, c.Sender().ID) {
-				return hf(ctx, c)
-			}
-			return nil
-		}
-	}
-	groupChatAdminAuthMiddleware := adminAuthMiddleware
+	authorize := authorizer(log.Named("authorizer"), userRepository)
 
 	log.Info("Adding admin command controller")
-	handlers.AdminCommandController(bot.Group(), adminAuthMiddleware, userRepository, groupChats, houses)
+	handlers.AdminCommandController(bot.Group(), authorize, userRepository, groupChats, houses)
+	handlers.RolesController(bot.Group(), authorize, userRepository)
+
+	handlers.ConfigController(bot.Group(), authorize, cfg)
+	handlers.WebhookController(bot.Group(), authorize, cfg)
+	handlers.DeadLetterController(bot.Group(), authorize, userRepository)
 
 	log.Info("Adding replay update controller")
-	handlers.ReplayUpdateController(bot.Group(), adminAuthMiddleware, updateLogRepository, bot)
+	var dryRunner handlers.DryRunner
+	// откатить обработку апдейта можно только в транзакции YDB, память откатывать нечем
+	if cfg.Storage == config.StorageYDB {
+		dryRunner = func() (handlers.UpdateProcessor, handlers.CallRecorder) {
+			recorder := http.NewRecorder()
+			var dryBot TBot
+			dryBot.Init(ctx, log.Named("dryRun"), cfg, userRepository, houses, groupChats,
+				updateLogRepository, processedUpdates, userGroupsByUserId, globalMiddlewares, recorder.Client())
+			return dryBot.Bot, recorder
+		}
+	}
+	handlers.ReplayUpdateController(bot.Group(), authorize, updateLogRepository, bot, dryRunner)
+	handlers.ProcessedUpdatesController(bot.Group(), authorize, processedUpdates)
+	handlers.UpdateLogController(bot.Group(), authorize, updateLogRepository)
 
 	handlers.StaticDataController(bot.Group())
 	log.Info("Adding phones controller")
 	handlers.PhonesController(bot.Group(), &markup.HelpMainMenuBtn, &markup.HelpfulPhonesBtn)
 
 	log.Info("Adding ChatGroupAdmin controller")
-	handlers.ChatGroupAdminController(bot.Group())
+	handlers.ChatGroupAdminController(bot.Group(), authorize)
 
 	log.Info("Adding Whois controller")
 	handlers.WhoisHandler(
 		bot.Group(),
-		groupChatAdminAuthMiddleware,
+		authorize,
 		func(ctx context.Context, userID int64) (*repository.User, error) {
 			return userRepository.GetUser(ctx, userRepository.ByID(userID))
 		},
@@ -163,11 +188,15 @@ func (b *TBot) Init(
 			markup.InlineMarkup(rows...),
 		)
 	}
-	bot.Handle(&markup.DistrictChatsBtn, chatsHandler)
-	bot.Handle("/chats", chatsHandler)
+	bot.Handle(&markup.DistrictChatsBtn, chatsHandler, ydbctx.ReadOnly)
+	bot.Handle("/chats", chatsHandler, ydbctx.ReadOnly)
+
+	registrationService := newTelegramRegistrar(log, userRepository, houses, cfg.Telegram.RegistrationChatID, cfg.Registration.ReviewSLA(), markup.HelpMainMenuBtn)
+	registrationService.Register(bot, authorize)
+	b.registrar = registrationService
 
-	registrationService := newTelegramRegistrar(log, userRepository, houses, markup.HelpMainMenuBtn)
-	registrationService.Register(bot)
+	households := newHouseholdService(log.Named("household"), userRepository)
+	households.Register(bot)
 
 	var authMiddleware telebot.MiddlewareFunc = func(next telebot.HandlerFunc) telebot.HandlerFunc {
 		return func(ctx context.Context, c telebot.Context) error {
@@ -181,7 +210,7 @@ func (b *TBot) Init(
 			if c.Chat().Type == telebot.ChatPrivate {
 				user := repository.CurrentUserFromContext(ctx)
 				if user != nil && user.HavePendingRegistration() {
-					rows = append(rows, markup.Row(markup.ContinueRegisterBtn))
+					rows = append(rows, markup.Row(markup.MyPropertiesBtn))
 				} else {
 					rows = append(rows, markup.Row(markup.RegisterBtn))
 				}
@@ -202,16 +231,24 @@ func (b *TBot) Init(
 	carsService := NewCarsHandler(userRepository, &markup.HelpMainMenuBtn)
 	carsService.Register(bot)
 
+	cameras := featureCameras.gate(cfg.Residency, userRepository)
+	contactLookup := featureContactLookup.gate(cfg.Residency, userRepository)
+
 	getResidentsMarkup := func(ctx context.Context, c telebot.Context) *telebot.ReplyMarkup {
-		_, span := tracer.Open(ctx, tracer.Named("getResidentsMarkup"))
+		ctx, span := tracer.Open(ctx, tracer.Named("getResidentsMarkup"))
 		defer span.Close()
+		residencies := userRepository.ResidenciesOf(ctx, c.Sender().ID)
 		var rows []telebot.Row
+		// residentsMenuMarkup.Row(intercomCodeBtn),
+		if featureCameras.allows(cfg.Residency, residencies) {
+			rows = append(rows, markup.Row(markup.VideoCamerasBtn))
+		}
+		if featureContactLookup.allows(cfg.Residency, residencies) {
+			rows = append(rows, markup.Row(markup.PMWithResidentsBtn), markup.Row(markup.PMWithCarOwnersBtn))
+		}
 		rows = append(rows,
-			// residentsMenuMarkup.Row(intercomCodeBtn),
-			markup.Row(markup.VideoCamerasBtn),
-			markup.Row(markup.PMWithResidentsBtn),
-			markup.Row(markup.PMWithCarOwnersBtn),
 			markup.Row(carsService.EntryPoint()),
+			markup.Row(markup.MyPropertiesBtn),
 			markup.Row(markup.HelpMainMenuBtn),
 		)
 		return markup.InlineMarkup(rows...)
@@ -225,6 +262,7 @@ func (b *TBot) Init(
 			userRepository.ConfirmRegistration(
 				ctx,
 				c.Sender().ID,
+				user.StreamVersion,
 				repository.ConfirmRegistrationEvent{UpdateID: int64(c.Update().ID), WithCode: approveCode},
 			)
 			return c.EditOrReply(ctx, "Спасибо. Регистрация завершена.", getResidentsMarkup(ctx, c))
@@ -232,6 +270,7 @@ func (b *TBot) Init(
 			userRepository.FailRegistration(
 				ctx,
 				c.Sender().ID,
+				user.StreamVersion,
 				repository.FailRegistrationEvent{UpdateID: int64(c.Update().ID), WithCode: approveCode},
 			)
 			return c.EditOrReply(ctx,
@@ -297,8 +336,10 @@ func (b *TBot) Init(
 		if len(c.Args()) == 1 && len(c.Args()[0]) > 4 {
 			if err := handleMaybeRegistration(c, ctx, c.Args()[0]); err == nil {
 				return nil
+			} else if inviteErr := households.HandleMaybeInvite(ctx, c, c.Args()[0]); inviteErr == nil {
+				return nil
 			} else {
-				log.Error("Ошибочная /start регистрация", zap.Error(err))
+				log.Error("Ошибочная /start регистрация", zap.Error(err), zap.NamedError("invite", inviteErr))
 			}
 		}
 		return c.EditOrReply(ctx, "Привет! "+handlers.BotDescription+"\nИспользуйте команду /help для вызова меню")
@@ -343,28 +384,30 @@ func (b *TBot) Init(
 			telebot.ModeHTML,
 			markup.InlineMarkup(markup.Row(markup.BackToResidentsBtn)))
 	}
-	authGroup.Handle(&markup.VideoCamerasBtn, videoCamerasHandler)
+	authGroup.Handle(&markup.VideoCamerasBtn, videoCamerasHandler, cameras)
 
 	residentsChatter, err := NewResidentsChatter(ctx, userRepository, houses, markup.BackToResidentsBtn)
 	if err != nil {
 		log.Fatal("Ошибка инициализации чатов", zap.Error(err))
 	}
-	residentsChatter.RegisterBotsHandlers(ctx, authGroup)
+	residentsChatter.RegisterBotsHandlers(ctx, authGroup, contactLookup)
 	pmWithResidentsHandler := residentsChatter.HandleChatWithResident
-	authGroup.Handle("/connect", pmWithResidentsHandler)
-	authGroup.Handle(&markup.PMWithResidentsBtn, pmWithResidentsHandler)
+	authGroup.Handle("/connect", pmWithResidentsHandler, contactLookup)
+	authGroup.Handle(&markup.PMWithResidentsBtn, pmWithResidentsHandler, contactLookup)
 
 	carownerChatter, err := NewCarOwnerChatter(markup.BackToResidentsBtn, userRepository)
 	if err != nil {
 		log.Fatal("Ошибка инициализации чатов", zap.Error(err))
 	}
-	carownerChatter.RegisterBotsHandlers(ctx, authGroup)
+	carownerChatter.RegisterBotsHandlers(ctx, authGroup, contactLookup)
 	authGroup.Handle("/beep", func(ctx context.Context, c telebot.Context) error {
 		return c.EditOrReply(ctx, "Пробуем связаться с владельцем авто", markup.InlineMarkup(markup.Row(markup.PMWithCarOwnersBtn)))
-	})
-	authGroup.Handle(&markup.PMWithCarOwnersBtn, carownerChatter.HandleInputCarPlate)
+	}, contactLookup)
+	authGroup.Handle(&markup.PMWithCarOwnersBtn, carownerChatter.HandleInputCarPlate, contactLookup)
+
+	bot.Handle(telebot.OnChatJoinRequest, autoApproveChatJoin(log.Named("chatJoin"), cfg.Residency, userRepository, groupChats))
 
-	forwardDeveloperHandler := devbotsender.ForwardToDeveloper(log.Named("forwardToDeveloper"))
+	forwardDeveloperHandler := devbotsender.ForwardToDeveloper(log.Named("forwardToDeveloper"), cfg.Telegram.DeveloperID)
 
 	obsceneFilter := services.NewObsceneFilter(log.Named("obsceneFilter"))
 
@@ -383,11 +426,11 @@ func (b *TBot) Init(
 			if err != nil {
 				return fmt.Errorf("telebot.OnMedia: %w", err)
 			}
-			if user.Registration != nil {
+			if user.Registration != nil || user.HavePendingRegistration() {
 				return registrationService.HandleMediaCreated(ctx, user, c)
 			}
-			if userRepository.IsAdmin(ctx, user.ID) {
-				plates := workWithPhoto(ctx, c, log)
+			if userRepository.HasPermission(ctx, user.ID, repository.PermissionRecognizePlates) {
+				plates := workWithPhoto(ctx, c, log, cfg.Vision.FolderID)
 				return c.Reply(fmt.Sprintf("License plates: %v", plates))
 			}
 			return forwardDeveloperHandler(ctx, c)
@@ -396,7 +439,7 @@ func (b *TBot) Init(
 	})
 }
 
-func workWithPhoto(ctx context.Context, c telebot.Context, log *zap.Logger) []string {
+func workWithPhoto(ctx context.Context, c telebot.Context, log *zap.Logger, visionFolderID string) []string {
 	if photo := c.Message().Photo; photo != nil {
 		reader, err := c.Bot().File(&photo.File)
 		if err != nil {
@@ -407,7 +450,7 @@ func workWithPhoto(ctx context.Context, c telebot.Context, log *zap.Logger) []st
 		if err != nil {
 			log.Error("Tried to read file, but failed", zap.Error(err))
 		}
-		v, err := vision.NewClient()
+		v, err := vision.NewClient(visionFolderID)
 		if err != nil {
 			log.Error("Tried to create vision client, but failed",
 				zap.Error(err))
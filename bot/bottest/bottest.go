@@ -0,0 +1,391 @@
+// Package bottest собирает бота целиком без телеграма и YDB: хранилища в памяти,
+// а вызовы Bot API только записываются. Тесты кормят бота обновлениями и проверяют,
+// что он отправил, какие кнопки показал и какие события пользователей записал.
+package bottest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"mikhailche/botcomod/bot"
+	"mikhailche/botcomod/config"
+	"mikhailche/botcomod/handlers/middleware"
+	"mikhailche/botcomod/handlers/middleware/outbox"
+	"mikhailche/botcomod/lib/http"
+	"mikhailche/botcomod/repository"
+	"mikhailche/botcomod/services"
+
+	"github.com/mikhailche/telebot"
+	"go.uber.org/zap/zaptest"
+)
+
+const (
+	// DeveloperID администратор бота
+	DeveloperID int64 = 1000
+	// RegistrationChatID чат регистраторов
+	RegistrationChatID int64 = -1001
+	BotUsername              = "TestBot"
+	// WebhookSecret секрет вебхука в конфигурации тестового бота
+	WebhookSecret = "test-webhook-secret"
+)
+
+// Harness бот с хранилищами в памяти и записью вызовов Bot API
+type Harness struct {
+	t        testing.TB
+	Bot      *bot.TBot
+	Storage  *repository.Storage
+	Users    *repository.UserRepository
+	recorder *http.Recorder
+	houses   repository.THouses
+
+	nextUpdateID  int
+	nextMessageID int
+}
+
+// New собирает бота так же, как приложение, но с хранилищами в памяти. houses - дома для выбора в меню.
+func New(t testing.TB, houses repository.THouses) *Harness {
+	t.Helper()
+	ctx := context.Background()
+	log := zaptest.NewLogger(t)
+	cfg := config.Default()
+	cfg.Storage = config.StorageMemory
+	cfg.Telegram = config.Telegram{
+		Token:              "test",
+		BotUsername:        BotUsername,
+		DeveloperID:        DeveloperID,
+		RegistrationChatID: RegistrationChatID,
+		WebhookSecret:      WebhookSecret,
+	}
+	storage := repository.NewMemoryStorage(log)
+	storage.Houses = &repository.MemoryHouseStorage{Houses: houses}
+	users, err := repository.NewUserRepository(ctx, storage.Users, log, cfg.Telegram.DeveloperID)
+	if err != nil {
+		t.Fatalf("репозиторий пользователей: %v", err)
+	}
+	h := &Harness{t: t, Storage: storage, Users: users, recorder: http.NewRecorder(), houses: houses}
+	middlewares := append(
+		[]telebot.MiddlewareFunc{middleware.CaptureHandlerError, middleware.TracingMiddleware, outbox.Middleware(log.Named("outbox"))},
+		bot.HandlerMiddlewares(log, &cfg, users, storage.TelegramChats)...,
+	)
+	tBot, err := bot.NewBot(
+		ctx,
+		log,
+		&cfg,
+		users,
+		services.NewHouseService(ctx, storage.Houses).Houses,
+		services.NewGroupChatService(ctx, storage.GroupChats),
+		storage.UpdateLog,
+		storage.Processed,
+		storage.TelegramChats.SelectTelegramChatsByUserID,
+		middlewares,
+		h.recorder.Client(),
+	)
+	if err != nil {
+		t.Fatalf("сборка бота: %v", err)
+	}
+	h.Bot = tBot
+	return h
+}
+
+// Process обрабатывает обновление и возвращает вызовы Bot API, которые бот при этом сделал.
+// Обновлению без ID присваивается следующий по порядку.
+func (h *Harness) Process(update telebot.Update) (Calls, error) {
+	h.t.Helper()
+	if update.ID == 0 {
+		h.nextUpdateID++
+		update.ID = h.nextUpdateID
+	} else if update.ID > h.nextUpdateID {
+		h.nextUpdateID = update.ID
+	}
+	ctx, handlerErr := middleware.WithHandlerError(context.Background())
+	err := h.Bot.Bot.ProcessUpdateCtx(ctx, update)
+	if err == nil {
+		err = handlerErr()
+	}
+	return newCalls(h.recorder.Take()), err
+}
+
+// Run выполняет действие бота вне обработки обновления, например задачу по расписанию, и возвращает его вызовы Bot API
+func (h *Harness) Run(task func(ctx context.Context) error) (Calls, error) {
+	h.t.Helper()
+	err := task(context.Background())
+	return newCalls(h.recorder.Take()), err
+}
+
+// MustProcess как Process, но ошибка обработки валит тест
+func (h *Harness) MustProcess(update telebot.Update) Calls {
+	h.t.Helper()
+	calls, err := h.Process(update)
+	if err != nil {
+		h.t.Fatalf("обработка обновления %d: %v", update.ID, err)
+	}
+	return calls
+}
+
+// Text сообщение пользователя боту в личку
+func (h *Harness) Text(from *telebot.User, text string) telebot.Update {
+	message := h.privateMessage(from)
+	message.Text = text
+	if strings.HasPrefix(text, "/") {
+		command, _, _ := strings.Cut(text, " ")
+		message.Entities = telebot.Entities{{Type: telebot.EntityCommand, Length: len(command)}}
+	}
+	return telebot.Update{Message: message}
+}
+
+// Photo фотография от пользователя в личку
+func (h *Harness) Photo(from *telebot.User, caption string) telebot.Update {
+	message := h.privateMessage(from)
+	message.Caption = caption
+	message.Photo = &telebot.Photo{File: telebot.File{FileID: fmt.Sprintf("photo-%d", message.ID)}, Width: 800, Height: 600}
+	return telebot.Update{Message: message}
+}
+
+// Press нажатие кнопки buttonText под сообщением бота. Валит тест, если такой кнопки нет.
+func (h *Harness) Press(from *telebot.User, message Call, buttonText string) telebot.Update {
+	h.t.Helper()
+	button, ok := message.Button(buttonText)
+	if !ok {
+		h.t.Fatalf("нет кнопки %q под сообщением %q, есть %v", buttonText, message.Text, message.ButtonTexts())
+	}
+	if button.Data == "" {
+		h.t.Fatalf("кнопка %q не callback: %+v", buttonText, button)
+	}
+	messageID := message.MessageID
+	if messageID == 0 {
+		h.nextMessageID++
+		messageID = h.nextMessageID
+	}
+	return telebot.Update{Callback: &telebot.Callback{
+		ID:     strconv.Itoa(messageID),
+		Sender: from,
+		Message: &telebot.Message{
+			ID:          messageID,
+			Chat:        &telebot.Chat{ID: message.ChatID, Type: chatType(message.ChatID)},
+			Text:        message.Text,
+			ReplyMarkup: &telebot.ReplyMarkup{InlineKeyboard: message.Keyboard},
+		},
+		Data: button.Data,
+	}}
+}
+
+// Tap нажатие кнопки btn под сообщением бота в личке, когда само сообщение тесту не важно
+func (h *Harness) Tap(from *telebot.User, btn telebot.Btn) telebot.Update {
+	h.t.Helper()
+	data := "\f" + btn.Unique
+	if btn.Data != "" {
+		data += "|" + btn.Data
+	}
+	message := Call{ChatID: from.ID, Keyboard: [][]telebot.InlineButton{{{Text: btn.Text, Data: data}}}}
+	return h.Press(from, message, btn.Text)
+}
+
+func (h *Harness) privateMessage(from *telebot.User) *telebot.Message {
+	h.nextMessageID++
+	return &telebot.Message{
+		ID:       h.nextMessageID,
+		Sender:   from,
+		Chat:     &telebot.Chat{ID: from.ID, Type: telebot.ChatPrivate, Username: from.Username},
+		Unixtime: 1700000000 + int64(h.nextMessageID),
+	}
+}
+
+// House дом с квартирами от minRoom до maxRoom
+func House(id uint64, number string, minRoom, maxRoom int) repository.THouse {
+	house := repository.THouse{ID: id, Number: number}
+	house.Rooms.Min = minRoom
+	house.Rooms.Max = maxRoom
+	return house
+}
+
+func chatType(chatID int64) telebot.ChatType {
+	if chatID < 0 {
+		return telebot.ChatSuperGroup
+	}
+	return telebot.ChatPrivate
+}
+
+// User загружает пользователя из хранилища
+func (h *Harness) User(userID int64) *repository.User {
+	h.t.Helper()
+	user, err := h.Users.GetUser(context.Background(), h.Users.ByID(userID))
+	if err != nil {
+		h.t.Fatalf("пользователь %d: %v", userID, err)
+	}
+	return user
+}
+
+// Events события пользователя в порядке применения
+func (h *Harness) Events(userID int64) []repository.UserEvent {
+	h.t.Helper()
+	var events []repository.UserEvent
+	for _, record := range h.User(userID).Events {
+		if record, ok := record.(repository.UserEventRecord); ok {
+			events = append(events, record.Event)
+		}
+	}
+	return events
+}
+
+// AddResident заводит подтверждённого резидента, не проходя регистрацию через бота
+func (h *Harness) AddResident(user *telebot.User, houseNumber, apartment string) {
+	h.t.Helper()
+	ctx := context.Background()
+	h.Users.UpsertUsername(ctx, user.ID, user.Username)
+	var houseID uint64
+	for _, house := range h.houses {
+		if house.Number == houseNumber {
+			houseID = house.ID
+		}
+	}
+	if _, err := h.Users.StartRegistration(ctx, user.ID, 0, houseID, houseNumber, apartment); err != nil {
+		h.t.Fatalf("регистрация резидента %d: %v", user.ID, err)
+	}
+	if err := h.Users.ConfirmRegistration(ctx, user.ID, repository.AnyStreamVersion,
+		repository.ConfirmRegistrationEvent{WithCode: "bottest"}); err != nil {
+		h.t.Fatalf("подтверждение резидента %d: %v", user.ID, err)
+	}
+}
+
+// SetClock подменяет часы хранилища пользователей: события получают время из now
+func (h *Harness) SetClock(now func() time.Time) {
+	h.t.Helper()
+	users, ok := h.Storage.Users.(*repository.MemoryUserStorage)
+	if !ok {
+		h.t.Fatalf("часы подменяются только у хранилища в памяти, а не у %T", h.Storage.Users)
+	}
+	users.SetClock(now)
+}
+
+// Grant выдаёт пользователю роль от имени разработчика
+func (h *Harness) Grant(user *telebot.User, role repository.Role) {
+	h.t.Helper()
+	ctx := context.Background()
+	h.Users.UpsertUsername(ctx, user.ID, user.Username)
+	if err := h.Users.GrantRole(ctx, user.ID, repository.GrantRoleEvent{AdminUserID: DeveloperID, Role: role}); err != nil {
+		h.t.Fatalf("выдача роли %s пользователю %d: %v", role, user.ID, err)
+	}
+}
+
+// Call вызов Bot API, разобранный для проверок
+type Call struct {
+	Method    string
+	ChatID    int64
+	MessageID int
+	Text      string
+	Keyboard  [][]telebot.InlineButton
+	Params    map[string]any
+}
+
+// Button кнопка под сообщением по тексту
+func (c Call) Button(text string) (telebot.InlineButton, bool) {
+	for _, row := range c.Keyboard {
+		for _, button := range row {
+			if button.Text == text {
+				return button, true
+			}
+		}
+	}
+	return telebot.InlineButton{}, false
+}
+
+func (c Call) ButtonTexts() []string {
+	var texts []string
+	for _, row := range c.Keyboard {
+		for _, button := range row {
+			texts = append(texts, button.Text)
+		}
+	}
+	return texts
+}
+
+// IsEdit вызов меняет уже отправленное сообщение
+func (c Call) IsEdit() bool {
+	return strings.HasPrefix(c.Method, "edit")
+}
+
+// IsSend вызов отправляет новое сообщение
+func (c Call) IsSend() bool {
+	return strings.HasPrefix(c.Method, "send") || strings.HasPrefix(c.Method, "forward") || strings.HasPrefix(c.Method, "copy")
+}
+
+func newCall(recorded http.RecordedCall) Call {
+	call := Call{Method: recorded.Method, Params: recorded.Params}
+	call.ChatID, _ = strconv.ParseInt(fmt.Sprint(recorded.Params["chat_id"]), 10, 64)
+	call.MessageID, _ = strconv.Atoi(fmt.Sprint(recorded.Params["message_id"]))
+	if text, ok := recorded.Params["text"].(string); ok {
+		call.Text = text
+	} else if caption, ok := recorded.Params["caption"].(string); ok {
+		call.Text = caption
+	}
+	if replyMarkup, ok := recorded.Params["reply_markup"].(string); ok {
+		var markup telebot.ReplyMarkup
+		if err := json.Unmarshal([]byte(replyMarkup), &markup); err == nil {
+			call.Keyboard = markup.InlineKeyboard
+		}
+	}
+	return call
+}
+
+// Calls вызовы Bot API в порядке выполнения
+type Calls []Call
+
+func newCalls(recorded []http.RecordedCall) Calls {
+	var calls Calls
+	for _, r := range recorded {
+		calls = append(calls, newCall(r))
+	}
+	return calls
+}
+
+// To вызовы в чат chatID
+func (calls Calls) To(chatID int64) Calls {
+	return calls.filter(func(c Call) bool { return c.ChatID == chatID })
+}
+
+// Messages отправленные и изменённые сообщения, без служебных вызовов вроде answerCallbackQuery
+func (calls Calls) Messages() Calls {
+	return calls.filter(func(c Call) bool { return c.IsSend() || c.IsEdit() })
+}
+
+// Method вызовы метода Bot API
+func (calls Calls) Method(method string) Calls {
+	return calls.filter(func(c Call) bool { return c.Method == method })
+}
+
+// Containing сообщения, в тексте которых есть substr
+func (calls Calls) Containing(substr string) Calls {
+	return calls.filter(func(c Call) bool { return strings.Contains(c.Text, substr) })
+}
+
+// Last последний вызов. Валит тест, если вызовов нет.
+func (calls Calls) Last(t testing.TB) Call {
+	t.Helper()
+	if len(calls) == 0 {
+		t.Fatalf("ожидался хотя бы один вызов Bot API")
+	}
+	return calls[len(calls)-1]
+}
+
+func (calls Calls) String() string {
+	var lines []string
+	for _, c := range calls {
+		lines = append(lines, fmt.Sprintf("%s chat=%d %q %v", c.Method, c.ChatID, c.Text, c.ButtonTexts()))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (calls Calls) filter(keep func(Call) bool) Calls {
+	var out Calls
+	for _, c := range calls {
+		if keep(c) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
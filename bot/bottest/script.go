@@ -0,0 +1,67 @@
+package bottest
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/mikhailche/telebot"
+)
+
+// scriptLine строка сценария: обновление телеграма как есть или запрос облачной функции из /updates_export
+type scriptLine struct {
+	HTTPMethod string `json:"httpMethod"`
+	Body       string `json:"body"`
+}
+
+// ReadUpdates читает сценарий в формате JSONL. Пустые строки и строки с # пропускаются.
+func ReadUpdates(r io.Reader) ([]telebot.Update, error) {
+	var updates []telebot.Update
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		raw := []byte(line)
+		var request scriptLine
+		if err := json.Unmarshal(raw, &request); err != nil {
+			return nil, fmt.Errorf("строка %d: %w", lineNumber, err)
+		}
+		if request.HTTPMethod != "" {
+			raw = []byte(request.Body)
+		}
+		var update telebot.Update
+		if err := json.Unmarshal(raw, &update); err != nil {
+			return nil, fmt.Errorf("строка %d: обновление: %w", lineNumber, err)
+		}
+		updates = append(updates, update)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return updates, nil
+}
+
+// ReplayFile обрабатывает по порядку обновления из файла сценария и возвращает все вызовы Bot API
+func (h *Harness) ReplayFile(path string) Calls {
+	h.t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		h.t.Fatalf("сценарий: %v", err)
+	}
+	defer file.Close()
+	updates, err := ReadUpdates(file)
+	if err != nil {
+		h.t.Fatalf("сценарий %s: %v", path, err)
+	}
+	var calls Calls
+	for _, update := range updates {
+		calls = append(calls, h.MustProcess(update)...)
+	}
+	return calls
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"mikhailche/botcomod/handlers/middleware/outbox"
 	markup "mikhailche/botcomod/lib/bot-markup"
 	"mikhailche/botcomod/lib/cars"
 	"mikhailche/botcomod/lib/tracer.v2"
@@ -39,11 +40,12 @@ func NewCarOwnerChatter(upperMenu telebot.Btn, users UserByVehicleLicensePlateRe
 	}, nil
 }
 
-func (r *CarOwnerChatter) RegisterBotsHandlers(ctx context.Context, bot HandleRegistrator) {
+// RegisterBotsHandlers lookup пускает к поиску владельца авто
+func (r *CarOwnerChatter) RegisterBotsHandlers(ctx context.Context, bot HandleRegistrator, lookup telebot.MiddlewareFunc) {
 	_, span := tracer.Open(ctx, tracer.Named("ResidentsChatter::RegisterBotsHandlers"))
 	defer span.Close()
-	bot.Handle(&r.handleInputCarPlateBtn, r.HandleInputCarPlate)
-	bot.Handle(&r.confirmCarPlateBtn, r.HandleChatRequestApproved)
+	bot.Handle(&r.handleInputCarPlateBtn, r.HandleInputCarPlate, lookup)
+	bot.Handle(&r.confirmCarPlateBtn, r.HandleChatRequestApproved, lookup)
 }
 
 func (r *CarOwnerChatter) HandleInputCarPlate(ctx context.Context, c telebot.Context) error {
@@ -99,12 +101,9 @@ func (r *CarOwnerChatter) HandleChatRequestApproved(ctx context.Context, c teleb
 
 	user, err := r.users.FindByVehicleLicensePlate(ctx, vehicleLicensePlate)
 	if errors.Is(err, repository.ErrNotFound) {
-		return fmt.Errorf(
-			"не нашел владельца [%v]: %w; %v",
-			vehicleLicensePlate, err,
-			c.EditOrReply(ctx, "Я не нашел автовладельца. Придется искать другим способом. Попробуйте общий чатик в разделе /chats",
-				markup.InlineMarkup(markup.Row(r.upperMenu)),
-			),
+		// не ошибка: с ошибкой ответ пользователю отменился бы вместе с обновлением
+		return c.EditOrReply(ctx, "Я не нашел автовладельца. Придется искать другим способом. Попробуйте общий чатик в разделе /chats",
+			markup.InlineMarkup(markup.Row(r.upperMenu)),
 		)
 	}
 	if err != nil {
@@ -113,7 +112,7 @@ func (r *CarOwnerChatter) HandleChatRequestApproved(ctx context.Context, c teleb
 		)
 	}
 
-	if _, err := c.Bot().Send(ctx, &telebot.User{ID: user.ID},
+	if err := outbox.Send(ctx, c, &telebot.User{ID: user.ID},
 		fmt.Sprintf(
 			"С вами хочет связаться %s %s (@%s). Можно ли передать ему ваши контактные данные?",
 			c.Sender().FirstName, c.Sender().LastName, c.Sender().Username,
@@ -3,6 +3,7 @@ package bot
 import (
 	"context"
 	"fmt"
+	"mikhailche/botcomod/handlers/middleware/outbox"
 	"mikhailche/botcomod/lib/cars"
 	"mikhailche/botcomod/repository"
 
@@ -84,7 +85,7 @@ func (ch *carsHandler) ConfirmPlateHandler(ctx context.Context, c telebot.Contex
 		repository.RegisterCarLicensePlateEvent{UpdateID: int64(c.Update().ID), LicensePlate: c.Args()[0]},
 	); err != nil {
 		return fmt.Errorf("ошибка регистрации авто: %v: %w",
-			c.Reply("Ошибка регистрации автомобиля. Попробуйте позже"),
+			outbox.Always(c).Reply("Ошибка регистрации автомобиля. Попробуйте позже"),
 			err,
 		)
 	}
@@ -0,0 +1,303 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mikhailche/botcomod/handlers/middleware/outbox"
+	"mikhailche/botcomod/handlers/middleware/ydbctx"
+	markup "mikhailche/botcomod/lib/bot-markup"
+	"mikhailche/botcomod/lib/tracer.v2"
+	"mikhailche/botcomod/repository"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mikhailche/telebot"
+	"go.uber.org/zap"
+)
+
+// householdInviteTTL сколько действует ссылка-приглашение домочадца
+const householdInviteTTL = 48 * time.Hour
+
+// householdInviteCodeLength длина кода приглашения. Вместе с идентификатором пригласившего
+// должна уместиться в подписанное сообщение, см. [EncodeSignedMessage].
+const householdInviteCodeLength = 6
+
+// householdInviteToken параметр /start в ссылке-приглашении. Всё остальное о приглашении хранится
+// в событиях пригласившего, поэтому в ссылке только кто пригласил и код.
+type householdInviteToken struct {
+	InviterID int64
+	Code      string
+}
+
+// MarshalJSON массивом, а не объектом: подписанное сообщение ограничено 64 символами
+func (t householdInviteToken) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]any{t.InviterID, t.Code})
+}
+
+func (t *householdInviteToken) UnmarshalJSON(b []byte) error {
+	fields := []any{&t.InviterID, &t.Code}
+	return json.Unmarshal(b, &fields)
+}
+
+type householdService struct {
+	log            *zap.Logger
+	userRepository *repository.UserRepository
+	//buttons
+	inviteBtn telebot.Btn
+	revokeBtn telebot.Btn
+}
+
+func newHouseholdService(log *zap.Logger, userRepository *repository.UserRepository) *householdService {
+	replyMarkup := &telebot.ReplyMarkup{}
+	return &householdService{
+		log:            log,
+		userRepository: userRepository,
+		inviteBtn:      replyMarkup.Data("➕ Пригласить", "household-invite"),
+		revokeBtn:      replyMarkup.Data("❌ Исключить", "household-revoke"),
+	}
+}
+
+func (h *householdService) Register(bot HandleRegistrator) {
+	bot.Handle(&markup.HouseholdBtn, h.HandleHousehold, ydbctx.ReadOnly)
+	bot.Handle("/household", h.HandleHousehold, ydbctx.ReadOnly)
+	bot.Handle(&h.inviteBtn, h.HandleCreateInvite)
+	bot.Handle(&h.revokeBtn, h.HandleRevokeMember)
+}
+
+func apartmentTitle(houseNumber, apartment string) string {
+	return fmt.Sprintf("дом %s, квартира %s", houseNumber, apartment)
+}
+
+func memberTitle(member repository.HouseholdMember) string {
+	if member.Username != "" {
+		return "@" + member.Username
+	}
+	return strconv.FormatInt(member.UserID, 10)
+}
+
+// HandleHousehold домочадцы в квартирах основного резидента и кнопки приглашения и исключения
+func (h *householdService) HandleHousehold(ctx context.Context, c telebot.Context) error {
+	ctx, span := tracer.Open(ctx, tracer.Named("household"))
+	defer span.Close()
+	user, err := h.userRepository.GetUser(ctx, h.userRepository.ByID(c.Sender().ID))
+	if err != nil {
+		return fmt.Errorf("домочадцы: %w", err)
+	}
+	return h.showHousehold(ctx, c, user)
+}
+
+func (h *householdService) showHousehold(ctx context.Context, c telebot.Context, user *repository.User) error {
+	apartments := user.HouseholdApartments(time.Now())
+	if len(apartments) == 0 {
+		return c.EditOrReply(ctx, "Приглашать домочадцев может собственник или арендатор подтверждённой квартиры.",
+			markup.InlineMarkup(markup.Row(markup.MyPropertiesBtn)))
+	}
+	menu := &telebot.ReplyMarkup{}
+	lines := []string{"👪 Домочадцы получают доступ к разделу для резидентов по вашей ссылке-приглашению, без фото документов."}
+	var rows []telebot.Row
+	for _, apartment := range apartments {
+		houseID := strconv.FormatUint(apartment.HouseID, 10)
+		lines = append(lines, "", fmt.Sprintf("🚪 %s:", apartmentTitle(apartment.HouseNumber, apartment.ApartmentNumber)))
+		var members int
+		for _, member := range user.Household.Members {
+			if member.HouseID != apartment.HouseID || member.Apartment != apartment.ApartmentNumber {
+				continue
+			}
+			members++
+			lines = append(lines, "— "+memberTitle(member))
+			rows = append(rows, menu.Row(menu.Data(
+				fmt.Sprintf("❌ Исключить %s из квартиры %s", memberTitle(member), member.Apartment),
+				h.revokeBtn.Unique, strconv.FormatInt(member.UserID, 10), houseID, member.Apartment,
+			)))
+		}
+		if members == 0 {
+			lines = append(lines, "— пока никого")
+		}
+		rows = append(rows, menu.Row(menu.Data(
+			fmt.Sprintf("➕ Пригласить в квартиру %s", apartment.ApartmentNumber),
+			h.inviteBtn.Unique, houseID, apartment.ApartmentNumber,
+		)))
+	}
+	menu.Inline(append(rows, menu.Row(markup.MyPropertiesBtn))...)
+	return c.EditOrReply(ctx, strings.Join(lines, "\n"), menu)
+}
+
+// HandleCreateInvite новая одноразовая ссылка-приглашение в квартиру
+func (h *householdService) HandleCreateInvite(ctx context.Context, c telebot.Context) error {
+	ctx, span := tracer.Open(ctx, tracer.Named("householdInvite"))
+	defer span.Close()
+	data := c.Args()
+	if len(data) != 2 {
+		return c.EditOrReply(ctx, "Что-то пошло не по плану")
+	}
+	houseID, err := strconv.ParseUint(data[0], 10, 64)
+	if err != nil {
+		return c.EditOrReply(ctx, "Что-то пошло не по плану")
+	}
+	user, err := h.userRepository.GetUser(ctx, h.userRepository.ByID(c.Sender().ID))
+	if err != nil {
+		return fmt.Errorf("приглашение домочадца: %w", err)
+	}
+	now := time.Now()
+	var apartment *repository.Apartment
+	for _, ppi := range user.HouseholdApartments(now) {
+		if ppi.HouseID == houseID && ppi.ApartmentNumber == data[1] {
+			apartment = &repository.Apartment{HouseID: ppi.HouseID, HouseNumber: ppi.HouseNumber, ApartmentNumber: ppi.ApartmentNumber}
+		}
+	}
+	if apartment == nil {
+		return c.EditOrReply(ctx, "Приглашать домочадцев можно только в подтверждённую квартиру.",
+			markup.InlineMarkup(markup.Row(markup.MyPropertiesBtn)))
+	}
+	event := repository.CreateHouseholdInviteEvent{
+		Code:        repository.GenerateApproveCode(ctx, householdInviteCodeLength),
+		HouseID:     apartment.HouseID,
+		HouseNumber: apartment.HouseNumber,
+		Apartment:   apartment.ApartmentNumber,
+		ExpiresAt:   now.Add(householdInviteTTL),
+	}
+	token, err := EncodeSignedMessage(householdInviteToken{InviterID: user.ID, Code: event.Code})
+	if err != nil {
+		return fmt.Errorf("ссылка-приглашение: %w", err)
+	}
+	if err := h.userRepository.CreateHouseholdInvite(ctx, user.ID, user.StreamVersion, event); err != nil {
+		return err
+	}
+	// телеграм не пропускает '=' в параметре start, выравнивание base64 восстановит DecodeSignedMessage
+	link := fmt.Sprintf("https://t.me/%s?start=%s", c.Bot().Me.Username, strings.TrimRight(token, "="))
+	return c.EditOrReply(ctx, fmt.Sprintf(`Ссылка-приглашение в квартиру (%s):
+%s
+
+Отправьте её члену семьи. По ссылке можно вступить один раз до %s. Домочадец получит доступ к разделу для резидентов, исключить его можно в разделе «Домочадцы».`,
+		apartmentTitle(apartment.HouseNumber, apartment.ApartmentNumber), link, event.ExpiresAt.Format("02.01.2006 15:04")),
+		markup.InlineMarkup(markup.Row(markup.HouseholdBtn)))
+}
+
+// HandleMaybeInvite вступление в квартиру по ссылке-приглашению из /start.
+// Ошибка означает, что token не приглашение или его не удалось обработать.
+func (h *householdService) HandleMaybeInvite(ctx context.Context, c telebot.Context, token string) error {
+	ctx, span := tracer.Open(ctx, tracer.Named("householdJoin"))
+	defer span.Close()
+	var invite householdInviteToken
+	if err := DecodeSignedMessage(token, &invite); err != nil {
+		return err
+	}
+	if invite.InviterID == c.Sender().ID {
+		return c.EditOrReply(ctx, "Это ваша ссылка-приглашение. Отправьте её члену семьи.", markup.InlineMarkup(markup.Row(markup.HouseholdBtn)))
+	}
+	inviter, err := h.userRepository.GetUser(ctx, h.userRepository.ByID(invite.InviterID))
+	if err != nil {
+		return fmt.Errorf("пригласивший домочадца: %w", err)
+	}
+	now := time.Now()
+	unavailable := func() error {
+		return c.EditOrReply(ctx, "Приглашение уже использовано или истекло. Попросите у родственника новую ссылку.", markup.HelpMenuMarkup(ctx))
+	}
+	details, ok := inviter.Household.Invite(invite.Code)
+	if !ok || !details.Usable(now) {
+		return unavailable()
+	}
+	var apartment *repository.Apartment
+	var expiresAt time.Time
+	for _, ppi := range inviter.HouseholdApartments(now) {
+		if ppi.HouseID == details.HouseID && ppi.ApartmentNumber == details.Apartment {
+			apartment = &repository.Apartment{HouseID: ppi.HouseID, HouseNumber: ppi.HouseNumber, ApartmentNumber: ppi.ApartmentNumber}
+			expiresAt = ppi.ExpiresAt
+		}
+	}
+	if apartment == nil {
+		return unavailable()
+	}
+	member, err := h.userRepository.GetUser(ctx, h.userRepository.ByID(c.Sender().ID))
+	if err != nil {
+		return fmt.Errorf("домочадец: %w", err)
+	}
+	title := apartmentTitle(apartment.HouseNumber, apartment.ApartmentNumber)
+	// своя заявка или квартира остаются как есть: приглашение не должно их подменить. Истёкшая аренда не мешает.
+	if ppi, ok := member.PrivateProperty.Find(repository.PropertyApartment, apartment.HouseID, apartment.ApartmentNumber); ok && !ppi.Expired(now) {
+		if ppi.Approved && !ppi.Expired(now) {
+			return c.EditOrReply(ctx, fmt.Sprintf("Вы уже резидент квартиры (%s), приглашение не понадобилось.", title), markup.InlineMarkup(markup.Row(markup.ResidentsBtn)))
+		}
+		return c.EditOrReply(ctx, fmt.Sprintf("У вас уже есть заявка на квартиру (%s). Дождитесь решения регистраторов или подайте новую заявку.", title),
+			markup.InlineMarkup(markup.Row(markup.MyPropertiesBtn)))
+	}
+	if err := h.userRepository.AcceptHouseholdInvite(ctx, inviter.ID, inviter.StreamVersion, repository.AcceptHouseholdInviteEvent{
+		Code:           invite.Code,
+		MemberID:       member.ID,
+		MemberUsername: c.Sender().Username,
+	}); errors.Is(err, repository.ErrStreamConflict) {
+		// ссылку одновременно открыл кто-то ещё и успел вступить первым
+		return unavailable()
+	} else if err != nil {
+		return err
+	}
+	if err := h.userRepository.JoinHousehold(ctx, member.ID, repository.JoinHouseholdEvent{
+		InviterID:   inviter.ID,
+		Code:        invite.Code,
+		HouseID:     apartment.HouseID,
+		HouseNumber: apartment.HouseNumber,
+		Apartment:   apartment.ApartmentNumber,
+		ExpiresAt:   expiresAt,
+	}); err != nil {
+		return err
+	}
+	h.log.Info("Домочадец вступил по приглашению", zap.Int64("inviterID", inviter.ID), zap.Int64("memberID", member.ID), zap.String("apartment", title))
+	joined := repository.HouseholdMember{UserID: member.ID, Username: c.Sender().Username}
+	if err := outbox.Send(ctx, c, &telebot.Chat{ID: inviter.ID},
+		fmt.Sprintf("По вашему приглашению в квартиру (%s) вступил домочадец %s.", title, memberTitle(joined)),
+		markup.InlineMarkup(markup.Row(markup.HouseholdBtn)),
+	); err != nil {
+		return fmt.Errorf("уведомление пригласившего: %w", err)
+	}
+	return c.EditOrReply(ctx, fmt.Sprintf("Добро пожаловать! Вы вступили в квартиру (%s) как член семьи. Раздел для резидентов уже доступен.", title),
+		markup.InlineMarkup(markup.Row(markup.ResidentsBtn)))
+}
+
+// HandleRevokeMember исключение домочадца: доступ к разделу для резидентов по этой квартире у него пропадает
+func (h *householdService) HandleRevokeMember(ctx context.Context, c telebot.Context) error {
+	ctx, span := tracer.Open(ctx, tracer.Named("householdRevoke"))
+	defer span.Close()
+	data := c.Args()
+	if len(data) != 3 {
+		return c.EditOrReply(ctx, "Что-то пошло не по плану")
+	}
+	memberID, err := strconv.ParseInt(data[0], 10, 64)
+	if err != nil {
+		return c.EditOrReply(ctx, "Что-то пошло не по плану")
+	}
+	houseID, err := strconv.ParseUint(data[1], 10, 64)
+	if err != nil {
+		return c.EditOrReply(ctx, "Что-то пошло не по плану")
+	}
+	user, err := h.userRepository.GetUser(ctx, h.userRepository.ByID(c.Sender().ID))
+	if err != nil {
+		return fmt.Errorf("исключение домочадца: %w", err)
+	}
+	member, ok := user.Household.Member(memberID, houseID, data[2])
+	if !ok {
+		return h.showHousehold(ctx, c, user)
+	}
+	revoke := repository.RevokeHouseholdMemberEvent{MemberID: member.UserID, HouseID: member.HouseID, Apartment: member.Apartment}
+	if err := h.userRepository.RevokeHouseholdMember(ctx, user.ID, user.StreamVersion, revoke); err != nil {
+		return err
+	}
+	// пользователь прочитан до исключения, список показываем уже без домочадца
+	revoke.Apply(ctx, user)
+	if err := h.userRepository.LeaveHousehold(ctx, member.UserID, repository.LeaveHouseholdEvent{
+		InviterID: user.ID,
+		HouseID:   member.HouseID,
+		Apartment: member.Apartment,
+	}); err != nil {
+		return err
+	}
+	h.log.Info("Домочадца исключили", zap.Int64("inviterID", user.ID), zap.Int64("memberID", member.UserID), zap.String("apartment", member.Apartment))
+	if err := outbox.Send(ctx, c, &telebot.Chat{ID: member.UserID},
+		"Вас исключили из домочадцев квартиры. Доступ к разделу для резидентов по ней закрыт.",
+	); err != nil {
+		return fmt.Errorf("уведомление домочадца: %w", err)
+	}
+	return h.showHousehold(ctx, c, user)
+}
@@ -0,0 +1,67 @@
+package bot
+
+import (
+	"context"
+	"mikhailche/botcomod/config"
+	"mikhailche/botcomod/handlers"
+	"mikhailche/botcomod/handlers/middleware"
+	"mikhailche/botcomod/lib/tracer.v2"
+	"mikhailche/botcomod/repository"
+
+	"github.com/mikhailche/telebot"
+	"go.uber.org/zap"
+)
+
+// HandlerMiddlewares middleware, которые идут после транзакции апдейта и нужны всем обработчикам:
+// учёт пользователей и чатов, ответ на кнопки, текущий пользователь и перехват паник
+func HandlerMiddlewares(
+	log *zap.Logger,
+	cfg *config.Config,
+	userRepository *repository.UserRepository,
+	telegramChats repository.TelegramChatStorage,
+) []telebot.MiddlewareFunc {
+	return []telebot.MiddlewareFunc{
+		middleware.UpsertUsernameMiddleware(
+			log.Named("upsertUsernameMiddleware"),
+			userRepository, telegramChats.UpsertTelegramChat,
+			telegramChats.UpsertTelegramChatToUserMapping,
+		),
+		middleware.AutoRespondCallback,
+		middleware.CurrentUserInContext(userRepository),
+		middleware.RecoverMiddleware(log.Named("recoverMiddleware")),
+	}
+}
+
+// chain склеивает middleware в одну. telebot дописывает middleware обработчика в общий срез бота,
+// и пока у среза есть свободная ёмкость, обработчики затирают друг другу свои middleware:
+// например, adminAuth подменялся проверкой резидента. Срез из одного элемента append всегда копирует.
+func chain(middlewares ...telebot.MiddlewareFunc) telebot.MiddlewareFunc {
+	return func(next telebot.HandlerFunc) telebot.HandlerFunc {
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			next = middlewares[i](next)
+		}
+		return next
+	}
+}
+
+// authorizer пропускает к группе обработчиков только пользователей с нужным правом.
+// На команды остальным бот молчит, чтобы не раскрывать служебные команды.
+func authorizer(log *zap.Logger, userRepository *repository.UserRepository) handlers.Authorizer {
+	return func(permission repository.Permission) telebot.MiddlewareFunc {
+		return func(next telebot.HandlerFunc) telebot.HandlerFunc {
+			return func(ctx context.Context, c telebot.Context) error {
+				ctx, span := tracer.Open(ctx, tracer.Named("Authorize "+string(permission)))
+				defer span.Close()
+				if userRepository.HasPermission(ctx, c.Sender().ID, permission) {
+					return next(ctx, c)
+				}
+				log.Info("Нет права на обработчик", zap.Int64("userID", c.Sender().ID), zap.String("permission", string(permission)))
+				if c.Callback() != nil {
+					// кнопки видят все участники чата, молчание выглядело бы как зависший бот
+					return c.Respond(ctx, &telebot.CallbackResponse{Text: "Недостаточно прав для этого действия", ShowAlert: true})
+				}
+				return nil
+			}
+		}
+	}
+}
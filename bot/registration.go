@@ -2,11 +2,16 @@ package bot
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"mikhailche/botcomod/handlers"
+	"mikhailche/botcomod/handlers/middleware/outbox"
+	"mikhailche/botcomod/handlers/middleware/ydbctx"
 	markup "mikhailche/botcomod/lib/bot-markup"
 	"mikhailche/botcomod/lib/tracer.v2"
 	"mikhailche/botcomod/repository"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/mikhailche/telebot"
@@ -17,25 +22,35 @@ type telegramRegistrator struct {
 	log            *zap.Logger
 	userRepository *repository.UserRepository
 	houses         func() repository.THouses
+	// registrationChatID чат регистраторов, куда уходят заявки
+	registrationChatID int64
+	// reviewSLA после этого срока о заявке напоминают регистраторам, 0 - не напоминать
+	reviewSLA time.Duration
 	//buttons
 	backBtn         telebot.Btn
 	adminApprove    telebot.Btn
 	adminDisapprove telebot.Btn
 	adminFail       telebot.Btn
+	// adminApproveTenancy подтверждение аренды со сроком по договору
+	adminApproveTenancy telebot.Btn
+	// adminReason причина отказа или повторного фото из списка
+	adminReason telebot.Btn
 }
 
-const registrationChatID = -1001860029647
-
-func newTelegramRegistrar(log *zap.Logger, userRepository *repository.UserRepository, houses func() repository.THouses, backBtn telebot.Btn) *telegramRegistrator {
+func newTelegramRegistrar(log *zap.Logger, userRepository *repository.UserRepository, houses func() repository.THouses, registrationChatID int64, reviewSLA time.Duration, backBtn telebot.Btn) *telegramRegistrator {
 	replyMarkup := &telebot.ReplyMarkup{}
 	return &telegramRegistrator{
-		backBtn:         backBtn,
-		log:             log,
-		userRepository:  userRepository,
-		houses:          houses,
-		adminApprove:    replyMarkup.Data("✅ Да, кажется всё совпадает", "admin-approve-registration"),
-		adminDisapprove: replyMarkup.Data("❌ Херня какая-то", "admin-disapprove-registration"),
-		adminFail:       replyMarkup.Data("🔐 В топку", "admin-fail-registration"),
+		backBtn:             backBtn,
+		log:                 log,
+		userRepository:      userRepository,
+		houses:              houses,
+		registrationChatID:  registrationChatID,
+		reviewSLA:           reviewSLA,
+		adminApprove:        replyMarkup.Data("✅ Да, кажется всё совпадает", "admin-approve-registration"),
+		adminDisapprove:     replyMarkup.Data("❌ Херня какая-то", "admin-disapprove-registration"),
+		adminFail:           replyMarkup.Data("🔐 В топку", "admin-fail-registration"),
+		adminApproveTenancy: replyMarkup.Data("✅ Срок аренды", "admin-approve-tenancy"),
+		adminReason:         replyMarkup.Data("Причина", "admin-review-reason"),
 	}
 }
 
@@ -43,89 +58,560 @@ func (r *telegramRegistrator) EntryPoint() *telebot.Btn {
 	return &markup.RegisterBtn
 }
 
-func (r *telegramRegistrator) Register(bot HandleRegistrator) {
+func (r *telegramRegistrator) Register(bot HandleRegistrator, authorize handlers.Authorizer) {
+	reviewAuth := authorize(repository.PermissionReviewRegistrations)
 	bot.Handle(r.EntryPoint(), r.HandleStartRegistration)
-	bot.Handle(&r.adminApprove, r.HandleAdminApprovedRegistration)
-	bot.Handle(&r.adminDisapprove, r.HandleAdminDisapprovedRegistration)
-	bot.Handle(&r.adminFail, r.HandleAdminFailRegistration)
+	bot.Handle(&markup.AddParkingBtn, r.HandleAddParking)
+	bot.Handle(&markup.MyPropertiesBtn, r.HandleMyProperties, ydbctx.ReadOnly)
+	bot.Handle("/properties", r.HandleMyProperties, ydbctx.ReadOnly)
+	bot.Handle(&r.adminApprove, r.HandleAdminApprovedRegistration, reviewAuth)
+	bot.Handle(&r.adminDisapprove, r.HandleAdminDisapprovedRegistration, reviewAuth)
+	bot.Handle(&r.adminFail, r.HandleAdminFailRegistration, reviewAuth)
+	bot.Handle(&r.adminApproveTenancy, r.HandleAdminApprovedTenancy, reviewAuth)
+	bot.Handle(&r.adminReason, r.HandleAdminReason, reviewAuth)
+	bot.Handle("/pending", r.HandlePending, reviewAuth, ydbctx.ReadOnly)
 }
 
-func (r *telegramRegistrator) HandleAdminApprovedRegistration(ctx context.Context, c telebot.Context) error {
-	userID, _ := strconv.Atoi(c.Args()[0])
+// alreadyProcessedText ответ регистратору, если заявку уже обработал кто-то другой
+const alreadyProcessedText = "\nЭту заявку уже обработал кто-то другой"
+
+func (r *telegramRegistrator) replyAlreadyProcessed(ctx context.Context, c telebot.Context) error {
+	return c.EditOrReply(ctx, c.Message().Text+alreadyProcessedText)
+}
+
+// reviewRequest заявка из данных кнопки регистратора. Старые кнопки содержат только пользователя,
+// новые ещё дом и квартиру, чтобы решение по прошлой заявке не легло на новую, и вид собственности, если это не квартира.
+type reviewRequest struct {
+	userID    int64
+	houseID   uint64
+	apartment string
+	kind      repository.PropertyKind
+	legacy    bool
+}
+
+func parseReviewRequest(args []string) (reviewRequest, error) {
+	if len(args) == 0 {
+		return reviewRequest{}, fmt.Errorf("нет данных заявки")
+	}
+	userID, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return reviewRequest{}, fmt.Errorf("пользователь заявки %q: %w", args[0], err)
+	}
+	if len(args) < 3 {
+		return reviewRequest{userID: userID, legacy: true}, nil
+	}
+	houseID, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return reviewRequest{}, fmt.Errorf("дом заявки %q: %w", args[1], err)
+	}
+	request := reviewRequest{userID: userID, houseID: houseID, apartment: args[2]}
+	if len(args) > 3 {
+		request.kind = repository.PropertyKind(args[3])
+	}
+	return request, nil
+}
+
+// legacyMatch заявка из кнопки - незавершённая регистрация пользователя по [repository.StartRegistrationEvent]
+func (q reviewRequest) legacyMatch(user *repository.User) bool {
+	if user.Registration == nil {
+		return false
+	}
+	start := user.Registration.Events.Start
+	return q.legacy || q.kind == repository.PropertyApartment && start.HouseID == q.houseID && start.Apartment == q.apartment
+}
+
+// pendingCount сколько заявок пользователя ждут решения
+func pendingCount(user *repository.User) int {
+	count := 0
+	for _, item := range user.PrivateProperty.List() {
+		if !item.Approved {
+			count++
+		}
+	}
+	return count
+}
+
+// pending заявка из кнопки всё ещё ждёт решения
+func (q reviewRequest) pending(user *repository.User) bool {
+	if q.legacyMatch(user) {
+		return true
+	}
+	if q.legacy {
+		return false
+	}
+	item, ok := user.PrivateProperty.Find(q.kind, q.houseID, q.apartment)
+	return ok && !item.Approved
+}
+
+// reviewButtons кнопки решения по заявке пользователя на квартиру или парковочное место
+func (r *telegramRegistrator) reviewButtons(userID int64, houseID uint64, apartment string, kind repository.PropertyKind) *telebot.ReplyMarkup {
+	data := []string{fmt.Sprint(userID), fmt.Sprint(houseID), apartment}
+	if kind != repository.PropertyApartment {
+		data = append(data, string(kind))
+	}
+	replyMarkup := &telebot.ReplyMarkup{}
+	replyMarkup.Inline(replyMarkup.Row(
+		replyMarkup.Data(r.adminApprove.Text, r.adminApprove.Unique, data...),
+		replyMarkup.Data(r.adminDisapprove.Text, r.adminDisapprove.Unique, data...),
+		replyMarkup.Data(r.adminFail.Text, r.adminFail.Unique, data...),
+	))
+	return replyMarkup
+}
+
+// registrationDecision решение регистратора: пометка в чате регистраторов и сообщение пользователю
+type registrationDecision struct {
+	review repository.RegistrationReview
+	note   string
+	// userMessage сообщение пользователю, вместо %s подставляется заявка
+	userMessage string
+	// termChosen регистратор выбрал срок аренды, expiresAt - срок по договору, пусто - как в заявке
+	termChosen bool
+	expiresAt  time.Time
+}
+
+// tenancyQuestion вопрос регистратору о сроке аренды под карточкой заявки
+const tenancyQuestion = "\nСрок аренды по договору?"
+
+// reasonQuestion вопрос регистратору о причине решения под карточкой заявки
+const reasonQuestion = "\nПричина?"
+
+// reviewReasons причины на выбор регистратору. В кнопке передаётся номер причины:
+// текст не влезает в 64 байта данных кнопки. Новые причины дописываются в конец, чтобы старые кнопки не поменяли смысл.
+var reviewReasons = map[repository.RegistrationDecision][]string{
+	repository.RegistrationNewPhotoRequired: {
+		"по фото не читается адрес или номер",
+		"на фото не тот документ",
+		"документ обрезан или закрыт",
+	},
+	repository.RegistrationFailed: {
+		"адрес в документе не совпадает с заявкой",
+		"документ выписан на другого человека",
+		"документ недействителен или истёк",
+	},
+}
+
+// reasonButtons причины решения decision для регистратора. args - данные кнопки заявки.
+func (r *telegramRegistrator) reasonButtons(decision repository.RegistrationDecision, args []string) *telebot.ReplyMarkup {
+	menu := &telebot.ReplyMarkup{}
+	var rows []telebot.Row
+	for i, reason := range reviewReasons[decision] {
+		rows = append(rows, menu.Row(menu.Data(upperFirst(reason), r.adminReason.Unique, append([]string{string(decision), fmt.Sprint(i)}, args...)...)))
+	}
+	rows = append(rows, menu.Row(menu.Data(r.adminApprove.Text, r.adminApprove.Unique, args...)))
+	menu.Inline(rows...)
+	return menu
+}
+
+// rejectionDecision повторное фото или отказ с причиной, которую выбрал регистратор
+func rejectionDecision(decision repository.RegistrationDecision, reason string) registrationDecision {
+	if decision == repository.RegistrationNewPhotoRequired {
+		return registrationDecision{
+			review:      repository.RegistrationReview{Decision: decision, Reason: reason},
+			note:        "Попросили прислать заново: " + reason,
+			userMessage: "Заявка не подтверждена: %s. Причина: " + reason + ". Пришлите новое фото, адрес и номер должны быть читаемы.",
+		}
+	}
+	return registrationDecision{
+		review:      repository.RegistrationReview{Decision: decision, Reason: reason},
+		note:        "Провалили регистрацию: " + reason,
+		userMessage: "Заявка отклонена: %s. Причина: " + reason + ".",
+	}
+}
+
+// tenancyButtons сроки аренды для регистратора: как просил арендатор или по договору.
+// args - данные кнопки заявки, отказ и повторное фото остаются доступны.
+func (r *telegramRegistrator) tenancyButtons(args []string, requested time.Time) *telebot.ReplyMarkup {
+	menu := &telebot.ReplyMarkup{}
+	option := func(text, term string) telebot.Row {
+		return menu.Row(menu.Data(text, r.adminApproveTenancy.Unique, append([]string{term}, args...)...))
+	}
+	asked := "без срока"
+	if !requested.IsZero() {
+		asked = "до " + requested.Format("02.01.2006")
+	}
+	rows := []telebot.Row{option("✅ Как в заявке: "+asked, "asked")}
+	for _, term := range tenancyTerms {
+		if term.months > 0 {
+			rows = append(rows, option("✅ "+term.title, fmt.Sprint(term.months)))
+		}
+	}
+	rows = append(rows, menu.Row(
+		menu.Data(r.adminDisapprove.Text, r.adminDisapprove.Unique, args...),
+		menu.Data(r.adminFail.Text, r.adminFail.Unique, args...),
+	))
+	menu.Inline(rows...)
+	return menu
+}
+
+// decide записывает решение регистратора по заявке из кнопки. Заявки, которые уже не на проверке
+// или сменились с момента отправки кнопки, не трогает.
+func (r *telegramRegistrator) decide(ctx context.Context, c telebot.Context, args []string, decision registrationDecision) error {
+	ctx, span := tracer.Open(ctx, tracer.Named("registration decision "+string(decision.review.Decision)))
+	defer span.Close()
 	ctx, cancel := context.WithTimeout(ctx, time.Second)
 	defer cancel()
-	if err := r.userRepository.ConfirmRegistration(ctx, int64(userID), repository.ConfirmRegistrationEvent{
-		UpdateID: int64(c.Update().ID),
-		WithCode: "квитанция",
-	}); err != nil {
-		return fmt.Errorf("HandleAdminApprovedRegistration: %w", err)
+	request, err := parseReviewRequest(args)
+	if err != nil {
+		return fmt.Errorf("решение по регистрации: %w", err)
+	}
+	reviewer := c.Sender()
+	if reviewer.ID == request.userID {
+		return c.Respond(ctx, &telebot.CallbackResponse{Text: "Свою заявку решает другой регистратор", ShowAlert: true})
 	}
-	c.EditOrReply(ctx, c.Message().Text+"\nЗавершили регистрацию")
-	_, err := c.Bot().Send(ctx, &telebot.User{ID: int64(userID)}, "Регистрация завершена. Теперь вам доступен раздел для резидентов.\n/help")
-	return err
+	user, err := r.userRepository.GetUser(ctx, r.userRepository.ByID(request.userID))
+	if err != nil {
+		return fmt.Errorf("решение по регистрации [id=%d]: %w", request.userID, err)
+	}
+	if !request.pending(user) {
+		return r.replyAlreadyProcessed(ctx, c)
+	}
+	if request.legacy && pendingCount(user) > 1 {
+		// старая кнопка не говорит, о какой заявке речь
+		return c.Respond(ctx, &telebot.CallbackResponse{Text: "У пользователя несколько заявок, эта кнопка устарела. Решите заявку из /pending", ShowAlert: true})
+	}
+	if request.legacy {
+		start := user.Registration.Events.Start
+		request.houseID, request.apartment = start.HouseID, start.Apartment
+	}
+	review := decision.review
+	review.ReviewerID = reviewer.ID
+	if review.Reason == "" {
+		return c.EditOrReply(ctx, c.Message().Text+reasonQuestion, r.reasonButtons(review.Decision, args))
+	}
+	if review.Decision == repository.RegistrationApproved && !decision.termChosen && !request.legacy {
+		// арендатор сам выбирает срок, регистратор сверяет его с договором
+		if item, ok := user.PrivateProperty.Find(request.kind, request.houseID, request.apartment); ok && item.Residency == repository.ResidencyTenant {
+			return c.EditOrReply(ctx, c.Message().Text+tenancyQuestion, r.tenancyButtons(args, item.ExpiresAt))
+		}
+	}
+	if err := r.emit(ctx, user, request, int64(c.Update().ID), review, decision.expiresAt); errors.Is(err, repository.ErrStreamConflict) {
+		return r.replyAlreadyProcessed(ctx, c)
+	} else if err != nil {
+		return fmt.Errorf("решение по регистрации: %w", err)
+	}
+	r.log.Info("Решение по регистрации",
+		zap.Int64("userID", user.ID),
+		zap.Int64("reviewerID", reviewer.ID),
+		zap.Uint64("houseID", request.houseID),
+		zap.String("apartment", request.apartment),
+		zap.String("kind", string(request.kind)),
+		zap.String("decision", string(review.Decision)),
+		zap.String("reason", review.Reason),
+	)
+	reviewerTitle := fmt.Sprint(reviewer.ID)
+	if reviewer.Username != "" {
+		reviewerTitle = "@" + reviewer.Username
+	}
+	if review.Decision == repository.RegistrationApproved && !request.legacy {
+		if err := r.renewHousehold(ctx, user, request, decision.expiresAt); err != nil {
+			return fmt.Errorf("решение по регистрации: %w", err)
+		}
+	}
+	note, userMessage := decision.note, fmt.Sprintf(decision.userMessage, r.propertyTitle(request.kind, request.houseID, request.apartment))
+	if !decision.expiresAt.IsZero() {
+		note += ", аренда до " + decision.expiresAt.Format("02.01.2006")
+		userMessage += "\nСрок аренды по договору: до " + decision.expiresAt.Format("02.01.2006") + "."
+	}
+	card := strings.TrimSuffix(strings.TrimSuffix(c.Message().Text, tenancyQuestion), reasonQuestion)
+	if err := c.EditOrReply(ctx, fmt.Sprintf("%s\n%s (%s)", card, note, reviewerTitle)); err != nil {
+		return fmt.Errorf("решение по регистрации: %w", err)
+	}
+	return outbox.Send(ctx, c, &telebot.User{ID: user.ID}, userMessage)
+}
+
+// renewHousehold продлевает домочадцам пользователя доступ к квартире до нового срока его резидентства.
+// expiresAt - срок по договору от регистратора, пусто - срок из заявки.
+func (r *telegramRegistrator) renewHousehold(ctx context.Context, user *repository.User, request reviewRequest, expiresAt time.Time) error {
+	item, ok := user.PrivateProperty.Find(request.kind, request.houseID, request.apartment)
+	if !ok || request.kind != repository.PropertyApartment {
+		return nil
+	}
+	if expiresAt.IsZero() {
+		expiresAt = item.ExpiresAt
+	}
+	for _, member := range user.Household.Members {
+		if member.HouseID != request.houseID || member.Apartment != request.apartment {
+			continue
+		}
+		if err := r.userRepository.RenewHousehold(ctx, member.UserID, repository.RenewHouseholdEvent{
+			InviterID: user.ID,
+			HouseID:   request.houseID,
+			Apartment: request.apartment,
+			ExpiresAt: expiresAt,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
+// emit записывает решение событием. Регистрация, начатая до заявок V2, решается своими событиями,
+// заявки из [repository.AddApartmentEventV2] - событиями V2 по одной квартире или месту.
+func (r *telegramRegistrator) emit(ctx context.Context, user *repository.User, request reviewRequest, updateID int64, review repository.RegistrationReview, expiresAt time.Time) error {
+	legacy := request.legacyMatch(user)
+	switch review.Decision {
+	case repository.RegistrationApproved:
+		if legacy {
+			return r.userRepository.ConfirmRegistration(ctx, user.ID, user.StreamVersion, repository.ConfirmRegistrationEvent{
+				UpdateID:           updateID,
+				WithCode:           "квитанция",
+				RegistrationReview: review,
+			})
+		}
+		return r.userRepository.ConfirmApartment(ctx, user.ID, user.StreamVersion, repository.AdminConfirmedAddApartmentEventV2{
+			AdminUserID: review.ReviewerID,
+			HouseID:     request.houseID,
+			Apartment:   request.apartment,
+			Kind:        request.kind,
+			ExpiresAt:   expiresAt,
+		})
+	case repository.RegistrationNewPhotoRequired:
+		return r.userRepository.RequestNewRegistrationPhoto(ctx, user.ID, user.StreamVersion, repository.RequestNewRegistrationPhotoEvent{
+			UpdateID:           updateID,
+			HouseID:            request.houseID,
+			Apartment:          request.apartment,
+			Kind:               request.kind,
+			RegistrationReview: review,
+		})
+	case repository.RegistrationFailed:
+		if legacy {
+			return r.userRepository.FailRegistration(ctx, user.ID, user.StreamVersion, repository.FailRegistrationEvent{
+				UpdateID:           updateID,
+				WithCode:           "квитанция",
+				RegistrationReview: review,
+			})
+		}
+		return r.userRepository.DeclineApartment(ctx, user.ID, user.StreamVersion, repository.AdminDeclinedAddApartmentEventV2{
+			AdminUserID: review.ReviewerID,
+			HouseID:     request.houseID,
+			Apartment:   request.apartment,
+			Kind:        request.kind,
+			Reason:      review.Reason,
+		})
+	}
+	return fmt.Errorf("неизвестное решение %q", review.Decision)
+}
+
+func (r *telegramRegistrator) HandleAdminApprovedRegistration(ctx context.Context, c telebot.Context) error {
+	return r.decide(ctx, c, c.Args(), approvedDecision())
+}
+
+func approvedDecision() registrationDecision {
+	return registrationDecision{
+		review:      repository.RegistrationReview{Decision: repository.RegistrationApproved, Reason: "адрес в документе совпадает с заявкой"},
+		note:        "Завершили регистрацию",
+		userMessage: "Регистрация завершена. Подтверждено: %s. Теперь вам доступен раздел для резидентов.\n/help",
+	}
+}
+
+// HandleAdminApprovedTenancy подтверждение аренды со сроком, который выбрал регистратор.
+// Первый аргумент кнопки - срок в месяцах или asked, остальные - заявка.
+func (r *telegramRegistrator) HandleAdminApprovedTenancy(ctx context.Context, c telebot.Context) error {
+	args := c.Args()
+	if len(args) < 2 {
+		return fmt.Errorf("срок аренды: нет данных заявки")
+	}
+	decision := approvedDecision()
+	decision.termChosen = true
+	if months, err := strconv.Atoi(args[0]); err == nil && months > 0 {
+		decision.expiresAt = time.Now().AddDate(0, months, 0)
+	}
+	return r.decide(ctx, c, args[1:], decision)
+}
+
+// HandleAdminDisapprovedRegistration и HandleAdminFailRegistration сначала спрашивают причину,
+// решение записывает [telegramRegistrator.HandleAdminReason]
 func (r *telegramRegistrator) HandleAdminDisapprovedRegistration(ctx context.Context, c telebot.Context) error {
-	userID, _ := strconv.Atoi(c.Args()[0])
-	c.EditOrReply(ctx, c.Message().Text+"\nПопросили прислать заново")
-	_, err := c.Bot().Send(ctx,
-		&telebot.User{ID: int64(userID)},
-		"Регистрация не завершена. Кажется, есть проблемы с фото. Попробуйте сделать более четкое фото. Адрес и номер квартиры должен быть читаем.")
-	return err
+	return r.decide(ctx, c, c.Args(), rejectionDecision(repository.RegistrationNewPhotoRequired, ""))
 }
 
 func (r *telegramRegistrator) HandleAdminFailRegistration(ctx context.Context, c telebot.Context) error {
-	userID, _ := strconv.Atoi(c.Args()[0])
-	ctx, cancel := context.WithTimeout(ctx, time.Second)
-	defer cancel()
-	if err := r.userRepository.FailRegistration(ctx, int64(userID), repository.FailRegistrationEvent{
-		UpdateID: int64(c.Update().ID),
-		WithCode: "квитанция",
-	}); err != nil {
-		return fmt.Errorf("HandleAdminFailRegistration: %w", err)
+	return r.decide(ctx, c, c.Args(), rejectionDecision(repository.RegistrationFailed, ""))
+}
+
+// HandleAdminReason решение с причиной из списка. Аргументы кнопки: решение, номер причины, заявка.
+func (r *telegramRegistrator) HandleAdminReason(ctx context.Context, c telebot.Context) error {
+	args := c.Args()
+	if len(args) < 3 {
+		return fmt.Errorf("причина решения: нет данных заявки")
 	}
-	c.EditOrReply(ctx, c.Message().Text+"\nПровалили регистрацию")
-	_, err := c.Bot().Send(ctx, &telebot.User{ID: int64(userID)}, "Регистрация провалена. Квартира в квитанции не сходится с квартирой, указанной при регистрации.")
-	return err
+	decision := repository.RegistrationDecision(args[0])
+	reasons := reviewReasons[decision]
+	i, err := strconv.Atoi(args[1])
+	if err != nil || i < 0 || i >= len(reasons) {
+		return fmt.Errorf("причина решения %q: нет причины %q", decision, args[1])
+	}
+	return r.decide(ctx, c, args[2:], rejectionDecision(decision, reasons[i]))
 }
 
+// pendingPageSize сколько заявок показывают /pending и напоминание
+const pendingPageSize = 10
+
+// HandlePending очередь заявок на проверку, самые старые первыми, с кнопками решения под каждой
+func (r *telegramRegistrator) HandlePending(ctx context.Context, c telebot.Context) error {
+	ctx, span := tracer.Open(ctx, tracer.Named("/pending"))
+	defer span.Close()
+	pending, err := r.userRepository.PendingReviews(ctx)
+	if err != nil {
+		return fmt.Errorf("/pending: %w", err)
+	}
+	if len(pending) == 0 {
+		return c.EditOrReply(ctx, "Заявок на проверке нет")
+	}
+	header := fmt.Sprintf("На проверке заявок: %d. Самые старые первыми.", len(pending))
+	if len(pending) > pendingPageSize {
+		header += fmt.Sprintf(" Показаны первые %d, остальные появятся после решения по этим.", pendingPageSize)
+		pending = pending[:pendingPageSize]
+	}
+	if err := c.EditOrReply(ctx, header); err != nil {
+		return fmt.Errorf("/pending: %w", err)
+	}
+	now := time.Now()
+	for _, p := range pending {
+		text := fmt.Sprintf("Заявка %s\n🏠 Дом %s\n%s\n👤 %s\n⏳ Ждёт %s",
+			p.User.Title(), r.houseNumber(p.HouseID), propertyLine(p.Kind, p.Apartment),
+			residencyTitle(p.Residency, p.ExpiresAt), formatAge(p.Age(now)))
+		if r.reviewSLA > 0 && len(repository.Overdue([]repository.PendingReview{p}, now, r.reviewSLA)) > 0 {
+			text += " ⚠️ дольше срока"
+		}
+		if err := outbox.Send(ctx, c, c.Chat(), text, r.reviewButtons(p.User.ID, p.HouseID, p.Apartment, p.Kind)); err != nil {
+			return fmt.Errorf("/pending: %w", err)
+		}
+	}
+	return nil
+}
+
+// RemindOverdue пишет в чат регистраторов о заявках, ждущих дольше срока. Вызывается по расписанию вне обработки обновлений.
+func (r *telegramRegistrator) RemindOverdue(ctx context.Context, bot *telebot.Bot) error {
+	ctx, span := tracer.Open(ctx, tracer.Named("telegramRegistrator::RemindOverdue"))
+	defer span.Close()
+	if r.reviewSLA == 0 {
+		return nil
+	}
+	pending, err := r.userRepository.PendingReviews(ctx)
+	if err != nil {
+		return fmt.Errorf("напоминание о заявках: %w", err)
+	}
+	now := time.Now()
+	overdue := repository.Overdue(pending, now, r.reviewSLA)
+	r.log.Info("Просроченные заявки", zap.Int("pending", len(pending)), zap.Int("overdue", len(overdue)))
+	if len(overdue) == 0 {
+		return nil
+	}
+	lines := []string{fmt.Sprintf("⏰ Заявок ждут решения дольше %s: %d", formatAge(r.reviewSLA), len(overdue))}
+	for i, p := range overdue {
+		if i == pendingPageSize {
+			lines = append(lines, fmt.Sprintf("и ещё %d", len(overdue)-pendingPageSize))
+			break
+		}
+		lines = append(lines, fmt.Sprintf("— %s: %s, ждёт %s",
+			p.User.Title(), r.propertyTitle(p.Kind, p.HouseID, p.Apartment), formatAge(p.Age(now))))
+	}
+	lines = append(lines, "Очередь с кнопками: /pending")
+	if _, err := bot.Send(ctx, &telebot.Chat{ID: r.registrationChatID}, strings.Join(lines, "\n")); err != nil {
+		return fmt.Errorf("напоминание о заявках: %w", err)
+	}
+	return nil
+}
+
+func (r *telegramRegistrator) findHouse(number string) *repository.THouse {
+	for _, house := range r.houses() {
+		if house.Number == number {
+			return &house
+		}
+	}
+	return nil
+}
+
+// propertyTitle заявка для сообщений: дом и квартира или парковочное место
+func (r *telegramRegistrator) propertyTitle(kind repository.PropertyKind, houseID uint64, number string) string {
+	if kind == repository.PropertyParking {
+		return fmt.Sprintf("дом %s, парковочное место %s", r.houseNumber(houseID), number)
+	}
+	return fmt.Sprintf("дом %s, квартира %s", r.houseNumber(houseID), number)
+}
+
+// propertyLine строка с номером квартиры или места под строкой с домом
+func propertyLine(kind repository.PropertyKind, number string) string {
+	if kind == repository.PropertyParking {
+		return "🅿️ Парковочное место " + number
+	}
+	return "🚪 Квартира " + number
+}
+
+func (r *telegramRegistrator) houseNumber(houseID uint64) string {
+	for _, house := range r.houses() {
+		if house.ID == houseID {
+			return house.Number
+		}
+	}
+	return fmt.Sprintf("#%d", houseID)
+}
+
+// formatAge срок для людей: часы до двух суток, дальше дни и часы. 0 - время заявки неизвестно.
+func formatAge(d time.Duration) string {
+	hours := int(d.Hours())
+	switch {
+	case d == 0:
+		return "с неизвестного времени"
+	case hours < 1:
+		return "меньше часа"
+	case hours < 48:
+		return fmt.Sprintf("%d ч.", hours)
+	case hours%24 == 0:
+		return fmt.Sprintf("%d дн.", hours/24)
+	}
+	return fmt.Sprintf("%d дн. %d ч.", hours/24, hours%24)
+}
+
+// HandleMediaCreated фото документа от пользователя с заявками: уходит регистраторам с кнопками решения
+// по каждой заявке, для которой документа ещё не было. Карточки уже присланных заявок не повторяются.
 func (r *telegramRegistrator) HandleMediaCreated(ctx context.Context, user *repository.User, c telebot.Context) error {
 	if c.Message().Photo == nil {
-		return c.EditOrReply(ctx, "Для регистрации нужно отправить фото вашей квитнации за квартиру. Так мы сможем убидеться, что вы являетесь резидентом района.")
+		return c.EditOrReply(ctx, "Для регистрации нужно отправить фото вашей квитнации за квартиру или документа на парковочное место. Так мы сможем убидеться, что вы являетесь резидентом района.")
+	}
+	items := user.PrivateProperty.List()
+	awaiting := items[:0]
+	for _, item := range items {
+		if !item.Approved && item.SubmittedAt.IsZero() {
+			awaiting = append(awaiting, item)
+		}
+	}
+	if len(awaiting) == 0 {
+		return c.Reply("Документы по вашим заявкам уже у регистраторов. Мы сообщим о результате.")
+	}
+	if err := r.userRepository.SubmitRegistrationDocument(ctx, user.ID, user.StreamVersion, repository.SubmitRegistrationDocumentEvent{
+		UpdateID: int64(c.Update().ID),
+	}); err != nil {
+		return fmt.Errorf("HandleMediaCreated: %w", err)
 	}
 	_ = c.Reply("Спасибо. Мы проверим и сообщим о результате.")
-	replyMarkup := &telebot.ReplyMarkup{}
-	replyMarkup.Inline(replyMarkup.Row(
-		replyMarkup.Data(r.adminApprove.Text, r.adminApprove.Unique, fmt.Sprint(c.Sender().ID)),
-		replyMarkup.Data(r.adminDisapprove.Text, r.adminDisapprove.Unique, fmt.Sprint(c.Sender().ID)),
-		replyMarkup.Data(r.adminFail.Text, r.adminFail.Unique, fmt.Sprint(c.Sender().ID)),
-	))
-	if err := c.ForwardTo(&telebot.Chat{ID: registrationChatID}, replyMarkup); err != nil {
+	if err := c.ForwardTo(&telebot.Chat{ID: r.registrationChatID}); err != nil {
 		return fmt.Errorf("HandleMediaCreated: %w", err)
 	}
-	return sendToRegistrationGroup(ctx, c, r.log,
-		`Фото от нового пользователя: %v %v %v.
-		Регистрация для адреса такой пользователь: %v %v.
-		Сравни с квитанцией. Похоже?`,
-		[]any{
-			c.Sender().Username, c.Sender().FirstName, c.Sender().LastName,
-			user.Registration.Events.Start.HouseNumber, user.Registration.Events.Start.Apartment},
-		replyMarkup)
+	for _, item := range awaiting {
+		if err := r.sendToRegistrationGroup(ctx, c,
+			`Фото от пользователя: %v %v %v.
+		Заявка: %s, %s.
+		Нужен документ: %s.
+		Сравни с документом. Похоже?`,
+			[]any{
+				c.Sender().Username, c.Sender().FirstName, c.Sender().LastName,
+				r.propertyTitle(item.Kind, item.HouseID, item.ApartmentNumber),
+				residencyTitle(item.Residency, item.ExpiresAt), item.Residency.Evidence(item.Kind)},
+			r.reviewButtons(user.ID, item.HouseID, item.ApartmentNumber, item.Kind),
+		); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
+// HandleStartRegistration заявка на квартиру: дом, диапазон квартир, квартира, подтверждение.
+// Заявок может быть сколько угодно, каждую регистраторы проверяют отдельно.
 func (r *telegramRegistrator) HandleStartRegistration(ctx context.Context, c telebot.Context) error {
 	ctx, span := tracer.Open(ctx, tracer.Named("registerBtn"))
 	defer span.Close()
-	user, err := r.userRepository.GetUser(ctx, r.userRepository.ByID(c.Sender().ID))
-	if err != nil {
-		return fmt.Errorf("регистрация: %w", err)
-	}
-	if user.Registration != nil {
-		return c.EditOrReply(ctx,
-			`Регистрация уже началась. Для завершение регистрации отправьте фотографию вашей квитанции за комуналку. Так мы сможем убедиться, что вы являетесь резидентом района.`,
-			markup.InlineMarkup(markup.Row(markup.BackToResidentsBtn)),
-		)
-	}
 	data := c.Args()
 	if len(data) == 0 || len(data) == 1 && data[0] == "" {
 		chooseHouseMenu := &telebot.ReplyMarkup{}
@@ -138,13 +624,7 @@ func (r *telegramRegistrator) HandleStartRegistration(ctx context.Context, c tel
 		return c.EditOrReply(ctx, "Выберите номер дома", chooseHouseMenu)
 	}
 	houseNumber := data[0]
-	var house *repository.THouse
-	for _, h := range r.houses() {
-		if houseNumber == h.Number {
-			house = &h
-			break
-		}
-	}
+	house := r.findHouse(houseNumber)
 	if house == nil {
 		return c.EditOrReply(ctx, "Что-то пошло не по плану")
 	}
@@ -213,35 +693,252 @@ func (r *telegramRegistrator) HandleStartRegistration(ctx context.Context, c tel
 			confirmMenu,
 		)
 	}
-	houseID := func() uint64 {
+	request := propertyRequest{kind: repository.PropertyApartment, house: house, number: fmt.Sprint(appartmentNumber)}
+	if done, err := r.chooseResidency(ctx, c, &request, r.EntryPoint().Unique, data[:4], data[4:]); !done {
+		return err
+	}
+	if added, err := r.addProperty(ctx, c, request); !added {
+		return err
+	}
+	return r.sendToRegistrationGroup(ctx, c, "Новая регистрация. Дом %s квартира %s, %s", []any{houseNumber, request.number, request.residencyTitle()})
+}
+
+// propertyRequest заявка, собранная мастером: что, где и кем пользователь приходится собственности
+type propertyRequest struct {
+	kind      repository.PropertyKind
+	house     *repository.THouse
+	number    string
+	residency repository.Residency
+	expiresAt time.Time
+}
+
+func (p propertyRequest) residencyTitle() string {
+	return residencyTitle(p.residency, p.expiresAt)
+}
+
+// residencyTitle вид резидентства и срок аренды для сообщений
+func residencyTitle(residency repository.Residency, expiresAt time.Time) string {
+	if residency == "" {
+		residency = repository.ResidencyOwner
+	}
+	if expiresAt.IsZero() {
+		return residency.Title()
+	}
+	return fmt.Sprintf("%s до %s", residency.Title(), expiresAt.Format("02.01.2006"))
+}
+
+// tenancyTerms сроки аренды на выбор в месяцах, 0 - без срока
+var tenancyTerms = []struct {
+	title  string
+	months int
+}{
+	{"3 месяца", 3},
+	{"6 месяцев", 6},
+	{"1 год", 12},
+	{"Без срока", 0},
+}
+
+// chooseResidency шаги мастера после подтверждения адреса: вид резидентства и срок аренды для арендаторов.
+// address - данные кнопки до выбора, choice - выбранное после адреса. Пока выбор не закончен, показывает
+// следующий шаг, а done ложно.
+func (r *telegramRegistrator) chooseResidency(ctx context.Context, c telebot.Context, request *propertyRequest, unique string, address, choice []string) (done bool, err error) {
+	menu := &telebot.ReplyMarkup{}
+	option := func(text string, args ...string) telebot.Row {
+		return menu.Row(menu.Data(text, unique, append(append([]string(nil), address...), args...)...))
+	}
+	if len(choice) == 0 || !repository.Residency(choice[0]).Valid() {
+		rows := []telebot.Row{
+			option("🏠 Я собственник", string(repository.ResidencyOwner)),
+			option("🔑 Я арендатор", string(repository.ResidencyTenant)),
+		}
+		whom := "месту"
+		if request.kind == repository.PropertyApartment {
+			whom = "квартире"
+			rows = append(rows, option("👪 Я член семьи собственника", string(repository.ResidencyFamily)))
+		}
+		menu.Inline(append(rows, menu.Row(r.backBtn))...)
+		title := upperFirst(r.propertyTitle(request.kind, request.house.ID, request.number))
+		return false, c.EditOrReply(ctx, fmt.Sprintf("%s. Кем вы приходитесь %s?", title, whom), menu)
+	}
+	request.residency = repository.Residency(choice[0])
+	if request.residency != repository.ResidencyTenant {
+		return true, nil
+	}
+	if len(choice) == 1 {
+		var rows []telebot.Row
+		for _, term := range tenancyTerms {
+			rows = append(rows, option(term.title, string(request.residency), fmt.Sprint(term.months)))
+		}
+		menu.Inline(append(rows, menu.Row(r.backBtn))...)
+		return false, c.EditOrReply(ctx, "На какой срок аренда? После него доступ к разделу для резидентов закончится, продлить можно новой заявкой.", menu)
+	}
+	if months, err := strconv.Atoi(choice[1]); err == nil && months > 0 {
+		request.expiresAt = time.Now().AddDate(0, months, 0)
+	}
+	return true, nil
+}
+
+func upperFirst(s string) string {
+	runes := []rune(s)
+	if len(runes) == 0 {
+		return s
+	}
+	return strings.ToUpper(string(runes[:1])) + string(runes[1:])
+}
+
+// addProperty записывает заявку и просит пользователя прислать документ. Повторные заявки не пишет,
+// кроме заявок с истёкшей арендой: added ложно, если заявка уже есть или записать её не удалось.
+func (r *telegramRegistrator) addProperty(ctx context.Context, c telebot.Context, request propertyRequest) (added bool, err error) {
+	ctx, span := tracer.Open(ctx, tracer.Named("addProperty"))
+	defer span.Close()
+	user, err := r.userRepository.GetUser(ctx, r.userRepository.ByID(c.Sender().ID))
+	if err != nil {
+		return false, fmt.Errorf("заявка на собственность: %w", err)
+	}
+	kind, house, number := request.kind, request.house, request.number
+	afterRequest := markup.InlineMarkup(markup.Row(markup.MyPropertiesBtn), markup.Row(r.backBtn))
+	if item, ok := user.PrivateProperty.Find(kind, house.ID, number); ok && !item.Expired(time.Now()) {
+		status := "уже на проверке. Если ещё не отправляли фото документа, отправьте его мне"
+		if item.Approved {
+			status = "уже подтверждена"
+		}
+		return false, c.EditOrReply(ctx, fmt.Sprintf("Заявка на %s %s.", r.propertyTitle(kind, house.ID, number), status), afterRequest)
+	}
+	if err := r.userRepository.AddApartment(ctx, user.ID, user.StreamVersion, repository.AddApartmentEventV2{
+		UpdateID:    int64(c.Update().ID),
+		HouseID:     house.ID,
+		HouseNumber: house.Number,
+		Apartment:   number,
+		Kind:        kind,
+		Residency:   request.residency,
+		ExpiresAt:   request.expiresAt,
+		// фото документа пользователь пришлёт следующим сообщением
+		DocumentRequired: true,
+	}); err != nil {
+		if serr := outbox.Always(c).EditOrReply(ctx, `Извините, в процессе регистрации произошла ошибка. Исправим как можно скорее.`); serr != nil {
+			return false, serr
+		}
+		return false, fmt.Errorf("заявка на собственность: %w", err)
+	}
+	text := fmt.Sprintf("Для завершения регистрации отправьте фотографию: %s. Так мы сможем убедиться, что вы являетесь резидентом района. Адрес и номер должны быть читаемы.",
+		request.residency.Evidence(kind))
+	if err := c.EditOrReply(ctx, text, afterRequest); err != nil {
+		return true, fmt.Errorf("отправка сообщения регистрации: %w", err)
+	}
+	return true, nil
+}
+
+// maxParkingNumberLength сколько цифр можно набрать в номере парковочного места
+const maxParkingNumberLength = 4
+
+// HandleAddParking заявка на парковочное место: дом и номер места, набранный кнопками
+func (r *telegramRegistrator) HandleAddParking(ctx context.Context, c telebot.Context) error {
+	ctx, span := tracer.Open(ctx, tracer.Named("addParkingBtn"))
+	defer span.Close()
+	unique := markup.AddParkingBtn.Unique
+	data := c.Args()
+	if len(data) == 0 || data[0] == "" {
+		chooseHouseMenu := &telebot.ReplyMarkup{}
+		var rows []telebot.Row
 		for _, house := range r.houses() {
-			if house.Number == houseNumber {
-				return house.ID
+			rows = append(rows, chooseHouseMenu.Row(chooseHouseMenu.Data(house.Number, unique, house.Number)))
+		}
+		rows = append(rows, chooseHouseMenu.Row(r.backBtn))
+		chooseHouseMenu.Inline(rows...)
+		return c.EditOrReply(ctx, "🅿️ Выберите дом, к которому относится парковка", chooseHouseMenu)
+	}
+	house := r.findHouse(data[0])
+	if house == nil {
+		return c.EditOrReply(ctx, "Что-то пошло не по плану")
+	}
+	var number string
+	if len(data) > 1 {
+		number = data[1]
+	}
+	if _, err := strconv.Atoi(number); number != "" && (err != nil || len(number) > maxParkingNumberLength) {
+		return c.EditOrReply(ctx, "Что-то пошло не по плану")
+	}
+	if len(data) > 2 && data[2] == "OK" && number != "" {
+		request := propertyRequest{kind: repository.PropertyParking, house: house, number: number}
+		if done, err := r.chooseResidency(ctx, c, &request, unique, data[:3], data[3:]); !done {
+			return err
+		}
+		if added, err := r.addProperty(ctx, c, request); !added {
+			return err
+		}
+		return r.sendToRegistrationGroup(ctx, c, "Новая заявка на парковочное место. Дом %s место %s, %s", []any{house.Number, number, request.residencyTitle()})
+	}
+	keypad := &telebot.ReplyMarkup{}
+	var rows []telebot.Row
+	if len(number) < maxParkingNumberLength {
+		var digits []telebot.Btn
+		for _, digit := range "7894561230" {
+			if number == "" && digit == '0' {
+				continue
 			}
+			digits = append(digits, keypad.Data(string(digit), unique, house.Number, number+string(digit)))
 		}
-		return 0
+		rows = append(rows, keypad.Split(3, digits)...)
 	}
-	code, err := r.userRepository.StartRegistration(ctx, c.Sender().ID, int64(c.Update().ID), houseID(), houseNumber, fmt.Sprint(appartmentNumber))
+	if number != "" {
+		rows = append(rows, keypad.Row(
+			keypad.Data("⌫", unique, house.Number, number[:len(number)-1]),
+			keypad.Data("✅ Готово", unique, house.Number, number, "OK"),
+		))
+	}
+	rows = append(rows, keypad.Row(keypad.Data("❌ Другой дом", unique)), keypad.Row(r.backBtn))
+	keypad.Inline(rows...)
+	return c.EditOrReply(ctx, fmt.Sprintf("🏠 Дом %s. Наберите номер парковочного места: %s", house.Number, number), keypad)
+}
+
+// HandleMyProperties квартиры и парковочные места пользователя с состоянием проверки каждой заявки
+func (r *telegramRegistrator) HandleMyProperties(ctx context.Context, c telebot.Context) error {
+	ctx, span := tracer.Open(ctx, tracer.Named("myProperties"))
+	defer span.Close()
+	user, err := r.userRepository.GetUser(ctx, r.userRepository.ByID(c.Sender().ID))
 	if err != nil {
-		if serr := c.EditOrReply(ctx, `Извините, в процессе регистрации произошла ошибка. Исправим как можно скорее.`); serr != nil {
-			return serr
+		return fmt.Errorf("моя недвижимость: %w", err)
+	}
+	items := user.PrivateProperty.List()
+	lines := []string{"🏘 Ваша недвижимость:"}
+	if len(items) == 0 {
+		lines = []string{"Вы ещё не добавили ни квартиры, ни парковочного места. Добавьте их, чтобы получить доступ к разделу для резидентов."}
+	}
+	now := time.Now()
+	var waiting bool
+	for _, item := range items {
+		status := "✅ подтверждено"
+		if item.Expired(now) {
+			status = "⌛ аренда закончилась, продлить можно новой заявкой"
+		} else if !item.Approved {
+			waiting = true
+			status = "⏳ на проверке"
+			if !item.RequestedAt.IsZero() {
+				status += " " + formatAge(now.Sub(item.RequestedAt))
+			}
+		}
+		icon := "🚪"
+		if item.Kind == repository.PropertyParking {
+			icon = "🅿️"
 		}
-		return fmt.Errorf("старт регистрации: %w", err)
+		lines = append(lines, fmt.Sprintf("%s %s (%s) — %s", icon, r.propertyTitle(item.Kind, item.HouseID, item.ApartmentNumber),
+			residencyTitle(item.Residency, item.ExpiresAt), status))
 	}
-
-	replyMarkup := &telebot.ReplyMarkup{}
-	replyMarkup.Inline(replyMarkup.Row(r.backBtn))
-	if err := c.EditOrReply(ctx, `Для завершение регистрации отправьте фотографию вашей квитанции за квартиру. Так мы сможем убедиться, что вы проживаете в квартире и являетесь резидентом района.`, replyMarkup); err != nil {
-		return fmt.Errorf("отправка сообщения регистрации: %w", err)
+	if waiting {
+		lines = append(lines, "", "Если ещё не отправляли фото квитанции или документа на парковочное место, отправьте его мне.")
+	}
+	rows := []telebot.Row{markup.Row(markup.AddApartmentBtn), markup.Row(markup.AddParkingBtn)}
+	if len(user.HouseholdApartments(now)) > 0 {
+		rows = append(rows, markup.Row(markup.HouseholdBtn))
 	}
-	return sendToRegistrationGroup(ctx, c, r.log, "Новая регистрация. Дом %s квартира %d. Код регистрации: %s", []any{houseNumber, appartmentNumber, code})
+	return c.EditOrReply(ctx, strings.Join(lines, "\n"), markup.InlineMarkup(append(rows, markup.Row(r.backBtn))...))
 }
 
-func sendToRegistrationGroup(ctx context.Context, c telebot.Context, log *zap.Logger, message string, args []any, opts ...any) error {
+func (r *telegramRegistrator) sendToRegistrationGroup(ctx context.Context, c telebot.Context, message string, args []any, opts ...any) error {
 	ctx, span := tracer.Open(ctx, tracer.Named("sendToRegistrationGroup"))
 	defer span.Close()
-	log.Named("регистратор").Info(message, zap.Any("args", args))
-	if _, err := c.Bot().Send(ctx, &telebot.Chat{ID: registrationChatID}, fmt.Sprintf(message, args...), opts...); err != nil {
+	r.log.Named("регистратор").Info(message, zap.Any("args", args))
+	if err := outbox.Send(ctx, c, &telebot.Chat{ID: r.registrationChatID}, fmt.Sprintf(message, args...), opts...); err != nil {
 		return fmt.Errorf("сообщение регистратору %v: %w", message, err)
 	}
 	return nil
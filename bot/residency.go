@@ -0,0 +1,85 @@
+package bot
+
+import (
+	"context"
+	"mikhailche/botcomod/config"
+	"mikhailche/botcomod/handlers/middleware/outbox"
+	markup "mikhailche/botcomod/lib/bot-markup"
+	"mikhailche/botcomod/lib/tracer.v2"
+	"mikhailche/botcomod/repository"
+	"mikhailche/botcomod/services"
+
+	"github.com/mikhailche/telebot"
+	"go.uber.org/zap"
+)
+
+// residentFeature возможность бота, которую конфигурация открывает или закрывает для вида резидентства
+type residentFeature func(config.ResidencyAccess) bool
+
+var (
+	featureCameras          residentFeature = func(a config.ResidencyAccess) bool { return a.Cameras }
+	featureContactLookup    residentFeature = func(a config.ResidencyAccess) bool { return a.ContactLookup }
+	featureChatAutoApproval residentFeature = func(a config.ResidencyAccess) bool { return a.ChatAutoApproval }
+)
+
+func residencyAccess(cfg config.Residency, residency repository.Residency) config.ResidencyAccess {
+	switch residency {
+	case repository.ResidencyOwner:
+		return cfg.Owner
+	case repository.ResidencyTenant:
+		return cfg.Tenant
+	case repository.ResidencyFamily:
+		return cfg.Family
+	}
+	return config.ResidencyAccess{}
+}
+
+// allows возможность открыта хотя бы одному из действующих видов резидентства
+func (f residentFeature) allows(cfg config.Residency, residencies []repository.Residency) bool {
+	for _, residency := range residencies {
+		if f(residencyAccess(cfg, residency)) {
+			return true
+		}
+	}
+	return false
+}
+
+// gate пускает к обработчику резидентов, которым открыта возможность. Ставится после проверки резидентства.
+func (f residentFeature) gate(cfg config.Residency, userRepository *repository.UserRepository) telebot.MiddlewareFunc {
+	return func(next telebot.HandlerFunc) telebot.HandlerFunc {
+		return func(ctx context.Context, c telebot.Context) error {
+			if f.allows(cfg, userRepository.ResidenciesOf(ctx, c.Sender().ID)) {
+				return next(ctx, c)
+			}
+			return c.EditOrSend(ctx, "Этот раздел недоступен для вашего вида резидентства.",
+				markup.InlineMarkup(markup.Row(markup.MyPropertiesBtn), markup.Row(markup.BackToResidentsBtn)))
+		}
+	}
+}
+
+// autoApproveChatJoin одобряет заявку на вступление в чат района, если резиденту открыто автоодобрение.
+// Остальные заявки остаются админам чата.
+func autoApproveChatJoin(log *zap.Logger, cfg config.Residency, userRepository *repository.UserRepository, groupChats *services.GroupChatService) telebot.HandlerFunc {
+	return func(ctx context.Context, c telebot.Context) error {
+		ctx, span := tracer.Open(ctx, tracer.Named("autoApproveChatJoin"))
+		defer span.Close()
+		request := c.ChatJoinRequest()
+		var known bool
+		for _, chat := range groupChats.GroupChats() {
+			known = known || chat.TelegramChatID == request.Chat.ID
+		}
+		if !known {
+			return nil
+		}
+		residencies := userRepository.ResidenciesOf(ctx, request.Sender.ID)
+		if !featureChatAutoApproval.allows(cfg, residencies) {
+			log.Info("Заявку в чат оставили админам", zap.Int64("chatID", request.Chat.ID), zap.Int64("userID", request.Sender.ID), zap.Any("residencies", residencies))
+			return nil
+		}
+		log.Info("Одобрили заявку в чат", zap.Int64("chatID", request.Chat.ID), zap.Int64("userID", request.Sender.ID), zap.Any("residencies", residencies))
+		// одобрение нельзя отозвать, поэтому только после того, как обработка апдейта прошла
+		return outbox.Defer(ctx, func(ctx context.Context) error {
+			return c.Bot().ApproveJoinRequest(request.Chat, request.Sender)
+		})
+	}
+}
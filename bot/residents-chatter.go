@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"mikhailche/botcomod/handlers/middleware/outbox"
 	markup "mikhailche/botcomod/lib/bot-markup"
 	"mikhailche/botcomod/lib/tracer.v2"
 	"strconv"
@@ -53,14 +54,15 @@ type HandleRegistrator interface {
 	Handle(endpoint interface{}, h telebot.HandlerFunc, m ...telebot.MiddlewareFunc)
 }
 
-func (r *ResidentsChatter) RegisterBotsHandlers(ctx context.Context, bot HandleRegistrator) {
+// RegisterBotsHandlers lookup пускает к поиску соседа. Ответить на запрос контакта может любой резидент.
+func (r *ResidentsChatter) RegisterBotsHandlers(ctx context.Context, bot HandleRegistrator, lookup telebot.MiddlewareFunc) {
 	_, span := tracer.Open(ctx, tracer.Named("ResidentsChatter::RegisterBotsHandlers"))
 	defer span.Close()
-	bot.Handle(&r.startChat, r.HandleChatWithResident)
-	bot.Handle(&r.houseIsChosen, r.HandleHouseIsChosen)
-	bot.Handle(&r.appartmentRangeChosen, r.HandleAppartmentRangeChosen)
-	bot.Handle(&r.appartmentChosen, r.HandleAppartmentChosen)
-	bot.Handle(&r.chatRequestApproved, r.HandleChatRequestApproved)
+	bot.Handle(&r.startChat, r.HandleChatWithResident, lookup)
+	bot.Handle(&r.houseIsChosen, r.HandleHouseIsChosen, lookup)
+	bot.Handle(&r.appartmentRangeChosen, r.HandleAppartmentRangeChosen, lookup)
+	bot.Handle(&r.appartmentChosen, r.HandleAppartmentChosen, lookup)
+	bot.Handle(&r.chatRequestApproved, r.HandleChatRequestApproved, lookup)
 	bot.Handle(&r.allowContact, r.HandleAllowContact)
 	bot.Handle(&r.denyContact, r.HandleDenyContact)
 }
@@ -184,12 +186,9 @@ func (r *ResidentsChatter) HandleChatRequestApproved(ctx context.Context, c tele
 
 	user, err := r.users.FindByAppartment(ctx, house.Number, fmt.Sprint(appartment))
 	if errors.Is(err, repository.ErrNotFound) {
-		return fmt.Errorf(
-			"не нашел пользователя проживающего в [%v %d]: %w; %v",
-			house.Number, appartment, err,
-			c.EditOrReply(ctx, "Я не нашел никого, зарегистрированного по этому адресу. Придется искать другим способом.",
-				markup.InlineMarkup(markup.Row(r.upperMenu)),
-			),
+		// не ошибка: с ошибкой ответ пользователю отменился бы вместе с обновлением
+		return c.EditOrReply(ctx, "Я не нашел никого, зарегистрированного по этому адресу. Придется искать другим способом.",
+			markup.InlineMarkup(markup.Row(r.upperMenu)),
 		)
 	}
 	if err != nil {
@@ -198,7 +197,7 @@ func (r *ResidentsChatter) HandleChatRequestApproved(ctx context.Context, c tele
 		)
 	}
 
-	if _, err := c.Bot().Send(ctx, &telebot.User{ID: user.ID},
+	if err := outbox.Send(ctx, c, &telebot.User{ID: user.ID},
 		fmt.Sprintf(
 			"С вами хочет связаться %s %s (@%s). Можно ли передать ему ваши контактные данные?",
 			c.Sender().FirstName, c.Sender().LastName, c.Sender().Username,
@@ -228,7 +227,7 @@ func (r *ResidentsChatter) HandleAllowContact(ctx context.Context, c telebot.Con
 			c.Args()[0], err,
 		)
 	}
-	c.Bot().Send(ctx, &telebot.User{ID: int64(recepient)},
+	outbox.Send(ctx, c, &telebot.User{ID: int64(recepient)},
 		fmt.Sprintf(
 			"Пользователь %s %s (@%s) разрешил поделиться контактом. Общайтесь!",
 			c.Sender().FirstName, c.Sender().LastName, c.Sender().Username,
@@ -253,7 +252,7 @@ func (r *ResidentsChatter) HandleDenyContact(ctx context.Context, c telebot.Cont
 		return fmt.Errorf("парсинг получателя для отказа в контакте: %w", err)
 	}
 
-	c.Bot().Send(ctx, &telebot.User{ID: int64(recepient)},
+	outbox.Send(ctx, c, &telebot.User{ID: int64(recepient)},
 		"Пользователь запретил делаться контактом. Придется сходить к нему пешком.",
 		markup.InlineMarkup(
 			markup.Row(r.upperMenu),
@@ -0,0 +1,734 @@
+package bot_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"mikhailche/botcomod/bot/bottest"
+	markup "mikhailche/botcomod/lib/bot-markup"
+	"mikhailche/botcomod/repository"
+
+	"github.com/mikhailche/telebot"
+)
+
+var testHouses = repository.THouses{
+	bottest.House(1, "108А", 1, 120),
+	bottest.House(2, "108Б", 1, 70),
+}
+
+func TestRegistrationScenario(t *testing.T) {
+	h := bottest.New(t, testHouses)
+	newbie := &telebot.User{ID: 501, Username: "newbie", FirstName: "Иван"}
+	registrar := &telebot.User{ID: 502, Username: "registrar"}
+	h.Grant(registrar, repository.RoleRegistrar)
+
+	houses := h.MustProcess(h.Tap(newbie, markup.RegisterBtn)).Messages().Last(t)
+	if houses.Text != "Выберите номер дома" {
+		t.Fatalf("ожидался выбор дома, получено %q", houses.Text)
+	}
+	ranges := h.MustProcess(h.Press(newbie, houses, "108Б")).Messages().Last(t)
+	if !ranges.IsEdit() {
+		t.Errorf("выбор дома должен менять сообщение, а не слать новое: %s", ranges.Method)
+	}
+	apartments := h.MustProcess(h.Press(newbie, ranges, "1 - 64")).Messages().Last(t)
+	confirm := h.MustProcess(h.Press(newbie, apartments, "17")).Messages().Last(t)
+	if want := "Давайте проверим, что всё верно.\n🏠 Дом 108Б\n🚪 Квартира 17\nВсё верно?"; confirm.Text != want {
+		t.Fatalf("подтверждение: %q, ожидалось %q", confirm.Text, want)
+	}
+
+	calls := confirmAsOwner(t, h, newbie, confirm)
+	if len(calls.To(bottest.RegistrationChatID).Containing("Новая регистрация. Дом 108Б квартира 17")) != 1 {
+		t.Errorf("регистраторы не узнали о заявке:\n%s", calls)
+	}
+	events := h.Events(newbie.ID)
+	if len(events) != 1 {
+		t.Fatalf("ожидалось одно событие, получено %v", events)
+	}
+	added, ok := events[0].(*repository.AddApartmentEventV2)
+	if !ok || added.HouseNumber != "108Б" || added.Apartment != "17" || added.HouseID != 2 || added.Kind != repository.PropertyApartment {
+		t.Fatalf("неожиданное событие заявки на квартиру: %#v", events[0])
+	}
+
+	calls = h.MustProcess(h.Photo(newbie, "квитанция"))
+	if len(calls.To(newbie.ID).Containing("Мы проверим")) != 1 {
+		t.Errorf("пользователь не получил подтверждение приёма фото:\n%s", calls)
+	}
+	forwarded := calls.Method("forwardMessage").To(bottest.RegistrationChatID)
+	if len(forwarded) != 1 {
+		t.Fatalf("фото не переслано регистраторам:\n%s", calls)
+	}
+	request := calls.Method("sendMessage").To(bottest.RegistrationChatID).Last(t)
+	if _, ok := request.Button("✅ Да, кажется всё совпадает"); !ok {
+		t.Fatalf("под заявкой нет кнопки подтверждения: %v", request.ButtonTexts())
+	}
+
+	// без роли регистратора решение не принимается
+	stranger := &telebot.User{ID: 503, Username: "stranger"}
+	calls = h.MustProcess(h.Press(stranger, request, "✅ Да, кажется всё совпадает"))
+	if len(calls.To(newbie.ID)) != 0 || h.User(newbie.ID).IsApprovedResident {
+		t.Fatalf("заявку подтвердил пользователь без роли регистратора:\n%s", calls)
+	}
+	if alert := calls.Method("answerCallbackQuery"); len(alert) == 0 || alert[0].Params["show_alert"] != true {
+		t.Errorf("без прав нажавший должен увидеть предупреждение:\n%s", calls)
+	}
+
+	calls = h.MustProcess(h.Press(registrar, request, "❌ Херня какая-то"))
+	if len(calls.To(newbie.ID)) != 0 {
+		t.Fatalf("решение записано до выбора причины:\n%s", calls)
+	}
+	calls = h.MustProcess(h.Press(registrar, calls.Messages().Last(t), "На фото не тот документ"))
+	if len(calls.To(newbie.ID).Containing("Причина: на фото не тот документ. Пришлите новое фото")) != 1 {
+		t.Errorf("пользователя не попросили прислать фото заново:\n%s", calls)
+	}
+	events = h.Events(newbie.ID)
+	newPhoto, ok := events[len(events)-1].(*repository.RequestNewRegistrationPhotoEvent)
+	if !ok || newPhoto.ReviewerID != registrar.ID || newPhoto.Decision != repository.RegistrationNewPhotoRequired || newPhoto.Reason != "на фото не тот документ" ||
+		newPhoto.HouseID != 2 || newPhoto.Apartment != "17" {
+		t.Fatalf("запрос нового фото не записан с регистратором и причиной: %#v", events[len(events)-1])
+	}
+
+	calls = h.MustProcess(h.Press(registrar, request, "✅ Да, кажется всё совпадает"))
+	if len(calls.To(newbie.ID).Containing("Регистрация завершена")) != 1 {
+		t.Errorf("пользователь не узнал о завершении регистрации:\n%s", calls)
+	}
+	if !h.User(newbie.ID).IsApprovedResident {
+		t.Errorf("после подтверждения пользователь должен стать резидентом")
+	}
+	events = h.Events(newbie.ID)
+	confirmed, ok := events[len(events)-1].(*repository.AdminConfirmedAddApartmentEventV2)
+	if !ok || confirmed.AdminUserID != registrar.ID || confirmed.HouseID != 2 || confirmed.Apartment != "17" {
+		t.Errorf("подтверждение не записано с регистратором и решением: %#v", events[len(events)-1])
+	}
+	if len(calls.Containing("Завершили регистрацию (@registrar)")) != 1 {
+		t.Errorf("в чате регистраторов не видно, кто решил заявку:\n%s", calls)
+	}
+
+	calls = h.MustProcess(h.Press(registrar, request, "🔐 В топку"))
+	if len(calls.Containing("Эту заявку уже обработал кто-то другой")) != 1 {
+		t.Errorf("повторное решение по заявке должно отклоняться:\n%s", calls)
+	}
+	if len(calls.To(newbie.ID)) != 0 {
+		t.Errorf("пользователь не должен получать второе решение:\n%s", calls)
+	}
+	// заявка, фото, запрос нового фото, подтверждение
+	if got := len(h.Events(newbie.ID)); got != 4 {
+		t.Errorf("ожидалось 4 события после подтверждения, получено %d", got)
+	}
+}
+
+// reject решение регистратора кнопкой button с причиной reason из списка
+func reject(t *testing.T, h *bottest.Harness, registrar *telebot.User, card bottest.Call, button, reason string) bottest.Calls {
+	t.Helper()
+	reasons := h.MustProcess(h.Press(registrar, card, button)).Messages().Last(t)
+	return h.MustProcess(h.Press(registrar, reasons, reason))
+}
+
+// confirmAsOwner подтверждает адрес в мастере регистрации и выбирает резидентство собственника
+func confirmAsOwner(t *testing.T, h *bottest.Harness, user *telebot.User, confirm bottest.Call) bottest.Calls {
+	t.Helper()
+	residency := h.MustProcess(h.Press(user, confirm, "✅ Да, всё верно")).Messages().Last(t)
+	return h.MustProcess(h.Press(user, residency, "🏠 Я собственник"))
+}
+
+func TestRegistrarCannotReviewOwnRequest(t *testing.T) {
+	h := bottest.New(t, testHouses)
+	registrar := &telebot.User{ID: 511, Username: "registrar"}
+	h.Grant(registrar, repository.RoleRegistrar)
+
+	houses := h.MustProcess(h.Tap(registrar, markup.RegisterBtn)).Messages().Last(t)
+	ranges := h.MustProcess(h.Press(registrar, houses, "108А")).Messages().Last(t)
+	apartments := h.MustProcess(h.Press(registrar, ranges, "1 - 64")).Messages().Last(t)
+	confirm := h.MustProcess(h.Press(registrar, apartments, "3")).Messages().Last(t)
+	confirmAsOwner(t, h, registrar, confirm)
+	request := h.MustProcess(h.Photo(registrar, "")).Method("sendMessage").To(bottest.RegistrationChatID).Last(t)
+
+	calls := h.MustProcess(h.Press(registrar, request, "✅ Да, кажется всё совпадает"))
+	if h.User(registrar.ID).IsApprovedResident || len(calls.Containing("Свою заявку решает другой регистратор")) != 1 {
+		t.Fatalf("регистратор не может подтвердить свою заявку:\n%s", calls)
+	}
+
+	// после провала и новой заявки старые кнопки не действуют
+	other := &telebot.User{ID: 512, Username: "other"}
+	h.Grant(other, repository.RoleRegistrar)
+	reject(t, h, other, request, "🔐 В топку", "Адрес в документе не совпадает с заявкой")
+	houses = h.MustProcess(h.Tap(registrar, markup.RegisterBtn)).Messages().Last(t)
+	ranges = h.MustProcess(h.Press(registrar, houses, "108Б")).Messages().Last(t)
+	apartments = h.MustProcess(h.Press(registrar, ranges, "1 - 64")).Messages().Last(t)
+	confirm = h.MustProcess(h.Press(registrar, apartments, "9")).Messages().Last(t)
+	confirmAsOwner(t, h, registrar, confirm)
+	calls = h.MustProcess(h.Press(other, request, "✅ Да, кажется всё совпадает"))
+	if h.User(registrar.ID).IsApprovedResident || len(calls.Containing("Эту заявку уже обработал кто-то другой")) != 1 {
+		t.Fatalf("кнопка прошлой заявки подтвердила новую:\n%s", calls)
+	}
+}
+
+func TestContactRequestScenario(t *testing.T) {
+	h := bottest.New(t, testHouses)
+	asker := &telebot.User{ID: 601, Username: "asker", FirstName: "Пётр"}
+	neighbour := &telebot.User{ID: 602, Username: "neighbour"}
+	h.AddResident(asker, "108А", "5")
+	h.AddResident(neighbour, "108А", "42")
+
+	houses := h.MustProcess(h.Tap(asker, markup.PMWithResidentsBtn)).Messages().Last(t)
+	ranges := h.MustProcess(h.Press(asker, houses, "108А")).Messages().Last(t)
+	apartments := h.MustProcess(h.Press(asker, ranges, "1 - 65")).Messages().Last(t)
+	confirm := h.MustProcess(h.Press(asker, apartments, "42")).Messages().Last(t)
+	calls := h.MustProcess(h.Press(asker, confirm, "✅ Всё ок"))
+
+	request := calls.To(neighbour.ID).Containing("С вами хочет связаться Пётр")
+	if len(request) != 1 {
+		t.Fatalf("сосед не получил запрос на контакт:\n%s", calls)
+	}
+	if len(calls.To(asker.ID).Containing("Я отправил приглашение")) != 1 {
+		t.Errorf("спрашивающий не получил подтверждение:\n%s", calls)
+	}
+
+	calls = h.MustProcess(h.Press(neighbour, request[0], "✅ Отправить"))
+	allowed := calls.To(asker.ID).Containing("разрешил поделиться контактом")
+	if len(allowed) != 1 {
+		t.Fatalf("спрашивающий не получил контакт:\n%s", calls)
+	}
+	if button, ok := allowed[0].Button("💬 Связаться"); !ok || button.URL != "tg://user?id=602" {
+		t.Errorf("ссылка на соседа: %+v", button)
+	}
+
+	// нерезидента в раздел не пускают
+	stranger := &telebot.User{ID: 603, Username: "stranger"}
+	calls = h.MustProcess(h.Tap(stranger, markup.PMWithResidentsBtn))
+	if _, ok := calls.Messages().Last(t).Button(markup.RegisterBtn.Text); !ok {
+		t.Errorf("нерезиденту должна предлагаться регистрация:\n%s", calls)
+	}
+}
+
+func TestCarPlateScenario(t *testing.T) {
+	h := bottest.New(t, testHouses)
+	owner := &telebot.User{ID: 701, Username: "owner"}
+	seeker := &telebot.User{ID: 702, Username: "seeker", FirstName: "Анна"}
+	h.AddResident(owner, "108Б", "3")
+	h.AddResident(seeker, "108А", "9")
+
+	// владелец набирает номер по кнопкам
+	addCar := telebot.Btn{Unique: "add-automoibile", Text: "Добавить автомобиль"}
+	keyboard := h.MustProcess(h.Tap(owner, addCar)).Messages().Last(t)
+	for _, char := range "A123BC96" {
+		keyboard = h.MustProcess(h.Press(owner, keyboard, string(char))).Messages().Last(t)
+	}
+	calls := h.MustProcess(h.Press(owner, keyboard, "✅ Готово"))
+	if len(calls.Containing("Добавили ваш номер")) != 1 {
+		t.Fatalf("номер не добавлен:\n%s", calls)
+	}
+	events := h.Events(owner.ID)
+	plate, ok := events[len(events)-1].(*repository.RegisterCarLicensePlateEvent)
+	if !ok || plate.LicensePlate != "A123BC96" {
+		t.Fatalf("неожиданное событие: %#v", events[len(events)-1])
+	}
+
+	// другой резидент ищет владельца по номеру
+	keyboard = h.MustProcess(h.Tap(seeker, markup.PMWithCarOwnersBtn)).Messages().Last(t)
+	for _, char := range "A123BC96" {
+		keyboard = h.MustProcess(h.Press(seeker, keyboard, string(char))).Messages().Last(t)
+	}
+	calls = h.MustProcess(h.Press(seeker, keyboard, "✅ Готово"))
+	if len(calls.To(owner.ID).Containing("С вами хочет связаться Анна")) != 1 {
+		t.Fatalf("владелец не получил запрос на контакт:\n%s", calls)
+	}
+
+	// неизвестный номер
+	keyboard = h.MustProcess(h.Tap(seeker, markup.PMWithCarOwnersBtn)).Messages().Last(t)
+	for _, char := range "B777OP66" {
+		keyboard = h.MustProcess(h.Press(seeker, keyboard, string(char))).Messages().Last(t)
+	}
+	calls = h.MustProcess(h.Press(seeker, keyboard, "✅ Готово"))
+	if len(calls.To(seeker.ID).Containing("Я не нашел автовладельца")) != 1 {
+		t.Errorf("ищущий не узнал, что владельца нет:\n%s", calls)
+	}
+}
+
+func TestScriptedUpdates(t *testing.T) {
+	h := bottest.New(t, testHouses)
+	calls := h.ReplayFile("testdata/start.jsonl")
+	if len(calls.To(777).Containing("Привет!")) != 2 {
+		t.Errorf("ожидалось два приветствия:\n%s", calls)
+	}
+}
+
+func TestSetWebhookScenario(t *testing.T) {
+	h := bottest.New(t, testHouses)
+	developer := &telebot.User{ID: bottest.DeveloperID, Username: "developer"}
+
+	calls := h.MustProcess(h.Text(developer, "/setwebhook https://bot.example.com/telegram"))
+	set := calls.Method("setWebhook")
+	if len(set) != 1 {
+		t.Fatalf("вебхук не зарегистрирован:\n%s", calls)
+	}
+	if set[0].Params["url"] != "https://bot.example.com/telegram" || set[0].Params["secret_token"] != bottest.WebhookSecret {
+		t.Errorf("неожиданные параметры setWebhook: %v", set[0].Params)
+	}
+	if len(calls.To(developer.ID).Containing("Вебхук зарегистрирован")) != 1 {
+		t.Errorf("администратор не получил подтверждение:\n%s", calls)
+	}
+
+	calls = h.MustProcess(h.Text(developer, "/setwebhook http://bot.example.com/telegram"))
+	if len(calls.Method("setWebhook")) != 0 {
+		t.Errorf("телеграм не принимает http вебхуки, регистрировать нельзя:\n%s", calls)
+	}
+
+	// резидент не администратор, даже если проверка резидента зарегистрирована позже админских команд
+	resident := &telebot.User{ID: 801, Username: "resident"}
+	h.AddResident(resident, "108А", "1")
+	calls = h.MustProcess(h.Text(resident, "/setwebhook https://evil.example.com/"))
+	if len(calls.Method("setWebhook")) != 0 {
+		t.Errorf("не администратор не может менять вебхук:\n%s", calls)
+	}
+}
+
+// Админские команды со своими middleware регистрируются подряд. Если бы они делили общий срез
+// middleware бота, следующая регистрация затёрла бы проверку прав у предыдущей.
+func TestAdminRoutesStayGuarded(t *testing.T) {
+	h := bottest.New(t, testHouses)
+	resident := &telebot.User{ID: 811, Username: "resident"}
+	h.AddResident(resident, "108А", "2")
+	for _, command := range []string{"/deadletters", "/deadletter 1", "/incomplete", "/updates", "/whois 811", "/config", "/roles"} {
+		if calls := h.MustProcess(h.Text(resident, command)); len(calls.Messages()) != 0 {
+			t.Errorf("%s без прав должна молчать:\n%s", command, calls)
+		}
+	}
+	developer := &telebot.User{ID: bottest.DeveloperID, Username: "developer"}
+	for _, command := range []string{"/deadletters", "/incomplete"} {
+		if calls := h.MustProcess(h.Text(developer, command)); len(calls.Messages()) == 0 {
+			t.Errorf("%s должна отвечать администратору:\n%s", command, calls)
+		}
+	}
+}
+
+func TestRolesScenario(t *testing.T) {
+	h := bottest.New(t, testHouses)
+	developer := &telebot.User{ID: bottest.DeveloperID, Username: "developer"}
+	guard := &telebot.User{ID: 901, Username: "guard"}
+	h.AddResident(guard, "108А", "7")
+
+	calls := h.MustProcess(h.Text(guard, "/whois 901"))
+	if len(calls.Messages()) != 0 {
+		t.Fatalf("без роли whois недоступен:\n%s", calls)
+	}
+
+	calls = h.MustProcess(h.Text(developer, "/grant @guard security_guard"))
+	if len(calls.Containing("Выдали @guard (901) роль охрана")) != 1 {
+		t.Fatalf("роль не выдана:\n%s", calls)
+	}
+	if grant, ok := h.Events(guard.ID)[len(h.Events(guard.ID))-1].(*repository.GrantRoleEvent); !ok || grant.AdminUserID != developer.ID {
+		t.Errorf("выдача роли должна писаться событием с автором: %#v", h.Events(guard.ID))
+	}
+	if len(h.MustProcess(h.Text(guard, "/whois 901")).Messages()) == 0 {
+		t.Errorf("охране должен быть доступен whois")
+	}
+	if len(h.MustProcess(h.Text(guard, "/grant @guard developer")).Messages()) != 0 {
+		t.Errorf("охрана не может раздавать роли")
+	}
+
+	calls = h.MustProcess(h.Text(developer, "/roles"))
+	if len(calls.Containing("охрана (security_guard): @guard (901)")) != 1 {
+		t.Errorf("роль не видна в списке:\n%s", calls)
+	}
+
+	h.MustProcess(h.Text(developer, "/revoke @guard security_guard"))
+	if len(h.MustProcess(h.Text(guard, "/whois 901")).Messages()) != 0 {
+		t.Errorf("после отзыва роли whois недоступен")
+	}
+	calls = h.MustProcess(h.Text(developer, "/revoke 1000 developer"))
+	if len(calls.Containing("задана в конфигурации")) != 1 {
+		t.Errorf("роль разработчика из конфигурации не отзывается:\n%s", calls)
+	}
+}
+
+func TestPendingReviewScenario(t *testing.T) {
+	h := bottest.New(t, testHouses)
+	registrar := &telebot.User{ID: 521, Username: "registrar"}
+	h.Grant(registrar, repository.RoleRegistrar)
+	register := func(user *telebot.User, house, apartment string) {
+		houses := h.MustProcess(h.Tap(user, markup.RegisterBtn)).Messages().Last(t)
+		ranges := h.MustProcess(h.Press(user, houses, house)).Messages().Last(t)
+		apartments := h.MustProcess(h.Press(user, ranges, "1 - 64")).Messages().Last(t)
+		confirm := h.MustProcess(h.Press(user, apartments, apartment)).Messages().Last(t)
+		confirmAsOwner(t, h, user, confirm)
+	}
+
+	// без документа регистратору нечего проверять
+	noPhoto := &telebot.User{ID: 524, Username: "nophoto"}
+	h.SetClock(func() time.Time { return time.Now().Add(-100 * time.Hour) })
+	register(noPhoto, "108А", "7")
+
+	// заявка двухдневной давности и свежая
+
+	old := &telebot.User{ID: 522, Username: "old"}
+	h.SetClock(func() time.Time { return time.Now().Add(-50 * time.Hour) })
+	register(old, "108А", "5")
+	h.MustProcess(h.Photo(old, ""))
+	h.SetClock(time.Now)
+	fresh := &telebot.User{ID: 523, Username: "fresh"}
+	register(fresh, "108Б", "12")
+	h.MustProcess(h.Photo(fresh, ""))
+
+	if calls := h.MustProcess(h.Text(fresh, "/pending")); len(calls.Messages()) != 0 {
+		t.Fatalf("очередь заявок показана пользователю без роли регистратора:\n%s", calls)
+	}
+
+	calls := h.MustProcess(h.Text(registrar, "/pending"))
+	if len(calls.Containing("На проверке заявок: 2")) != 1 {
+		t.Fatalf("нет заголовка очереди:\n%s", calls)
+	}
+	items := calls.Containing("Заявка ")
+	if len(items) != 2 {
+		t.Fatalf("ожидались две заявки:\n%s", calls)
+	}
+	if want := "Заявка @old (522)\n🏠 Дом 108А\n🚪 Квартира 5\n👤 собственник\n⏳ Ждёт 2 дн. 2 ч. ⚠️ дольше срока"; items[0].Text != want {
+		t.Errorf("первой должна идти старая заявка: %q, ожидалось %q", items[0].Text, want)
+	}
+	if strings.Contains(items[1].Text, "дольше срока") || !strings.Contains(items[1].Text, "Квартира 12") {
+		t.Errorf("свежая заявка не просрочена: %q", items[1].Text)
+	}
+
+	calls, err := h.Run(h.Bot.RemindPendingReviews)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reminder := calls.To(bottest.RegistrationChatID).Containing("⏰ Заявок ждут решения дольше 24 ч.: 1")
+	if len(reminder) != 1 || !strings.Contains(reminder[0].Text, "@old (522): дом 108А, квартира 5") || strings.Contains(reminder[0].Text, "@fresh") {
+		t.Fatalf("напоминание о просроченной заявке:\n%s", calls)
+	}
+
+	// решение из очереди работает так же, как из заявки в чате регистраторов
+	calls = h.MustProcess(h.Press(registrar, items[0], "✅ Да, кажется всё совпадает"))
+	if !h.User(old.ID).IsApprovedResident || len(calls.To(old.ID).Containing("Регистрация завершена")) != 1 {
+		t.Fatalf("заявка из очереди не подтверждена:\n%s", calls)
+	}
+	calls, err = h.Run(h.Bot.RemindPendingReviews)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 0 {
+		t.Errorf("напоминать больше не о чем:\n%s", calls)
+	}
+}
+
+func TestMultiplePropertiesScenario(t *testing.T) {
+	h := bottest.New(t, testHouses)
+	owner := &telebot.User{ID: 531, Username: "owner"}
+	registrar := &telebot.User{ID: 532, Username: "registrar"}
+	h.Grant(registrar, repository.RoleRegistrar)
+
+	for _, apartment := range []string{"7", "8"} {
+		houses := h.MustProcess(h.Tap(owner, markup.AddApartmentBtn)).Messages().Last(t)
+		ranges := h.MustProcess(h.Press(owner, houses, "108А")).Messages().Last(t)
+		apartments := h.MustProcess(h.Press(owner, ranges, "1 - 64")).Messages().Last(t)
+		confirm := h.MustProcess(h.Press(owner, apartments, apartment)).Messages().Last(t)
+		calls := confirmAsOwner(t, h, owner, confirm)
+		if len(calls.To(bottest.RegistrationChatID).Containing("Новая регистрация. Дом 108А квартира "+apartment)) != 1 {
+			t.Fatalf("вторая заявка не должна блокироваться первой:\n%s", calls)
+		}
+	}
+
+	houses := h.MustProcess(h.Tap(owner, markup.AddParkingBtn)).Messages().Last(t)
+	keypad := h.MustProcess(h.Press(owner, houses, "108Б")).Messages().Last(t)
+	keypad = h.MustProcess(h.Press(owner, keypad, "1")).Messages().Last(t)
+	keypad = h.MustProcess(h.Press(owner, keypad, "5")).Messages().Last(t)
+	keypad = h.MustProcess(h.Press(owner, keypad, "⌫")).Messages().Last(t)
+	keypad = h.MustProcess(h.Press(owner, keypad, "2")).Messages().Last(t)
+	if want := "🏠 Дом 108Б. Наберите номер парковочного места: 12"; keypad.Text != want {
+		t.Fatalf("набор номера места: %q, ожидалось %q", keypad.Text, want)
+	}
+	residency := h.MustProcess(h.Press(owner, keypad, "✅ Готово")).Messages().Last(t)
+	if _, ok := residency.Button("👪 Я член семьи собственника"); ok {
+		t.Errorf("член семьи бывает только у квартиры: %v", residency.ButtonTexts())
+	}
+	terms := h.MustProcess(h.Press(owner, residency, "🔑 Я арендатор")).Messages().Last(t)
+	calls := h.MustProcess(h.Press(owner, terms, "Без срока"))
+	if len(calls.To(bottest.RegistrationChatID).Containing("Новая заявка на парковочное место. Дом 108Б место 12, арендатор")) != 1 {
+		t.Fatalf("регистраторы не узнали о заявке на место:\n%s", calls)
+	}
+
+	calls = h.MustProcess(h.Photo(owner, ""))
+	requests := calls.Method("sendMessage").To(bottest.RegistrationChatID)
+	if len(requests) != 3 {
+		t.Fatalf("по каждой заявке нужна своя карточка с кнопками:\n%s", calls)
+	}
+	calls = h.MustProcess(h.Photo(owner, ""))
+	if len(calls.To(bottest.RegistrationChatID)) != 0 || len(calls.To(owner.ID).Containing("уже у регистраторов")) != 1 {
+		t.Fatalf("повторное фото не должно дублировать карточки заявок:\n%s", calls)
+	}
+	card := func(title string) bottest.Call {
+		t.Helper()
+		found := requests.Containing(title)
+		if len(found) != 1 {
+			t.Fatalf("нет карточки %q:\n%s", title, requests)
+		}
+		return found[0]
+	}
+	h.MustProcess(h.Press(registrar, card("дом 108А, квартира 7"), "✅ Да, кажется всё совпадает"))
+	calls = reject(t, h, registrar, card("дом 108Б, парковочное место 12"), "🔐 В топку", "Документ выписан на другого человека")
+	if len(calls.To(owner.ID).Containing("Заявка отклонена: дом 108Б, парковочное место 12. Причина: документ выписан на другого человека.")) != 1 {
+		t.Errorf("владелец не узнал об отклонении места:\n%s", calls)
+	}
+
+	owned := h.User(owner.ID)
+	if !owned.IsApprovedResident {
+		t.Errorf("подтверждённая квартира делает резидентом")
+	}
+	events := h.Events(owner.ID)
+	declined, ok := events[len(events)-1].(*repository.AdminDeclinedAddApartmentEventV2)
+	if !ok || declined.Kind != repository.PropertyParking || declined.Apartment != "12" || declined.AdminUserID != registrar.ID || declined.Reason == "" {
+		t.Errorf("отклонение места записано неверно: %#v", events[len(events)-1])
+	}
+
+	screen := h.MustProcess(h.Tap(owner, markup.MyPropertiesBtn)).Messages().Last(t)
+	for _, line := range []string{"🚪 дом 108А, квартира 7 (собственник) — ✅ подтверждено", "🚪 дом 108А, квартира 8 (собственник) — ⏳ на проверке"} {
+		if !strings.Contains(screen.Text, line) {
+			t.Errorf("на экране собственности нет %q:\n%s", line, screen.Text)
+		}
+	}
+	if strings.Contains(screen.Text, "парковочное место 12") {
+		t.Errorf("отклонённое место не должно показываться:\n%s", screen.Text)
+	}
+	if _, ok := screen.Button(markup.AddParkingBtn.Text); !ok {
+		t.Errorf("с экрана собственности можно добавить место: %v", screen.ButtonTexts())
+	}
+
+	// повторная заявка на ту же квартиру не пишется
+	houses = h.MustProcess(h.Tap(owner, markup.AddApartmentBtn)).Messages().Last(t)
+	ranges := h.MustProcess(h.Press(owner, houses, "108А")).Messages().Last(t)
+	apartments := h.MustProcess(h.Press(owner, ranges, "1 - 64")).Messages().Last(t)
+	confirm := h.MustProcess(h.Press(owner, apartments, "7")).Messages().Last(t)
+	calls = confirmAsOwner(t, h, owner, confirm)
+	if len(calls.Containing("уже подтверждена")) != 1 || len(calls.To(bottest.RegistrationChatID)) != 0 {
+		t.Errorf("повторная заявка на подтверждённую квартиру:\n%s", calls)
+	}
+	if got := len(h.Events(owner.ID)); got != len(events) {
+		t.Errorf("повторная заявка записала событие: было %d, стало %d", len(events), got)
+	}
+}
+
+func TestLegacyRegistrationIsStillReviewed(t *testing.T) {
+	h := bottest.New(t, testHouses)
+	legacy := &telebot.User{ID: 541, Username: "legacy"}
+	registrar := &telebot.User{ID: 542, Username: "registrar"}
+	h.Grant(registrar, repository.RoleRegistrar)
+	h.Users.UpsertUsername(context.Background(), legacy.ID, legacy.Username)
+	if _, err := h.Users.StartRegistration(context.Background(), legacy.ID, 0, 1, "108А", "11"); err != nil {
+		t.Fatal(err)
+	}
+
+	request := h.MustProcess(h.Photo(legacy, "")).Method("sendMessage").To(bottest.RegistrationChatID).Last(t)
+	calls := h.MustProcess(h.Press(registrar, request, "✅ Да, кажется всё совпадает"))
+	if len(calls.To(legacy.ID).Containing("Регистрация завершена. Подтверждено: дом 108А, квартира 11")) != 1 {
+		t.Errorf("пользователь старой регистрации не узнал о решении:\n%s", calls)
+	}
+	events := h.Events(legacy.ID)
+	if _, ok := events[len(events)-1].(*repository.ConfirmRegistrationEvent); !ok {
+		t.Errorf("старая регистрация подтверждается старым событием: %#v", events[len(events)-1])
+	}
+	if user := h.User(legacy.ID); !user.IsApprovedResident || user.Registration != nil || len(user.Apartments) != 1 {
+		t.Errorf("старая регистрация не завершена: %#v", user)
+	}
+}
+
+func TestLegacyButtonRejectedWithSeveralRequests(t *testing.T) {
+	h := bottest.New(t, testHouses)
+	legacy := &telebot.User{ID: 545, Username: "legacy"}
+	registrar := &telebot.User{ID: 546, Username: "registrar"}
+	h.Grant(registrar, repository.RoleRegistrar)
+	h.Users.UpsertUsername(context.Background(), legacy.ID, legacy.Username)
+	if _, err := h.Users.StartRegistration(context.Background(), legacy.ID, 0, 1, "108А", "11"); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Users.AddApartment(context.Background(), legacy.ID, repository.AnyStreamVersion, repository.AddApartmentEventV2{
+		HouseID: 2, HouseNumber: "108Б", Apartment: "4",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// карточка времён, когда в кнопке был только пользователь
+	card := bottest.Call{ChatID: bottest.RegistrationChatID, Text: "Фото от пользователя", Keyboard: [][]telebot.InlineButton{{
+		{Text: "✅ Да, кажется всё совпадает", Data: "\fadmin-approve-registration|545"},
+	}}}
+	calls := h.MustProcess(h.Press(registrar, card, "✅ Да, кажется всё совпадает"))
+	if len(calls.Containing("эта кнопка устарела")) != 1 || len(calls.To(legacy.ID)) != 0 {
+		t.Fatalf("старая кнопка не должна решать одну из нескольких заявок:\n%s", calls)
+	}
+	if h.User(legacy.ID).IsApprovedResident {
+		t.Errorf("заявка подтверждена старой кнопкой")
+	}
+}
+
+func TestResidencyScenario(t *testing.T) {
+	h := bottest.New(t, testHouses)
+	tenant := &telebot.User{ID: 551, Username: "tenant"}
+	relative := &telebot.User{ID: 552, Username: "relative"}
+	registrar := &telebot.User{ID: 553, Username: "registrar"}
+	h.Grant(registrar, repository.RoleRegistrar)
+
+	register := func(user *telebot.User, apartment string, choices ...string) bottest.Calls {
+		t.Helper()
+		houses := h.MustProcess(h.Tap(user, markup.RegisterBtn)).Messages().Last(t)
+		ranges := h.MustProcess(h.Press(user, houses, "108А")).Messages().Last(t)
+		apartments := h.MustProcess(h.Press(user, ranges, "1 - 64")).Messages().Last(t)
+		confirm := h.MustProcess(h.Press(user, apartments, apartment)).Messages().Last(t)
+		calls := h.MustProcess(h.Press(user, confirm, "✅ Да, всё верно"))
+		for _, choice := range choices {
+			calls = h.MustProcess(h.Press(user, calls.Messages().Last(t), choice))
+		}
+		return calls
+	}
+
+	calls := register(tenant, "21", "🔑 Я арендатор", "3 месяца")
+	if len(calls.To(bottest.RegistrationChatID).Containing("Новая регистрация. Дом 108А квартира 21, арендатор до ")) != 1 {
+		t.Fatalf("регистраторы не узнали срок аренды:\n%s", calls)
+	}
+	if len(calls.To(tenant.ID).Containing("договор аренды квартиры")) != 1 {
+		t.Errorf("арендатора не попросили прислать договор аренды:\n%s", calls)
+	}
+	added, ok := h.Events(tenant.ID)[0].(*repository.AddApartmentEventV2)
+	if !ok || added.Residency != repository.ResidencyTenant || added.ExpiresAt.Before(time.Now().AddDate(0, 3, -1)) {
+		t.Fatalf("заявка арендатора записана без срока: %#v", h.Events(tenant.ID)[0])
+	}
+
+	// срок аренды регистратор сверяет с договором
+	card := h.MustProcess(h.Photo(tenant, "")).Method("sendMessage").To(bottest.RegistrationChatID).Last(t)
+	terms := h.MustProcess(h.Press(registrar, card, "✅ Да, кажется всё совпадает")).Messages().Last(t)
+	if h.User(tenant.ID).IsApprovedResident {
+		t.Fatalf("аренда подтверждена без срока по договору")
+	}
+	if _, ok := terms.Button("✅ Как в заявке: до " + added.ExpiresAt.Format("02.01.2006")); !ok {
+		t.Fatalf("регистратору не предложили срок из заявки: %v", terms.ButtonTexts())
+	}
+	calls = h.MustProcess(h.Press(registrar, terms, "✅ 1 год"))
+	if len(calls.To(tenant.ID).Containing("Срок аренды по договору: до ")) != 1 {
+		t.Errorf("арендатор не узнал срок по договору:\n%s", calls)
+	}
+	item, _ := h.User(tenant.ID).PrivateProperty.Find(repository.PropertyApartment, 1, "21")
+	if !item.Approved || item.ExpiresAt.Before(time.Now().AddDate(1, 0, -1)) {
+		t.Errorf("аренда подтверждена не со сроком из договора: %#v", item)
+	}
+
+	register(relative, "22", "👪 Я член семьи собственника")
+	request := h.MustProcess(h.Photo(relative, "")).Method("sendMessage").To(bottest.RegistrationChatID).Last(t)
+	if !strings.Contains(request.Text, "документ о родстве") {
+		t.Errorf("регистратору не подсказали, какой документ нужен:\n%s", request.Text)
+	}
+	h.MustProcess(h.Press(registrar, request, "✅ Да, кажется всё совпадает"))
+
+	// членам семьи по умолчанию не открыт поиск соседей, камеры открыты
+	menu := h.MustProcess(h.Tap(relative, markup.ResidentsBtn)).Messages().Last(t)
+	if _, ok := menu.Button(markup.PMWithResidentsBtn.Text); ok {
+		t.Errorf("члену семьи не положен поиск соседей: %v", menu.ButtonTexts())
+	}
+	if _, ok := menu.Button(markup.VideoCamerasBtn.Text); !ok {
+		t.Errorf("члену семьи положены камеры: %v", menu.ButtonTexts())
+	}
+	calls = h.MustProcess(h.Tap(relative, markup.PMWithResidentsBtn))
+	if len(calls.To(relative.ID).Containing("недоступен для вашего вида резидентства")) != 1 {
+		t.Errorf("поиск соседей должен быть закрыт для члена семьи:\n%s", calls)
+	}
+}
+
+func TestHouseholdInviteScenario(t *testing.T) {
+	h := bottest.New(t, testHouses)
+	owner := &telebot.User{ID: 561, Username: "owner"}
+	relative := &telebot.User{ID: 562, Username: "relative"}
+	latecomer := &telebot.User{ID: 563, Username: "latecomer"}
+	h.AddResident(owner, "108А", "5")
+
+	properties := h.MustProcess(h.Tap(owner, markup.MyPropertiesBtn)).Messages().Last(t)
+	if _, ok := properties.Button(markup.HouseholdBtn.Text); !ok {
+		t.Fatalf("собственник может пригласить домочадцев: %v", properties.ButtonTexts())
+	}
+	household := h.MustProcess(h.Press(owner, properties, markup.HouseholdBtn.Text)).Messages().Last(t)
+	invite := h.MustProcess(h.Press(owner, household, "➕ Пригласить в квартиру 5")).Messages().Last(t)
+	_, link, ok := strings.Cut(invite.Text, "https://t.me/"+bottest.BotUsername+"?start=")
+	if !ok {
+		t.Fatalf("в приглашении нет ссылки: %q", invite.Text)
+	}
+	token, _, _ := strings.Cut(link, "\n")
+	if strings.ContainsAny(token, "=") {
+		t.Errorf("телеграм не пропустит '=' в параметре start: %q", token)
+	}
+
+	calls := h.MustProcess(h.Text(relative, "/start "+token))
+	if len(calls.To(relative.ID).Containing("Вы вступили в квартиру (дом 108А, квартира 5)")) != 1 {
+		t.Fatalf("домочадец не вступил по приглашению:\n%s", calls)
+	}
+	if len(calls.To(owner.ID).Containing("вступил домочадец @relative")) != 1 {
+		t.Errorf("пригласивший не узнал о домочадце:\n%s", calls)
+	}
+	if got := h.Users.ResidenciesOf(context.Background(), relative.ID); len(got) != 1 || got[0] != repository.ResidencyFamily {
+		t.Errorf("домочадец должен стать резидентом как член семьи: %v", got)
+	}
+	if _, ok := h.MustProcess(h.Tap(relative, markup.MyPropertiesBtn)).Messages().Last(t).Button(markup.HouseholdBtn.Text); ok {
+		t.Errorf("домочадец не приглашает других домочадцев")
+	}
+
+	calls = h.MustProcess(h.Text(latecomer, "/start "+token))
+	if len(calls.To(latecomer.ID).Containing("Приглашение уже использовано")) != 1 || h.Users.IsResident(context.Background(), latecomer.ID) {
+		t.Fatalf("по ссылке можно вступить только один раз:\n%s", calls)
+	}
+
+	household = h.MustProcess(h.Tap(owner, markup.HouseholdBtn)).Messages().Last(t)
+	if !strings.Contains(household.Text, "— @relative") {
+		t.Errorf("в списке домочадцев нет вступившего:\n%s", household.Text)
+	}
+	calls = h.MustProcess(h.Press(owner, household, "❌ Исключить @relative из квартиры 5"))
+	if len(calls.To(relative.ID).Containing("Вас исключили из домочадцев")) != 1 {
+		t.Errorf("домочадец не узнал об исключении:\n%s", calls)
+	}
+	if h.Users.IsResident(context.Background(), relative.ID) {
+		t.Errorf("исключённый домочадец не должен оставаться резидентом")
+	}
+	if strings.Contains(calls.Messages().Last(t).Text, "@relative") {
+		t.Errorf("исключённый домочадец остался в списке:\n%s", calls.Messages().Last(t).Text)
+	}
+
+	// своя заявка на ту же квартиру не подменяется приглашением
+	applicant := &telebot.User{ID: 564, Username: "applicant"}
+	houses := h.MustProcess(h.Tap(applicant, markup.RegisterBtn)).Messages().Last(t)
+	ranges := h.MustProcess(h.Press(applicant, houses, "108А")).Messages().Last(t)
+	apartments := h.MustProcess(h.Press(applicant, ranges, "1 - 64")).Messages().Last(t)
+	confirmAsOwner(t, h, applicant, h.MustProcess(h.Press(applicant, apartments, "5")).Messages().Last(t))
+	household = h.MustProcess(h.Tap(owner, markup.HouseholdBtn)).Messages().Last(t)
+	invite = h.MustProcess(h.Press(owner, household, "➕ Пригласить в квартиру 5")).Messages().Last(t)
+	_, link, _ = strings.Cut(invite.Text, "https://t.me/"+bottest.BotUsername+"?start=")
+	token, _, _ = strings.Cut(link, "\n")
+	calls = h.MustProcess(h.Text(applicant, "/start "+token))
+	if len(calls.To(applicant.ID).Containing("У вас уже есть заявка на квартиру")) != 1 {
+		t.Fatalf("приглашение не должно подменять собственную заявку:\n%s", calls)
+	}
+	if ppi, ok := h.User(applicant.ID).PrivateProperty.Find(repository.PropertyApartment, 1, "5"); !ok || ppi.Approved || ppi.InvitedBy != 0 {
+		t.Errorf("собственная заявка изменилась: %#v", ppi)
+	}
+
+	// истёкшая аренда той же квартиры вступить не мешает
+	formerTenant := &telebot.User{ID: 565, Username: "former"}
+	ctx := context.Background()
+	h.Users.UpsertUsername(ctx, formerTenant.ID, formerTenant.Username)
+	if err := h.Users.AddApartment(ctx, formerTenant.ID, repository.AnyStreamVersion, repository.AddApartmentEventV2{
+		HouseID: 1, HouseNumber: "108А", Apartment: "5", Residency: repository.ResidencyTenant, ExpiresAt: time.Now().Add(-time.Hour),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Users.ConfirmApartment(ctx, formerTenant.ID, repository.AnyStreamVersion, repository.AdminConfirmedAddApartmentEventV2{
+		HouseID: 1, Apartment: "5",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	household = h.MustProcess(h.Tap(owner, markup.HouseholdBtn)).Messages().Last(t)
+	invite = h.MustProcess(h.Press(owner, household, "➕ Пригласить в квартиру 5")).Messages().Last(t)
+	_, link, _ = strings.Cut(invite.Text, "https://t.me/"+bottest.BotUsername+"?start=")
+	token, _, _ = strings.Cut(link, "\n")
+	calls = h.MustProcess(h.Text(formerTenant, "/start "+token))
+	if len(calls.To(formerTenant.ID).Containing("Вы вступили в квартиру (дом 108А, квартира 5)")) != 1 {
+		t.Fatalf("бывший арендатор должен вступить домочадцем:\n%s", calls)
+	}
+	if got := h.Users.ResidenciesOf(ctx, formerTenant.ID); len(got) != 1 || got[0] != repository.ResidencyFamily {
+		t.Errorf("бывший арендатор должен стать резидентом как член семьи: %v", got)
+	}
+}
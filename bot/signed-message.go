@@ -22,6 +22,10 @@ func DecodeSignedMessage(b64 string, into any) error {
 	if len(b64) > 64 {
 		return signedMessageTooLargeError(len(b64))
 	}
+	// в ссылках с параметром start выравнивание отрезано: телеграм не пропускает '='
+	if pad := len(b64) % 4; pad != 0 {
+		b64 += strings.Repeat("=", 4-pad)
+	}
 	data, err := base64.URLEncoding.DecodeString(b64)
 	if err != nil {
 		return err
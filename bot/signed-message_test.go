@@ -37,8 +37,14 @@ func TestEncodeDecodeSignedMessage(t *testing.T) {
 			wantErr: false,
 		},
 		{
+			// два поля с именами не сжимаются в 64 символа: 72 вместе с подписью
 			name:    "Hello, struct",
 			message: struct{ Hello, World string }{"Hello", "world!"},
+			wantErr: true,
+		},
+		{
+			name:    "Household invite",
+			message: householdInviteToken{InviterID: 7_999_999_999, Code: "ZZZZZZ"},
 			wantErr: false,
 		},
 		{
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mikhailche/botcomod/app"
+	"mikhailche/botcomod/lib/tracer.v2"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const usage = `Использование: bot [флаги] poll|webhook
+
+Запускает бота вне облачной функции. Конфигурация та же, что у функции: CONFIG_FILE и переменные окружения.
+
+Режимы:
+  poll     забирать обновления через getUpdates. Вебхук в телеграме при старте снимается.
+  webhook  HTTPS сервер, на который телеграм присылает обновления. Вебхук регистрируется командой /setwebhook.
+
+Флаги:
+`
+
+// shutdownTimeout сколько ждать завершения обработки текущих обновлений при остановке
+const shutdownTimeout = 30 * time.Second
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	listen := flag.String("listen", ":8443", "webhook: адрес сервера")
+	path := flag.String("path", "/telegram", "webhook: путь, на который телеграм присылает обновления")
+	certFile := flag.String("tls-cert", "", "webhook: файл сертификата. Без него сервер слушает HTTP, например за обратным прокси")
+	keyFile := flag.String("tls-key", "", "webhook: файл ключа сертификата")
+	pollTimeout := flag.Duration("poll-timeout", 30*time.Second, "poll: сколько телеграм держит запрос getUpdates без обновлений")
+	purgeEvery := flag.Duration("purge-every", 24*time.Hour, "как часто удалять журнал обновлений старше срока хранения, 0 - не удалять")
+	remindEvery := flag.Duration("remind-every", 4*time.Hour, "как часто напоминать регистраторам о просроченных заявках, 0 - не напоминать")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	theApp := app.APP(ctx)
+	log := theApp.Log.Named("runner")
+
+	if *purgeEvery > 0 {
+		go schedule(ctx, log, *purgeEvery, app.TaskPurgeExpired, theApp.PurgeExpired)
+	}
+	if *remindEvery > 0 {
+		go schedule(ctx, log, *remindEvery, app.TaskRemindPendingReviews, theApp.RemindPendingReviews)
+	}
+	var err error
+	switch flag.Arg(0) {
+	case "poll":
+		err = poll(ctx, theApp, log, *pollTimeout)
+	case "webhook":
+		err = serveWebhook(ctx, theApp, log, *listen, *path, *certFile, *keyFile)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Error("Бот остановился с ошибкой", zap.Error(err))
+	}
+	closeCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := theApp.Close(closeCtx); err != nil {
+		log.Error("Ошибка при остановке приложения", zap.Error(err))
+	}
+	log.Info("Бот остановлен")
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+// poll забирает обновления long polling'ом, пока не отменят ctx. Начатое обновление дорабатывается до конца.
+func poll(ctx context.Context, theApp *app.App, log *zap.Logger, timeout time.Duration) error {
+	bot := theApp.Bot.Bot
+	if _, err := bot.Raw(ctx, "deleteWebhook", map[string]string{}); err != nil {
+		return fmt.Errorf("снятие вебхука: %w", err)
+	}
+	log.Info("Забираем обновления через getUpdates")
+	var offset int64
+	for ctx.Err() == nil {
+		data, err := bot.Raw(ctx, "getUpdates", map[string]string{
+			"offset":  strconv.FormatInt(offset, 10),
+			"timeout": strconv.Itoa(int(timeout.Seconds())),
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			log.Error("Ошибка getUpdates, повторим", zap.Error(err))
+			sleep(ctx, 5*time.Second)
+			continue
+		}
+		var response struct {
+			Result []json.RawMessage `json:"result"`
+		}
+		if err := json.Unmarshal(data, &response); err != nil {
+			return fmt.Errorf("разбор ответа getUpdates: %w", err)
+		}
+		for _, raw := range response.Result {
+			var header struct {
+				ID int64 `json:"update_id"`
+			}
+			if err := json.Unmarshal(raw, &header); err != nil {
+				log.Error("Обновление без update_id, пропускаем", zap.Error(err))
+				continue
+			}
+			offset = header.ID + 1
+			// остановка не должна обрывать обновление на середине
+			if err := theApp.HandleUpdate(context.WithoutCancel(ctx), string(raw)); err != nil {
+				log.Error("Ошибка обработки обновления", zap.Int64("updateID", header.ID), zap.Error(err))
+			}
+		}
+	}
+	return nil
+}
+
+// serveWebhook принимает обновления по HTTP(S), пока не отменят ctx, затем дожидается текущих запросов
+func serveWebhook(ctx context.Context, theApp *app.App, log *zap.Logger, listen, path, certFile, keyFile string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := tracer.Open(r.Context(), tracer.Named("Webhook"))
+		defer span.Close()
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !theApp.AuthenticateWebhook(r.Header.Get(app.WebhookSecretHeader), "webhook", r.RemoteAddr) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if err := theApp.HandleUpdate(context.WithoutCancel(ctx), string(body)); err != nil {
+			log.Error("Ошибка обработки обновления", zap.Error(err))
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	server := &http.Server{
+		Addr:              listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	errs := make(chan error, 1)
+	go func() {
+		log.Info("Принимаем вебхуки", zap.String("listen", listen), zap.String("path", path), zap.Bool("tls", certFile != ""))
+		if certFile != "" {
+			errs <- server.ListenAndServeTLS(certFile, keyFile)
+		} else {
+			errs <- server.ListenAndServe()
+		}
+	}()
+	select {
+	case err := <-errs:
+		return fmt.Errorf("сервер вебхуков: %w", err)
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("остановка сервера вебхуков: %w", err)
+	}
+	if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("сервер вебхуков: %w", err)
+	}
+	return nil
+}
+
+// schedule заменяет таймеры облачной функции: периодически выполняет задачу, пока не отменят ctx
+func schedule(ctx context.Context, log *zap.Logger, every time.Duration, name string, task func(context.Context) error) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := task(ctx); err != nil {
+				log.Error("Ошибка задачи по расписанию", zap.String("task", name), zap.Error(err))
+			}
+		}
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
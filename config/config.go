@@ -0,0 +1,299 @@
+// Package config настройки бота. Значения по умолчанию соответствуют продовому боту,
+// поверх них накладывается необязательный json файл из CONFIG_FILE, а поверх файла переменные окружения.
+// Так staging и production запускаются из одной сборки.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Значения Storage
+const (
+	StorageYDB    = "ydb"
+	StorageMemory = "memory"
+)
+
+const redacted = "***"
+
+type Config struct {
+	// Storage бэкенд хранилища: ydb или memory
+	Storage   string    `json:"storage"`
+	YDB       YDB       `json:"ydb"`
+	Telegram  Telegram  `json:"telegram"`
+	Vision    Vision    `json:"vision"`
+	UpdateLog UpdateLog `json:"update_log"`
+	// Registration проверка заявок на регистрацию
+	Registration Registration `json:"registration"`
+	// Residency что доступно резидентам каждого вида
+	Residency Residency `json:"residency"`
+}
+
+type YDB struct {
+	Endpoint string `json:"endpoint"`
+	// SAKey токен доступа. Если пуст, используются креды из метаданных облачной функции.
+	SAKey string `json:"sa_key"`
+}
+
+type Telegram struct {
+	Token string `json:"token"`
+	// BotUsername нужен для команд в группах: в офлайн режиме telebot не запрашивает getMe
+	BotUsername string `json:"bot_username"`
+	// DeveloperID получает ошибки, паники и сообщения пользователей для разработчиков
+	DeveloperID int64 `json:"developer_id"`
+	// RegistrationChatID чат, куда приходят заявки на регистрацию резидентов
+	RegistrationChatID int64 `json:"registration_chat_id"`
+	// APIURL адрес Bot API. Пустой - настоящий телеграм, для локального запуска можно указать fakebotapi.
+	APIURL string `json:"api_url"`
+	// WebhookURL адрес, на который телеграм присылает обновления. Регистрируется командой /setwebhook.
+	WebhookURL string `json:"webhook_url"`
+	// WebhookSecret секрет из заголовка X-Telegram-Bot-Api-Secret-Token. Обязателен, если задан WebhookURL.
+	// Пустой отключает проверку вебхука, каждый такой запрос логируется как событие безопасности.
+	WebhookSecret string `json:"webhook_secret"`
+}
+
+type Vision struct {
+	// FolderID каталог Yandex Cloud, в котором вызывается распознавание номеров
+	FolderID string `json:"folder_id"`
+}
+
+type UpdateLog struct {
+	// SpillFile локальный файл для обновлений, которые не удалось записать в YDB. Пустой отключает сброс.
+	SpillFile string `json:"spill_file"`
+	// RetentionDays сколько дней хранить журнал обновлений. 0 - хранить всегда.
+	RetentionDays int64 `json:"retention_days"`
+	// Redact маскировать персональные данные перед записью в журнал и в логи.
+	// Маскируется при записи, поэтому text= в /updates ищет только по командам,
+	// а /replayupdate повторяет обновления с замаскированным текстом: ввод номера, квартиры и т.п. не воспроизвести.
+	Redact bool `json:"redact"`
+}
+
+type Registration struct {
+	// ReviewSLAHours сколько часов заявка может ждать решения, прежде чем о ней напомнят регистраторам. 0 - не напоминать.
+	ReviewSLAHours int64 `json:"review_sla_hours"`
+}
+
+// ResidencyAccess возможности бота, открытые резиденту
+type ResidencyAccess struct {
+	// Cameras ссылки на камеры видеонаблюдения
+	Cameras bool `json:"cameras"`
+	// ContactLookup связаться с соседом по номеру квартиры или с владельцем авто по номеру машины
+	ContactLookup bool `json:"contact_lookup"`
+	// ChatAutoApproval бот сам одобряет заявки на вступление в чаты района
+	ChatAutoApproval bool `json:"chat_auto_approval"`
+}
+
+// Residency доступ по видам резидентства. Резидент с несколькими видами получает всё, что открыто хотя бы одному.
+type Residency struct {
+	Owner  ResidencyAccess `json:"owner"`
+	Tenant ResidencyAccess `json:"tenant"`
+	Family ResidencyAccess `json:"family"`
+}
+
+// ReviewSLA срок проверки заявки, 0 - без напоминаний
+func (r Registration) ReviewSLA() time.Duration {
+	return time.Duration(r.ReviewSLAHours) * time.Hour
+}
+
+// Retention срок хранения журнала обновлений, 0 - без ограничения
+func (u UpdateLog) Retention() time.Duration {
+	return time.Duration(u.RetentionDays) * 24 * time.Hour
+}
+
+func Default() Config {
+	return Config{
+		Storage: StorageYDB,
+		YDB: YDB{
+			Endpoint: "grpcs://ydb.serverless.yandexcloud.net:2135/ru-central1/b1gekmt72ibh4jkb7edu/etnq0a1lnsfuvp5eulft",
+		},
+		Telegram: Telegram{
+			BotUsername:        "IzumrudnyBot",
+			DeveloperID:        257582730,
+			RegistrationChatID: -1001860029647,
+		},
+		Vision: Vision{
+			FolderID: "b1gr2sfp90l7fhpvdi7c",
+		},
+		UpdateLog: UpdateLog{
+			SpillFile:     filepath.Join(os.TempDir(), "botcomod-updates-log.jsonl"),
+			RetentionDays: 90,
+			Redact:        true,
+		},
+		Registration: Registration{
+			ReviewSLAHours: 24,
+		},
+		Residency: Residency{
+			Owner:  ResidencyAccess{Cameras: true, ContactLookup: true, ChatAutoApproval: true},
+			Tenant: ResidencyAccess{Cameras: true, ContactLookup: true},
+			Family: ResidencyAccess{Cameras: true, ChatAutoApproval: true},
+		},
+	}
+}
+
+// Load собирает конфигурацию из значений по умолчанию, файла CONFIG_FILE и окружения и валидирует её
+func Load() (*Config, error) {
+	return load(os.Getenv)
+}
+
+func load(getenv func(string) string) (*Config, error) {
+	cfg := Default()
+	if path := getenv("CONFIG_FILE"); path != "" {
+		bb, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("чтение файла конфигурации: %w", err)
+		}
+		decoder := json.NewDecoder(bytes.NewReader(bb))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&cfg); err != nil {
+			return nil, fmt.Errorf("разбор файла конфигурации %s: %w", path, err)
+		}
+	}
+	if err := cfg.applyEnv(getenv); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+func (c *Config) applyEnv(getenv func(string) string) error {
+	var errs []error
+	str := func(name string, dst *string) {
+		if v := getenv(name); v != "" {
+			*dst = v
+		}
+	}
+	integer := func(name string, dst *int64) {
+		v := getenv(name)
+		if v == "" {
+			return
+		}
+		parsed, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: не число: %q", name, v))
+			return
+		}
+		*dst = parsed
+	}
+	boolean := func(name string, dst *bool) {
+		v := getenv(name)
+		if v == "" {
+			return
+		}
+		parsed, err := strconv.ParseBool(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: ожидается true или false: %q", name, v))
+			return
+		}
+		*dst = parsed
+	}
+	str("STORAGE", &c.Storage)
+	str("YDB_ENDPOINT", &c.YDB.Endpoint)
+	str("YDB_SA_KEY", &c.YDB.SAKey)
+	str("TELEGRAM_TOKEN", &c.Telegram.Token)
+	str("BOT_USERNAME", &c.Telegram.BotUsername)
+	integer("DEVELOPER_ID", &c.Telegram.DeveloperID)
+	integer("REGISTRATION_CHAT_ID", &c.Telegram.RegistrationChatID)
+	str("TELEGRAM_API_URL", &c.Telegram.APIURL)
+	str("TELEGRAM_WEBHOOK_URL", &c.Telegram.WebhookURL)
+	str("TELEGRAM_WEBHOOK_SECRET", &c.Telegram.WebhookSecret)
+	str("VISION_FOLDER_ID", &c.Vision.FolderID)
+	str("UPDATE_LOG_SPILL_FILE", &c.UpdateLog.SpillFile)
+	integer("UPDATE_LOG_RETENTION_DAYS", &c.UpdateLog.RetentionDays)
+	boolean("UPDATE_LOG_REDACT", &c.UpdateLog.Redact)
+	integer("REGISTRATION_REVIEW_SLA_HOURS", &c.Registration.ReviewSLAHours)
+	return errors.Join(errs...)
+}
+
+// Validate проверяет конфигурацию целиком и возвращает все найденные ошибки сразу.
+// Пустой токен телеграма допустим: он не нужен миграциям и прочим офлайн утилитам.
+func (c Config) Validate() error {
+	var errs []error
+	switch c.Storage {
+	case StorageYDB:
+		if !strings.HasPrefix(c.YDB.Endpoint, "grpc://") && !strings.HasPrefix(c.YDB.Endpoint, "grpcs://") {
+			errs = append(errs, fmt.Errorf("ydb.endpoint: ожидается grpc:// или grpcs:// адрес, получено %q", c.YDB.Endpoint))
+		}
+	case StorageMemory:
+	default:
+		errs = append(errs, fmt.Errorf("storage: неизвестное хранилище %q", c.Storage))
+	}
+	if c.Telegram.BotUsername == "" {
+		errs = append(errs, fmt.Errorf("telegram.bot_username: не задан"))
+	}
+	if c.Telegram.DeveloperID <= 0 {
+		errs = append(errs, fmt.Errorf("telegram.developer_id: ожидается идентификатор пользователя, получено %d", c.Telegram.DeveloperID))
+	}
+	if c.Telegram.RegistrationChatID >= 0 {
+		errs = append(errs, fmt.Errorf("telegram.registration_chat_id: ожидается идентификатор группы (отрицательный), получено %d", c.Telegram.RegistrationChatID))
+	}
+	if c.Telegram.APIURL != "" && !strings.HasPrefix(c.Telegram.APIURL, "http://") && !strings.HasPrefix(c.Telegram.APIURL, "https://") {
+		errs = append(errs, fmt.Errorf("telegram.api_url: ожидается http:// или https:// адрес, получено %q", c.Telegram.APIURL))
+	}
+	if c.Telegram.WebhookURL != "" && !strings.HasPrefix(c.Telegram.WebhookURL, "https://") {
+		errs = append(errs, fmt.Errorf("telegram.webhook_url: телеграм принимает только https:// адрес, получено %q", c.Telegram.WebhookURL))
+	}
+	if !validWebhookSecret(c.Telegram.WebhookSecret) {
+		errs = append(errs, fmt.Errorf("telegram.webhook_secret: ожидается от 1 до 256 символов A-Z, a-z, 0-9, _ и -"))
+	}
+	if c.Telegram.WebhookURL != "" && c.Telegram.WebhookSecret == "" {
+		errs = append(errs, fmt.Errorf("telegram.webhook_secret: обязателен вместе с telegram.webhook_url, иначе вебхук примет обновления от кого угодно"))
+	}
+	if c.Vision.FolderID == "" {
+		errs = append(errs, fmt.Errorf("vision.folder_id: не задан"))
+	}
+	if c.UpdateLog.RetentionDays < 0 {
+		errs = append(errs, fmt.Errorf("update_log.retention_days: не может быть отрицательным, получено %d", c.UpdateLog.RetentionDays))
+	}
+	if c.Registration.ReviewSLAHours < 0 {
+		errs = append(errs, fmt.Errorf("registration.review_sla_hours: не может быть отрицательным, получено %d", c.Registration.ReviewSLAHours))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("некорректная конфигурация: %w", err)
+	}
+	return nil
+}
+
+// validWebhookSecret проверяет секрет по правилам setWebhook. Пустой секрет допустим.
+func validWebhookSecret(secret string) bool {
+	if len(secret) > 256 {
+		return false
+	}
+	for _, r := range secret {
+		if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '_' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// Redacted копия конфигурации без секретов, пригодная для логов и показа в чате
+func (c Config) Redacted() Config {
+	hide := func(s string) string {
+		if s == "" {
+			return ""
+		}
+		return redacted
+	}
+	c.YDB.SAKey = hide(c.YDB.SAKey)
+	c.Telegram.Token = hide(c.Telegram.Token)
+	c.Telegram.WebhookSecret = hide(c.Telegram.WebhookSecret)
+	return c
+}
+
+// Dump конфигурация без секретов в виде json
+func (c Config) Dump() string {
+	bb, err := json.MarshalIndent(c.Redacted(), "", "  ")
+	if err != nil {
+		return fmt.Sprintf("не удалось сериализовать конфигурацию: %v", err)
+	}
+	return string(bb)
+}
@@ -0,0 +1,85 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func envOf(values map[string]string) func(string) string {
+	return func(name string) string {
+		return values[name]
+	}
+}
+
+func TestDefaultsAreValid(t *testing.T) {
+	cfg, err := load(envOf(nil))
+	require.NoError(t, err)
+	assert.Equal(t, Default(), *cfg)
+}
+
+func TestEnvOverridesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{
+  "storage": "memory",
+  "telegram": {"bot_username": "StagingBot", "registration_chat_id": -100}
+}`), 0o600))
+	cfg, err := load(envOf(map[string]string{
+		"CONFIG_FILE":          path,
+		"REGISTRATION_CHAT_ID": "-200",
+		"TELEGRAM_TOKEN":       "secret-token",
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, StorageMemory, cfg.Storage)
+	assert.Equal(t, "StagingBot", cfg.Telegram.BotUsername)
+	assert.Equal(t, int64(-200), cfg.Telegram.RegistrationChatID)
+	assert.Equal(t, Default().Telegram.DeveloperID, cfg.Telegram.DeveloperID)
+}
+
+func TestResidencyAccessFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"residency": {"tenant": {"cameras": false}}}`), 0o600))
+	cfg, err := load(envOf(map[string]string{"CONFIG_FILE": path}))
+	require.NoError(t, err)
+	assert.False(t, cfg.Residency.Tenant.Cameras)
+	assert.True(t, cfg.Residency.Tenant.ContactLookup, "не указанные в файле возможности остаются по умолчанию")
+	assert.Equal(t, Default().Residency.Owner, cfg.Residency.Owner)
+}
+
+func TestValidation(t *testing.T) {
+	_, err := load(envOf(map[string]string{
+		"STORAGE":                       "sqlite",
+		"DEVELOPER_ID":                  "0",
+		"REGISTRATION_CHAT_ID":          "42",
+		"TELEGRAM_WEBHOOK_URL":          "http://bot.example.com/telegram",
+		"TELEGRAM_WEBHOOK_SECRET":       "не ascii",
+		"REGISTRATION_REVIEW_SLA_HOURS": "-1",
+	}))
+	require.Error(t, err)
+	for _, field := range []string{"storage", "telegram.developer_id", "telegram.registration_chat_id", "telegram.webhook_url", "telegram.webhook_secret", "registration.review_sla_hours"} {
+		assert.Contains(t, err.Error(), field)
+	}
+
+	_, err = load(envOf(map[string]string{"TELEGRAM_WEBHOOK_URL": "https://bot.example.com/telegram"}))
+	assert.ErrorContains(t, err, "telegram.webhook_secret", "вебхук без секрета открыт для подделки обновлений")
+
+	_, err = load(envOf(map[string]string{"DEVELOPER_ID": "me"}))
+	assert.ErrorContains(t, err, "DEVELOPER_ID")
+}
+
+func TestDumpHidesSecrets(t *testing.T) {
+	cfg := Default()
+	cfg.Telegram.Token = "123:telegram-secret"
+	cfg.YDB.SAKey = "ydb-secret"
+	cfg.Telegram.WebhookSecret = "webhook-secret"
+	dump := cfg.Dump()
+	assert.False(t, strings.Contains(dump, "telegram-secret"))
+	assert.False(t, strings.Contains(dump, "webhook-secret"))
+	assert.False(t, strings.Contains(dump, "ydb-secret"))
+	assert.Contains(t, dump, cfg.Telegram.BotUsername)
+	assert.Equal(t, "123:telegram-secret", cfg.Telegram.Token, "Dump не должен менять исходную конфигурацию")
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"mikhailche/botcomod/handlers/middleware/outbox"
 	"mikhailche/botcomod/lib/tracer.v2"
 	"strconv"
 	"strings"
@@ -20,8 +21,8 @@ const BotDescription = `Я бот микрорайона Изумрудный Б
 Меня разрабатывают сами жители района на добровольных началах. Если есть предложения - напишите их мне, а я передам разработчикам.
 Зарегистрированные резиденты в скором времени смогут искать друг друга по номеру авто или квартиры.`
 
-func AdminCommandController(mux botMux, adminAuth telebot.MiddlewareFunc, userRepository *repository.UserRepository, groupChatService *services.GroupChatService, houses func() repository.THouses) {
-	mux.Use(adminAuth)
+func AdminCommandController(mux botMux, authorize Authorizer, userRepository *repository.UserRepository, groupChatService *services.GroupChatService, houses func() repository.THouses) {
+	mux.Use(authorize(repository.PermissionManageBot))
 	mux.Handle("/chatidlink", func(ctx context.Context, c telebot.Context) error {
 		ctx, span := tracer.Open(ctx, tracer.Named("/chatidlink"))
 		defer span.Close()
@@ -82,8 +83,13 @@ func AdminCommandController(mux botMux, adminAuth telebot.MiddlewareFunc, userRe
 			return fmt.Errorf("не могу достать пользователя: %w", err)
 		}
 		userRepository.IsResident(ctx, userID)
+		// user.Events после снапшота неполные, историю читаем целиком
+		history, err := userRepository.EventHistory(ctx, userID)
+		if err != nil {
+			return fmt.Errorf("не могу достать события пользователя: %w", err)
+		}
 		userAsJson, _ := json.MarshalIndent(*user, "", "  ")
-		eventsAsJson, _ := json.MarshalIndent(user.Events, "", "  ")
+		eventsAsJson, _ := json.MarshalIndent(history, "", "  ")
 		return c.EditOrReply(ctx, fmt.Sprintf("%#v\n\n%v\n\n%v", *user, string(userAsJson), string(eventsAsJson)))
 	})
 
@@ -114,7 +120,7 @@ func AdminCommandController(mux botMux, adminAuth telebot.MiddlewareFunc, userRe
 			return c.Reply(fmt.Sprintf("Ошибка регистрации: %v", err))
 		}
 
-		if _, err := c.Bot().Send(ctx,
+		if err := outbox.Send(ctx, c,
 			&telebot.User{ID: userID},
 			`Спасибо за регистрацию. 
 Пока что вам доступен раздел со ссылками на камеры видеонаблюдения.
@@ -136,12 +142,12 @@ func AdminCommandController(mux botMux, adminAuth telebot.MiddlewareFunc, userRe
 		if err != nil {
 			return fmt.Errorf(
 				"парсинг id пользователья для ответа: %v: %w",
-				c.Reply(fmt.Sprintf("Не получилось: %v", err)),
+				outbox.Always(c).Reply(fmt.Sprintf("Не получилось: %v", err)),
 				err,
 			)
 		}
 		message := strings.Join(c.Args()[1:], " ")
-		_, err = c.Bot().Send(ctx, &telebot.User{ID: int64(id)}, message)
+		err = outbox.Send(ctx, c, &telebot.User{ID: int64(id)}, message)
 		if err != nil {
 			return fmt.Errorf("/reply пользователю: %w", err)
 		}
@@ -0,0 +1,21 @@
+package handlers
+
+import (
+	"context"
+	"html"
+	"mikhailche/botcomod/config"
+	"mikhailche/botcomod/lib/tracer.v2"
+	"mikhailche/botcomod/repository"
+
+	"github.com/mikhailche/telebot"
+)
+
+// ConfigController показывает администратору текущую конфигурацию без секретов
+func ConfigController(mux botMux, authorize Authorizer, cfg *config.Config) {
+	mux.Use(authorize(repository.PermissionManageBot))
+	mux.Handle("/config", func(ctx context.Context, c telebot.Context) error {
+		ctx, span := tracer.Open(ctx, tracer.Named("/config"))
+		defer span.Close()
+		return c.EditOrReply(ctx, "<pre>"+html.EscapeString(cfg.Dump())+"</pre>", telebot.ModeHTML)
+	})
+}
@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"mikhailche/botcomod/handlers/middleware/ydbctx"
+	"mikhailche/botcomod/lib/tracer.v2"
+	"strings"
+
+	"mikhailche/botcomod/repository"
+
+	"github.com/mikhailche/telebot"
+)
+
+const deadLettersPageSize = 20
+
+// DeadLetterController команды администратора для событий в карантине:
+// /deadletters - список, /deadletter <id> - подробности,
+// /deadletter_fix <id> [type] <json> - исправить, /deadletter_drop <id> - удалить из истории
+func DeadLetterController(mux botMux, authorize Authorizer, storage repository.DeadLetterStorage) {
+	adminAuth := authorize(repository.PermissionDebugUpdates)
+	mux.Handle("/deadletters", func(ctx context.Context, c telebot.Context) error {
+		ctx, span := tracer.Open(ctx, tracer.Named("/deadletters"))
+		defer span.Close()
+		letters, err := storage.ListDeadLetters(ctx, deadLettersPageSize)
+		if err != nil {
+			return c.EditOrReply(ctx, fmt.Sprintf("Не удалось получить карантин событий: %v", err))
+		}
+		if len(letters) == 0 {
+			return c.EditOrReply(ctx, "Карантин событий пуст")
+		}
+		var lines []string
+		for _, dl := range letters {
+			lines = append(lines, fmt.Sprintf("%s\nпользователь %d, %s v%d\n%s", dl.ID, dl.User, dl.Type, dl.Version, dl.Reason))
+		}
+		return c.EditOrReply(ctx, strings.Join(lines, "\n\n"))
+	}, adminAuth, ydbctx.ReadOnly)
+
+	mux.Handle("/deadletter", func(ctx context.Context, c telebot.Context) error {
+		ctx, span := tracer.Open(ctx, tracer.Named("/deadletter"))
+		defer span.Close()
+		if len(c.Args()) == 0 {
+			return c.EditOrReply(ctx, "Укажи ID события аргументом к команде")
+		}
+		dl, err := storage.GetDeadLetter(ctx, c.Args()[0])
+		if err != nil {
+			return c.EditOrReply(ctx, fmt.Sprintf("Не удалось получить событие: %v", err))
+		}
+		return c.EditOrReply(ctx, fmt.Sprintf(
+			"Событие %s\nПользователь: %d\nВремя: %s\nТип: %s v%d\nОбнаружено: %s\nПричина: %s\n\n%s",
+			dl.ID, dl.User, dl.Timestamp.Format("2006-01-02 15:04:05"), dl.Type, dl.Version,
+			dl.DetectedAt.Format("2006-01-02 15:04:05"), dl.Reason, dl.Event,
+		))
+	}, adminAuth, ydbctx.ReadOnly)
+
+	mux.Handle("/deadletter_fix", func(ctx context.Context, c telebot.Context) error {
+		ctx, span := tracer.Open(ctx, tracer.Named("/deadletter_fix"))
+		defer span.Close()
+		eventID, rest, _ := strings.Cut(strings.TrimSpace(c.Message().Payload), " ")
+		rest = strings.TrimSpace(rest)
+		if eventID == "" || rest == "" {
+			return c.EditOrReply(ctx, "Формат: /deadletter_fix <id> [тип] <json>")
+		}
+		eventType, payload := "", rest
+		if !strings.HasPrefix(rest, "{") {
+			eventType, payload, _ = strings.Cut(rest, " ")
+			payload = strings.TrimSpace(payload)
+		}
+		if eventType == "" {
+			dl, err := storage.GetDeadLetter(ctx, eventID)
+			if err != nil {
+				return c.EditOrReply(ctx, fmt.Sprintf("Не удалось получить событие: %v", err))
+			}
+			eventType = dl.Type
+		}
+		if err := storage.FixDeadLetter(ctx, eventID, eventType, []byte(payload)); err != nil {
+			return c.EditOrReply(ctx, fmt.Sprintf("Не удалось исправить событие: %v", err))
+		}
+		return c.EditOrReply(ctx, fmt.Sprintf("Событие %s исправлено и вернулось в историю пользователя", eventID))
+	}, adminAuth)
+
+	mux.Handle("/deadletter_drop", func(ctx context.Context, c telebot.Context) error {
+		ctx, span := tracer.Open(ctx, tracer.Named("/deadletter_drop"))
+		defer span.Close()
+		if len(c.Args()) == 0 {
+			return c.EditOrReply(ctx, "Укажи ID события аргументом к команде")
+		}
+		if err := storage.DropDeadLetter(ctx, c.Args()[0]); err != nil {
+			return c.EditOrReply(ctx, fmt.Sprintf("Не удалось удалить событие: %v", err))
+		}
+		return c.EditOrReply(ctx, fmt.Sprintf("Событие %s удалено из истории пользователя", c.Args()[0]))
+	}, adminAuth)
+}
@@ -3,11 +3,13 @@ package handlers
 import (
 	"context"
 	markup "mikhailche/botcomod/lib/bot-markup"
+	"mikhailche/botcomod/repository"
 
 	"github.com/mikhailche/telebot"
 )
 
-func ChatGroupAdminController(mux botMux) {
+func ChatGroupAdminController(mux botMux, authorize Authorizer) {
+	mux.Use(authorize(repository.PermissionManageChats))
 	mux.Handle(&markup.ChatGroupAdminBtn, func(ctx context.Context, c telebot.Context) error {
 		return c.EditOrReply(ctx,
 			`Тут пока ничего нет. 
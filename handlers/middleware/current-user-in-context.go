@@ -3,7 +3,6 @@ package middleware
 import (
 	"context"
 	"github.com/mikhailche/telebot"
-	"mikhailche/botcomod/handlers/middleware/ydbctx"
 	"mikhailche/botcomod/lib/tracer.v2"
 	"mikhailche/botcomod/repository"
 )
@@ -12,12 +11,9 @@ func CurrentUserInContext(users *repository.UserRepository) telebot.MiddlewareFu
 	return func(hf telebot.HandlerFunc) telebot.HandlerFunc {
 		return func(ctx context.Context, c telebot.Context) error {
 			mwctx, span := tracer.Open(ctx)
-			sess := ydbctx.YdbSessionFromContext(mwctx)
-			if sess != nil {
-				user, err := users.GetUser(mwctx, users.ByID(c.Sender().ID))
-				if err == nil {
-					ctx = repository.PutCurrentUserToContext(ctx, user)
-				}
+			user, err := users.GetUser(mwctx, users.ByID(c.Sender().ID))
+			if err == nil {
+				ctx = repository.PutCurrentUserToContext(ctx, user)
 			}
 			span.Close()
 			return hf(ctx, c)
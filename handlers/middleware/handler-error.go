@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"context"
+
+	"github.com/mikhailche/telebot"
+)
+
+type handlerErrorSlot struct {
+	err error
+}
+
+type handlerErrorKeyType int
+
+var handlerErrorKey handlerErrorKeyType
+
+// WithHandlerError место в контексте для ошибки обработчика. telebot отдаёт ошибку обработчика в OnError,
+// а ProcessUpdateCtx возвращает только ошибки маршрутизации. Вызывающий передаёт полученный ctx
+// в ProcessUpdateCtx и после неё забирает ошибку обработчика функцией handlerErr.
+func WithHandlerError(ctx context.Context) (_ context.Context, handlerErr func() error) {
+	slot := &handlerErrorSlot{}
+	return context.WithValue(ctx, handlerErrorKey, slot), func() error { return slot.err }
+}
+
+// CaptureHandlerError кладёт ошибку обработчика в место из [WithHandlerError].
+// Ставится первой, чтобы видеть и ошибки остальных middleware, например коммита транзакции.
+func CaptureHandlerError(hf telebot.HandlerFunc) telebot.HandlerFunc {
+	return func(ctx context.Context, c telebot.Context) error {
+		err := hf(ctx, c)
+		if slot, ok := ctx.Value(handlerErrorKey).(*handlerErrorSlot); ok {
+			slot.err = err
+		}
+		return err
+	}
+}
@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/mikhailche/telebot"
+)
+
+func TestCaptureHandlerError(t *testing.T) {
+	failed := errors.New("обработчик упал")
+	handler := CaptureHandlerError(func(context.Context, telebot.Context) error { return failed })
+
+	ctx, handlerErr := WithHandlerError(context.Background())
+	if err := handler(ctx, nil); !errors.Is(err, failed) {
+		t.Fatalf("ошибка должна идти дальше по цепочке: %v", err)
+	}
+	if !errors.Is(handlerErr(), failed) {
+		t.Errorf("ошибка обработчика не поймана: %v", handlerErr())
+	}
+
+	// вложенная обработка, как при повторе обновлений, ловит свою ошибку, не трогая внешнюю
+	inner, innerErr := WithHandlerError(ctx)
+	if err := CaptureHandlerError(func(context.Context, telebot.Context) error { return nil })(inner, nil); err != nil || innerErr() != nil {
+		t.Errorf("у вложенной обработки ошибки не было: %v, %v", err, innerErr())
+	}
+	if !errors.Is(handlerErr(), failed) {
+		t.Errorf("вложенная обработка затёрла внешнюю ошибку: %v", handlerErr())
+	}
+
+	if err := handler(context.Background(), nil); !errors.Is(err, failed) {
+		t.Errorf("без места в контексте ошибка просто идёт дальше: %v", err)
+	}
+}
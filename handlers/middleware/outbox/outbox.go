@@ -0,0 +1,202 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"mikhailche/botcomod/lib/tracer.v2"
+	"sync"
+
+	"github.com/mikhailche/telebot"
+	"go.uber.org/zap"
+)
+
+// Action отложенное обращение к Telegram
+type Action func(ctx context.Context) error
+
+// Outbox буфер исходящих действий апдейта. Действия выполняются только после успешной обработки,
+// поэтому повтор транзакции не приводит к повторной отправке сообщений.
+// Исключение — действия из [Always]: они выполняются и при ошибке обработчика.
+type Outbox struct {
+	mu      sync.Mutex
+	actions []deferred
+}
+
+type deferred struct {
+	action Action
+	always bool
+}
+
+type outboxInCtxType int
+
+var outboxInCtx outboxInCtxType
+
+func FromContext(ctx context.Context) *Outbox {
+	if box, ok := ctx.Value(outboxInCtx).(*Outbox); ok {
+		return box
+	}
+	return nil
+}
+
+// Defer откладывает действие до конца обработки апдейта. Без буфера в контексте выполняет его сразу.
+func Defer(ctx context.Context, action Action) error {
+	if box := FromContext(ctx); box != nil {
+		box.add(action, false)
+		return nil
+	}
+	return action(ctx)
+}
+
+// Always контекст, действия которого выполняются и при ошибке обработчика: для ответа пользователю об этой ошибке.
+// Повтор транзакции их, как и остальные, выбрасывает.
+func Always(c telebot.Context) telebot.Context {
+	if bc, ok := c.(*bufferedContext); ok {
+		return &bufferedContext{Context: bc.Context, box: bc.box, always: true}
+	}
+	return c
+}
+
+// Send отложенный c.Bot().Send. Отправленное сообщение недоступно, поэтому возвращается только ошибка.
+func Send(ctx context.Context, c telebot.Context, to telebot.Recipient, what interface{}, opts ...interface{}) error {
+	return Defer(ctx, func(ctx context.Context) error {
+		_, err := c.Bot().Send(ctx, to, what, opts...)
+		return err
+	})
+}
+
+// Discard выбрасывает накопленные действия. Вызывается перед повтором обработки апдейта.
+func Discard(ctx context.Context) {
+	if box := FromContext(ctx); box != nil {
+		box.mu.Lock()
+		defer box.mu.Unlock()
+		box.actions = nil
+	}
+}
+
+func (box *Outbox) add(action Action, always bool) {
+	box.mu.Lock()
+	defer box.mu.Unlock()
+	box.actions = append(box.actions, deferred{action: action, always: always})
+}
+
+func (box *Outbox) take() []deferred {
+	box.mu.Lock()
+	defer box.mu.Unlock()
+	actions := box.actions
+	box.actions = nil
+	return actions
+}
+
+// dropFailed выбрасывает действия, которые не должны выполняться после ошибки обработчика, и возвращает их число
+func (box *Outbox) dropFailed() int {
+	box.mu.Lock()
+	defer box.mu.Unlock()
+	kept := box.actions[:0]
+	for _, a := range box.actions {
+		if a.always {
+			kept = append(kept, a)
+		}
+	}
+	dropped := len(box.actions) - len(kept)
+	box.actions = kept
+	return dropped
+}
+
+// Flush выполняет накопленные действия по порядку. Ошибка одного действия не отменяет остальные.
+// Действия, добавленные во время Flush, выполняются следом.
+func (box *Outbox) Flush(ctx context.Context) error {
+	ctx, span := tracer.Open(ctx, tracer.Named("Outbox::Flush"))
+	defer span.Close()
+	var errs []error
+	for actions := box.take(); len(actions) > 0; actions = box.take() {
+		for _, action := range actions {
+			if err := action.action(ctx); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Middleware собирает исходящие действия обработчика и выполняет их после успешного завершения.
+// При ошибке обработчика действия выбрасываются вместе с откатом транзакции, кроме действий из [Always].
+// Должен стоять снаружи ydbctx.WithYdbTxInContext, чтобы сообщения уходили после коммита.
+func Middleware(log *zap.Logger) telebot.MiddlewareFunc {
+	return func(hf telebot.HandlerFunc) telebot.HandlerFunc {
+		return func(ctx context.Context, c telebot.Context) error {
+			ctx, span := tracer.Open(ctx, tracer.Named("Outbox"))
+			defer span.Close()
+			box := &Outbox{}
+			if err := hf(context.WithValue(ctx, outboxInCtx, box), &bufferedContext{Context: c, box: box}); err != nil {
+				if dropped := box.dropFailed(); dropped > 0 {
+					log.Info("Исходящие действия отменены из-за ошибки обработчика", zap.Int("dropped", dropped))
+				}
+				if flushErr := box.Flush(ctx); flushErr != nil {
+					log.Error("Не удалось сообщить об ошибке обработчика", zap.Error(flushErr))
+				}
+				return err
+			}
+			return box.Flush(ctx)
+		}
+	}
+}
+
+// bufferedContext откладывает действия telebot.Context, которые меняют чаты
+type bufferedContext struct {
+	telebot.Context
+	box    *Outbox
+	always bool
+}
+
+func (c *bufferedContext) add(action Action) {
+	c.box.add(action, c.always)
+}
+
+func (c *bufferedContext) Send(_ context.Context, what interface{}, opts ...interface{}) error {
+	c.add(func(ctx context.Context) error { return c.Context.Send(ctx, what, opts...) })
+	return nil
+}
+
+func (c *bufferedContext) SendAlbum(a telebot.Album, opts ...interface{}) error {
+	c.add(func(context.Context) error { return c.Context.SendAlbum(a, opts...) })
+	return nil
+}
+
+func (c *bufferedContext) Reply(what interface{}, opts ...interface{}) error {
+	c.add(func(context.Context) error { return c.Context.Reply(what, opts...) })
+	return nil
+}
+
+func (c *bufferedContext) Forward(msg telebot.Editable, opts ...interface{}) error {
+	c.add(func(context.Context) error { return c.Context.Forward(msg, opts...) })
+	return nil
+}
+
+func (c *bufferedContext) ForwardTo(to telebot.Recipient, opts ...interface{}) error {
+	c.add(func(context.Context) error { return c.Context.ForwardTo(to, opts...) })
+	return nil
+}
+
+func (c *bufferedContext) Edit(_ context.Context, what interface{}, opts ...interface{}) error {
+	c.add(func(ctx context.Context) error { return c.Context.Edit(ctx, what, opts...) })
+	return nil
+}
+
+func (c *bufferedContext) EditCaption(caption string, opts ...interface{}) error {
+	c.add(func(context.Context) error { return c.Context.EditCaption(caption, opts...) })
+	return nil
+}
+
+func (c *bufferedContext) EditOrSend(_ context.Context, what interface{}, opts ...interface{}) error {
+	c.add(func(ctx context.Context) error { return c.Context.EditOrSend(ctx, what, opts...) })
+	return nil
+}
+
+func (c *bufferedContext) EditOrReply(_ context.Context, what interface{}, opts ...interface{}) error {
+	c.add(func(ctx context.Context) error { return c.Context.EditOrReply(ctx, what, opts...) })
+	return nil
+}
+
+func (c *bufferedContext) Delete() error {
+	c.add(func(context.Context) error { return c.Context.Delete() })
+	return nil
+}
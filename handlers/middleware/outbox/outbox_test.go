@@ -0,0 +1,86 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/mikhailche/telebot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type recordingContext struct {
+	telebot.Context
+	sent []interface{}
+}
+
+func (c *recordingContext) Send(_ context.Context, what interface{}, _ ...interface{}) error {
+	c.sent = append(c.sent, what)
+	return nil
+}
+
+func (c *recordingContext) Reply(what interface{}, _ ...interface{}) error {
+	c.sent = append(c.sent, what)
+	return nil
+}
+
+func TestOutboxFlushesAfterSuccess(t *testing.T) {
+	rc := &recordingContext{}
+	handler := Middleware(zap.NewNop())(func(ctx context.Context, c telebot.Context) error {
+		require.NoError(t, c.Send(ctx, "first"))
+		require.NoError(t, c.Reply("second"))
+		require.NoError(t, Defer(ctx, func(context.Context) error { return c.Send(ctx, "third") }))
+		assert.Empty(t, rc.sent, "до конца обработки ничего не отправляется")
+		return nil
+	})
+	require.NoError(t, handler(context.Background(), rc))
+	assert.Equal(t, []interface{}{"first", "second", "third"}, rc.sent)
+}
+
+func TestOutboxDropsOnHandlerError(t *testing.T) {
+	rc := &recordingContext{}
+	handlerErr := errors.New("boom")
+	handler := Middleware(zap.NewNop())(func(ctx context.Context, c telebot.Context) error {
+		_ = c.Send(ctx, "lost")
+		return handlerErr
+	})
+	assert.ErrorIs(t, handler(context.Background(), rc), handlerErr)
+	assert.Empty(t, rc.sent)
+}
+
+func TestOutboxDiscardOnRetry(t *testing.T) {
+	rc := &recordingContext{}
+	handler := Middleware(zap.NewNop())(func(ctx context.Context, c telebot.Context) error {
+		// так ydbctx повторяет обработку после конфликта транзакций
+		for attempt := 0; attempt < 3; attempt++ {
+			Discard(ctx)
+			_ = c.Send(ctx, "contact request")
+		}
+		return nil
+	})
+	require.NoError(t, handler(context.Background(), rc))
+	assert.Equal(t, []interface{}{"contact request"}, rc.sent)
+}
+
+func TestDeferWithoutOutboxRunsImmediately(t *testing.T) {
+	ran := false
+	require.NoError(t, Defer(context.Background(), func(context.Context) error {
+		ran = true
+		return nil
+	}))
+	assert.True(t, ran)
+}
+
+func TestOutboxSendsAlwaysOnHandlerError(t *testing.T) {
+	rc := &recordingContext{}
+	handlerErr := errors.New("boom")
+	handler := Middleware(zap.NewNop())(func(ctx context.Context, c telebot.Context) error {
+		_ = c.Send(ctx, "lost")
+		_ = Always(c).Reply("Ошибка. Попробуйте позже")
+		return handlerErr
+	})
+	assert.ErrorIs(t, handler(context.Background(), rc), handlerErr)
+	assert.Equal(t, []interface{}{"Ошибка. Попробуйте позже"}, rc.sent)
+}
@@ -2,6 +2,7 @@ package middleware
 
 import (
 	"context"
+	"mikhailche/botcomod/handlers/middleware/ydbctx"
 	"mikhailche/botcomod/lib/tracer.v2"
 	"mikhailche/botcomod/repository"
 
@@ -17,9 +18,15 @@ func UpsertUsernameMiddleware(
 ) func(hf telebot.HandlerFunc) telebot.HandlerFunc {
 	return func(hf telebot.HandlerFunc) telebot.HandlerFunc {
 		return func(ctx context.Context, c telebot.Context) error {
+			if ydbctx.IsDryRun(ctx) {
+				// чаты пишутся мимо транзакции апдейта, и откатить их не получится
+				return hf(ctx, c)
+			}
 			func() {
 				ctx, span := tracer.Open(ctx, tracer.Named("UpsertUsername middleware"))
 				defer span.Close()
+				// имя пользователя и чаты обновляем вне транзакции апдейта, чтобы не откатывать их при ошибке обработчика
+				ctx = ydbctx.WithoutTx(ctx)
 				userRepository.UpsertUsername(ctx, c.Sender().ID, c.Sender().Username)
 				if err := telegramChatUpserter(ctx, *c.Chat()); err != nil {
 					log.Error("telegramChatUpserter middleware failed", zap.Error(err))
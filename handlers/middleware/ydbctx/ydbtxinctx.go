@@ -2,16 +2,27 @@ package ydbctx
 
 import (
 	"context"
+	"fmt"
 	"github.com/mikhailche/telebot"
 	"github.com/ydb-platform/ydb-go-sdk/v3/table"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/options"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/result"
 	"go.uber.org/zap"
+	"mikhailche/botcomod/handlers/middleware/outbox"
 	"mikhailche/botcomod/lib/tracer.v2"
+	"sync"
 )
 
 type ydbSessionInCtxType int
 
-var ydbSessionInCtx ydbSessionInCtxType
+const (
+	ydbSessionInCtx ydbSessionInCtxType = iota
+	readOnlyInCtx
+	dryRunInCtx
+)
 
+// YdbSessionFromContext сессия апдейта. Все запросы через неё выполняются в транзакции апдейта,
+// какой бы TxControl ни передал вызывающий код.
 func YdbSessionFromContext(ctx context.Context) table.Session {
 	if sess, ok := ctx.Value(ydbSessionInCtx).(table.Session); ok {
 		return sess
@@ -19,10 +30,111 @@ func YdbSessionFromContext(ctx context.Context) table.Session {
 	return nil
 }
 
+// WithoutTx контекст без сессии апдейта. Запросы в нём выполняются отдельно и не откатываются вместе с апдейтом.
+// В режиме DryRun сессия остаётся, чтобы откатились и эти запросы.
+func WithoutTx(ctx context.Context) context.Context {
+	if IsDryRun(ctx) {
+		return ctx
+	}
+	return context.WithValue(ctx, ydbSessionInCtx, nil)
+}
+
+// DryRun обработка апдейта без изменений в базе: транзакция откатывается даже при успехе
+func DryRun(ctx context.Context) context.Context {
+	return context.WithValue(ctx, dryRunInCtx, true)
+}
+
+func IsDryRun(ctx context.Context) bool {
+	dryRun, _ := ctx.Value(dryRunInCtx).(bool)
+	return dryRun
+}
+
+// ReadOnly отказ от транзакции апдейта для обработчиков, которые только читают.
+// Запросы обработчика выполняются каждый в своей транзакции с переданным TxControl и не берут блокировок апдейта.
+func ReadOnly(hf telebot.HandlerFunc) telebot.HandlerFunc {
+	return func(ctx context.Context, c telebot.Context) error {
+		return hf(context.WithValue(ctx, readOnlyInCtx, true), c)
+	}
+}
+
+func isReadOnly(ctx context.Context) bool {
+	readOnly, _ := ctx.Value(readOnlyInCtx).(bool)
+	return readOnly
+}
+
+// txSession сессия, которая выполняет все запросы в одной serializable транзакции.
+// Транзакция начинается первым запросом, завершает её middleware.
+type txSession struct {
+	table.Session
+	mu sync.Mutex
+	tx table.Transaction
+}
+
+func (s *txSession) Execute(
+	ctx context.Context,
+	txControl *table.TransactionControl,
+	query string,
+	params *table.QueryParameters,
+	opts ...options.ExecuteDataQueryOption,
+) (table.Transaction, result.Result, error) {
+	if isReadOnly(ctx) && !IsDryRun(ctx) {
+		return s.Session.Execute(ctx, txControl, query, params, opts...)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tx != nil {
+		return s.Session.Execute(ctx, table.TxControl(table.WithTx(s.tx)), query, params, opts...)
+	}
+	tx, res, err := s.Session.Execute(ctx,
+		table.TxControl(table.BeginTx(table.WithSerializableReadWrite())),
+		query, params, opts...,
+	)
+	if err != nil {
+		return tx, res, err
+	}
+	s.tx = tx
+	return tx, res, nil
+}
+
+func (s *txSession) finish(ctx context.Context, handlerErr error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tx == nil {
+		return handlerErr
+	}
+	if handlerErr != nil || IsDryRun(ctx) {
+		if err := s.tx.Rollback(ctx); err != nil {
+			if handlerErr == nil {
+				return fmt.Errorf("откат транзакции: %w", err)
+			}
+			return fmt.Errorf("%w; откат транзакции: %v", handlerErr, err)
+		}
+		return handlerErr
+	}
+	if _, err := s.tx.CommitTx(ctx); err != nil {
+		return fmt.Errorf("коммит транзакции: %w", err)
+	}
+	return nil
+}
+
+// runInTx обрабатывает апдейт в транзакции sess. Паника обработчика становится ошибкой,
+// чтобы транзакция откатилась, а не закоммитила половину записей.
+func runInTx(ctx context.Context, c telebot.Context, hf telebot.HandlerFunc, sess *txSession) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = sess.finish(ctx, fmt.Errorf("паника в обработчике: %v", r))
+		}
+	}()
+	return sess.finish(ctx, hf(context.WithValue(ctx, ydbSessionInCtx, table.Session(sess)), c))
+}
+
 type ydbDriver interface {
 	Table() table.Client
 }
 
+// WithYdbTxInContext выполняет обработку апдейта в одной serializable транзакции:
+// коммит при успехе, откат при ошибке или панике обработчика. При конфликте транзакций апдейт обрабатывается заново,
+// а накопленные в outbox сообщения прошлой попытки выбрасываются.
 func WithYdbTxInContext(db ydbDriver, log *zap.Logger) telebot.MiddlewareFunc {
 	return func(hf telebot.HandlerFunc) telebot.HandlerFunc {
 		return func(ctx context.Context, c telebot.Context) error {
@@ -35,8 +147,9 @@ func WithYdbTxInContext(db ydbDriver, log *zap.Logger) telebot.MiddlewareFunc {
 				defer span.Close()
 				log.Debug("Inside Ydb transaction")
 				defer log.Debug("Outside Ydb transaction")
-				ctx = context.WithValue(ctx, ydbSessionInCtx, s)
-				return hf(ctx, c)
+				// сообщения от предыдущей попытки не должны уйти
+				outbox.Discard(ctx)
+				return runInTx(ctx, c, hf, &txSession{Session: s})
 			}, table.WithIdempotent())
 		}
 	}
@@ -0,0 +1,116 @@
+package ydbctx
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/mikhailche/telebot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/options"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/result"
+)
+
+type fakeTx struct {
+	table.Transaction
+	committed, rolledBack bool
+}
+
+func (tx *fakeTx) ID() string { return "tx" }
+
+func (tx *fakeTx) CommitTx(context.Context, ...options.CommitTransactionOption) (result.Result, error) {
+	tx.committed = true
+	return nil, nil
+}
+
+func (tx *fakeTx) Rollback(context.Context) error {
+	tx.rolledBack = true
+	return nil
+}
+
+type fakeSession struct {
+	table.Session
+	tx       *fakeTx
+	controls []*table.TransactionControl
+}
+
+func (s *fakeSession) Execute(
+	_ context.Context, txControl *table.TransactionControl, _ string, _ *table.QueryParameters, _ ...options.ExecuteDataQueryOption,
+) (table.Transaction, result.Result, error) {
+	s.controls = append(s.controls, txControl)
+	return s.tx, nil, nil
+}
+
+func execute(ctx context.Context, s table.Session) {
+	_, _, _ = s.Execute(ctx, table.DefaultTxControl(), "SELECT 1;", table.NewQueryParameters())
+}
+
+func TestTxSessionJoinsSingleTransaction(t *testing.T) {
+	ctx := context.Background()
+	fake := &fakeSession{tx: &fakeTx{}}
+	sess := &txSession{Session: fake}
+	execute(ctx, sess)
+	execute(ctx, sess)
+	require.NoError(t, sess.finish(ctx, nil))
+
+	require.Len(t, fake.controls, 2)
+	assert.NotNil(t, fake.controls[0].Desc().GetBeginTx().GetSerializableReadWrite())
+	assert.False(t, fake.controls[0].Desc().GetCommitTx())
+	assert.Equal(t, "tx", fake.controls[1].Desc().GetTxId())
+	assert.True(t, fake.tx.committed)
+	assert.False(t, fake.tx.rolledBack)
+}
+
+func TestTxSessionRollsBackOnHandlerError(t *testing.T) {
+	ctx := context.Background()
+	fake := &fakeSession{tx: &fakeTx{}}
+	sess := &txSession{Session: fake}
+	execute(ctx, sess)
+	handlerErr := errors.New("handler failed")
+	assert.ErrorIs(t, sess.finish(ctx, handlerErr), handlerErr)
+	assert.True(t, fake.tx.rolledBack)
+	assert.False(t, fake.tx.committed)
+}
+
+func TestReadOnlyKeepsCallerTxControl(t *testing.T) {
+	fake := &fakeSession{tx: &fakeTx{}}
+	sess := &txSession{Session: fake}
+	ctx := context.WithValue(context.Background(), readOnlyInCtx, true)
+	execute(ctx, sess)
+	require.NoError(t, sess.finish(ctx, nil))
+	assert.True(t, fake.controls[0].Desc().GetCommitTx())
+	assert.False(t, fake.tx.committed)
+}
+
+func TestWithoutTxHidesSession(t *testing.T) {
+	ctx := context.WithValue(context.Background(), ydbSessionInCtx, table.Session(&txSession{}))
+	require.NotNil(t, YdbSessionFromContext(ctx))
+	assert.Nil(t, YdbSessionFromContext(WithoutTx(ctx)))
+}
+
+func TestDryRunRollsBackOnSuccess(t *testing.T) {
+	fake := &fakeSession{tx: &fakeTx{}}
+	sess := &txSession{Session: fake}
+	ctx := DryRun(context.WithValue(context.Background(), readOnlyInCtx, true))
+	execute(ctx, sess)
+	require.NoError(t, sess.finish(ctx, nil))
+	assert.NotNil(t, fake.controls[0].Desc().GetBeginTx(), "в dry-run даже read-only запросы идут в транзакции")
+	assert.True(t, fake.tx.rolledBack)
+	assert.False(t, fake.tx.committed)
+
+	withSession := context.WithValue(ctx, ydbSessionInCtx, table.Session(sess))
+	assert.NotNil(t, YdbSessionFromContext(WithoutTx(withSession)), "в dry-run запросы вне транзакции тоже откатываются")
+}
+
+func TestPanicRollsBackTransaction(t *testing.T) {
+	fake := &fakeSession{tx: &fakeTx{}}
+	err := runInTx(context.Background(), nil, func(ctx context.Context, _ telebot.Context) error {
+		execute(ctx, YdbSessionFromContext(ctx))
+		panic("половина записей")
+	}, &txSession{Session: fake})
+	assert.ErrorContains(t, err, "половина записей")
+	assert.True(t, fake.tx.rolledBack)
+	assert.False(t, fake.tx.committed)
+}
@@ -1,8 +1,16 @@
 package handlers
 
-import "github.com/mikhailche/telebot"
+import (
+	"mikhailche/botcomod/repository"
+
+	"github.com/mikhailche/telebot"
+)
 
 type botMux interface {
 	Handle(endpoint interface{}, h telebot.HandlerFunc, m ...telebot.MiddlewareFunc)
 	Use(middleware ...telebot.MiddlewareFunc)
 }
+
+// Authorizer middleware, пропускающая к обработчикам только пользователей с правом permission.
+// Каждая группа обработчиков сама объявляет, какое право ей нужно.
+type Authorizer func(permission repository.Permission) telebot.MiddlewareFunc
@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"mikhailche/botcomod/handlers/middleware/ydbctx"
+	"mikhailche/botcomod/lib/tracer.v2"
+	"mikhailche/botcomod/repository"
+	"strings"
+	"time"
+
+	"github.com/mikhailche/telebot"
+)
+
+const (
+	incompleteUpdatesPageSize = 20
+	// incompleteUpdateGrace обновления моложе этого ещё могут обрабатываться
+	incompleteUpdateGrace = time.Minute
+)
+
+type IncompleteUpdatesLister interface {
+	ListIncompleteUpdates(ctx context.Context, before time.Time, limit uint64) ([]repository.ProcessedUpdate, error)
+}
+
+// ProcessedUpdatesController /incomplete - обновления, обработка которых началась, но не завершилась
+func ProcessedUpdatesController(mux botMux, authorize Authorizer, lister IncompleteUpdatesLister) {
+	adminAuth := authorize(repository.PermissionDebugUpdates)
+	mux.Handle("/incomplete", func(ctx context.Context, c telebot.Context) error {
+		ctx, span := tracer.Open(ctx, tracer.Named("/incomplete"))
+		defer span.Close()
+		updates, err := lister.ListIncompleteUpdates(ctx, time.Now().Add(-incompleteUpdateGrace), incompleteUpdatesPageSize)
+		if err != nil {
+			return c.EditOrReply(ctx, fmt.Sprintf("Не удалось получить незавершённые обновления: %v", err))
+		}
+		if len(updates) == 0 {
+			return c.EditOrReply(ctx, "Незавершённых обновлений нет")
+		}
+		var lines []string
+		for _, u := range updates {
+			lines = append(lines, fmt.Sprintf("%d получено %s\n/replayupdate %d",
+				u.UpdateID, u.ReceivedAt.Format("2006-01-02 15:04:05"), u.UpdateID))
+		}
+		return c.EditOrReply(ctx, "Обработка этих обновлений началась, но не завершилась:\n\n"+strings.Join(lines, "\n\n"))
+	}, adminAuth, ydbctx.ReadOnly)
+}
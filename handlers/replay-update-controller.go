@@ -1,38 +1,185 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"mikhailche/botcomod/handlers/middleware"
+	"mikhailche/botcomod/handlers/middleware/ydbctx"
+	"mikhailche/botcomod/lib/http"
+	"mikhailche/botcomod/lib/tracer.v2"
+	"mikhailche/botcomod/repository"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/mikhailche/telebot"
 )
 
+// replayLimit сколько обновлений можно повторить одной командой
+const replayLimit = 100
+
 type UpdateProcessor interface {
 	ProcessUpdateCtx(context.Context, telebot.Update) error
 }
 
 type UpdateLogGetter interface {
 	GetByUpdateId(context.Context, uint64) (*telebot.Update, error)
+	UpdateLogSearcher
+}
+
+// CallRecorder запись вызовов Bot API, сделанных пробным ботом
+type CallRecorder interface {
+	Take() []http.RecordedCall
+}
+
+// DryRunner собирает бота для пробного повтора: вызовы Bot API он только записывает
+type DryRunner func() (UpdateProcessor, CallRecorder)
+
+// replayReport отчёт о повторе обновлений, присылается файлом
+type replayReport struct {
+	DryRun  bool             `json:"dry_run"`
+	Updates []replayedUpdate `json:"updates"`
 }
 
-func ReplayUpdateController(mux botMux, adminAuth telebot.MiddlewareFunc, getter UpdateLogGetter, processor UpdateProcessor) {
+type replayedUpdate struct {
+	UpdateID int                 `json:"update_id"`
+	Calls    []http.RecordedCall `json:"calls,omitempty"`
+	Error    string              `json:"error,omitempty"`
+}
+
+// ReplayUpdateController повтор обработки обновлений из журнала:
+// /replayupdate <id>, /replayupdate <с>-<по> или /replayupdate с фильтрами как у /updates.
+// С первым аргументом dry обновления обрабатываются пробным ботом: транзакция откатывается,
+// а сообщения не уходят в телеграм, а попадают в отчёт.
+// При маскировке журнала повторяется замаскированный текст: команды доходят до своих обработчиков,
+// но введённые пользователем данные не воспроизводятся.
+func ReplayUpdateController(mux botMux, authorize Authorizer, getter UpdateLogGetter, processor UpdateProcessor, dryRunner DryRunner) {
+	adminAuth := authorize(repository.PermissionDebugUpdates)
 	mux.Handle("/replayupdate", func(ctx context.Context, c telebot.Context) error {
-		if len(c.Args()) == 0 {
-			return c.EditOrReply(ctx, "Укажи ID обновления аргументом к команде")
+		ctx, span := tracer.Open(ctx, tracer.Named("/replayupdate"))
+		defer span.Close()
+		payload := strings.TrimSpace(c.Message().Payload)
+		if payload == "" {
+			return c.EditOrReply(ctx, "Укажи ID обновления, диапазон <с>-<по> или фильтры как у /updates. Первым аргументом dry для пробного прогона")
 		}
-		updateID, err := strconv.Atoi(c.Args()[0])
-		if err != nil {
-			return c.EditOrReply(ctx, fmt.Sprintf("ID должен быть числовой: %v", err))
+		dryRun := false
+		if first, rest, _ := strings.Cut(payload, " "); first == "dry" {
+			dryRun = true
+			payload = strings.TrimSpace(rest)
 		}
-		update, err := getter.GetByUpdateId(ctx, uint64(updateID))
+		if dryRun && dryRunner == nil {
+			return c.EditOrReply(ctx, "Пробный прогон работает только с хранилищем YDB")
+		}
+		updates, err := selectReplayUpdates(ctx, getter, payload)
 		if err != nil {
-			return c.EditOrReply(ctx, fmt.Sprintf("Не удалось получить обновление из базы: %v", err))
+			return c.EditOrReply(ctx, err.Error())
+		}
+		if len(updates) == 0 {
+			return c.EditOrReply(ctx, "Ничего не нашлось")
 		}
-		err = processor.ProcessUpdateCtx(ctx, *update)
+
+		report := replayReport{DryRun: dryRun}
+		var recorder CallRecorder
+		replayCtx := ctx
+		if dryRun {
+			processor, recorder = dryRunner()
+			// транзакция администратора не нужна пробному боту, у него своя, которая откатится
+			replayCtx = ydbctx.DryRun(ydbctx.WithoutTx(ctx))
+		}
+		failed := 0
+		for _, update := range updates {
+			replayed := replayedUpdate{UpdateID: update.ID}
+			// у каждого обновления своё место для ошибки: место апдейта /replayupdate занято его собственной
+			updateCtx, handlerErr := middleware.WithHandlerError(replayCtx)
+			err := processor.ProcessUpdateCtx(updateCtx, update)
+			if err == nil {
+				err = handlerErr()
+			}
+			if err != nil {
+				replayed.Error = err.Error()
+				failed++
+			}
+			if recorder != nil {
+				replayed.Calls = recorder.Take()
+			}
+			report.Updates = append(report.Updates, replayed)
+		}
+
+		body, err := json.MarshalIndent(report, "", "  ")
 		if err != nil {
-			return c.EditOrReply(ctx, fmt.Sprintf("Ошибка повторной обработки update: %v", err))
+			return fmt.Errorf("отчёт о повторе обновлений: %w", err)
 		}
-		return c.EditOrReply(ctx, "Наверное, всё удалось, но я точно не знаю")
+		caption := fmt.Sprintf("Повторено обновлений: %d, с ошибкой: %d", len(updates), failed)
+		if dryRun {
+			caption = "Пробный прогон. " + caption
+		} else {
+			caption += ". Сообщения бота записываются только в пробном прогоне"
+		}
+		return c.Send(ctx, &telebot.Document{
+			File:     telebot.FromReader(bytes.NewReader(body)),
+			FileName: "report.json",
+			Caption:  caption,
+		})
 	}, adminAuth)
 }
+
+// selectReplayUpdates обновления для повтора от старых к новым
+func selectReplayUpdates(ctx context.Context, getter UpdateLogGetter, payload string) ([]telebot.Update, error) {
+	if from, to, ok := parseUpdateIDRange(payload); ok {
+		if to < from {
+			return nil, fmt.Errorf("Начало диапазона больше конца")
+		}
+		if to-from >= replayLimit {
+			return nil, fmt.Errorf("За раз можно повторить не больше %d обновлений", replayLimit)
+		}
+		var updates []telebot.Update
+		for id := from; id <= to; id++ {
+			update, err := getter.GetByUpdateId(ctx, id)
+			if errors.Is(err, repository.ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("Не удалось получить обновление %d из базы: %v", id, err)
+			}
+			updates = append(updates, *update)
+		}
+		return updates, nil
+	}
+	query, err := parseUpdateLogQuery(payload, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("Не понял запрос: %v", err)
+	}
+	logged, more, err := getter.SearchUpdates(ctx, query.Filter, 0, replayLimit)
+	if err != nil {
+		return nil, fmt.Errorf("Не удалось найти обновления: %v", err)
+	}
+	if more {
+		return nil, fmt.Errorf("Нашлось больше %d обновлений, сузьте фильтр", replayLimit)
+	}
+	var updates []telebot.Update
+	// поиск отдаёт от новых к старым, а повторять нужно в исходном порядке
+	for i := len(logged) - 1; i >= 0; i-- {
+		updates = append(updates, logged[i].Update)
+	}
+	return updates, nil
+}
+
+// parseUpdateIDRange разбирает "<id>" или "<с>-<по>"
+func parseUpdateIDRange(payload string) (from, to uint64, ok bool) {
+	first, last, isRange := strings.Cut(payload, "-")
+	from, err := strconv.ParseUint(first, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	if !isRange {
+		return from, from, true
+	}
+	to, err = strconv.ParseUint(last, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return from, to, true
+}
@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mikhailche/botcomod/handlers/middleware/ydbctx"
+	"mikhailche/botcomod/lib/tracer.v2"
+	"mikhailche/botcomod/repository"
+	"strconv"
+	"strings"
+
+	"github.com/mikhailche/telebot"
+)
+
+// RolesController управление ролями: /roles [пользователь] - кто какие роли имеет,
+// /grant <пользователь> <роль> и /revoke <пользователь> <роль>.
+// Пользователь указывается идентификатором или @username. Выдача и отзыв пишутся событиями пользователя.
+func RolesController(mux botMux, authorize Authorizer, userRepository *repository.UserRepository) {
+	mux.Use(authorize(repository.PermissionManageRoles))
+
+	findUser := func(ctx context.Context, ref string) (*repository.User, error) {
+		if username, ok := strings.CutPrefix(ref, "@"); ok {
+			return userRepository.GetUser(ctx, userRepository.ByUsername(username))
+		}
+		userID, err := strconv.ParseInt(ref, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("ожидается идентификатор или @username, получено %q", ref)
+		}
+		user, err := userRepository.GetUser(ctx, userRepository.ByID(userID))
+		if errors.Is(err, repository.ErrNotFound) {
+			// роль можно выдать и тому, кто ещё не писал боту
+			return &repository.User{ID: userID}, nil
+		}
+		return user, err
+	}
+
+	mux.Handle("/roles", func(ctx context.Context, c telebot.Context) error {
+		ctx, span := tracer.Open(ctx, tracer.Named("/roles"))
+		defer span.Close()
+		if len(c.Args()) > 0 {
+			user, err := findUser(ctx, c.Args()[0])
+			if err != nil {
+				return c.EditOrReply(ctx, fmt.Sprintf("Не нашёл пользователя: %v", err))
+			}
+			return c.EditOrReply(ctx, fmt.Sprintf("Роли %s: %s", user.Title(), rolesTitle(userRepository.RolesOf(user))))
+		}
+		users, err := userRepository.GetAllUsers(ctx)
+		if err != nil {
+			return fmt.Errorf("/roles: %w", err)
+		}
+		holders := make(map[repository.Role][]string)
+		for _, user := range users {
+			for _, role := range userRepository.RolesOf(user) {
+				holders[role] = append(holders[role], user.Title())
+			}
+		}
+		var lines []string
+		for _, role := range repository.Roles {
+			names := "никого"
+			if len(holders[role]) > 0 {
+				names = strings.Join(holders[role], ", ")
+			}
+			lines = append(lines, fmt.Sprintf("%s (%s): %s", role.Title(), role, names))
+		}
+		lines = append(lines, "", "Выдать роль: /grant <id или @username> <роль>", "Отозвать: /revoke <id или @username> <роль>")
+		return c.EditOrReply(ctx, strings.Join(lines, "\n"))
+	}, ydbctx.ReadOnly)
+
+	// changeRole разбирает аргументы /grant и /revoke и вызывает change, если роль действительно меняется
+	changeRole := func(ctx context.Context, c telebot.Context, grant bool, change func(ctx context.Context, userID int64, role repository.Role) error) error {
+		if len(c.Args()) != 2 {
+			return c.EditOrReply(ctx, fmt.Sprintf("Нужно указать пользователя и роль, например /grant @username %s", repository.RoleRegistrar))
+		}
+		role := repository.Role(c.Args()[1])
+		if !role.Valid() {
+			return c.EditOrReply(ctx, fmt.Sprintf("Неизвестная роль %q. Роли: %s", role, rolesTitle(repository.Roles)))
+		}
+		user, err := findUser(ctx, c.Args()[0])
+		if err != nil {
+			return c.EditOrReply(ctx, fmt.Sprintf("Не нашёл пользователя: %v", err))
+		}
+		if user.Roles.Has(role) == grant {
+			if grant {
+				return c.EditOrReply(ctx, fmt.Sprintf("У %s уже есть роль %s", user.Title(), role.Title()))
+			}
+			if userRepository.RolesOf(user).Has(role) {
+				return c.EditOrReply(ctx, fmt.Sprintf("Роль %s у %s задана в конфигурации, командой её не отозвать", role.Title(), user.Title()))
+			}
+			return c.EditOrReply(ctx, fmt.Sprintf("У %s нет роли %s", user.Title(), role.Title()))
+		}
+		if err := change(ctx, user.ID, role); err != nil {
+			return err
+		}
+		if grant {
+			return c.EditOrReply(ctx, fmt.Sprintf("Выдали %s роль %s", user.Title(), role.Title()))
+		}
+		return c.EditOrReply(ctx, fmt.Sprintf("Отозвали у %s роль %s", user.Title(), role.Title()))
+	}
+
+	mux.Handle("/grant", func(ctx context.Context, c telebot.Context) error {
+		ctx, span := tracer.Open(ctx, tracer.Named("/grant"))
+		defer span.Close()
+		return changeRole(ctx, c, true, func(ctx context.Context, userID int64, role repository.Role) error {
+			return userRepository.GrantRole(ctx, userID, repository.GrantRoleEvent{AdminUserID: c.Sender().ID, Role: role})
+		})
+	})
+
+	mux.Handle("/revoke", func(ctx context.Context, c telebot.Context) error {
+		ctx, span := tracer.Open(ctx, tracer.Named("/revoke"))
+		defer span.Close()
+		return changeRole(ctx, c, false, func(ctx context.Context, userID int64, role repository.Role) error {
+			return userRepository.RevokeRole(ctx, userID, repository.RevokeRoleEvent{AdminUserID: c.Sender().ID, Role: role})
+		})
+	})
+}
+
+func rolesTitle[T ~[]repository.Role](roles T) string {
+	if len(roles) == 0 {
+		return "нет"
+	}
+	var titles []string
+	for _, role := range roles {
+		titles = append(titles, fmt.Sprintf("%s (%s)", role.Title(), role))
+	}
+	return strings.Join(titles, ", ")
+}
@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mikhailche/botcomod/handlers/middleware/ydbctx"
+	"mikhailche/botcomod/lib/tracer.v2"
+	"mikhailche/botcomod/repository"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mikhailche/telebot"
+)
+
+const (
+	updateLogPageSize    = 15
+	updateLogExportLimit = 5000
+	updateLogTextPreview = 60
+	// updateLogDefaultWindow окно поиска, если from не указан
+	updateLogDefaultWindow = 24 * time.Hour
+)
+
+// adminTimeZone время в командах администратора указывается по Москве
+var adminTimeZone = time.FixedZone("MSK", 3*60*60)
+
+type UpdateLogSearcher interface {
+	SearchUpdates(ctx context.Context, filter repository.UpdateLogFilter, offset, limit int) ([]repository.LoggedUpdate, bool, error)
+}
+
+// exportedRequest строка выгрузки в формате запроса облачной функции, её можно скормить index.Handler
+type exportedRequest struct {
+	HTTPMethod string `json:"httpMethod"`
+	Body       string `json:"body"`
+}
+
+// UpdateLogController поиск по журналу обновлений:
+// /updates user=<id> chat=<id> from=<время> to=<время> type=<тип> page=<n> text=<подстрока до конца строки>
+// /updates_export с теми же фильтрами присылает результат файлом JSONL.
+// Время в формате 2006-01-02 или 2006-01-02T15:04 по Москве, по умолчанию последние сутки.
+// При маскировке журнала text= находит только команды в начале сообщений, остальной текст замаскирован.
+func UpdateLogController(mux botMux, authorize Authorizer, searcher UpdateLogSearcher) {
+	adminAuth := authorize(repository.PermissionDebugUpdates)
+	mux.Handle("/updates", func(ctx context.Context, c telebot.Context) error {
+		ctx, span := tracer.Open(ctx, tracer.Named("/updates"))
+		defer span.Close()
+		query, err := parseUpdateLogQuery(c.Message().Payload, time.Now())
+		if err != nil {
+			return c.EditOrReply(ctx, fmt.Sprintf("Не понял запрос: %v", err))
+		}
+		updates, more, err := searcher.SearchUpdates(ctx, query.Filter, (query.Page-1)*updateLogPageSize, updateLogPageSize)
+		if err != nil {
+			return c.EditOrReply(ctx, fmt.Sprintf("Не удалось найти обновления: %v", err))
+		}
+		if len(updates) == 0 {
+			return c.EditOrReply(ctx, "Ничего не нашлось")
+		}
+		var lines []string
+		for _, u := range updates {
+			lines = append(lines, formatLoggedUpdate(u))
+		}
+		text := fmt.Sprintf("Страница %d\n\n%s", query.Page, strings.Join(lines, "\n\n"))
+		if more {
+			text += "\n\nДальше: /updates " + query.withPage(query.Page+1)
+		}
+		return c.EditOrReply(ctx, text)
+	}, adminAuth, ydbctx.ReadOnly)
+
+	mux.Handle("/updates_export", func(ctx context.Context, c telebot.Context) error {
+		ctx, span := tracer.Open(ctx, tracer.Named("/updates_export"))
+		defer span.Close()
+		query, err := parseUpdateLogQuery(c.Message().Payload, time.Now())
+		if err != nil {
+			return c.EditOrReply(ctx, fmt.Sprintf("Не понял запрос: %v", err))
+		}
+		updates, more, err := searcher.SearchUpdates(ctx, query.Filter, 0, updateLogExportLimit)
+		if err != nil {
+			return c.EditOrReply(ctx, fmt.Sprintf("Не удалось найти обновления: %v", err))
+		}
+		if len(updates) == 0 {
+			return c.EditOrReply(ctx, "Ничего не нашлось")
+		}
+		var buf bytes.Buffer
+		encoder := json.NewEncoder(&buf)
+		// от старых к новым, чтобы при повторе порядок совпал с исходным
+		for i := len(updates) - 1; i >= 0; i-- {
+			if err := encoder.Encode(exportedRequest{HTTPMethod: "POST", Body: updates[i].Raw}); err != nil {
+				return fmt.Errorf("выгрузка обновления %d: %w", updates[i].ID, err)
+			}
+		}
+		caption := fmt.Sprintf("Обновлений: %d", len(updates))
+		if more {
+			caption += fmt.Sprintf(". Выгружены последние %d, сузьте фильтр", updateLogExportLimit)
+		}
+		return c.Send(ctx, &telebot.Document{
+			File:     telebot.FromReader(&buf),
+			FileName: "updates.jsonl",
+			Caption:  caption,
+		})
+	}, adminAuth, ydbctx.ReadOnly)
+}
+
+func formatLoggedUpdate(u repository.LoggedUpdate) string {
+	text := u.Text()
+	if utf8.RuneCountInString(text) > updateLogTextPreview {
+		text = string([]rune(text)[:updateLogTextPreview]) + "…"
+	}
+	return fmt.Sprintf("%d %s %s\nuser=%d chat=%d %s",
+		u.ID, u.Timestamp.In(adminTimeZone).Format("2006-01-02 15:04:05"), u.Type(), u.SenderID(), u.ChatID(), text)
+}
+
+type updateLogQuery struct {
+	Filter repository.UpdateLogFilter
+	Page   int
+	// args исходные аргументы без page, нужны для ссылки на следующую страницу
+	args []string
+}
+
+func (q updateLogQuery) withPage(page int) string {
+	args := append([]string{fmt.Sprintf("page=%d", page)}, q.args...)
+	return strings.Join(args, " ")
+}
+
+func parseUpdateLogQuery(payload string, now time.Time) (updateLogQuery, error) {
+	query := updateLogQuery{Page: 1}
+	filter := &query.Filter
+	rest := strings.TrimSpace(payload)
+	for rest != "" {
+		var token string
+		token, rest, _ = strings.Cut(rest, " ")
+		rest = strings.TrimSpace(rest)
+		key, value, ok := strings.Cut(token, "=")
+		if !ok {
+			return query, fmt.Errorf("ожидается ключ=значение, получено %q", token)
+		}
+		if key == "text" {
+			// text забирает остаток строки, чтобы искать фразы с пробелами
+			value = strings.TrimSpace(value + " " + rest)
+			rest = ""
+		}
+		var err error
+		switch key {
+		case "user":
+			filter.UserID, err = strconv.ParseInt(value, 10, 64)
+		case "chat":
+			filter.ChatID, err = strconv.ParseInt(value, 10, 64)
+		case "from":
+			filter.From, err = parseAdminTime(value)
+		case "to":
+			filter.To, err = parseAdminTime(value)
+		case "type":
+			filter.Type = value
+		case "text":
+			filter.Text = value
+		case "page":
+			query.Page, err = strconv.Atoi(value)
+			if err == nil && query.Page < 1 {
+				err = fmt.Errorf("страницы нумеруются с 1")
+			}
+		default:
+			return query, fmt.Errorf("неизвестный фильтр %q", key)
+		}
+		if err != nil {
+			return query, fmt.Errorf("%s: %w", key, err)
+		}
+		if key != "page" {
+			query.args = append(query.args, key+"="+value)
+		}
+	}
+	if filter.To.IsZero() {
+		filter.To = now
+	}
+	if filter.From.IsZero() {
+		filter.From = filter.To.Add(-updateLogDefaultWindow)
+	}
+	return query, nil
+}
+
+func parseAdminTime(value string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, adminTimeZone); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("ожидается 2006-01-02 или 2006-01-02T15:04, получено %q", value)
+}
@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"mikhailche/botcomod/config"
+	"mikhailche/botcomod/lib/tracer.v2"
+	"mikhailche/botcomod/repository"
+	"strings"
+	"time"
+
+	"github.com/mikhailche/telebot"
+)
+
+// WebhookController регистрирует вебхук в телеграме вместе с секретом, по которому бот отличает запросы телеграма от чужих
+func WebhookController(mux botMux, authorize Authorizer, cfg *config.Config) {
+	mux.Use(authorize(repository.PermissionManageBot))
+	mux.Handle("/setwebhook", func(ctx context.Context, c telebot.Context) error {
+		ctx, span := tracer.Open(ctx, tracer.Named("/setwebhook"))
+		defer span.Close()
+		url := cfg.Telegram.WebhookURL
+		if len(c.Args()) > 0 {
+			url = c.Args()[0]
+		}
+		if !strings.HasPrefix(url, "https://") {
+			return c.Reply("Использование: /setwebhook [https://адрес]. Без адреса берётся telegram.webhook_url из конфигурации.")
+		}
+		if cfg.Telegram.WebhookSecret == "" {
+			return c.Reply("Секрет вебхука не задан. Задайте telegram.webhook_secret или TELEGRAM_WEBHOOK_SECRET, иначе бот не сможет отличить запросы телеграма от чужих.")
+		}
+		if _, err := c.Bot().Raw(ctx, "setWebhook", map[string]string{
+			"url":          url,
+			"secret_token": cfg.Telegram.WebhookSecret,
+		}); err != nil {
+			return fmt.Errorf("/setwebhook: %w", err)
+		}
+		return c.Reply(fmt.Sprintf("Вебхук зарегистрирован: %s. Запросы без секрета будут отклоняться.", url))
+	})
+
+	mux.Handle("/webhookinfo", func(ctx context.Context, c telebot.Context) error {
+		ctx, span := tracer.Open(ctx, tracer.Named("/webhookinfo"))
+		defer span.Close()
+		data, err := c.Bot().Raw(ctx, "getWebhookInfo", map[string]string{})
+		if err != nil {
+			return fmt.Errorf("/webhookinfo: %w", err)
+		}
+		var response struct {
+			Result struct {
+				URL                string `json:"url"`
+				PendingUpdateCount int    `json:"pending_update_count"`
+				LastErrorDate      int64  `json:"last_error_date"`
+				LastErrorMessage   string `json:"last_error_message"`
+			} `json:"result"`
+		}
+		if err := json.Unmarshal(data, &response); err != nil {
+			return fmt.Errorf("/webhookinfo разбор ответа: %w", err)
+		}
+		info := response.Result
+		if info.URL == "" {
+			return c.Reply("Вебхук не зарегистрирован, бот получает обновления через getUpdates")
+		}
+		text := fmt.Sprintf("Вебхук: %s\nОбновлений в очереди: %d", html.EscapeString(info.URL), info.PendingUpdateCount)
+		if info.LastErrorMessage != "" {
+			text += fmt.Sprintf("\nПоследняя ошибка %s: %s",
+				time.Unix(info.LastErrorDate, 0).Format(time.DateTime), html.EscapeString(info.LastErrorMessage))
+		}
+		return c.Reply(text, telebot.ModeHTML)
+	})
+}
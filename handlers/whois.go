@@ -3,6 +3,7 @@ package handlers
 import (
 	"context"
 	"fmt"
+	"mikhailche/botcomod/handlers/middleware/ydbctx"
 	"mikhailche/botcomod/repository"
 	"strconv"
 	"time"
@@ -27,13 +28,13 @@ func with[A any](
 
 func WhoisHandler(
 	mux botMux,
-	groupChatAdminMiddleware telebot.MiddlewareFunc,
+	authorize Authorizer,
 	userByID func(context.Context, int64) (*repository.User, error),
 	userByUsername func(context.Context, string) (*repository.User, error),
 	userGroupsByUserId func(context.Context, int64) ([]int64, error),
 	log *zap.Logger,
 ) {
-	mux.Use(groupChatAdminMiddleware)
+	mux.Use(authorize(repository.PermissionWhois))
 
 	byUser := func(ctx context.Context, user repository.User) (string, error) {
 		groupIDs, err := userGroupsByUserId(ctx, user.ID)
@@ -70,5 +71,5 @@ func WhoisHandler(
 		}
 		return c.EditOrReply(ctx, message)
 	}
-	mux.Handle("/whois", whois)
+	mux.Handle("/whois", whois, ydbctx.ReadOnly)
 }
@@ -7,7 +7,6 @@ import (
 
 	"mikhailche/botcomod/app"
 
-	"github.com/mikhailche/telebot"
 	"go.uber.org/zap"
 )
 
@@ -36,36 +35,38 @@ func Handler(ctx context.Context, body []byte) (*LambdaResponse, error) {
 			appInstance.Log.WithOptions(zap.AddCallerSkip(3)).Error("Паника в верхнем уровне", zap.Any("panicObj", r))
 		}
 	}()
+	if app.IsTimerTrigger(body) {
+		task := app.TimerPayload(body)
+		if err := appInstance.RunScheduled(ctx, task); err != nil {
+			appInstance.Log.Error("Ошибка задачи по расписанию", zap.String("task", task), zap.Error(err))
+		}
+		return &LambdaResponse{
+			StatusCode: 200,
+			Body:       "OK",
+		}, nil
+	}
 	var request LambdaRequest
 	if err := json.Unmarshal(body, &request); err != nil {
 		appInstance.Log.Error("Не получилось распарсить запрос", zap.Error(err))
 	}
+	secret := app.HeaderValue(request.Headers, app.WebhookSecretHeader)
+	if !appInstance.AuthenticateWebhook(secret, "function", app.HeaderValue(request.Headers, "X-Forwarded-For")) {
+		return &LambdaResponse{
+			StatusCode: 403,
+			Body:       "Forbidden",
+		}, nil
+	}
 	appInstance.Log.Info("Parsed lambda request",
-		zap.ByteString("body", body),
-		zap.String("lambdaRuntimeFunctionName", ctx.Value("lambdaRuntimeFunctionName").(string)),
-		zap.String("lambdaRuntimeFunctionVersion", ctx.Value("lambdaRuntimeFunctionVersion").(string)),
-		zap.Int("lambdaRuntimeMemoryLimit", ctx.Value("lambdaRuntimeMemoryLimit").(int)),
-		zap.String("lambdaRuntimeRequestID", ctx.Value("lambdaRuntimeRequestID").(string)),
+		zap.String("httpMethod", request.HTTPMethod),
+		zap.String("body", appInstance.RedactUpdate(request.Body)),
+		zap.Any("lambdaRuntimeFunctionName", ctx.Value("lambdaRuntimeFunctionName")),
+		zap.Any("lambdaRuntimeFunctionVersion", ctx.Value("lambdaRuntimeFunctionVersion")),
+		zap.Any("lambdaRuntimeMemoryLimit", ctx.Value("lambdaRuntimeMemoryLimit")),
+		zap.Any("lambdaRuntimeRequestID", ctx.Value("lambdaRuntimeRequestID")),
 	)
-	var updateMap map[string]any
-	_ = json.Unmarshal([]byte(request.Body), &updateMap)
-	appInstance.UpdateLogger.LogUpdate(ctx, updateMap, request.Body)
-
-	var update telebot.Update
-	if err := json.Unmarshal([]byte(request.Body), &update); err != nil {
+	if err := appInstance.HandleUpdate(ctx, request.Body); err != nil {
 		appInstance.Log.Error("Запросец", zap.Error(err))
 	}
-	if appInstance.Bot == nil {
-		panic("nil appInstance.bot")
-	}
-	if appInstance.Bot.Bot == nil {
-		panic("nil appInstance.bot.bot")
-	}
-	appInstance.Log.Debug("Запускаем процессинг обновления")
-	if err := appInstance.Bot.Bot.ProcessUpdateCtx(ctx, update); err != nil {
-		appInstance.Log.Error("Error processing update", zap.Error(err), zap.Any("update", update))
-	}
-	appInstance.Log.Debug("Завершили процессинг обновления")
 
 	return &LambdaResponse{
 		StatusCode: 200,
@@ -20,8 +20,11 @@ var (
 	PMWithResidentsBtn = Data("💬 Чат с другими резидентами", "resident-pm")
 	PMWithCarOwnersBtn = Data("💬🚗🅿️ Чат с владельцами авто", "carowner-pm")
 
-	RegisterBtn         = Data("📒 Начать регистрацию", "registration")
-	ContinueRegisterBtn = Data("📒 Продолжить регистрацию", "registration")
+	RegisterBtn     = Data("📒 Начать регистрацию", "registration")
+	AddApartmentBtn = Data("➕ Добавить квартиру", "registration")
+	AddParkingBtn   = Data("🅿️ Добавить парковочное место", "add-parking")
+	MyPropertiesBtn = Data("🏘 Моя недвижимость", "my-properties")
+	HouseholdBtn    = Data("👪 Домочадцы", "household")
 
 	ChatGroupAdminBtn = Data("⚙️ Для админов чатов", "chatgroupadmin")
 )
@@ -9,9 +9,7 @@ import (
 	"go.uber.org/zap"
 )
 
-const DeveloperID = 257582730
-
-func ForwardToDeveloper(log *zap.Logger) func(context.Context, telebot.Context) error {
+func ForwardToDeveloper(log *zap.Logger, developerID int64) func(context.Context, telebot.Context) error {
 	return func(ctx context.Context, c telebot.Context) error {
 		ctx, span := tracer.Open(ctx, tracer.Named("ForwardToDeveloper"))
 		defer span.Close()
@@ -24,7 +22,7 @@ func ForwardToDeveloper(log *zap.Logger) func(context.Context, telebot.Context)
 			return handleReply(ctx, c, log)
 		}
 
-		if err := doForwardToDeveloper(ctx, c); err != nil {
+		if err := doForwardToDeveloper(ctx, c, developerID); err != nil {
 			log.Error("Не могу передать разработчику", zap.Error(err))
 			return c.Reply("Не получилось передать сообщение разработчику. Давайте попробуем позже.")
 		}
@@ -55,31 +53,31 @@ func handleReply(ctx context.Context, c telebot.Context, log *zap.Logger) error
 	return nil
 }
 
-func doForwardToDeveloper(ctx context.Context, c telebot.Context) error {
+func doForwardToDeveloper(ctx context.Context, c telebot.Context, developerID int64) error {
 	ctx, span := tracer.Open(ctx, tracer.Named("doForwardToDeveloper"))
 	defer span.Close()
 
 	sender := c.Sender()
 	message := fmt.Sprintf("Сообщение от клиента [%v]: %v %v @%v", sender.ID, sender.FirstName, sender.LastName, sender.Username)
 
-	if _, err := c.Bot().Send(ctx, &telebot.Chat{ID: DeveloperID}, message); err != nil {
+	if _, err := c.Bot().Send(ctx, &telebot.Chat{ID: developerID}, message); err != nil {
 		return fmt.Errorf("форвардинг разработчику: %w", err)
 	}
 
-	if err := c.ForwardTo(&telebot.User{ID: DeveloperID}); err != nil {
+	if err := c.ForwardTo(&telebot.User{ID: developerID}); err != nil {
 		return fmt.Errorf("ошибка при пересылке разработчику: %w", err)
 	}
 
 	return nil
 }
 
-func SendToDeveloper(ctx context.Context, c telebot.Context, log *zap.Logger, message string, opts ...any) error {
+func SendToDeveloper(ctx context.Context, c telebot.Context, log *zap.Logger, developerID int64, message string, opts ...any) error {
 	ctx, span := tracer.Open(ctx, tracer.Named("SendToDeveloper"))
 	defer span.Close()
 
 	log.Named("сообщения для разработчиков").Info(message, zap.Any("opts", opts))
 
-	if _, err := c.Bot().Send(ctx, &telebot.Chat{ID: DeveloperID}, message, opts...); err != nil {
+	if _, err := c.Bot().Send(ctx, &telebot.Chat{ID: developerID}, message, opts...); err != nil {
 		return fmt.Errorf("сообщение разработчику %v: %w", message, err)
 	}
 
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"mikhailche/botcomod/lib/fakebotapi"
+	"net/http"
+	"os"
+)
+
+const usage = `Использование: fakebotapi [-addr :8081]
+
+Поддельный Bot API для ручного запуска бота. Бот направляется сюда через TELEGRAM_API_URL=http://localhost:8081.
+  POST /fake/updates  положить обновление телеграма (json) в очередь getUpdates
+  GET  /fake/calls    вызовы Bot API, которые сделал бот
+`
+
+func main() {
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	addr := flag.String("addr", ":8081", "адрес, на котором слушать")
+	flag.Parse()
+
+	server := fakebotapi.NewServer()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/fake/updates", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "ожидается POST", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil || !json.Valid(body) {
+			http.Error(w, "ожидается обновление в json", http.StatusBadRequest)
+			return
+		}
+		server.PushUpdate(body)
+	})
+	mux.HandleFunc("/fake/calls", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(server.Calls())
+	})
+	mux.Handle("/", server)
+	log.Printf("Поддельный Bot API слушает %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, mux))
+}
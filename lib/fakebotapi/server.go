@@ -0,0 +1,334 @@
+// Package fakebotapi локальная замена Bot API телеграма. Отвечает на методы, которыми пользуется бот,
+// записывает вызовы и по сценарию возвращает ошибки, например 403 от заблокировавшего бота пользователя или 429.
+// Подходит для интеграционных тестов и ручного запуска бота без телеграма.
+package fakebotapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	libhttp "mikhailche/botcomod/lib/http"
+)
+
+// BotID идентификатор бота, от имени которого отправляются сообщения
+const BotID int64 = 100500
+
+// Call вызов метода Bot API
+type Call struct {
+	Method string         `json:"method"`
+	Params map[string]any `json:"params,omitempty"`
+	At     time.Time      `json:"at"`
+}
+
+// Response ответ по сценарию вместо обычного. Status 200 с пустым Description отдаёт Result как успешный.
+type Response struct {
+	Status      int
+	Description string
+	RetryAfter  int
+	Result      any
+}
+
+// Forbidden ответ 403, как если бы пользователь заблокировал бота
+func Forbidden() Response {
+	return Response{Status: http.StatusForbidden, Description: "Forbidden: bot was blocked by the user"}
+}
+
+// TooManyRequests ответ 429 с просьбой повторить через retryAfter секунд
+func TooManyRequests(retryAfter int) Response {
+	return Response{
+		Status:      http.StatusTooManyRequests,
+		Description: fmt.Sprintf("Too Many Requests: retry after %d", retryAfter),
+		RetryAfter:  retryAfter,
+	}
+}
+
+// File файл, который можно получить через getFile и скачать
+type File struct {
+	Path    string
+	Content []byte
+}
+
+// Server обработчик HTTP запросов Bot API вида /bot<token>/<method> и /file/bot<token>/<path>.
+// Токен не проверяется.
+type Server struct {
+	mu            sync.Mutex
+	calls         []Call
+	scripted      map[string][]Response
+	admins        map[int64][]map[string]any
+	members       map[int64]map[int64]map[string]any
+	files         map[string]File
+	updates       []json.RawMessage
+	updatesSignal chan struct{}
+	nextMessageID int
+	webhookURL    string
+	now           func() time.Time
+}
+
+func NewServer() *Server {
+	return &Server{
+		scripted:      make(map[string][]Response),
+		admins:        make(map[int64][]map[string]any),
+		members:       make(map[int64]map[int64]map[string]any),
+		files:         make(map[string]File),
+		updatesSignal: make(chan struct{}),
+		now:           time.Now,
+	}
+}
+
+// Script ставит ответы в очередь для метода. Каждый следующий вызов метода забирает один ответ,
+// когда очередь кончится, метод снова отвечает как обычно.
+func (s *Server) Script(method string, responses ...Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scripted[method] = append(s.scripted[method], responses...)
+}
+
+// SetChatAdministrators задаёт ответ getChatAdministrators для чата.
+// Элементы - объекты ChatMember из Bot API, например {"status": "creator", "user": {"id": 1}}.
+func (s *Server) SetChatAdministrators(chatID int64, admins ...map[string]any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.admins[chatID] = admins
+}
+
+// SetChatMember задаёт ответ getChatMember. Без него пользователь считается обычным участником чата.
+func (s *Server) SetChatMember(chatID, userID int64, member map[string]any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.members[chatID] == nil {
+		s.members[chatID] = make(map[int64]map[string]any)
+	}
+	s.members[chatID][userID] = member
+}
+
+// AddFile делает файл доступным через getFile
+func (s *Server) AddFile(fileID string, content []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[fileID] = File{Path: "files/" + fileID, Content: content}
+}
+
+// PushUpdate ставит обновление в очередь getUpdates
+func (s *Server) PushUpdate(update json.RawMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.updates = append(s.updates, update)
+	close(s.updatesSignal)
+	s.updatesSignal = make(chan struct{})
+}
+
+// Calls все вызовы с момента запуска или прошлого Take
+func (s *Server) Calls() []Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Call(nil), s.calls...)
+}
+
+// Take возвращает вызовы и очищает запись
+func (s *Server) Take() []Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	calls := s.calls
+	s.calls = nil
+	return calls
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if strings.HasPrefix(path, "file/bot") {
+		s.serveFile(w, path)
+		return
+	}
+	token, method, ok := strings.Cut(strings.TrimPrefix(path, "bot"), "/")
+	if !strings.HasPrefix(path, "bot") || !ok || token == "" {
+		writeResponse(w, Response{Status: http.StatusNotFound, Description: "Not Found"})
+		return
+	}
+	params, err := libhttp.RequestParams(r)
+	if err != nil {
+		writeResponse(w, Response{Status: http.StatusBadRequest, Description: "Bad Request: " + err.Error()})
+		return
+	}
+	if method == "getUpdates" {
+		// опрос обновлений не записывается, иначе он забил бы всю запись
+		writeResponse(w, s.getUpdates(r, params))
+		return
+	}
+	writeResponse(w, s.call(method, params))
+}
+
+func (s *Server) call(method string, params map[string]any) Response {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, Call{Method: method, Params: params, At: s.now()})
+	if queue := s.scripted[method]; len(queue) > 0 {
+		s.scripted[method] = queue[1:]
+		response := queue[0]
+		if response.Status == 0 {
+			response.Status = http.StatusOK
+		}
+		return response
+	}
+	switch method {
+	case "getMe":
+		return ok(map[string]any{"id": BotID, "is_bot": true, "first_name": "Fake", "username": "FakeBot"})
+	case "sendMessage", "sendPhoto", "sendDocument", "forwardMessage", "copyMessage":
+		return ok(s.newMessage(params, 0))
+	case "editMessageText", "editMessageCaption", "editMessageReplyMarkup":
+		if _, inline := params["inline_message_id"]; inline {
+			return ok(true)
+		}
+		return ok(s.newMessage(params, intParam(params, "message_id")))
+	case "answerCallbackQuery", "deleteMessage", "setMyCommands", "deleteMyCommands",
+		"setMyDescription", "setMyShortDescription":
+		return ok(true)
+	case "setWebhook":
+		s.webhookURL, _ = params["url"].(string)
+		return ok(true)
+	case "deleteWebhook":
+		s.webhookURL = ""
+		return ok(true)
+	case "getWebhookInfo":
+		return ok(map[string]any{"url": s.webhookURL, "has_custom_certificate": false, "pending_update_count": len(s.updates)})
+	case "getChatAdministrators":
+		admins := s.admins[intParam(params, "chat_id")]
+		if admins == nil {
+			admins = []map[string]any{}
+		}
+		return ok(admins)
+	case "getChatMember":
+		chatID, userID := intParam(params, "chat_id"), intParam(params, "user_id")
+		if member, found := s.members[chatID][userID]; found {
+			return ok(member)
+		}
+		return ok(map[string]any{"status": "member", "user": map[string]any{"id": userID}})
+	case "getFile":
+		fileID, _ := params["file_id"].(string)
+		file, found := s.files[fileID]
+		if !found {
+			return Response{Status: http.StatusBadRequest, Description: "Bad Request: invalid file_id"}
+		}
+		return ok(map[string]any{"file_id": fileID, "file_unique_id": fileID, "file_size": len(file.Content), "file_path": file.Path})
+	}
+	return Response{Status: http.StatusNotFound, Description: "Not Found: method " + method + " is not supported by fake"}
+}
+
+// newMessage сообщение бота в ответ на отправку. messageID 0 - новое сообщение.
+func (s *Server) newMessage(params map[string]any, messageID int64) map[string]any {
+	if messageID == 0 {
+		s.nextMessageID++
+		messageID = int64(s.nextMessageID)
+	}
+	chatID := intParam(params, "chat_id")
+	chatType := "private"
+	if chatID < 0 {
+		chatType = "supergroup"
+	}
+	message := map[string]any{
+		"message_id": messageID,
+		"date":       s.now().Unix(),
+		"from":       map[string]any{"id": BotID, "is_bot": true, "first_name": "Fake"},
+		"chat":       map[string]any{"id": chatID, "type": chatType},
+	}
+	for _, field := range []string{"text", "caption"} {
+		if value, found := params[field]; found {
+			message[field] = value
+		}
+	}
+	if replyMarkup, found := params["reply_markup"].(string); found {
+		var markup map[string]any
+		if json.Unmarshal([]byte(replyMarkup), &markup) == nil && markup["inline_keyboard"] != nil {
+			message["reply_markup"] = map[string]any{"inline_keyboard": markup["inline_keyboard"]}
+		}
+	}
+	return message
+}
+
+// getUpdates отдаёт обновления с update_id не меньше offset. Если их нет, ждёт timeout секунд, как настоящий long polling.
+func (s *Server) getUpdates(r *http.Request, params map[string]any) Response {
+	offset := intParam(params, "offset")
+	timeout := time.Duration(intParam(params, "timeout")) * time.Second
+	deadline := time.After(timeout)
+	for {
+		s.mu.Lock()
+		var pending []json.RawMessage
+		kept := s.updates[:0]
+		for _, update := range s.updates {
+			var header struct {
+				ID int64 `json:"update_id"`
+			}
+			_ = json.Unmarshal(update, &header)
+			if header.ID < offset {
+				continue
+			}
+			kept = append(kept, update)
+			pending = append(pending, update)
+		}
+		s.updates = kept
+		signal := s.updatesSignal
+		s.mu.Unlock()
+		if len(pending) > 0 || timeout <= 0 {
+			if pending == nil {
+				pending = []json.RawMessage{}
+			}
+			return ok(pending)
+		}
+		select {
+		case <-signal:
+		case <-deadline:
+			timeout = 0
+		case <-r.Context().Done():
+			return ok([]json.RawMessage{})
+		}
+	}
+}
+
+func (s *Server) serveFile(w http.ResponseWriter, path string) {
+	_, filePath, _ := strings.Cut(strings.TrimPrefix(path, "file/bot"), "/")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, file := range s.files {
+		if file.Path == filePath {
+			_, _ = w.Write(file.Content)
+			return
+		}
+	}
+	http.NotFound(w, nil)
+}
+
+func ok(result any) Response {
+	return Response{Status: http.StatusOK, Result: result}
+}
+
+func writeResponse(w http.ResponseWriter, response Response) {
+	body := map[string]any{"ok": response.Description == "" && response.Status == http.StatusOK}
+	if body["ok"] == true {
+		body["result"] = response.Result
+	} else {
+		body["error_code"] = response.Status
+		body["description"] = response.Description
+		if response.RetryAfter > 0 {
+			body["parameters"] = map[string]any{"retry_after": response.RetryAfter}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(response.Status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// intParam числовой параметр: telebot передаёт идентификаторы строками, а json числами
+func intParam(params map[string]any, name string) int64 {
+	switch value := params[name].(type) {
+	case float64:
+		return int64(value)
+	case string:
+		parsed, _ := strconv.ParseInt(value, 10, 64)
+		return parsed
+	}
+	return 0
+}
@@ -0,0 +1,151 @@
+package fakebotapi
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mikhailche/telebot"
+)
+
+func newTestBot(t *testing.T) (*Server, *telebot.Bot) {
+	t.Helper()
+	server := NewServer()
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+	bot, err := telebot.NewBot(telebot.Settings{URL: httpServer.URL, Token: "test", Offline: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, bot
+}
+
+func TestSendAndEdit(t *testing.T) {
+	server, bot := newTestBot(t)
+	ctx := context.Background()
+	markup := &telebot.ReplyMarkup{}
+	markup.Inline(markup.Row(markup.Data("Да", "yes", "1")))
+	msg, err := bot.Send(ctx, &telebot.User{ID: 42}, "привет", markup)
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if msg.Chat.ID != 42 || msg.Text != "привет" || msg.ID == 0 {
+		t.Fatalf("неожиданное сообщение: %+v", msg)
+	}
+	edited, err := bot.Edit(ctx, msg, "пока")
+	if err != nil {
+		t.Fatalf("Edit: %v", err)
+	}
+	if edited.ID != msg.ID || edited.Text != "пока" {
+		t.Errorf("правка должна сохранить сообщение: %+v", edited)
+	}
+	calls := server.Take()
+	if len(calls) != 2 || calls[0].Method != "sendMessage" || calls[1].Method != "editMessageText" {
+		t.Fatalf("неожиданные вызовы: %+v", calls)
+	}
+	if calls[0].Params["text"] != "привет" {
+		t.Errorf("параметры не записаны: %+v", calls[0].Params)
+	}
+	if len(server.Calls()) != 0 {
+		t.Errorf("Take должен очищать запись")
+	}
+}
+
+func TestScriptedErrors(t *testing.T) {
+	server, bot := newTestBot(t)
+	ctx := context.Background()
+	server.Script("sendMessage", Forbidden(), TooManyRequests(7))
+
+	_, err := bot.Send(ctx, &telebot.User{ID: 42}, "раз")
+	if !errors.Is(err, telebot.ErrBlockedByUser) {
+		t.Errorf("ожидалась блокировка пользователем, получено %v", err)
+	}
+	_, err = bot.Send(ctx, &telebot.User{ID: 42}, "два")
+	var flood telebot.FloodError
+	if !errors.As(err, &flood) || flood.RetryAfter != 7 {
+		t.Errorf("ожидалась FloodError с retry_after 7, получено %v", err)
+	}
+	if _, err := bot.Send(ctx, &telebot.User{ID: 42}, "три"); err != nil {
+		t.Errorf("после сценария метод должен отвечать как обычно: %v", err)
+	}
+	if got := len(server.Take()); got != 3 {
+		t.Errorf("ошибочные вызовы тоже записываются, ожидалось 3, получено %d", got)
+	}
+}
+
+func TestChatMembersAndFiles(t *testing.T) {
+	server, bot := newTestBot(t)
+	chat := &telebot.Chat{ID: -100}
+	server.SetChatAdministrators(chat.ID, map[string]any{"status": "creator", "user": map[string]any{"id": 7}})
+	server.SetChatMember(chat.ID, BotID, map[string]any{"status": "administrator", "user": map[string]any{"id": BotID}})
+	server.AddFile("photo-1", []byte("jpeg"))
+
+	admins, err := bot.AdminsOf(chat)
+	if err != nil || len(admins) != 1 || admins[0].User.ID != 7 || admins[0].Role != telebot.Creator {
+		t.Errorf("AdminsOf: %+v, %v", admins, err)
+	}
+	member, err := bot.ChatMemberOf(chat, telebot.ChatID(BotID))
+	if err != nil || member.Role != telebot.Administrator {
+		t.Errorf("ChatMemberOf: %+v, %v", member, err)
+	}
+	member, err = bot.ChatMemberOf(chat, telebot.ChatID(8))
+	if err != nil || member.Role != telebot.Member {
+		t.Errorf("по умолчанию пользователь участник чата: %+v, %v", member, err)
+	}
+
+	reader, err := bot.File(&telebot.File{FileID: "photo-1"})
+	if err != nil {
+		t.Fatalf("File: %v", err)
+	}
+	defer reader.Close()
+	content, _ := io.ReadAll(reader)
+	if string(content) != "jpeg" {
+		t.Errorf("содержимое файла: %q", content)
+	}
+	if _, err := bot.FileByID("unknown"); err == nil {
+		t.Errorf("неизвестный файл должен давать ошибку")
+	}
+}
+
+func TestGetUpdates(t *testing.T) {
+	server, bot := newTestBot(t)
+	ctx := context.Background()
+	server.PushUpdate([]byte(`{"update_id":5,"message":{"message_id":1,"chat":{"id":42,"type":"private"},"text":"/start"}}`))
+	server.PushUpdate([]byte(`{"update_id":6,"message":{"message_id":2,"chat":{"id":42,"type":"private"},"text":"/help"}}`))
+
+	updates, err := bot.Raw(ctx, "getUpdates", map[string]string{"offset": "6"})
+	if err != nil {
+		t.Fatalf("getUpdates: %v", err)
+	}
+	if !strings.Contains(string(updates), `"update_id":6`) || strings.Contains(string(updates), `"update_id":5`) {
+		t.Errorf("ожидалось только обновление 6: %s", updates)
+	}
+	if len(server.Calls()) != 0 {
+		t.Errorf("опрос обновлений не записывается: %+v", server.Calls())
+	}
+}
+
+func TestWebhookInfo(t *testing.T) {
+	_, bot := newTestBot(t)
+	ctx := context.Background()
+	if _, err := bot.Raw(ctx, "setWebhook", map[string]string{"url": "https://bot.example.com/telegram", "secret_token": "s"}); err != nil {
+		t.Fatalf("setWebhook: %v", err)
+	}
+	data, err := bot.Raw(ctx, "getWebhookInfo", map[string]string{})
+	if err != nil {
+		t.Fatalf("getWebhookInfo: %v", err)
+	}
+	if !strings.Contains(string(data), `"url":"https://bot.example.com/telegram"`) {
+		t.Errorf("вебхук не запомнен: %s", data)
+	}
+	if _, err := bot.Raw(ctx, "deleteWebhook", map[string]string{}); err != nil {
+		t.Fatalf("deleteWebhook: %v", err)
+	}
+	data, _ = bot.Raw(ctx, "getWebhookInfo", map[string]string{})
+	if !strings.Contains(string(data), `"url":""`) {
+		t.Errorf("вебхук не снят: %s", data)
+	}
+}
@@ -126,6 +126,15 @@ func logResponse(resp *http.Response, logger *zap.Logger, callID string, secrets
 
 	// Mask secrets in headers and body
 	maskedHeaders := maskSecrets(resp.Header, secrets...)
+	if carriesUpdates(resp.Request) {
+		logger.Info("HTTP Response",
+			zap.String("call_id", callID),
+			zap.Int("status_code", resp.StatusCode),
+			zap.Any("headers", maskedHeaders),
+			zap.Int("body_bytes", len(body)),
+		)
+		return
+	}
 	maskedBody := maskSecretsInString(string(body), secrets...)
 
 	var jsonBody interface{}
@@ -183,6 +192,12 @@ func logError(r *http.Request, err error, logger *zap.Logger, callID string, sec
 	}
 }
 
+// carriesUpdates ответ с сырыми обновлениями телеграма: в них телефоны и тексты сообщений.
+// Тело такого ответа не логируется, обновления попадают в журнал уже замаскированными.
+func carriesUpdates(r *http.Request) bool {
+	return r != nil && strings.HasSuffix(r.URL.Path, "/getUpdates")
+}
+
 func maskSecrets(headers http.Header, secrets ...string) http.Header {
 	maskedHeaders := headers.Clone()
 	for key, values := range maskedHeaders {
@@ -200,6 +215,10 @@ func maskSecrets(headers http.Header, secrets ...string) http.Header {
 func maskSecretsInString(s string, secrets ...string) string {
 	masked := s
 	for _, secret := range secrets {
+		if secret == "" {
+			// незаданный секрет, иначе маска встала бы между всеми символами
+			continue
+		}
 		masked = strings.ReplaceAll(masked, secret, "##")
 	}
 	return masked
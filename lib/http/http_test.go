@@ -0,0 +1,39 @@
+package http
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestMaskSecretsInString(t *testing.T) {
+	body := `{"url":"https://bot.example.com/telegram","secret_token":"hook-secret"}`
+	want := `{"url":"https://bot.example.com/telegram","secret_token":"##"}`
+	if got := maskSecretsInString(body, "bot-token", "hook-secret"); got != want {
+		t.Errorf("секрет вебхука не замаскирован: %s", got)
+	}
+	if got := maskSecretsInString(body, "bot-token", ""); got != body {
+		t.Errorf("незаданный секрет не должен менять строку: %s", got)
+	}
+}
+
+func TestUpdatesResponseBodyIsNotLogged(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	request := httptest.NewRequest(http.MethodPost, "https://api.telegram.org/botTOKEN/getUpdates", nil)
+	body := `{"ok":true,"result":[{"update_id":1,"message":{"contact":{"phone_number":"+79990001122"}}}]}`
+	logResponse(&http.Response{StatusCode: 200, Request: request, Body: io.NopCloser(strings.NewReader(body))}, zap.New(core), "1")
+	for _, entry := range logs.All() {
+		if strings.Contains(fmt.Sprint(entry.ContextMap()), "79990001122") {
+			t.Fatalf("ответ getUpdates с персональными данными попал в лог: %v", entry.ContextMap())
+		}
+	}
+	if logs.Len() != 1 || logs.All()[0].ContextMap()["body_bytes"] != int64(len(body)) {
+		t.Errorf("вместо тела логируется его размер: %v", logs.All())
+	}
+}
@@ -0,0 +1,139 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RecordedCall вызов Bot API, перехваченный Recorder
+type RecordedCall struct {
+	Method string         `json:"method"`
+	Params map[string]any `json:"params,omitempty"`
+}
+
+// Recorder HTTP клиент для телеграма, который никуда не ходит. Запоминает вызовы Bot API
+// и отвечает на них успехом: методы отправки и правки возвращают выдуманное сообщение, остальные - true.
+type Recorder struct {
+	mu            sync.Mutex
+	calls         []RecordedCall
+	nextMessageID int
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+func (r *Recorder) Client() *http.Client {
+	return &http.Client{Transport: roundTripperFunc(r.roundTrip)}
+}
+
+// Take возвращает вызовы с прошлого Take
+func (r *Recorder) Take() []RecordedCall {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	calls := r.calls
+	r.calls = nil
+	return calls
+}
+
+func (r *Recorder) roundTrip(req *http.Request) (*http.Response, error) {
+	params, err := RequestParams(req)
+	if err != nil {
+		return nil, fmt.Errorf("разбор запроса к Bot API: %w", err)
+	}
+	method := path.Base(req.URL.Path)
+	r.mu.Lock()
+	r.calls = append(r.calls, RecordedCall{Method: method, Params: params})
+	r.nextMessageID++
+	messageID := r.nextMessageID
+	r.mu.Unlock()
+
+	var result any = true
+	if returnsMessage(method) {
+		message := map[string]any{
+			"message_id": messageID,
+			"date":       time.Now().Unix(),
+			"chat":       map[string]any{"id": chatID(params["chat_id"])},
+		}
+		if text, ok := params["text"]; ok {
+			message["text"] = text
+		}
+		result = message
+	}
+	body, err := json.Marshal(map[string]any{"ok": true, "result": result})
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(bytes.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+func returnsMessage(method string) bool {
+	for _, prefix := range []string{"send", "forward", "copy", "edit"} {
+		if strings.HasPrefix(method, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// chatID telebot передаёт chat_id строкой, а в сообщении он числовой
+func chatID(value any) int64 {
+	switch id := value.(type) {
+	case float64:
+		return int64(id)
+	case string:
+		parsed, _ := strconv.ParseInt(id, 10, 64)
+		return parsed
+	}
+	return 0
+}
+
+// RequestParams параметры вызова Bot API из json или multipart тела запроса. Тело запроса вычитывается.
+func RequestParams(req *http.Request) (map[string]any, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	defer req.Body.Close()
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) == 0 {
+		return nil, nil
+	}
+	mediaType, mediaParams, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		form, err := multipart.NewReader(bytes.NewReader(body), mediaParams["boundary"]).ReadForm(32 << 20)
+		if err != nil {
+			return nil, err
+		}
+		params := make(map[string]any)
+		for name, values := range form.Value {
+			params[name] = values[0]
+		}
+		for name, files := range form.File {
+			params[name] = "файл " + files[0].Filename
+		}
+		return params, nil
+	}
+	var params map[string]any
+	if err := json.Unmarshal(body, &params); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
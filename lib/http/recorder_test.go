@@ -0,0 +1,39 @@
+package http
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mikhailche/telebot"
+)
+
+func TestRecorderAnswersBotAPI(t *testing.T) {
+	recorder := NewRecorder()
+	bot, err := telebot.NewBot(telebot.Settings{Token: "test", Offline: true, Client: recorder.Client()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := bot.Send(context.Background(), &telebot.User{ID: 42}, "привет")
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if msg.Chat == nil || msg.Chat.ID != 42 || msg.Text != "привет" {
+		t.Fatalf("неожиданное сообщение: %+v", msg)
+	}
+	if err := bot.Respond(context.Background(), &telebot.Callback{ID: "1"}); err != nil {
+		t.Fatalf("Respond: %v", err)
+	}
+	calls := recorder.Take()
+	if len(calls) != 2 {
+		t.Fatalf("ожидалось 2 вызова, получено %+v", calls)
+	}
+	if calls[0].Method != "sendMessage" || calls[0].Params["text"] != "привет" {
+		t.Errorf("неожиданный вызов: %+v", calls[0])
+	}
+	if calls[1].Method != "answerCallbackQuery" {
+		t.Errorf("неожиданный вызов: %+v", calls[1])
+	}
+	if calls := recorder.Take(); len(calls) != 0 {
+		t.Errorf("Take должен очищать запись, осталось %+v", calls)
+	}
+}
@@ -0,0 +1,89 @@
+package redact
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Update маскирует персональные данные в сыром обновлении телеграма: телефоны и имена из контактов,
+// текст сообщений, подписи (например к фото квитанций) и текст inline запросов.
+// update_id, идентификаторы, типы и данные кнопок сохраняются, поэтому обновление можно повторить.
+// У текста сохраняется команда в начале, чтобы повтор попал в тот же обработчик.
+func Update(raw []byte) ([]byte, error) {
+	var update map[string]any
+	if err := json.Unmarshal(raw, &update); err != nil {
+		return nil, fmt.Errorf("парсинг обновления для маскировки: %w", err)
+	}
+	redacted, err := json.Marshal(Map(update))
+	if err != nil {
+		return nil, fmt.Errorf("сериализация замаскированного обновления: %w", err)
+	}
+	return redacted, nil
+}
+
+// Map маскирует обновление, разобранное в map. Исходная map не меняется.
+func Map(update map[string]any) map[string]any {
+	return redactValue("", update).(map[string]any)
+}
+
+func redactValue(key string, value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, item := range v {
+			if key == "contact" && (k == "first_name" || k == "last_name") {
+				out[k] = Text(fmt.Sprint(item))
+				continue
+			}
+			out[k] = redactValue(k, item)
+		}
+		return out
+	case []any:
+		out := make([]any, len(v))
+		for i, item := range v {
+			out[i] = redactValue(key, item)
+		}
+		return out
+	case string:
+		switch key {
+		case "phone_number":
+			return Phone(v)
+		case "vcard", "caption", "query":
+			return Text(v)
+		case "text":
+			return Message(v)
+		}
+	}
+	return value
+}
+
+// Phone оставляет от номера только последние две цифры
+func Phone(phone string) string {
+	runes := []rune(phone)
+	if len(runes) <= 2 {
+		return strings.Repeat("*", len(runes))
+	}
+	return strings.Repeat("*", len(runes)-2) + string(runes[len(runes)-2:])
+}
+
+// Text заменяет текст отметкой о его длине
+func Text(text string) string {
+	if text == "" {
+		return ""
+	}
+	return fmt.Sprintf("[скрыто %d символов]", utf8.RuneCountInString(text))
+}
+
+// Message маскирует текст сообщения, сохраняя команду бота в начале
+func Message(text string) string {
+	if !strings.HasPrefix(text, "/") {
+		return Text(text)
+	}
+	command, args, found := strings.Cut(text, " ")
+	if !found || args == "" {
+		return command
+	}
+	return command + " " + Text(args)
+}
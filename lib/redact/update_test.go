@@ -0,0 +1,41 @@
+package redact
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/mikhailche/telebot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdateMasksPersonalData(t *testing.T) {
+	raw := `{"update_id":42,"message":{"message_id":7,"from":{"id":10,"username":"resident"},"chat":{"id":10,"type":"private"},
+"contact":{"phone_number":"+79161234567","first_name":"Иван","last_name":"Петров","user_id":10},
+"caption":"Квитанция кв. 15","text":"/deadletter_fix abc {\"Apartment\":\"15\"}"}}`
+	redacted, err := Update([]byte(raw))
+	require.NoError(t, err)
+	s := string(redacted)
+	for _, secret := range []string{"1234567", "Иван", "Петров", "Квитанция", "Apartment"} {
+		assert.NotContains(t, s, secret)
+	}
+
+	var update telebot.Update
+	require.NoError(t, json.Unmarshal(redacted, &update))
+	assert.Equal(t, 42, update.ID)
+	assert.Equal(t, int64(10), update.Message.Sender.ID)
+	assert.Equal(t, "resident", update.Message.Sender.Username)
+	assert.Equal(t, "**********67", update.Message.Contact.PhoneNumber)
+	assert.Equal(t, int64(10), update.Message.Contact.UserID)
+	assert.Equal(t, "/deadletter_fix [скрыто 22 символов]", update.Message.Text)
+}
+
+func TestUpdateKeepsCallbackData(t *testing.T) {
+	raw := `{"update_id":1,"callback_query":{"id":"q","from":{"id":10},"data":"\fadmin-approve-registration|42","message":{"message_id":1,"chat":{"id":-100},"text":"Фото от нового пользователя"}}}`
+	redacted, err := Update([]byte(raw))
+	require.NoError(t, err)
+	var update telebot.Update
+	require.NoError(t, json.Unmarshal(redacted, &update))
+	assert.Equal(t, "\fadmin-approve-registration|42", update.Callback.Data)
+	assert.Equal(t, "[скрыто 27 символов]", update.Callback.Message.Text)
+}
@@ -13,17 +13,22 @@ const serviceURL = "https://ocr.api.cloud.yandex.net"
 const textRecognitionRecognize = "ocr/v1/recognizeText"
 
 type Client struct {
-	client http.Client
+	client   http.Client
+	folderID string
 }
 
-func NewClient() (*Client, error) {
+func NewClient(folderID string) (*Client, error) {
+	if folderID == "" {
+		return nil, fmt.Errorf("не задан каталог для распознавания")
+	}
 	return &Client{
-		client: http.Client{},
+		client:   http.Client{},
+		folderID: folderID,
 	}, nil
 }
 
 func (c *Client) DetectLicensePlates(ctx context.Context, mimeType string, content []byte, CredentialsProvider func(*http.Request)) ([]string, error) {
-	request, err := textRecognitionRequest(mimeType, content)
+	request, err := textRecognitionRequest(mimeType, content, c.folderID)
 	if err != nil {
 		return nil, err
 	}
@@ -63,7 +68,7 @@ func (c *Client) DetectLicensePlates(ctx context.Context, mimeType string, conte
 	return output, nil
 }
 
-func textRecognitionRequest(mimeType string, content []byte) (*http.Request, error) {
+func textRecognitionRequest(mimeType string, content []byte, folderID string) (*http.Request, error) {
 	var err error
 	body := textRecognitionRecognizeRequestBody{
 		MimeType:      mimeType,
@@ -83,7 +88,7 @@ func textRecognitionRequest(mimeType string, content []byte) (*http.Request, err
 	}
 	request.Header.Add("Content-Type", "application/json")
 	request.Header.Add("x-data-logging-enabled", "true")
-	request.Header.Add("x-folder-id", "b1gr2sfp90l7fhpvdi7c")
+	request.Header.Add("x-folder-id", folderID)
 
 	return request, nil
 }
@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"mikhailche/botcomod/config"
 	"mikhailche/botcomod/lib/cloud"
 	"mikhailche/botcomod/lib/vision"
 	"os"
@@ -12,7 +13,11 @@ import (
 )
 
 func main() {
-	v, err := vision.NewClient()
+	cfg, err := config.Load()
+	if err != nil {
+		panic(err)
+	}
+	v, err := vision.NewClient(cfg.Vision.FolderID)
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"mikhailche/botcomod/config"
+	"mikhailche/botcomod/logger"
+	"mikhailche/botcomod/repository"
+	"mikhailche/botcomod/repository/ydb"
+
+	"go.uber.org/zap"
+)
+
+// Пересобирает справочники user_by_plate и user_by_apartment из событий user_event.
+// Таблицы создаются миграциями: go run ./repository/cmd/migrate up
+func main() {
+	ctx := context.Background()
+	log, err := logger.New(ctx)
+	if err != nil {
+		panic(err)
+	}
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatal("Ошибка конфигурации", zap.Error(err))
+	}
+	ydbd, err := ydb.NewYDBDriver(ctx, log, cfg.YDB)
+	if err != nil {
+		panic(err)
+	}
+	users := repository.NewYDBUserStorage(ydbd, log)
+	if err := users.RebuildLookups(ctx); err != nil {
+		log.Fatal("Не удалось пересобрать справочники", zap.Error(err))
+	}
+	log.Info("Справочники пересобраны")
+}
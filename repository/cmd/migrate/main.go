@@ -2,27 +2,94 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
+	"mikhailche/botcomod/config"
 	"mikhailche/botcomod/logger"
 	"mikhailche/botcomod/repository"
+	"mikhailche/botcomod/repository/migrations"
 	"mikhailche/botcomod/repository/ydb"
+	"os"
 
 	"go.uber.org/zap"
 )
 
+const usage = `Использование: migrate <команда>
+
+Команды:
+  up       применить все неприменённые миграции (на пустой базе создаёт всю схему)
+  status   показать применённые и ожидающие миграции
+  dry-run  показать, какие шаги выполнит up, ничего не меняя
+  houses   вывести список домов
+`
+
 func main() {
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
 	ctx := context.Background()
 	log, err := logger.New(ctx)
 	if err != nil {
 		panic(err)
 	}
-	ydbd, err := ydb.NewYDBDriver(ctx, log)
+	cfg, err := config.Load()
 	if err != nil {
-		panic(err)
+		log.Fatal("Ошибка конфигурации", zap.Error(err))
 	}
-	houses := repository.HouseRepository{DB: ydbd}
-	hh, err := houses.GetHouses(ctx)
+	ydbd, err := ydb.NewYDBDriver(ctx, log, cfg.YDB)
 	if err != nil {
 		panic(err)
 	}
-	log.Info("Дома", zap.Any("hh", hh))
+	migrator, err := migrations.NewMigrator(ydbd, log, migrations.All)
+	if err != nil {
+		log.Fatal("Некорректный список миграций", zap.Error(err))
+	}
+
+	switch flag.Arg(0) {
+	case "up":
+		if err := migrator.Up(ctx); err != nil {
+			log.Fatal("Не удалось применить миграции", zap.Error(err))
+		}
+		log.Info("Миграции применены")
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			log.Fatal("Не удалось получить статус миграций", zap.Error(err))
+		}
+		for _, status := range statuses {
+			applied := "ожидает"
+			if status.Applied() {
+				applied = status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%4d  %-20s  %s\n", status.Version, applied, status.Name)
+		}
+	case "dry-run":
+		pending, err := migrator.Pending(ctx)
+		if err != nil {
+			log.Fatal("Не удалось получить список миграций", zap.Error(err))
+		}
+		if len(pending) == 0 {
+			fmt.Println("Схема актуальна, применять нечего")
+		}
+		for _, migration := range pending {
+			fmt.Printf("-- %d %s\n", migration.Version, migration.Name)
+			for _, step := range migration.Steps {
+				fmt.Println(step)
+			}
+		}
+	case "houses":
+		houses := repository.HouseRepository{DB: ydbd}
+		hh, err := houses.GetHouses(ctx)
+		if err != nil {
+			panic(err)
+		}
+		log.Info("Дома", zap.Any("hh", hh))
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
 }
@@ -0,0 +1,240 @@
+package repository
+
+import (
+	"context"
+	"mikhailche/botcomod/lib/tracer.v2"
+	"slices"
+	"time"
+)
+
+// HouseholdInvite приглашение домочадца в квартиру по ссылке. Действует один раз и до ExpiresAt.
+type HouseholdInvite struct {
+	Code        string
+	HouseID     uint64
+	HouseNumber string
+	Apartment   string
+	ExpiresAt   time.Time
+	// AcceptedBy кто вступил по приглашению, 0 - приглашением ещё не воспользовались
+	AcceptedBy int64 `json:",omitempty"`
+}
+
+// Usable по приглашению ещё можно вступить
+func (i HouseholdInvite) Usable(now time.Time) bool {
+	return i.AcceptedBy == 0 && now.Before(i.ExpiresAt)
+}
+
+// HouseholdMember домочадец, вступивший по приглашению основного резидента
+type HouseholdMember struct {
+	UserID    int64
+	Username  string `json:",omitempty"`
+	HouseID   uint64
+	Apartment string
+	JoinedAt  time.Time
+}
+
+// tHousehold приглашения и домочадцы основного резидента
+type tHousehold struct {
+	Invites map[string]HouseholdInvite `json:",omitempty"`
+	Members []HouseholdMember          `json:",omitempty"`
+}
+
+// Invite приглашение по коду
+func (h tHousehold) Invite(code string) (HouseholdInvite, bool) {
+	invite, ok := h.Invites[code]
+	return invite, ok
+}
+
+// Member домочадец в квартире
+func (h tHousehold) Member(userID int64, houseID uint64, apartment string) (HouseholdMember, bool) {
+	i := slices.IndexFunc(h.Members, func(m HouseholdMember) bool {
+		return m.UserID == userID && m.HouseID == houseID && m.Apartment == apartment
+	})
+	if i < 0 {
+		return HouseholdMember{}, false
+	}
+	return h.Members[i], true
+}
+
+// HouseholdApartments квартиры, в которые пользователь может приглашать домочадцев: подтверждённые,
+// с действующим резидентством собственника или арендатора и полученные не по приглашению.
+func (u *User) HouseholdApartments(now time.Time) []tPrivatePropertyItem {
+	var apartments []tPrivatePropertyItem
+	for _, ppi := range u.PrivateProperty.List() {
+		if ppi.Kind != PropertyApartment || !ppi.Approved || ppi.Expired(now) || ppi.InvitedBy != 0 || ppi.Residency == ResidencyFamily {
+			continue
+		}
+		apartments = append(apartments, ppi)
+	}
+	return apartments
+}
+
+// CreateHouseholdInviteEvent основной резидент создал ссылку-приглашение в квартиру
+type CreateHouseholdInviteEvent struct {
+	Code        string
+	HouseID     uint64
+	HouseNumber string
+	Apartment   string
+	ExpiresAt   time.Time
+}
+
+// AcceptHouseholdInviteEvent по приглашению вступил домочадец. Пишется основному резиденту.
+type AcceptHouseholdInviteEvent struct {
+	Code           string
+	MemberID       int64
+	MemberUsername string `json:",omitempty"`
+}
+
+// JoinHouseholdEvent пользователь вступил в квартиру домочадцем по приглашению. Пишется домочадцу.
+type JoinHouseholdEvent struct {
+	InviterID   int64
+	Code        string
+	HouseID     uint64
+	HouseNumber string
+	Apartment   string
+	// ExpiresAt окончание аренды пригласившего, вместе с ней заканчивается и доступ домочадца
+	ExpiresAt time.Time `json:",omitempty"`
+}
+
+// RenewHouseholdEvent регистратор подтвердил пригласившему новый срок резидентства,
+// доступ домочадца продлевается вместе с ним. Пишется домочадцу.
+type RenewHouseholdEvent struct {
+	InviterID int64
+	HouseID   uint64
+	Apartment string
+	// ExpiresAt новое окончание аренды пригласившего, пусто - бессрочно
+	ExpiresAt time.Time `json:",omitempty"`
+}
+
+// RevokeHouseholdMemberEvent основной резидент исключил домочадца из квартиры
+type RevokeHouseholdMemberEvent struct {
+	MemberID  int64
+	HouseID   uint64
+	Apartment string
+}
+
+// LeaveHouseholdEvent домочадца исключили из квартиры. Пишется домочадцу.
+type LeaveHouseholdEvent struct {
+	InviterID int64
+	HouseID   uint64
+	Apartment string
+}
+
+func (e *CreateHouseholdInviteEvent) Apply(ctx context.Context, u *User) {
+	ctx, span := tracer.Open(ctx)
+	defer span.Close()
+	// истёкшие и использованные приглашения больше не нужны
+	now := eventTime(ctx)
+	for code, invite := range u.Household.Invites {
+		if !invite.Usable(now) {
+			delete(u.Household.Invites, code)
+		}
+	}
+	if u.Household.Invites == nil {
+		u.Household.Invites = make(map[string]HouseholdInvite)
+	}
+	u.Household.Invites[e.Code] = HouseholdInvite{
+		Code:        e.Code,
+		HouseID:     e.HouseID,
+		HouseNumber: e.HouseNumber,
+		Apartment:   e.Apartment,
+		ExpiresAt:   e.ExpiresAt,
+	}
+}
+
+func (e *AcceptHouseholdInviteEvent) Apply(ctx context.Context, u *User) {
+	ctx, span := tracer.Open(ctx)
+	defer span.Close()
+	invite, ok := u.Household.Invite(e.Code)
+	if !ok || invite.AcceptedBy != 0 {
+		return
+	}
+	invite.AcceptedBy = e.MemberID
+	u.Household.Invites[e.Code] = invite
+	if _, ok := u.Household.Member(e.MemberID, invite.HouseID, invite.Apartment); ok {
+		return
+	}
+	u.Household.Members = append(u.Household.Members, HouseholdMember{
+		UserID:    e.MemberID,
+		Username:  e.MemberUsername,
+		HouseID:   invite.HouseID,
+		Apartment: invite.Apartment,
+		JoinedAt:  eventTime(ctx),
+	})
+}
+
+// ApplyVersion 2: не затирает заявку или квартиру, которые у пользователя уже есть, 3: кроме истёкшей аренды
+func (e *JoinHouseholdEvent) ApplyVersion() int {
+	return 3
+}
+
+func (e *JoinHouseholdEvent) Apply(ctx context.Context, u *User) {
+	ctx, span := tracer.Open(ctx)
+	defer span.Close()
+	// иначе последующее исключение из домочадцев удалило бы и собственную заявку
+	if ppi, ok := u.PrivateProperty.Find(PropertyApartment, e.HouseID, e.Apartment); ok && ppi.InvitedBy != e.InviterID && !ppi.Expired(eventTime(ctx)) {
+		return
+	}
+	u.PrivateProperty.Add(tPrivatePropertyItem{
+		HouseID:         e.HouseID,
+		HouseNumber:     e.HouseNumber,
+		ApartmentNumber: e.Apartment,
+		Approved:        true,
+		RequestedAt:     eventTime(ctx),
+		Residency:       ResidencyFamily,
+		ExpiresAt:       e.ExpiresAt,
+		InvitedBy:       e.InviterID,
+	})
+}
+
+func (e *RenewHouseholdEvent) Apply(ctx context.Context, u *User) {
+	ctx, span := tracer.Open(ctx)
+	defer span.Close()
+	if ppi, ok := u.PrivateProperty.Find(PropertyApartment, e.HouseID, e.Apartment); ok && ppi.InvitedBy == e.InviterID {
+		ppi.ExpiresAt = e.ExpiresAt
+		u.PrivateProperty.Add(ppi)
+	}
+}
+
+func (e *RevokeHouseholdMemberEvent) Apply(ctx context.Context, u *User) {
+	ctx, span := tracer.Open(ctx)
+	defer span.Close()
+	u.Household.Members = slices.DeleteFunc(u.Household.Members, func(m HouseholdMember) bool {
+		return m.UserID == e.MemberID && m.HouseID == e.HouseID && m.Apartment == e.Apartment
+	})
+	if len(u.Household.Members) == 0 {
+		u.Household.Members = nil
+	}
+}
+
+func (e *LeaveHouseholdEvent) Apply(ctx context.Context, u *User) {
+	ctx, span := tracer.Open(ctx)
+	defer span.Close()
+	// квартиру, подтверждённую своими документами, исключение из домочадцев не трогает
+	if ppi, ok := u.PrivateProperty.Find(PropertyApartment, e.HouseID, e.Apartment); ok && ppi.InvitedBy == e.InviterID {
+		delete(u.PrivateProperty.Items, ppi.Key())
+	}
+}
+
+func (e *CreateHouseholdInviteEvent) FQDN() string {
+	return "CreateHouseholdInviteEvent"
+}
+
+func (e *AcceptHouseholdInviteEvent) FQDN() string {
+	return "AcceptHouseholdInviteEvent"
+}
+
+func (e *JoinHouseholdEvent) FQDN() string {
+	return "JoinHouseholdEvent"
+}
+
+func (e *RenewHouseholdEvent) FQDN() string {
+	return "RenewHouseholdEvent"
+}
+
+func (e *RevokeHouseholdMemberEvent) FQDN() string {
+	return "RevokeHouseholdMemberEvent"
+}
+
+func (e *LeaveHouseholdEvent) FQDN() string {
+	return "LeaveHouseholdEvent"
+}
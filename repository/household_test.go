@@ -0,0 +1,101 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestHouseholdInviteIsSingleUse(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	inviter := &User{ID: 1}
+	for _, event := range []UserEvent{
+		&CreateHouseholdInviteEvent{Code: "ABC123", HouseID: 1, HouseNumber: "108А", Apartment: "5", ExpiresAt: now.Add(time.Hour)},
+		&AcceptHouseholdInviteEvent{Code: "ABC123", MemberID: 2, MemberUsername: "first"},
+		&AcceptHouseholdInviteEvent{Code: "ABC123", MemberID: 3, MemberUsername: "second"},
+	} {
+		event.Apply(ctx, inviter)
+	}
+	invite, ok := inviter.Household.Invite("ABC123")
+	if !ok || invite.AcceptedBy != 2 || invite.Usable(now) {
+		t.Fatalf("приглашение должно достаться первому: %#v", invite)
+	}
+	if len(inviter.Household.Members) != 1 || inviter.Household.Members[0].UserID != 2 {
+		t.Fatalf("по одному приглашению вступает один домочадец: %#v", inviter.Household.Members)
+	}
+	if fresh := (HouseholdInvite{ExpiresAt: now.Add(time.Hour)}); !fresh.Usable(now) || fresh.Usable(now.Add(time.Hour)) {
+		t.Errorf("приглашение действует до срока: %#v", fresh)
+	}
+
+	(&RevokeHouseholdMemberEvent{MemberID: 2, HouseID: 1, Apartment: "5"}).Apply(ctx, inviter)
+	if len(inviter.Household.Members) != 0 {
+		t.Errorf("исключённый домочадец остался: %#v", inviter.Household.Members)
+	}
+}
+
+func TestLeaveHouseholdKeepsOwnApartment(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	member := &User{ID: 2}
+	for _, event := range []UserEvent{
+		&JoinHouseholdEvent{InviterID: 1, Code: "ABC123", HouseID: 1, HouseNumber: "108А", Apartment: "5"},
+		&AddApartmentEventV2{HouseID: 2, HouseNumber: "108Б", Apartment: "7"},
+		&AdminConfirmedAddApartmentEventV2{HouseID: 2, Apartment: "7"},
+	} {
+		event.Apply(ctx, member)
+	}
+	if got := member.HouseholdApartments(now); len(got) != 1 || got[0].ApartmentNumber != "7" {
+		t.Fatalf("приглашать можно только в свою квартиру, не в квартиру пригласившего: %#v", got)
+	}
+	(&LeaveHouseholdEvent{InviterID: 1, HouseID: 2, Apartment: "7"}).Apply(ctx, member)
+	(&LeaveHouseholdEvent{InviterID: 1, HouseID: 1, Apartment: "5"}).Apply(ctx, member)
+	if _, ok := member.PrivateProperty.Find(PropertyApartment, 1, "5"); ok {
+		t.Errorf("после исключения квартира пригласившего осталась")
+	}
+	if _, ok := member.PrivateProperty.Find(PropertyApartment, 2, "7"); !ok {
+		t.Errorf("исключение из домочадцев не трогает квартиру, подтверждённую документами")
+	}
+}
+
+func TestJoinHouseholdKeepsOwnRequest(t *testing.T) {
+	ctx := context.Background()
+	member := &User{ID: 2}
+	for _, event := range []UserEvent{
+		&AddApartmentEventV2{HouseID: 1, HouseNumber: "108А", Apartment: "5", Residency: ResidencyTenant},
+		&JoinHouseholdEvent{InviterID: 1, Code: "ABC123", HouseID: 1, HouseNumber: "108А", Apartment: "5"},
+		&LeaveHouseholdEvent{InviterID: 1, HouseID: 1, Apartment: "5"},
+	} {
+		event.Apply(ctx, member)
+	}
+	if ppi, ok := member.PrivateProperty.Find(PropertyApartment, 1, "5"); !ok || ppi.Approved || ppi.InvitedBy != 0 {
+		t.Fatalf("собственная заявка должна пережить приглашение и исключение: %#v", ppi)
+	}
+}
+
+func TestJoinHouseholdReplacesExpiredTenancy(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	ctx := withEventTime(context.Background(), now)
+	member := &User{ID: 2}
+	for _, event := range []UserEvent{
+		&AddApartmentEventV2{HouseID: 1, HouseNumber: "108А", Apartment: "5", Residency: ResidencyTenant, ExpiresAt: now.Add(-time.Hour)},
+		&AdminConfirmedAddApartmentEventV2{HouseID: 1, Apartment: "5"},
+		&JoinHouseholdEvent{InviterID: 1, Code: "ABC123", HouseID: 1, HouseNumber: "108А", Apartment: "5"},
+	} {
+		event.Apply(ctx, member)
+	}
+	if ppi, ok := member.PrivateProperty.Find(PropertyApartment, 1, "5"); !ok || ppi.InvitedBy != 1 || ppi.Expired(now) {
+		t.Fatalf("истёкшая аренда не мешает вступить домочадцем: %#v", ppi)
+	}
+}
+
+func TestRenewHouseholdFollowsInviter(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	member := &User{ID: 2}
+	(&JoinHouseholdEvent{InviterID: 1, Code: "ABC123", HouseID: 1, HouseNumber: "108А", Apartment: "5", ExpiresAt: now}).Apply(ctx, member)
+	(&RenewHouseholdEvent{InviterID: 1, HouseID: 1, Apartment: "5", ExpiresAt: now.AddDate(1, 0, 0)}).Apply(ctx, member)
+	if got := member.ResidentApartments(now.AddDate(0, 6, 0)); len(got) != 1 {
+		t.Fatalf("доступ домочадца продлевается вместе с арендой пригласившего: %#v", member.PrivateProperty.Items)
+	}
+}
@@ -0,0 +1,254 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mikhailche/botcomod/lib/tracer.v2"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mikhailche/telebot"
+	"go.uber.org/zap"
+)
+
+// MemoryHouseStorage дома в памяти. Заполняется напрямую через Houses.
+type MemoryHouseStorage struct {
+	Houses THouses
+}
+
+func (m *MemoryHouseStorage) GetHouses(ctx context.Context) (THouses, error) {
+	_, span := tracer.Open(ctx, tracer.Named("MemoryHouseStorage::GetHouses"))
+	defer span.Close()
+	return m.Houses, nil
+}
+
+// MemoryGroupChatStorage групповые чаты в памяти. Заполняется напрямую через Chats.
+type MemoryGroupChatStorage struct {
+	Chats TGroupChats
+}
+
+func (m *MemoryGroupChatStorage) GetGroupChats(ctx context.Context) (TGroupChats, error) {
+	_, span := tracer.Open(ctx, tracer.Named("MemoryGroupChatStorage::GetGroupChats"))
+	defer span.Close()
+	chats := append(TGroupChats(nil), m.Chats...)
+	sort.SliceStable(chats, func(i, j int) bool { return chats[i].Order < chats[j].Order })
+	return chats, nil
+}
+
+// MemoryUpdateLog журнал обновлений в памяти. Пишет синхронно, поэтому после LogUpdate обновление сразу доступно.
+type MemoryUpdateLog struct {
+	mu      sync.Mutex
+	log     *zap.Logger
+	updates map[uint64]LoggedUpdate
+	now     func() time.Time
+}
+
+func NewMemoryUpdateLog(log *zap.Logger) *MemoryUpdateLog {
+	return &MemoryUpdateLog{log: log, updates: make(map[uint64]LoggedUpdate), now: time.Now}
+}
+
+func (m *MemoryUpdateLog) LogUpdate(ctx context.Context, upd map[string]any, rawUpdate string) {
+	_, span := tracer.Open(ctx, tracer.Named("MemoryUpdateLog::LogUpdate"))
+	defer span.Close()
+	m.log.Info("Обновление от телеги", zap.Any("update", upd))
+	id, ok := upd["update_id"].(float64)
+	if !ok {
+		m.log.Error("В обновлении нет update_id")
+		return
+	}
+	logged, err := newLoggedUpdate(uint64(id), m.now(), rawUpdate)
+	if err != nil {
+		m.log.Error("Битое обновление в журнале", zap.Error(err))
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.updates[uint64(id)] = logged
+}
+
+func (m *MemoryUpdateLog) Flush(context.Context) error {
+	return nil
+}
+
+func (m *MemoryUpdateLog) Stats() UpdateLogStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return UpdateLogStats{Written: uint64(len(m.updates))}
+}
+
+func (m *MemoryUpdateLog) PurgeBefore(ctx context.Context, before time.Time) (uint64, error) {
+	_, span := tracer.Open(ctx, tracer.Named("MemoryUpdateLog::PurgeBefore"))
+	defer span.Close()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var deleted uint64
+	for id, u := range m.updates {
+		if u.Timestamp.Before(before) {
+			delete(m.updates, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (m *MemoryUpdateLog) GetByUpdateId(ctx context.Context, updateID uint64) (*telebot.Update, error) {
+	_, span := tracer.Open(ctx, tracer.Named("MemoryUpdateLog::GetByUpdateId"))
+	defer span.Close()
+	m.mu.Lock()
+	logged, ok := m.updates[updateID]
+	m.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("обновление %d: %w", updateID, ErrNotFound)
+	}
+	var teleUpd telebot.Update
+	if err := json.Unmarshal([]byte(logged.Raw), &teleUpd); err != nil {
+		return nil, err
+	}
+	return &teleUpd, nil
+}
+
+func (m *MemoryUpdateLog) SearchUpdates(ctx context.Context, filter UpdateLogFilter, offset, limit int) ([]LoggedUpdate, bool, error) {
+	_, span := tracer.Open(ctx, tracer.Named("MemoryUpdateLog::SearchUpdates"))
+	defer span.Close()
+	if err := filter.validate(); err != nil {
+		return nil, false, err
+	}
+	m.mu.Lock()
+	var found []LoggedUpdate
+	for _, u := range m.updates {
+		if filter.matches(u) {
+			found = append(found, u)
+		}
+	}
+	m.mu.Unlock()
+	sort.Slice(found, func(i, j int) bool {
+		if !found[i].Timestamp.Equal(found[j].Timestamp) {
+			return found[i].Timestamp.After(found[j].Timestamp)
+		}
+		return found[i].ID > found[j].ID
+	})
+	return paginate(found, offset, limit)
+}
+
+// MemoryTelegramChatStorage чаты и связи чат-пользователь в памяти
+type MemoryTelegramChatStorage struct {
+	mu          sync.Mutex
+	chats       map[int64]telebot.Chat
+	chatsByUser map[int64]map[int64]bool
+}
+
+func NewMemoryTelegramChatStorage() *MemoryTelegramChatStorage {
+	return &MemoryTelegramChatStorage{
+		chats:       make(map[int64]telebot.Chat),
+		chatsByUser: make(map[int64]map[int64]bool),
+	}
+}
+
+func (m *MemoryTelegramChatStorage) UpsertTelegramChat(ctx context.Context, chat telebot.Chat) error {
+	_, span := tracer.Open(ctx, tracer.Named("MemoryTelegramChatStorage::UpsertTelegramChat"))
+	defer span.Close()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.chats[chat.ID] = chat
+	return nil
+}
+
+func (m *MemoryTelegramChatStorage) UpsertTelegramChatToUserMapping(ctx context.Context, chat, user int64) error {
+	_, span := tracer.Open(ctx, tracer.Named("MemoryTelegramChatStorage::UpsertTelegramChatToUserMapping"))
+	defer span.Close()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.chatsByUser[user] == nil {
+		m.chatsByUser[user] = make(map[int64]bool)
+	}
+	m.chatsByUser[user][chat] = true
+	return nil
+}
+
+func (m *MemoryTelegramChatStorage) SelectTelegramChatsByUserID(ctx context.Context, user int64) ([]int64, error) {
+	_, span := tracer.Open(ctx, tracer.Named("MemoryTelegramChatStorage::SelectTelegramChatsByUserID"))
+	defer span.Close()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var ids []int64
+	for chat := range m.chatsByUser[user] {
+		ids = append(ids, chat)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// MemoryProcessedUpdates журнал обработки обновлений в памяти
+type MemoryProcessedUpdates struct {
+	mu      sync.Mutex
+	updates map[uint64]*ProcessedUpdate
+	now     func() time.Time
+}
+
+func NewMemoryProcessedUpdates() *MemoryProcessedUpdates {
+	return &MemoryProcessedUpdates{updates: make(map[uint64]*ProcessedUpdate), now: time.Now}
+}
+
+func (m *MemoryProcessedUpdates) BeginUpdate(ctx context.Context, updateID uint64) (bool, error) {
+	_, span := tracer.Open(ctx, tracer.Named("MemoryProcessedUpdates::BeginUpdate"))
+	defer span.Close()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, seen := m.updates[updateID]; seen {
+		return false, nil
+	}
+	m.updates[updateID] = &ProcessedUpdate{UpdateID: updateID, ReceivedAt: m.now(), Status: UpdateStarted}
+	return true, nil
+}
+
+func (m *MemoryProcessedUpdates) CompleteUpdate(ctx context.Context, updateID uint64, processErr error) error {
+	_, span := tracer.Open(ctx, tracer.Named("MemoryProcessedUpdates::CompleteUpdate"))
+	defer span.Close()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.updates[updateID]
+	if !ok {
+		return nil
+	}
+	finishedAt := m.now()
+	u.FinishedAt = &finishedAt
+	u.Status, u.Error = UpdateDone, ""
+	if processErr != nil {
+		u.Status, u.Error = UpdateFailed, processErr.Error()
+	}
+	return nil
+}
+
+func (m *MemoryProcessedUpdates) PurgeBefore(ctx context.Context, before time.Time) (uint64, error) {
+	_, span := tracer.Open(ctx, tracer.Named("MemoryProcessedUpdates::PurgeBefore"))
+	defer span.Close()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var deleted uint64
+	for id, u := range m.updates {
+		if u.ReceivedAt.Before(before) {
+			delete(m.updates, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (m *MemoryProcessedUpdates) ListIncompleteUpdates(ctx context.Context, before time.Time, limit uint64) ([]ProcessedUpdate, error) {
+	_, span := tracer.Open(ctx, tracer.Named("MemoryProcessedUpdates::ListIncompleteUpdates"))
+	defer span.Close()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var updates []ProcessedUpdate
+	for _, u := range m.updates {
+		if u.Status == UpdateStarted && u.ReceivedAt.Before(before) {
+			updates = append(updates, *u)
+		}
+	}
+	sort.Slice(updates, func(i, j int) bool { return updates[i].UpdateID > updates[j].UpdateID })
+	if uint64(len(updates)) > limit {
+		updates = updates[:limit]
+	}
+	return updates, nil
+}
@@ -0,0 +1,316 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mikhailche/botcomod/lib/tracer.v2"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type memoryUserRow struct {
+	ID       int64
+	Username string
+}
+
+// MemoryUserStorage хранилище пользователей в памяти с той же семантикой, что и YDBUserStorage:
+// пользователь существует только после UpsertUsername, события хранятся сериализованными
+// и применяются в порядке (timestamp, id).
+type MemoryUserStorage struct {
+	mu     sync.Mutex
+	users  map[int64]memoryUserRow
+	events map[int64][]memoryEventRecord
+	// deadLetters события в карантине по идентификатору события
+	deadLetters map[string]DeadLetter
+	now         func() time.Time
+}
+
+type memoryEventRecord struct {
+	Timestamp time.Time
+	ID        string
+	Type      string
+	Version   uint32
+	Event     []byte
+}
+
+func (e memoryEventRecord) before(other memoryEventRecord) bool {
+	if !e.Timestamp.Equal(other.Timestamp) {
+		return e.Timestamp.Before(other.Timestamp)
+	}
+	return e.ID < other.ID
+}
+
+func NewMemoryUserStorage() *MemoryUserStorage {
+	return &MemoryUserStorage{
+		users:       make(map[int64]memoryUserRow),
+		events:      make(map[int64][]memoryEventRecord),
+		deadLetters: make(map[string]DeadLetter),
+		now:         time.Now,
+	}
+}
+
+// SetClock подменяет часы, по которым ставится время событий. Нужно тестам, где важен возраст событий.
+func (m *MemoryUserStorage) SetClock(now func() time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.now = now
+}
+
+func (m *MemoryUserStorage) GetUser(ctx context.Context, query UserQuery) (*User, error) {
+	ctx, span := tracer.Open(ctx, tracer.Named("MemoryUserStorage::GetUser"))
+	defer span.Close()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, row := range m.sortedUsers() {
+		user := &User{ID: row.ID, Username: row.Username}
+		if !query.matches(user) {
+			continue
+		}
+		if err := m.applyEvents(ctx, user); err != nil {
+			return nil, err
+		}
+		return user, nil
+	}
+	return nil, fmt.Errorf("MemoryUserStorage::GetUser: пользователь: %w", ErrNotFound)
+}
+
+func (m *MemoryUserStorage) GetAllUsers(ctx context.Context) ([]*User, error) {
+	ctx, span := tracer.Open(ctx, tracer.Named("MemoryUserStorage::GetAllUsers"))
+	defer span.Close()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var users []*User
+	for _, row := range m.sortedUsers() {
+		user := &User{ID: row.ID, Username: row.Username}
+		if err := m.applyEvents(ctx, user); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+func (m *MemoryUserStorage) LogEvent(ctx context.Context, userID int64, event UserEvent) error {
+	return m.AppendEvent(ctx, userID, AnyStreamVersion, event)
+}
+
+func (m *MemoryUserStorage) AppendEvent(ctx context.Context, userID int64, expectedVersion int64, event UserEvent) error {
+	ctx, span := tracer.Open(ctx, tracer.Named("MemoryUserStorage::AppendEvent"))
+	defer span.Close()
+	eventBytes, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("сериализация события %v: %w", event, err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if current := int64(len(m.events[userID])); expectedVersion != AnyStreamVersion && current != expectedVersion {
+		return &StreamConflictError{UserID: userID, Expected: expectedVersion, Actual: current}
+	}
+	record := memoryEventRecord{
+		Timestamp: m.now(),
+		ID:        uuid.New().String(),
+		Type:      event.FQDN(),
+		Version:   eventVersionOf(event),
+		Event:     eventBytes,
+	}
+	events := m.events[userID]
+	i := sort.Search(len(events), func(i int) bool { return record.before(events[i]) })
+	events = append(events, memoryEventRecord{})
+	copy(events[i+1:], events[i:])
+	events[i] = record
+	m.events[userID] = events
+	return nil
+}
+
+func (m *MemoryUserStorage) ClearEvents(ctx context.Context, userID int64) error {
+	_, span := tracer.Open(ctx, tracer.Named("MemoryUserStorage::ClearEvents"))
+	defer span.Close()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.events, userID)
+	return nil
+}
+
+func (m *MemoryUserStorage) FindByVehicleLicensePlate(ctx context.Context, vehicleLicensePlate string) (*User, error) {
+	ctx, span := tracer.Open(ctx, tracer.Named("MemoryUserStorage::FindByVehicleLicensePlate"))
+	defer span.Close()
+	return m.findFirst(ctx, func(user *User) bool {
+		for _, car := range user.Cars {
+			if car.LicensePlate == vehicleLicensePlate {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (m *MemoryUserStorage) FindByAppartment(ctx context.Context, house string, appartment string) (*User, error) {
+	ctx, span := tracer.Open(ctx, tracer.Named("MemoryUserStorage::FindByAppartment"))
+	defer span.Close()
+	return m.findFirst(ctx, func(user *User) bool {
+		for _, appart := range user.ResidentApartments(m.now()) {
+			if appart.HouseNumber == house && appart.ApartmentNumber == appartment {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (m *MemoryUserStorage) UpsertUsername(ctx context.Context, userID int64, username string) {
+	_, span := tracer.Open(ctx, tracer.Named("MemoryUserStorage::UpsertUsername"))
+	defer span.Close()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.users[userID] = memoryUserRow{ID: userID, Username: username}
+}
+
+func (m *MemoryUserStorage) findFirst(ctx context.Context, match func(*User) bool) (*User, error) {
+	users, err := m.GetAllUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		if match(user) {
+			return user, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *MemoryUserStorage) sortedUsers() []memoryUserRow {
+	var rows []memoryUserRow
+	for _, row := range m.users {
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].ID < rows[j].ID })
+	return rows
+}
+
+func (m *MemoryUserStorage) applyEvents(ctx context.Context, user *User) error {
+	user.PrivateProperty.Items = make(map[string]tPrivatePropertyItem)
+	user.StreamVersion = int64(len(m.events[user.ID]))
+	for _, record := range m.events[user.ID] {
+		event, err := decodeUserEvent(ctx, record.Type, record.Version, record.Event)
+		if err != nil {
+			corrupt := &CorruptEventError{
+				Record:  UserEventRecord{User: user.ID, Timestamp: record.Timestamp, ID: record.ID, Type: record.Type, Version: record.Version},
+				Payload: record.Event,
+				Reason:  err,
+			}
+			m.deadLetters[record.ID] = corrupt.deadLetter(m.now())
+			continue
+		}
+		applied := UserEventRecord{
+			User:      user.ID,
+			Timestamp: record.Timestamp,
+			ID:        record.ID,
+			Type:      record.Type,
+			Version:   eventVersionOf(event),
+			Event:     event,
+		}
+		applied.apply(ctx, user)
+		user.Events = append(user.Events, applied)
+	}
+	return nil
+}
+
+func (m *MemoryUserStorage) EventHistory(ctx context.Context, userID int64) ([]UserEventRecord, error) {
+	ctx, span := tracer.Open(ctx, tracer.Named("MemoryUserStorage::EventHistory"))
+	defer span.Close()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var history []UserEventRecord
+	for _, record := range m.events[userID] {
+		event, err := decodeUserEvent(ctx, record.Type, record.Version, record.Event)
+		if err != nil {
+			// испорченные события разбирает карантин
+			continue
+		}
+		history = append(history, UserEventRecord{
+			User:      userID,
+			Timestamp: record.Timestamp,
+			ID:        record.ID,
+			Type:      record.Type,
+			Version:   eventVersionOf(event),
+			Event:     event,
+		})
+	}
+	return history, nil
+}
+
+func (m *MemoryUserStorage) ListDeadLetters(ctx context.Context, limit int) ([]DeadLetter, error) {
+	_, span := tracer.Open(ctx, tracer.Named("MemoryUserStorage::ListDeadLetters"))
+	defer span.Close()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var letters []DeadLetter
+	for _, dl := range m.deadLetters {
+		letters = append(letters, dl)
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i].DetectedAt.After(letters[j].DetectedAt) })
+	if len(letters) > limit {
+		letters = letters[:limit]
+	}
+	return letters, nil
+}
+
+func (m *MemoryUserStorage) GetDeadLetter(ctx context.Context, eventID string) (*DeadLetter, error) {
+	_, span := tracer.Open(ctx, tracer.Named("MemoryUserStorage::GetDeadLetter"))
+	defer span.Close()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dl, ok := m.deadLetters[eventID]
+	if !ok {
+		return nil, fmt.Errorf("событие %s в карантине: %w", eventID, ErrNotFound)
+	}
+	return &dl, nil
+}
+
+func (m *MemoryUserStorage) FixDeadLetter(ctx context.Context, eventID string, eventType string, payload []byte) error {
+	ctx, span := tracer.Open(ctx, tracer.Named("MemoryUserStorage::FixDeadLetter"))
+	defer span.Close()
+	version, err := validateFixedEvent(ctx, eventType, payload)
+	if err != nil {
+		return err
+	}
+	return m.resolveDeadLetter(eventID, func(record *memoryEventRecord) bool {
+		record.Type = eventType
+		record.Version = version
+		record.Event = payload
+		return true
+	})
+}
+
+func (m *MemoryUserStorage) DropDeadLetter(ctx context.Context, eventID string) error {
+	_, span := tracer.Open(ctx, tracer.Named("MemoryUserStorage::DropDeadLetter"))
+	defer span.Close()
+	return m.resolveDeadLetter(eventID, func(*memoryEventRecord) bool { return false })
+}
+
+// resolveDeadLetter применяет keep к событию из карантина: true оставляет изменённое событие, false удаляет его
+func (m *MemoryUserStorage) resolveDeadLetter(eventID string, keep func(*memoryEventRecord) bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dl, ok := m.deadLetters[eventID]
+	if !ok {
+		return fmt.Errorf("событие %s в карантине: %w", eventID, ErrNotFound)
+	}
+	events := m.events[dl.User]
+	for i := range events {
+		if events[i].ID != eventID {
+			continue
+		}
+		if !keep(&events[i]) {
+			events = append(events[:i], events[i+1:]...)
+		}
+		break
+	}
+	m.events[dl.User] = events
+	delete(m.deadLetters, eventID)
+	return nil
+}
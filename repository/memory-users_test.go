@@ -0,0 +1,79 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryUserStorageNotFound(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryUserStorage()
+	// события без строки пользователя не делают его существующим, как и в YDB
+	require.NoError(t, storage.LogEvent(ctx, 1, &RegisterCarLicensePlateEvent{LicensePlate: "А001АА"}))
+	_, err := storage.GetUser(ctx, UserQuery{ID: 1})
+	assert.True(t, errors.Is(err, ErrNotFound))
+	_, err = storage.FindByVehicleLicensePlate(ctx, "А001АА")
+	assert.True(t, errors.Is(err, ErrNotFound))
+}
+
+func TestMemoryUserStorageAppliesEventsInOrder(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryUserStorage()
+	clock := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	storage.now = func() time.Time { return clock }
+	storage.UpsertUsername(ctx, 1, "resident")
+
+	clock = clock.Add(time.Minute)
+	require.NoError(t, storage.LogEvent(ctx, 1, &ConfirmRegistrationEvent{WithCode: "CODE"}))
+	// событие с более ранним временем должно примениться первым, несмотря на порядок записи
+	clock = clock.Add(-time.Hour)
+	require.NoError(t, storage.LogEvent(ctx, 1, &StartRegistrationEvent{HouseID: 1, HouseNumber: "1", Apartment: "10", ApproveCode: "CODE"}))
+
+	user, err := storage.GetUser(ctx, UserQuery{Username: "resident"})
+	require.NoError(t, err)
+	assert.True(t, user.IsApprovedResident)
+	assert.Len(t, user.Events, 2)
+	history, err := storage.EventHistory(ctx, 1)
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	assert.IsType(t, &StartRegistrationEvent{}, history[0].Event)
+
+	found, err := storage.FindByAppartment(ctx, "1", "10")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), found.ID)
+
+	require.NoError(t, storage.ClearEvents(ctx, 1))
+	user, err = storage.GetUser(ctx, UserQuery{ID: 1})
+	require.NoError(t, err)
+	assert.False(t, user.IsApprovedResident)
+}
+
+func TestMemoryUserStorageStreamConflict(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryUserStorage()
+	storage.UpsertUsername(ctx, 1, "resident")
+	require.NoError(t, storage.LogEvent(ctx, 1, &StartRegistrationEvent{HouseID: 1, HouseNumber: "1", Apartment: "10", ApproveCode: "CODE"}))
+
+	// два регистратора прочитали одну и ту же версию заявки
+	user, err := storage.GetUser(ctx, UserQuery{ID: 1})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), user.StreamVersion)
+
+	require.NoError(t, storage.AppendEvent(ctx, 1, user.StreamVersion, &ConfirmRegistrationEvent{WithCode: "квитанция"}))
+	err = storage.AppendEvent(ctx, 1, user.StreamVersion, &FailRegistrationEvent{WithCode: "квитанция"})
+	require.ErrorIs(t, err, ErrStreamConflict)
+	var conflict *StreamConflictError
+	require.ErrorAs(t, err, &conflict)
+	assert.Equal(t, int64(1), conflict.Expected)
+	assert.Equal(t, int64(2), conflict.Actual)
+
+	user, err = storage.GetUser(ctx, UserQuery{ID: 1})
+	require.NoError(t, err)
+	assert.True(t, user.IsApprovedResident)
+	assert.Equal(t, int64(2), user.StreamVersion)
+}
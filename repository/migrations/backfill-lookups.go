@@ -0,0 +1,73 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"mikhailche/botcomod/lib/tracer.v2"
+	"mikhailche/botcomod/repository"
+
+	"github.com/ydb-platform/ydb-go-sdk/v3/table"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/result/named"
+	"go.uber.org/zap"
+)
+
+// Запросы заполнения справочников зафиксированы на схеме миграции 3: читаем только колонки user_event
+// из миграции 1 и не идём через хранилище, которое со временем читает колонки более поздних миграций.
+
+const selectLookupsBackfillEvents = `SELECT user, timestamp, id, type, event FROM user_event ORDER BY user, timestamp, id;`
+
+const upsertLookupsBackfill = `
+DECLARE $plates AS List<Struct<plate:Utf8, user_id:Int64>>;
+DECLARE $apartments AS List<Struct<house:Utf8, apartment:Utf8, user_id:Int64>>;
+
+DELETE FROM user_by_plate;
+DELETE FROM user_by_apartment;
+UPSERT INTO user_by_plate SELECT * FROM AS_TABLE($plates);
+UPSERT INTO user_by_apartment SELECT * FROM AS_TABLE($apartments);
+`
+
+// backfillLookups заполняет user_by_plate и user_by_apartment из user_event
+func backfillLookups(ctx context.Context, env Env) error {
+	ctx, span := tracer.Open(ctx, tracer.Named("migrations::backfillLookups"))
+	defer span.Close()
+	var events []repository.RawUserEvent
+	if err := env.DB.Table().Do(ctx, func(ctx context.Context, s table.Session) error {
+		events = nil
+		_, res, err := s.Execute(ctx, table.DefaultTxControl(), selectLookupsBackfillEvents, table.NewQueryParameters())
+		if err != nil {
+			return fmt.Errorf("SELECT user_event: %w", err)
+		}
+		defer res.Close()
+		if !res.NextResultSet(ctx) {
+			return fmt.Errorf("не нашел result set в user_event")
+		}
+		for res.NextRow() {
+			var e repository.RawUserEvent
+			if err := res.ScanNamed(
+				named.OptionalWithDefault("user", &e.User),
+				named.OptionalWithDefault("timestamp", &e.Timestamp),
+				named.OptionalWithDefault("id", &e.ID),
+				named.OptionalWithDefault("type", &e.Type),
+				named.OptionalWithDefault("event", &e.Event),
+			); err != nil {
+				return fmt.Errorf("скан user_event: %w", err)
+			}
+			events = append(events, e)
+		}
+		return res.Err()
+	}, table.WithIdempotent()); err != nil {
+		return err
+	}
+	params, skipped := repository.LookupsBackfillParams(ctx, events)
+	if skipped > 0 {
+		// в карантин их отправит хранилище при первом чтении, таблицы для карантина на этой версии схемы ещё нет
+		env.Log.Warn("Пропустил недекодируемые события при заполнении справочников", zap.Int("skipped", skipped))
+	}
+	env.Log.Info("Заполняю справочники", zap.Int("events", len(events)))
+	return env.DB.Table().Do(ctx, func(ctx context.Context, s table.Session) error {
+		if _, _, err := s.Execute(ctx, table.DefaultTxControl(), upsertLookupsBackfill, params); err != nil {
+			return fmt.Errorf("заполнение справочников: %w", err)
+		}
+		return nil
+	}, table.WithIdempotent())
+}
@@ -0,0 +1,217 @@
+// Package migrations версионированные миграции схемы YDB.
+// Применённые версии хранятся в таблице schema_migrations, каждая миграция применяется один раз.
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"mikhailche/botcomod/lib/tracer.v2"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/ydb-platform/ydb-go-sdk/v3"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/options"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/result/named"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/types"
+	"go.uber.org/zap"
+)
+
+const migrationsTable = "schema_migrations"
+
+type Migration struct {
+	Version uint32
+	Name    string
+	Steps   []Step
+}
+
+// MigrationStatus состояние миграции в базе
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+func (s MigrationStatus) Applied() bool {
+	return s.AppliedAt != nil
+}
+
+type Migrator struct {
+	env        Env
+	migrations []Migration
+}
+
+func NewMigrator(db *ydb.Driver, log *zap.Logger, migrations []Migration) (*Migrator, error) {
+	if err := validate(migrations); err != nil {
+		return nil, err
+	}
+	sorted := append([]Migration(nil), migrations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+	return &Migrator{env: Env{DB: db, Log: log}, migrations: sorted}, nil
+}
+
+func validate(migrations []Migration) error {
+	seen := make(map[uint32]string)
+	for _, m := range migrations {
+		if m.Version == 0 {
+			return fmt.Errorf("миграция %q: версия должна быть больше нуля", m.Name)
+		}
+		if other, ok := seen[m.Version]; ok {
+			return fmt.Errorf("миграции %q и %q с одинаковой версией %d", other, m.Name, m.Version)
+		}
+		seen[m.Version] = m.Name
+		if len(m.Steps) == 0 {
+			return fmt.Errorf("миграция %d %q без шагов", m.Version, m.Name)
+		}
+	}
+	return nil
+}
+
+// Status возвращает все известные миграции с отметкой о применении
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	ctx, span := tracer.Open(ctx, tracer.Named("Migrator::Status"))
+	defer span.Close()
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var statuses []MigrationStatus
+	for _, migration := range m.migrations {
+		status := MigrationStatus{Migration: migration}
+		if at, ok := applied[migration.Version]; ok {
+			at := at
+			status.AppliedAt = &at
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// Pending возвращает ещё не применённые миграции
+func (m *Migrator) Pending(ctx context.Context) ([]Migration, error) {
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	for _, status := range statuses {
+		if !status.Applied() {
+			pending = append(pending, status.Migration)
+		}
+	}
+	return pending, nil
+}
+
+// Up применяет все неприменённые миграции по порядку и останавливается на первой ошибке.
+// На пустой базе сначала создаётся таблица schema_migrations.
+func (m *Migrator) Up(ctx context.Context) error {
+	ctx, span := tracer.Open(ctx, tracer.Named("Migrator::Up"))
+	defer span.Close()
+	if err := m.bootstrap(ctx); err != nil {
+		return err
+	}
+	pending, err := m.Pending(ctx)
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		m.env.Log.Info("Схема актуальна, применять нечего")
+		return nil
+	}
+	for _, migration := range pending {
+		if err := m.apply(ctx, migration); err != nil {
+			return fmt.Errorf("миграция %d %q: %w", migration.Version, migration.Name, err)
+		}
+	}
+	return nil
+}
+
+func (m *Migrator) apply(ctx context.Context, migration Migration) error {
+	ctx, span := tracer.Open(ctx, tracer.Named(fmt.Sprintf("Migrator::apply::%d", migration.Version)))
+	defer span.Close()
+	log := m.env.Log.With(zap.Uint32("version", migration.Version), zap.String("name", migration.Name))
+	log.Info("Применяю миграцию")
+	for _, step := range migration.Steps {
+		log.Info("Шаг миграции", zap.Stringer("step", step))
+		if err := m.env.DB.Table().Do(ctx, func(ctx context.Context, s table.Session) error {
+			return step.Apply(ctx, m.env, s)
+		}, table.WithIdempotent()); err != nil {
+			return fmt.Errorf("шаг %s: %w", step, err)
+		}
+	}
+	return m.env.DB.Table().Do(ctx, func(ctx context.Context, s table.Session) error {
+		_, _, err := s.Execute(ctx, table.DefaultTxControl(),
+			`DECLARE $version AS Uint32;
+DECLARE $name AS Utf8;
+DECLARE $applied_at AS Timestamp;
+UPSERT INTO schema_migrations (version, name, applied_at) VALUES ($version, $name, $applied_at);`,
+			table.NewQueryParameters(
+				table.ValueParam("$version", types.Uint32Value(migration.Version)),
+				table.ValueParam("$name", types.UTF8Value(migration.Name)),
+				table.ValueParam("$applied_at", types.TimestampValueFromTime(time.Now())),
+			),
+		)
+		if err != nil {
+			return fmt.Errorf("UPSERT INTO schema_migrations: %w", err)
+		}
+		return nil
+	}, table.WithIdempotent())
+}
+
+func (m *Migrator) bootstrap(ctx context.Context) error {
+	ctx, span := tracer.Open(ctx, tracer.Named("Migrator::bootstrap"))
+	defer span.Close()
+	return m.env.DB.Table().Do(ctx, func(ctx context.Context, s table.Session) error {
+		exists, err := tableExists(ctx, m.env, s, migrationsTable)
+		if err != nil || exists {
+			return err
+		}
+		m.env.Log.Info("Создаю таблицу миграций")
+		return s.CreateTable(ctx, path.Join(m.env.DB.Name(), migrationsTable),
+			options.WithColumn("version", types.Optional(types.TypeUint32)),
+			options.WithColumn("name", types.Optional(types.TypeUTF8)),
+			options.WithColumn("applied_at", types.Optional(types.TypeTimestamp)),
+			options.WithPrimaryKeyColumn("version"),
+		)
+	})
+}
+
+// applied читает применённые версии. Отсутствие таблицы schema_migrations означает пустую базу.
+func (m *Migrator) applied(ctx context.Context) (map[uint32]time.Time, error) {
+	ctx, span := tracer.Open(ctx, tracer.Named("Migrator::applied"))
+	defer span.Close()
+	applied := make(map[uint32]time.Time)
+	err := m.env.DB.Table().Do(ctx, func(ctx context.Context, s table.Session) error {
+		exists, err := tableExists(ctx, m.env, s, migrationsTable)
+		if err != nil || !exists {
+			return err
+		}
+		_, res, err := s.Execute(ctx, table.DefaultTxControl(),
+			`SELECT version, applied_at FROM schema_migrations;`,
+			table.NewQueryParameters(),
+		)
+		if err != nil {
+			return fmt.Errorf("SELECT schema_migrations: %w", err)
+		}
+		defer res.Close()
+		if !res.NextResultSet(ctx) {
+			return fmt.Errorf("не нашел result set в schema_migrations")
+		}
+		for res.NextRow() {
+			var version uint32
+			var at time.Time
+			if err := res.ScanNamed(
+				named.OptionalWithDefault("version", &version),
+				named.OptionalWithDefault("applied_at", &at),
+			); err != nil {
+				return fmt.Errorf("скан schema_migrations: %w", err)
+			}
+			applied[version] = at
+		}
+		return res.Err()
+	}, table.WithIdempotent())
+	if err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
@@ -0,0 +1,83 @@
+package migrations
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/types"
+)
+
+func TestAllMigrationsAreValid(t *testing.T) {
+	require.NoError(t, validate(All))
+	for i := 1; i < len(All); i++ {
+		assert.Greater(t, All[i].Version, All[i-1].Version, "миграции должны идти по возрастанию версий")
+	}
+}
+
+func TestValidateRejectsDuplicateVersions(t *testing.T) {
+	step := AddColumns{Table: "t", Columns: []Column{{"c", types.TypeBool}}}
+	err := validate([]Migration{
+		{Version: 1, Name: "a", Steps: []Step{step}},
+		{Version: 1, Name: "b", Steps: []Step{step}},
+	})
+	assert.Error(t, err)
+}
+
+func TestStepString(t *testing.T) {
+	step := CreateTable{
+		Table:      "t",
+		Columns:    []Column{{"id", types.Optional(types.TypeInt64)}, {"name", types.TypeUTF8}},
+		PrimaryKey: []string{"id"},
+	}
+	assert.Equal(t, "CREATE TABLE IF NOT EXISTS `t` (id Optional<Int64>, name Utf8, PRIMARY KEY (id))", step.String())
+}
+
+// TestRunFuncStepsMatchSchemaOfTheirVersion проходит миграции с 1 по N, собирая схему из DDL-шагов,
+// и проверяет, что каждый RunFunc читает и пишет только то, что уже есть на момент его миграции
+func TestRunFuncStepsMatchSchemaOfTheirVersion(t *testing.T) {
+	schema := make(map[string]map[string]bool)
+	for _, migration := range All {
+		for _, step := range migration.Steps {
+			switch step := step.(type) {
+			case CreateTable:
+				columns := make(map[string]bool)
+				for _, column := range step.Columns {
+					columns[column.Name] = true
+				}
+				schema[step.Table] = columns
+			case AddColumns:
+				require.Contains(t, schema, step.Table, "миграция %d", migration.Version)
+				for _, column := range step.Columns {
+					schema[step.Table][column.Name] = true
+				}
+			case AddIndex:
+				require.Contains(t, schema, step.Table, "миграция %d", migration.Version)
+			case RunFunc:
+				require.NotEmpty(t, step.Reads, "миграция %d: шаг %s должен перечислить, что читает", migration.Version, step)
+				for tableName, columns := range step.Reads {
+					require.Contains(t, schema, tableName, "миграция %d читает таблицу из будущих миграций", migration.Version)
+					for _, column := range columns {
+						assert.True(t, schema[tableName][column], "миграция %d читает %s.%s, которой ещё нет", migration.Version, tableName, column)
+					}
+				}
+				for _, tableName := range step.Writes {
+					assert.Contains(t, schema, tableName, "миграция %d пишет в таблицу из будущих миграций", migration.Version)
+				}
+			}
+		}
+	}
+}
+
+func TestLookupsBackfillReadsDeclaredColumns(t *testing.T) {
+	var reads map[string][]string
+	for _, step := range All[2].Steps {
+		if run, ok := step.(RunFunc); ok {
+			reads = run.Reads
+		}
+	}
+	require.Equal(t, uint32(3), All[2].Version)
+	selected := strings.TrimPrefix(strings.Split(selectLookupsBackfillEvents, " FROM ")[0], "SELECT ")
+	assert.Equal(t, reads["user_event"], strings.Split(selected, ", "), "запрос заполнения должен читать ровно объявленные колонки")
+}
@@ -0,0 +1,215 @@
+package migrations
+
+import (
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/types"
+)
+
+func optional(t types.Type) types.Type {
+	return types.Optional(t)
+}
+
+// All миграции схемы в порядке применения. Уже выпущенные миграции не меняем, только добавляем новые в конец.
+var All = []Migration{
+	{
+		Version: 1,
+		Name:    "initial schema",
+		Steps: []Step{
+			CreateTable{
+				Table: "house",
+				Columns: []Column{
+					{"id", types.TypeUint64},
+					{"number", optional(types.TypeString)},
+					{"construction", optional(types.TypeString)},
+					{"rooms_min", optional(types.TypeInt16)},
+					{"rooms_max", optional(types.TypeInt16)},
+				},
+				PrimaryKey: []string{"id"},
+			},
+			CreateTable{
+				Table: "groupChat",
+				Columns: []Column{
+					{"group", types.TypeString},
+					{"name", types.TypeString},
+					{"link", optional(types.TypeString)},
+					{"order", optional(types.TypeInt64)},
+					{"telegram_chat_id", optional(types.TypeInt64)},
+					{"telegram_chat_title", optional(types.TypeUTF8)},
+					{"telegram_chat_type", optional(types.TypeUTF8)},
+				},
+				PrimaryKey: []string{"group", "name"},
+			},
+			CreateTable{
+				Table: "user",
+				Columns: []Column{
+					{"id", optional(types.TypeInt64)},
+					{"username", optional(types.TypeString)},
+					{"appartments", optional(types.TypeJSON)},
+					{"cars", optional(types.TypeJSON)},
+					{"is_approved_resident", optional(types.TypeBool)},
+				},
+				PrimaryKey: []string{"id"},
+			},
+			CreateTable{
+				Table: "user_event",
+				Columns: []Column{
+					{"user", optional(types.TypeInt64)},
+					{"timestamp", optional(types.TypeTimestamp)},
+					{"id", optional(types.TypeString)},
+					{"type", optional(types.TypeString)},
+					{"event", optional(types.TypeJSONDocument)},
+				},
+				PrimaryKey: []string{"user", "timestamp", "id"},
+			},
+			CreateTable{
+				Table: "updates-log",
+				Columns: []Column{
+					{"timestamp", optional(types.TypeTimestamp)},
+					{"id", optional(types.TypeUint64)},
+					{"update", optional(types.TypeJSONDocument)},
+				},
+				PrimaryKey: []string{"id"},
+			},
+			CreateTable{
+				Table: "telegram_chat",
+				Columns: []Column{
+					{"id", optional(types.TypeInt64)},
+					{"type", optional(types.TypeUTF8)},
+					{"first_name", optional(types.TypeUTF8)},
+					{"last_name", optional(types.TypeUTF8)},
+					{"username", optional(types.TypeUTF8)},
+					{"title", optional(types.TypeUTF8)},
+				},
+				PrimaryKey: []string{"id"},
+			},
+			CreateTable{
+				Table: "telegram_chat_to_user",
+				Columns: []Column{
+					{"user_id", optional(types.TypeInt64)},
+					{"chat_id", optional(types.TypeInt64)},
+				},
+				PrimaryKey: []string{"user_id", "chat_id"},
+			},
+		},
+	},
+	{
+		Version: 2,
+		Name:    "groupChat anti_obscene",
+		Steps: []Step{
+			AddColumns{
+				Table:   "groupChat",
+				Columns: []Column{{"anti_obscene", optional(types.TypeBool)}},
+			},
+		},
+	},
+	{
+		Version: 3,
+		Name:    "resident lookups",
+		Steps: []Step{
+			CreateTable{
+				Table: "user_by_plate",
+				Columns: []Column{
+					{"plate", optional(types.TypeUTF8)},
+					{"user_id", optional(types.TypeInt64)},
+				},
+				PrimaryKey: []string{"plate", "user_id"},
+			},
+			CreateTable{
+				Table: "user_by_apartment",
+				Columns: []Column{
+					{"house", optional(types.TypeUTF8)},
+					{"apartment", optional(types.TypeUTF8)},
+					{"user_id", optional(types.TypeInt64)},
+				},
+				PrimaryKey: []string{"house", "apartment", "user_id"},
+			},
+			RunFunc{
+				Description: "заполнение user_by_plate и user_by_apartment из user_event",
+				Reads:       map[string][]string{"user_event": {"user", "timestamp", "id", "type", "event"}},
+				Writes:      []string{"user_by_plate", "user_by_apartment"},
+				Fn:          backfillLookups,
+			},
+		},
+	},
+	{
+		Version: 4,
+		Name:    "user projection snapshots",
+		Steps: []Step{
+			CreateTable{
+				Table: "user_snapshot",
+				Columns: []Column{
+					{"user_id", optional(types.TypeInt64)},
+					{"projection_version", optional(types.TypeUTF8)},
+					{"event_timestamp", optional(types.TypeTimestamp)},
+					{"event_id", optional(types.TypeString)},
+					{"state", optional(types.TypeJSONDocument)},
+					{"updated_at", optional(types.TypeTimestamp)},
+				},
+				PrimaryKey: []string{"user_id"},
+			},
+		},
+	},
+	{
+		Version: 5,
+		Name:    "user_event schema version",
+		Steps: []Step{
+			AddColumns{
+				Table:   "user_event",
+				Columns: []Column{{"version", optional(types.TypeUint32)}},
+			},
+		},
+	},
+	{
+		Version: 6,
+		Name:    "user_event dead letters",
+		Steps: []Step{
+			CreateTable{
+				Table: "user_event_dead_letter",
+				Columns: []Column{
+					{"user", optional(types.TypeInt64)},
+					{"timestamp", optional(types.TypeTimestamp)},
+					{"id", optional(types.TypeString)},
+					{"type", optional(types.TypeString)},
+					{"version", optional(types.TypeUint32)},
+					{"event", optional(types.TypeString)},
+					{"reason", optional(types.TypeUTF8)},
+					{"detected_at", optional(types.TypeTimestamp)},
+				},
+				PrimaryKey: []string{"user", "timestamp", "id"},
+			},
+		},
+	},
+	{
+		Version: 7,
+		Name:    "user_snapshot stream version",
+		Steps: []Step{
+			AddColumns{
+				Table:   "user_snapshot",
+				Columns: []Column{{"stream_version", optional(types.TypeInt64)}},
+			},
+		},
+	},
+	{
+		Version: 8,
+		Name:    "processed updates ledger",
+		Steps: []Step{
+			CreateTable{
+				Table: "processed_update",
+				Columns: []Column{
+					{"update_id", optional(types.TypeUint64)},
+					{"received_at", optional(types.TypeTimestamp)},
+					{"finished_at", optional(types.TypeTimestamp)},
+					{"status", optional(types.TypeUTF8)},
+					{"error", optional(types.TypeUTF8)},
+				},
+				PrimaryKey: []string{"update_id"},
+			},
+		},
+	},
+	{
+		Version: 9,
+		Name:    "updates-log time index",
+		Steps: []Step{
+			AddIndex{Table: "updates-log", Index: "updates_log_by_time", Columns: []string{"timestamp"}},
+		},
+	},
+}
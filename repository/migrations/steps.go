@@ -0,0 +1,181 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"mikhailche/botcomod/lib/tracer.v2"
+	"path"
+	"strings"
+
+	"github.com/ydb-platform/ydb-go-sdk/v3"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/options"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/types"
+	"go.uber.org/zap"
+)
+
+// Env окружение, в котором выполняется шаг миграции
+type Env struct {
+	DB  *ydb.Driver
+	Log *zap.Logger
+}
+
+// Step шаг миграции. Шаги должны быть идемпотентными: DDL в YDB не транзакционный,
+// и упавшую на середине миграцию запускают заново целиком.
+type Step interface {
+	Apply(ctx context.Context, env Env, s table.Session) error
+	String() string
+}
+
+type Column struct {
+	Name string
+	Type types.Type
+}
+
+func (c Column) String() string {
+	return c.Name + " " + c.Type.Yql()
+}
+
+// CreateTable создаёт таблицу, если её ещё нет. Существующая таблица не проверяется и не меняется,
+// так миграции можно накатить на базу, где таблицы когда-то создавали руками.
+type CreateTable struct {
+	Table      string
+	Columns    []Column
+	PrimaryKey []string
+}
+
+func (c CreateTable) Apply(ctx context.Context, env Env, s table.Session) error {
+	ctx, span := tracer.Open(ctx, tracer.Named("CreateTable::"+c.Table))
+	defer span.Close()
+	exists, err := tableExists(ctx, env, s, c.Table)
+	if err != nil {
+		return err
+	}
+	if exists {
+		env.Log.Info("Таблица уже существует", zap.String("table", c.Table))
+		return nil
+	}
+	var opts []options.CreateTableOption
+	for _, column := range c.Columns {
+		opts = append(opts, options.WithColumn(column.Name, column.Type))
+	}
+	opts = append(opts, options.WithPrimaryKeyColumn(c.PrimaryKey...))
+	if err := s.CreateTable(ctx, path.Join(env.DB.Name(), c.Table), opts...); err != nil {
+		return fmt.Errorf("создание таблицы %s: %w", c.Table, err)
+	}
+	return nil
+}
+
+func (c CreateTable) String() string {
+	var columns []string
+	for _, column := range c.Columns {
+		columns = append(columns, column.String())
+	}
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS `%s` (%s, PRIMARY KEY (%s))",
+		c.Table, strings.Join(columns, ", "), strings.Join(c.PrimaryKey, ", "))
+}
+
+// AddColumns добавляет в таблицу недостающие колонки
+type AddColumns struct {
+	Table   string
+	Columns []Column
+}
+
+func (a AddColumns) Apply(ctx context.Context, env Env, s table.Session) error {
+	ctx, span := tracer.Open(ctx, tracer.Named("AddColumns::"+a.Table))
+	defer span.Close()
+	desc, err := s.DescribeTable(ctx, path.Join(env.DB.Name(), a.Table))
+	if err != nil {
+		return fmt.Errorf("описание таблицы %s: %w", a.Table, err)
+	}
+	existing := make(map[string]bool)
+	for _, column := range desc.Columns {
+		existing[column.Name] = true
+	}
+	var opts []options.AlterTableOption
+	for _, column := range a.Columns {
+		if existing[column.Name] {
+			continue
+		}
+		opts = append(opts, options.WithAddColumn(column.Name, column.Type))
+	}
+	if len(opts) == 0 {
+		return nil
+	}
+	if err := s.AlterTable(ctx, path.Join(env.DB.Name(), a.Table), opts...); err != nil {
+		return fmt.Errorf("добавление колонок в %s: %w", a.Table, err)
+	}
+	return nil
+}
+
+func (a AddColumns) String() string {
+	var columns []string
+	for _, column := range a.Columns {
+		columns = append(columns, "ADD COLUMN IF NOT EXISTS "+column.String())
+	}
+	return fmt.Sprintf("ALTER TABLE `%s` %s", a.Table, strings.Join(columns, ", "))
+}
+
+// AddIndex добавляет в таблицу глобальный вторичный индекс, если его ещё нет
+type AddIndex struct {
+	Table   string
+	Index   string
+	Columns []string
+}
+
+func (a AddIndex) Apply(ctx context.Context, env Env, s table.Session) error {
+	ctx, span := tracer.Open(ctx, tracer.Named("AddIndex::"+a.Table))
+	defer span.Close()
+	desc, err := s.DescribeTable(ctx, path.Join(env.DB.Name(), a.Table))
+	if err != nil {
+		return fmt.Errorf("описание таблицы %s: %w", a.Table, err)
+	}
+	for _, index := range desc.Indexes {
+		if index.Name == a.Index {
+			return nil
+		}
+	}
+	if err := s.AlterTable(ctx, path.Join(env.DB.Name(), a.Table),
+		options.WithAddIndex(a.Index,
+			options.WithIndexColumns(a.Columns...),
+			options.WithIndexType(options.GlobalIndex()),
+		),
+	); err != nil {
+		return fmt.Errorf("добавление индекса %s в %s: %w", a.Index, a.Table, err)
+	}
+	return nil
+}
+
+func (a AddIndex) String() string {
+	return fmt.Sprintf("ALTER TABLE `%s` ADD INDEX IF NOT EXISTS %s GLOBAL ON (%s)", a.Table, a.Index, strings.Join(a.Columns, ", "))
+}
+
+// RunFunc шаг с произвольным кодом, например заполнение новой таблицы данными.
+// Код шага не должен зависеть от схемы новее своей миграции: на старой базе он выполняется раньше них.
+type RunFunc struct {
+	Description string
+	// Reads колонки по таблицам, которые читает шаг, Writes таблицы, в которые он пишет.
+	// По ним тест проверяет, что всё это есть в схеме на момент миграции.
+	Reads  map[string][]string
+	Writes []string
+	Fn     func(ctx context.Context, env Env) error
+}
+
+func (r RunFunc) Apply(ctx context.Context, env Env, _ table.Session) error {
+	return r.Fn(ctx, env)
+}
+
+func (r RunFunc) String() string {
+	return "RUN " + r.Description
+}
+
+func tableExists(ctx context.Context, env Env, s table.Session, name string) (bool, error) {
+	_, err := s.DescribeTable(ctx, path.Join(env.DB.Name(), name))
+	if err == nil {
+		return true, nil
+	}
+	if ydb.IsOperationErrorSchemeError(err) || ydb.IsOperationErrorNotFoundError(err) {
+		return false, nil
+	}
+	return false, fmt.Errorf("проверка существования таблицы %s: %w", name, err)
+}
@@ -0,0 +1,87 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"mikhailche/botcomod/lib/tracer.v2"
+	"sort"
+	"time"
+)
+
+// PendingReview квартира или парковочное место пользователя, которые ещё не подтверждены
+type PendingReview struct {
+	User      *User
+	Kind      PropertyKind
+	HouseID   uint64
+	Apartment string
+	Residency Residency
+	// ExpiresAt окончание аренды, пусто - бессрочно
+	ExpiresAt   time.Time
+	RequestedAt time.Time
+	// SubmittedAt когда прислали документ: с этого момента заявка ждёт регистратора.
+	// У заявок до появления отметки о документе - время запроса, у совсем старых может быть пусто.
+	SubmittedAt time.Time
+}
+
+// Age сколько заявка ждёт решения с присланного документа. Для заявок без времени возвращает 0.
+func (p PendingReview) Age(now time.Time) time.Duration {
+	if p.SubmittedAt.IsZero() {
+		return 0
+	}
+	return now.Sub(p.SubmittedAt)
+}
+
+// PendingReviews очередь заявок на проверку, самые старые первыми.
+// В очереди заявки с присланным документом и старые заявки, по которым документ мог прийти до появления отметки о нём.
+// Заявки, ждущие документ от пользователя, в очередь не попадают: регистратору нечего проверять.
+func (r *UserRepository) PendingReviews(ctx context.Context) ([]PendingReview, error) {
+	ctx, span := tracer.Open(ctx, tracer.Named("UserRepository::PendingReviews"))
+	defer span.Close()
+	users, err := r.GetAllUsers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("очередь заявок: %w", err)
+	}
+	var pending []PendingReview
+	for _, user := range users {
+		for _, item := range user.PrivateProperty.Items {
+			since, ok := item.WaitingReviewSince()
+			if !ok {
+				continue
+			}
+			pending = append(pending, PendingReview{
+				User:        user,
+				Kind:        item.Kind,
+				HouseID:     item.HouseID,
+				Apartment:   item.ApartmentNumber,
+				Residency:   item.Residency.orOwner(),
+				ExpiresAt:   item.ExpiresAt,
+				RequestedAt: item.RequestedAt,
+				SubmittedAt: since,
+			})
+		}
+	}
+	sort.SliceStable(pending, func(i, j int) bool {
+		if !pending[i].SubmittedAt.Equal(pending[j].SubmittedAt) {
+			return pending[i].SubmittedAt.Before(pending[j].SubmittedAt)
+		}
+		if pending[i].User.ID != pending[j].User.ID {
+			return pending[i].User.ID < pending[j].User.ID
+		}
+		if pending[i].Kind != pending[j].Kind {
+			return pending[i].Kind < pending[j].Kind
+		}
+		return pending[i].Apartment < pending[j].Apartment
+	})
+	return pending, nil
+}
+
+// Overdue заявки, ждущие дольше sla. Заявка без времени документа просроченной не считается.
+func Overdue(pending []PendingReview, now time.Time, sla time.Duration) []PendingReview {
+	var overdue []PendingReview
+	for _, p := range pending {
+		if !p.SubmittedAt.IsZero() && p.Age(now) > sla {
+			overdue = append(overdue, p)
+		}
+	}
+	return overdue
+}
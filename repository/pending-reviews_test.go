@@ -0,0 +1,94 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestPendingReviews(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryUserStorage()
+	clock := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	storage.now = func() time.Time { return clock }
+	users, err := NewUserRepository(ctx, storage, zap.NewNop(), 0)
+	require.NoError(t, err)
+
+	for id, username := range map[int64]string{1: "old", 2: "new", 3: "approved", 4: "nodocument"} {
+		storage.UpsertUsername(ctx, id, username)
+	}
+	require.NoError(t, storage.LogEvent(ctx, 4, &AddApartmentEventV2{HouseID: 2, Apartment: "6", DocumentRequired: true}))
+	require.NoError(t, storage.LogEvent(ctx, 1, &StartRegistrationEvent{HouseID: 1, HouseNumber: "1", Apartment: "10", DocumentRequired: true}))
+	clock = clock.Add(time.Second)
+	require.NoError(t, storage.LogEvent(ctx, 1, &SubmitRegistrationDocumentEvent{}))
+	clock = clock.Add(30 * time.Hour)
+	require.NoError(t, storage.LogEvent(ctx, 2, &AddApartmentEventV2{HouseID: 2, Apartment: "5", DocumentRequired: true}))
+	clock = clock.Add(time.Second)
+	require.NoError(t, storage.LogEvent(ctx, 2, &SubmitRegistrationDocumentEvent{}))
+	require.NoError(t, storage.LogEvent(ctx, 3, &StartRegistrationEvent{HouseID: 1, HouseNumber: "1", Apartment: "11", DocumentRequired: true}))
+	clock = clock.Add(time.Second)
+	require.NoError(t, storage.LogEvent(ctx, 3, &ConfirmRegistrationEvent{}))
+
+	pending, err := users.PendingReviews(ctx)
+	require.NoError(t, err)
+	require.Len(t, pending, 2, "заявка без документа не ждёт регистратора")
+	assert.Equal(t, int64(1), pending[0].User.ID, "самая старая заявка первой")
+	assert.Equal(t, "10", pending[0].Apartment)
+	assert.Equal(t, time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), pending[0].RequestedAt)
+	assert.Equal(t, uint64(2), pending[1].HouseID)
+
+	now := pending[0].SubmittedAt.Add(31 * time.Hour)
+	assert.Equal(t, 31*time.Hour, pending[0].Age(now))
+	overdue := Overdue(pending, now, 24*time.Hour)
+	require.Len(t, overdue, 1)
+	assert.Equal(t, int64(1), overdue[0].User.ID)
+
+	// после запроса нового фото заявка ждёт пользователя, а не регистратора
+	clock = clock.Add(time.Second)
+	require.NoError(t, storage.LogEvent(ctx, 1, &RequestNewRegistrationPhotoEvent{}))
+	pending, err = users.PendingReviews(ctx)
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	assert.Equal(t, int64(2), pending[0].User.ID)
+	assert.Empty(t, Overdue([]PendingReview{{User: pending[0].User}}, now, time.Hour), "заявка без времени не просрочена")
+}
+
+// TestPendingReviewsKeepsLegacyRequests заявки до появления отметки о документе остаются в очереди:
+// фото по ним могли прислать раньше, и без очереди они потеряются
+func TestPendingReviewsKeepsLegacyRequests(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryUserStorage()
+	clock := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	storage.now = func() time.Time { return clock }
+	users, err := NewUserRepository(ctx, storage, zap.NewNop(), 0)
+	require.NoError(t, err)
+
+	storage.UpsertUsername(ctx, 1, "legacy")
+	storage.UpsertUsername(ctx, 2, "fresh")
+	require.NoError(t, storage.LogEvent(ctx, 1, &StartRegistrationEvent{HouseID: 1, HouseNumber: "1", Apartment: "10"}))
+	clock = clock.Add(time.Hour)
+	require.NoError(t, storage.LogEvent(ctx, 2, &StartRegistrationEvent{HouseID: 1, HouseNumber: "1", Apartment: "11", DocumentRequired: true}))
+	clock = clock.Add(time.Second)
+	require.NoError(t, storage.LogEvent(ctx, 2, &SubmitRegistrationDocumentEvent{}))
+
+	pending, err := users.PendingReviews(ctx)
+	require.NoError(t, err)
+	require.Len(t, pending, 2)
+	assert.Equal(t, int64(1), pending[0].User.ID, "старая заявка ждёт с момента запроса")
+	assert.Equal(t, time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), pending[0].SubmittedAt)
+	overdue := Overdue(pending, pending[0].SubmittedAt.Add(25*time.Hour), 24*time.Hour)
+	require.Len(t, overdue, 1)
+	assert.Equal(t, int64(1), overdue[0].User.ID)
+
+	// после запроса нового фото и старая заявка ждёт документ от пользователя
+	clock = clock.Add(time.Second)
+	require.NoError(t, storage.LogEvent(ctx, 1, &RequestNewRegistrationPhotoEvent{}))
+	pending, err = users.PendingReviews(ctx)
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	assert.Equal(t, int64(2), pending[0].User.ID)
+}
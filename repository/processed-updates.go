@@ -0,0 +1,178 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"mikhailche/botcomod/lib/tracer.v2"
+	"time"
+
+	"github.com/ydb-platform/ydb-go-sdk/v3"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/result/named"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/types"
+	"go.uber.org/zap"
+)
+
+// Статусы обработки обновления в журнале processed_update
+const (
+	UpdateStarted = "started"
+	UpdateDone    = "done"
+	UpdateFailed  = "failed"
+)
+
+// ProcessedUpdate запись журнала обработки обновления. Запись в статусе started без FinishedAt
+// означает, что обработка упала посередине.
+type ProcessedUpdate struct {
+	UpdateID   uint64
+	ReceivedAt time.Time
+	FinishedAt *time.Time
+	Status     string
+	Error      string
+}
+
+// ProcessedUpdateStorage журнал обработанных обновлений по update_id.
+// Защищает от повторной обработки, когда телеграм доставляет обновление ещё раз.
+type ProcessedUpdateStorage interface {
+	// BeginUpdate отмечает начало обработки. Возвращает false, если обновление уже получали.
+	BeginUpdate(ctx context.Context, updateID uint64) (bool, error)
+	// CompleteUpdate отмечает конец обработки. processErr сохраняется как причина ошибки.
+	CompleteUpdate(ctx context.Context, updateID uint64, processErr error) error
+	// ListIncompleteUpdates обновления, обработка которых началась раньше before и не завершилась
+	ListIncompleteUpdates(ctx context.Context, before time.Time, limit uint64) ([]ProcessedUpdate, error)
+	// PurgeBefore удаляет записи об обновлениях, полученных раньше before
+	PurgeBefore(ctx context.Context, before time.Time) (uint64, error)
+}
+
+type YDBProcessedUpdates struct {
+	db  *ydb.Driver
+	log *zap.Logger
+}
+
+func NewYDBProcessedUpdates(db *ydb.Driver, log *zap.Logger) *YDBProcessedUpdates {
+	return &YDBProcessedUpdates{db: db, log: log}
+}
+
+const beginUpdateQuery = `
+DECLARE $id AS Uint64;
+DECLARE $received_at AS Timestamp;
+DECLARE $status AS Utf8;
+
+$seen = (SELECT COUNT(*) FROM processed_update WHERE update_id = $id);
+$seen_received_at = (SELECT received_at FROM processed_update WHERE update_id = $id);
+
+UPSERT INTO processed_update (update_id, received_at, status)
+SELECT $id AS update_id, $received_at AS received_at, $status AS status
+FROM AS_TABLE(AsList(AsStruct(1 AS one)))
+WHERE $seen = 0;
+
+SELECT $seen AS seen, $seen_received_at AS received_at;
+`
+
+// startedByThisCall запись в журнале сделана этим же вызовом BeginUpdate: запрос повторяется при потере ответа
+// от YDB после коммита, и повтор видит свою же запись. Её узнаём по времени получения, которое запрос записал.
+func startedByThisCall(seen uint64, seenReceivedAt, receivedAt time.Time) bool {
+	return seen == 0 || seenReceivedAt.Equal(receivedAt)
+}
+
+func (p *YDBProcessedUpdates) BeginUpdate(ctx context.Context, updateID uint64) (bool, error) {
+	ctx, span := tracer.Open(ctx, tracer.Named("YDBProcessedUpdates::BeginUpdate"))
+	defer span.Close()
+	var seen uint64
+	var seenReceivedAt time.Time
+	// время одно на все повторы запроса: по нему повтор узнает свою запись, YDB хранит его с точностью до микросекунд
+	receivedAt := time.Now().Truncate(time.Microsecond)
+	err := p.db.Table().Do(ctx, func(ctx context.Context, s table.Session) error {
+		_, res, err := s.Execute(ctx, table.SerializableReadWriteTxControl(table.CommitTx()), beginUpdateQuery,
+			table.NewQueryParameters(
+				table.ValueParam("$id", types.Uint64Value(updateID)),
+				table.ValueParam("$received_at", types.TimestampValueFromTime(receivedAt)),
+				table.ValueParam("$status", types.UTF8Value(UpdateStarted)),
+			),
+		)
+		if err != nil {
+			return fmt.Errorf("processed_update [%d]: %w", updateID, err)
+		}
+		defer res.Close()
+		if !res.NextResultSet(ctx) || !res.NextRow() {
+			return fmt.Errorf("processed_update [%d]: нет результата: %w", updateID, res.Err())
+		}
+		return res.ScanNamed(
+			named.OptionalWithDefault("seen", &seen),
+			named.OptionalWithDefault("received_at", &seenReceivedAt),
+		)
+	}, table.WithIdempotent())
+	if err != nil {
+		return false, err
+	}
+	return startedByThisCall(seen, seenReceivedAt, receivedAt), nil
+}
+
+func (p *YDBProcessedUpdates) CompleteUpdate(ctx context.Context, updateID uint64, processErr error) error {
+	ctx, span := tracer.Open(ctx, tracer.Named("YDBProcessedUpdates::CompleteUpdate"))
+	defer span.Close()
+	status, reason := UpdateDone, ""
+	if processErr != nil {
+		status, reason = UpdateFailed, processErr.Error()
+	}
+	return p.db.Table().Do(ctx, func(ctx context.Context, s table.Session) error {
+		_, _, err := s.Execute(ctx, table.DefaultTxControl(),
+			`DECLARE $id AS Uint64;
+DECLARE $finished_at AS Timestamp;
+DECLARE $status AS Utf8;
+DECLARE $error AS Utf8;
+UPDATE processed_update SET finished_at = $finished_at, status = $status, error = $error WHERE update_id = $id;`,
+			table.NewQueryParameters(
+				table.ValueParam("$id", types.Uint64Value(updateID)),
+				table.ValueParam("$finished_at", types.TimestampValueFromTime(time.Now())),
+				table.ValueParam("$status", types.UTF8Value(status)),
+				table.ValueParam("$error", types.UTF8Value(reason)),
+			),
+		)
+		if err != nil {
+			return fmt.Errorf("завершение processed_update [%d]: %w", updateID, err)
+		}
+		return nil
+	}, table.WithIdempotent())
+}
+
+func (p *YDBProcessedUpdates) ListIncompleteUpdates(ctx context.Context, before time.Time, limit uint64) ([]ProcessedUpdate, error) {
+	ctx, span := tracer.Open(ctx, tracer.Named("YDBProcessedUpdates::ListIncompleteUpdates"))
+	defer span.Close()
+	var updates []ProcessedUpdate
+	err := p.db.Table().Do(ctx, func(ctx context.Context, s table.Session) error {
+		updates = nil
+		_, res, err := s.Execute(ctx, table.DefaultTxControl(),
+			`DECLARE $status AS Utf8;
+DECLARE $before AS Timestamp;
+DECLARE $limit AS Uint64;
+SELECT update_id, received_at, status FROM processed_update
+WHERE status = $status AND received_at < $before
+ORDER BY update_id DESC LIMIT $limit;`,
+			table.NewQueryParameters(
+				table.ValueParam("$status", types.UTF8Value(UpdateStarted)),
+				table.ValueParam("$before", types.TimestampValueFromTime(before)),
+				table.ValueParam("$limit", types.Uint64Value(limit)),
+			),
+		)
+		if err != nil {
+			return fmt.Errorf("незавершённые обновления: %w", err)
+		}
+		defer res.Close()
+		if !res.NextResultSet(ctx) {
+			return fmt.Errorf("не нашел result set для незавершённых обновлений")
+		}
+		for res.NextRow() {
+			var u ProcessedUpdate
+			if err := res.ScanNamed(
+				named.Required("update_id", &u.UpdateID),
+				named.OptionalWithDefault("received_at", &u.ReceivedAt),
+				named.OptionalWithDefault("status", &u.Status),
+			); err != nil {
+				return fmt.Errorf("скан незавершённого обновления: %w", err)
+			}
+			updates = append(updates, u)
+		}
+		return res.Err()
+	}, table.WithIdempotent())
+	return updates, err
+}
@@ -0,0 +1,59 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryProcessedUpdatesDeduplicates(t *testing.T) {
+	ctx := context.Background()
+	ledger := NewMemoryProcessedUpdates()
+	isNew, err := ledger.BeginUpdate(ctx, 100)
+	require.NoError(t, err)
+	assert.True(t, isNew)
+
+	// повторная доставка, пока первая обработка ещё идёт
+	isNew, err = ledger.BeginUpdate(ctx, 100)
+	require.NoError(t, err)
+	assert.False(t, isNew)
+
+	require.NoError(t, ledger.CompleteUpdate(ctx, 100, errors.New("handler failed")))
+	isNew, err = ledger.BeginUpdate(ctx, 100)
+	require.NoError(t, err)
+	assert.False(t, isNew)
+}
+
+func TestMemoryProcessedUpdatesListsIncomplete(t *testing.T) {
+	ctx := context.Background()
+	ledger := NewMemoryProcessedUpdates()
+	clock := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	ledger.now = func() time.Time { return clock }
+	for _, id := range []uint64{1, 2, 3} {
+		_, err := ledger.BeginUpdate(ctx, id)
+		require.NoError(t, err)
+	}
+	require.NoError(t, ledger.CompleteUpdate(ctx, 2, nil))
+	clock = clock.Add(time.Hour)
+	_, err := ledger.BeginUpdate(ctx, 4)
+	require.NoError(t, err)
+
+	incomplete, err := ledger.ListIncompleteUpdates(ctx, clock.Add(-time.Minute), 10)
+	require.NoError(t, err)
+	var ids []uint64
+	for _, u := range incomplete {
+		ids = append(ids, u.UpdateID)
+	}
+	assert.Equal(t, []uint64{3, 1}, ids)
+}
+
+func TestStartedByThisCall(t *testing.T) {
+	receivedAt := time.Date(2023, 1, 1, 0, 0, 0, 123000, time.UTC)
+	assert.True(t, startedByThisCall(0, time.Time{}, receivedAt), "обновление видим впервые")
+	assert.True(t, startedByThisCall(1, receivedAt, receivedAt), "повтор запроса после потерянного ответа видит свою запись")
+	assert.False(t, startedByThisCall(1, receivedAt.Add(-time.Minute), receivedAt), "повторная доставка телеграмом")
+}
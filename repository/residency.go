@@ -0,0 +1,87 @@
+package repository
+
+import (
+	"slices"
+	"time"
+)
+
+// Residency вид резидентства в квартире или на парковочном месте. Хранится в каждой заявке на собственность.
+type Residency string
+
+const (
+	ResidencyOwner  Residency = "owner"
+	ResidencyTenant Residency = "tenant"
+	ResidencyFamily Residency = "family"
+)
+
+// Residencies все виды резидентства в порядке показа
+var Residencies = []Residency{ResidencyOwner, ResidencyTenant, ResidencyFamily}
+
+// Title вид резидентства для людей
+func (r Residency) Title() string {
+	switch r {
+	case ResidencyOwner:
+		return "собственник"
+	case ResidencyTenant:
+		return "арендатор"
+	case ResidencyFamily:
+		return "член семьи собственника"
+	}
+	return string(r)
+}
+
+// Valid вид резидентства из списка известных
+func (r Residency) Valid() bool {
+	return slices.Contains(Residencies, r)
+}
+
+// Evidence документ, по которому регистраторы проверяют заявку
+func (r Residency) Evidence(kind PropertyKind) string {
+	switch {
+	case r == ResidencyTenant && kind == PropertyParking:
+		return "договор аренды парковочного места"
+	case r == ResidencyTenant:
+		return "договор аренды квартиры"
+	case r == ResidencyFamily:
+		return "квитанция за квартиру на имя собственника и документ о родстве с ним, например свидетельство о браке"
+	case kind == PropertyParking:
+		return "договор или выписка из ЕГРН на парковочное место"
+	}
+	return "квитанция за квартиру или выписка из ЕГРН"
+}
+
+// orOwner заявки до появления видов резидентства подавали собственники
+func (r Residency) orOwner() Residency {
+	if r == "" {
+		return ResidencyOwner
+	}
+	return r
+}
+
+// Expired срок резидентства истёк к моменту now. Без срока не истекает.
+func (ppi tPrivatePropertyItem) Expired(now time.Time) bool {
+	return !ppi.ExpiresAt.IsZero() && !now.Before(ppi.ExpiresAt)
+}
+
+// Residencies действующие на момент now виды резидентства: по подтверждённым заявкам, срок которых не истёк.
+// Резиденты, подтверждённые до заявок на собственность, считаются собственниками.
+func (u *User) Residencies(now time.Time) []Residency {
+	var residencies []Residency
+	var approved bool
+	for _, ppi := range u.PrivateProperty.Items {
+		if !ppi.Approved {
+			continue
+		}
+		approved = true
+		if residency := ppi.Residency.orOwner(); !ppi.Expired(now) && !slices.Contains(residencies, residency) {
+			residencies = append(residencies, residency)
+		}
+	}
+	if !approved && u.IsApprovedResident {
+		return []Residency{ResidencyOwner}
+	}
+	slices.SortFunc(residencies, func(a, b Residency) int {
+		return slices.Index(Residencies, a) - slices.Index(Residencies, b)
+	})
+	return residencies
+}
@@ -0,0 +1,59 @@
+package repository
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestResidenciesLapseWithTenancy(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	user := &User{ID: 42}
+	for _, event := range []UserEvent{
+		&AddApartmentEventV2{HouseID: 1, HouseNumber: "108А", Apartment: "5", Residency: ResidencyTenant, ExpiresAt: now.AddDate(0, 3, 0)},
+		&AdminConfirmedAddApartmentEventV2{HouseID: 1, Apartment: "5"},
+		&AddApartmentEventV2{HouseID: 1, HouseNumber: "108А", Apartment: "9", Kind: PropertyParking, Residency: ResidencyFamily},
+		&AddApartmentEventV2{HouseID: 2, HouseNumber: "108Б", Apartment: "3", Residency: ResidencyFamily},
+	} {
+		event.Apply(ctx, user)
+	}
+	if got, want := user.Residencies(now), []Residency{ResidencyTenant}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("неподтверждённые заявки не дают резидентства: %v, ожидалось %v", got, want)
+	}
+	(&AdminConfirmedAddApartmentEventV2{HouseID: 2, Apartment: "3"}).Apply(ctx, user)
+	if got, want := user.Residencies(now), []Residency{ResidencyTenant, ResidencyFamily}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("резидентства: %v, ожидалось %v", got, want)
+	}
+	if got, want := user.Residencies(now.AddDate(0, 3, 0)), []Residency{ResidencyFamily}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("аренда должна закончиться в срок: %v, ожидалось %v", got, want)
+	}
+	if got := user.ResidentApartments(now.AddDate(0, 3, 0)); len(got) != 1 || got[0].ApartmentNumber != "3" {
+		t.Fatalf("квартира с истёкшей арендой осталась среди квартир резидента: %v", got)
+	}
+}
+
+func TestRegistrarSetsTenancyTerm(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	user := &User{ID: 42}
+	(&AddApartmentEventV2{HouseID: 1, HouseNumber: "108А", Apartment: "5", Residency: ResidencyTenant}).Apply(ctx, user)
+	(&AdminConfirmedAddApartmentEventV2{HouseID: 1, Apartment: "5", ExpiresAt: now.AddDate(0, 6, 0)}).Apply(ctx, user)
+	if item, _ := user.PrivateProperty.Find(PropertyApartment, 1, "5"); !item.Approved || !item.ExpiresAt.Equal(now.AddDate(0, 6, 0)) {
+		t.Fatalf("срок аренды из договора: %#v", item)
+	}
+}
+
+func TestLegacyResidentIsOwner(t *testing.T) {
+	user := &User{ID: 42}
+	for _, event := range []UserEvent{
+		&StartRegistrationEvent{HouseNumber: "108Г", HouseID: 4, Apartment: "3"},
+		&ConfirmRegistrationEvent{WithCode: "квитанция"},
+	} {
+		event.Apply(context.Background(), user)
+	}
+	if got, want := user.Residencies(time.Now()), []Residency{ResidencyOwner}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("резидент старой регистрации: %v, ожидалось %v", got, want)
+	}
+}
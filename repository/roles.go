@@ -0,0 +1,134 @@
+package repository
+
+import (
+	"context"
+	"mikhailche/botcomod/lib/tracer.v2"
+	"slices"
+)
+
+// Role роль пользователя в боте. Выдаётся и отзывается событиями [GrantRoleEvent] и [RevokeRoleEvent].
+type Role string
+
+const (
+	RoleDeveloper         Role = "developer"
+	RoleDistrictModerator Role = "district_moderator"
+	RoleRegistrar         Role = "registrar"
+	RoleChatAdmin         Role = "chat_admin"
+	RoleSecurityGuard     Role = "security_guard"
+)
+
+// Roles все роли в порядке показа
+var Roles = []Role{RoleDeveloper, RoleDistrictModerator, RoleRegistrar, RoleChatAdmin, RoleSecurityGuard}
+
+// Title название роли для людей
+func (r Role) Title() string {
+	switch r {
+	case RoleDeveloper:
+		return "разработчик"
+	case RoleDistrictModerator:
+		return "модератор района"
+	case RoleRegistrar:
+		return "регистратор"
+	case RoleChatAdmin:
+		return "админ чатов"
+	case RoleSecurityGuard:
+		return "охрана"
+	}
+	return string(r)
+}
+
+// Valid роль из списка известных
+func (r Role) Valid() bool {
+	return slices.Contains(Roles, r)
+}
+
+// Permission право на группу обработчиков. Группа объявляет нужное право, роли дают набор прав.
+type Permission string
+
+const (
+	// PermissionManageRoles выдавать и отзывать роли
+	PermissionManageRoles Permission = "manage_roles"
+	// PermissionManageBot служебные команды: настройка бота, конфигурация, вебхук, сообщения пользователям
+	PermissionManageBot Permission = "manage_bot"
+	// PermissionDebugUpdates журнал обновлений, повтор обновлений и журнал обработки. В журнале персональные данные.
+	PermissionDebugUpdates Permission = "debug_updates"
+	// PermissionWhois смотреть данные пользователя
+	PermissionWhois Permission = "whois"
+	// PermissionReviewRegistrations решать по заявкам на регистрацию
+	PermissionReviewRegistrations Permission = "review_registrations"
+	// PermissionManageChats раздел админа чатов
+	PermissionManageChats Permission = "manage_chats"
+	// PermissionRecognizePlates распознавать номера автомобилей на фото
+	PermissionRecognizePlates Permission = "recognize_plates"
+)
+
+var rolePermissions = map[Role][]Permission{
+	RoleDeveloper: {
+		PermissionManageRoles, PermissionManageBot, PermissionDebugUpdates, PermissionWhois,
+		PermissionReviewRegistrations, PermissionManageChats, PermissionRecognizePlates,
+	},
+	RoleDistrictModerator: {PermissionWhois, PermissionReviewRegistrations, PermissionManageChats},
+	RoleRegistrar:         {PermissionReviewRegistrations},
+	RoleChatAdmin:         {PermissionWhois, PermissionManageChats},
+	RoleSecurityGuard:     {PermissionWhois, PermissionRecognizePlates},
+}
+
+// Permits роль даёт право
+func (r Role) Permits(permission Permission) bool {
+	return slices.Contains(rolePermissions[r], permission)
+}
+
+// UserRoles роли пользователя, отсортированы и без повторов
+type UserRoles []Role
+
+func (roles UserRoles) Has(role Role) bool {
+	return slices.Contains(roles, role)
+}
+
+func (roles UserRoles) Permits(permission Permission) bool {
+	for _, role := range roles {
+		if role.Permits(permission) {
+			return true
+		}
+	}
+	return false
+}
+
+// GrantRoleEvent администратор выдал пользователю роль
+type GrantRoleEvent struct {
+	AdminUserID int64
+	Role        Role
+}
+
+// RevokeRoleEvent администратор отозвал у пользователя роль
+type RevokeRoleEvent struct {
+	AdminUserID int64
+	Role        Role
+}
+
+func (e *GrantRoleEvent) Apply(ctx context.Context, u *User) {
+	ctx, span := tracer.Open(ctx)
+	defer span.Close()
+	if u.Roles.Has(e.Role) {
+		return
+	}
+	u.Roles = append(u.Roles, e.Role)
+	slices.Sort(u.Roles)
+}
+
+func (e *RevokeRoleEvent) Apply(ctx context.Context, u *User) {
+	ctx, span := tracer.Open(ctx)
+	defer span.Close()
+	u.Roles = slices.DeleteFunc(u.Roles, func(role Role) bool { return role == e.Role })
+	if len(u.Roles) == 0 {
+		u.Roles = nil
+	}
+}
+
+func (e *GrantRoleEvent) FQDN() string {
+	return "GrantRoleEvent"
+}
+
+func (e *RevokeRoleEvent) FQDN() string {
+	return "RevokeRoleEvent"
+}
@@ -0,0 +1,48 @@
+package repository
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestRoleEvents(t *testing.T) {
+	ctx := context.Background()
+	var user User
+	for _, event := range []UserEvent{
+		&GrantRoleEvent{AdminUserID: 1, Role: RoleSecurityGuard},
+		&GrantRoleEvent{AdminUserID: 1, Role: RoleRegistrar},
+		&GrantRoleEvent{AdminUserID: 2, Role: RoleRegistrar},
+	} {
+		event.Apply(ctx, &user)
+	}
+	if want := (UserRoles{RoleRegistrar, RoleSecurityGuard}); !reflect.DeepEqual(user.Roles, want) {
+		t.Fatalf("roles: want %v, got %v", want, user.Roles)
+	}
+	if !user.Roles.Permits(PermissionReviewRegistrations) || !user.Roles.Permits(PermissionRecognizePlates) {
+		t.Errorf("registrar and guard permissions expected, got roles %v", user.Roles)
+	}
+	if user.Roles.Permits(PermissionManageRoles) {
+		t.Errorf("only developer may manage roles")
+	}
+
+	(&RevokeRoleEvent{AdminUserID: 1, Role: RoleRegistrar}).Apply(ctx, &user)
+	(&RevokeRoleEvent{AdminUserID: 1, Role: RoleSecurityGuard}).Apply(ctx, &user)
+	if user.Roles != nil {
+		t.Fatalf("expected no roles after revoke, got %v", user.Roles)
+	}
+}
+
+func TestEveryRoleHasPermissions(t *testing.T) {
+	for _, role := range Roles {
+		if len(rolePermissions[role]) == 0 {
+			t.Errorf("role %s grants nothing", role)
+		}
+		if role.Title() == string(role) {
+			t.Errorf("role %s has no title", role)
+		}
+	}
+	if Role("admin").Valid() {
+		t.Errorf("unknown role must be invalid")
+	}
+}
@@ -0,0 +1,93 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/mikhailche/telebot"
+	"github.com/ydb-platform/ydb-go-sdk/v3"
+	"go.uber.org/zap"
+)
+
+type HouseStorage interface {
+	GetHouses(ctx context.Context) (THouses, error)
+}
+
+type GroupChatStorage interface {
+	GetGroupChats(ctx context.Context) (TGroupChats, error)
+}
+
+// UpdateLogStorage журнал входящих обновлений телеграма
+type UpdateLogStorage interface {
+	LogUpdate(ctx context.Context, upd map[string]any, rawUpdate string)
+	GetByUpdateId(ctx context.Context, updateID uint64) (*telebot.Update, error)
+	// SearchUpdates поиск по журналу от новых к старым с постраничной выдачей
+	SearchUpdates(ctx context.Context, filter UpdateLogFilter, offset, limit int) ([]LoggedUpdate, bool, error)
+	// Flush дописывает накопленные обновления. Вызывается до ответа на запрос, пока среда не заморозила процесс.
+	Flush(ctx context.Context) error
+	Stats() UpdateLogStats
+	// PurgeBefore удаляет обновления, полученные раньше before, и возвращает их число
+	PurgeBefore(ctx context.Context, before time.Time) (uint64, error)
+}
+
+// TelegramChatStorage известные боту чаты и их участники
+type TelegramChatStorage interface {
+	UpsertTelegramChat(ctx context.Context, chat telebot.Chat) error
+	UpsertTelegramChatToUserMapping(ctx context.Context, chat, user int64) error
+	SelectTelegramChatsByUserID(ctx context.Context, user int64) ([]int64, error)
+}
+
+// Storage набор хранилищ приложения на одном бэкенде
+type Storage struct {
+	Users         UserStorage
+	Houses        HouseStorage
+	GroupChats    GroupChatStorage
+	UpdateLog     UpdateLogStorage
+	TelegramChats TelegramChatStorage
+	Processed     ProcessedUpdateStorage
+}
+
+func NewYDBStorage(ctx context.Context, db *ydb.Driver, log *zap.Logger, updateLogSpillFile string) *Storage {
+	return &Storage{
+		Users:      NewYDBUserStorage(db, log),
+		Houses:     NewHouseRepository(db, log),
+		GroupChats: NewGroupChatRepository(db, log.Named("groupChatRepository")),
+		UpdateLog:  NewUpdateLogger(db, log.Named("updateLogger"), updateLogSpillFile),
+		TelegramChats: &ydbTelegramChatStorage{
+			upsertChat:    UpsertTelegramChat(ctx, db),
+			upsertMapping: UpsertTelegramChatToUserMapping(db),
+			selectChats:   SelectTelegramChatsByUserID(db),
+		},
+		Processed: NewYDBProcessedUpdates(db, log.Named("processedUpdates")),
+	}
+}
+
+// NewMemoryStorage хранилища в памяти процесса для локального запуска и тестов. Данные теряются при остановке.
+func NewMemoryStorage(log *zap.Logger) *Storage {
+	return &Storage{
+		Users:         NewMemoryUserStorage(),
+		Houses:        &MemoryHouseStorage{},
+		GroupChats:    &MemoryGroupChatStorage{},
+		UpdateLog:     NewMemoryUpdateLog(log.Named("updateLogger")),
+		TelegramChats: NewMemoryTelegramChatStorage(),
+		Processed:     NewMemoryProcessedUpdates(),
+	}
+}
+
+type ydbTelegramChatStorage struct {
+	upsertChat    func(ctx context.Context, chat telebot.Chat) error
+	upsertMapping func(ctx context.Context, chat, user int64) error
+	selectChats   func(ctx context.Context, user int64) ([]int64, error)
+}
+
+func (s *ydbTelegramChatStorage) UpsertTelegramChat(ctx context.Context, chat telebot.Chat) error {
+	return s.upsertChat(ctx, chat)
+}
+
+func (s *ydbTelegramChatStorage) UpsertTelegramChatToUserMapping(ctx context.Context, chat, user int64) error {
+	return s.upsertMapping(ctx, chat, user)
+}
+
+func (s *ydbTelegramChatStorage) SelectTelegramChatsByUserID(ctx context.Context, user int64) ([]int64, error) {
+	return s.selectChats(ctx, user)
+}
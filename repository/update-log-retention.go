@@ -0,0 +1,79 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"mikhailche/botcomod/lib/tracer.v2"
+	"time"
+
+	"github.com/ydb-platform/ydb-go-sdk/v3/table"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/result/named"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/types"
+)
+
+// purgeBatchSize сколько строк удаляется одним запросом при очистке
+const purgeBatchSize = 1000
+
+// purgeInBatches удаляет строки пачками запросом query, который возвращает число удалённых строк в колонке deleted.
+// Считать строки запрос должен до DELETE: после него подзапрос вычисляется заново и находит уже следующую пачку
+// или ничего, и очистка останавливается после первой пачки.
+// Пачки нужны, чтобы не упереться в лимиты YDB на размер транзакции.
+func purgeInBatches(ctx context.Context, db ydbDriver, query string, before time.Time) (uint64, error) {
+	var total uint64
+	for {
+		var deleted uint64
+		err := db.Table().Do(ctx, func(ctx context.Context, s table.Session) error {
+			_, res, err := s.Execute(ctx, table.DefaultTxControl(), query,
+				table.NewQueryParameters(
+					table.ValueParam("$before", types.TimestampValueFromTime(before)),
+					table.ValueParam("$limit", types.Uint64Value(purgeBatchSize)),
+				),
+			)
+			if err != nil {
+				return err
+			}
+			defer res.Close()
+			if !res.NextResultSet(ctx) || !res.NextRow() {
+				return fmt.Errorf("нет результата очистки: %w", res.Err())
+			}
+			return res.ScanNamed(named.OptionalWithDefault("deleted", &deleted))
+		}, table.WithIdempotent())
+		if err != nil {
+			return total, err
+		}
+		total += deleted
+		if deleted < purgeBatchSize {
+			return total, nil
+		}
+	}
+}
+
+// PurgeBefore удаляет из журнала обновления, полученные раньше before
+func (l *UpdateLogger) PurgeBefore(ctx context.Context, before time.Time) (uint64, error) {
+	ctx, span := tracer.Open(ctx, tracer.Named("UpdateLogger::PurgeBefore"))
+	defer span.Close()
+	deleted, err := purgeInBatches(ctx, l.db, `DECLARE $before AS Timestamp;
+DECLARE $limit AS Uint64;
+$expired = (SELECT id FROM `+"`updates-log`"+` VIEW updates_log_by_time WHERE timestamp < $before LIMIT $limit);
+SELECT COUNT(*) AS deleted FROM $expired;
+DELETE FROM `+"`updates-log`"+` ON SELECT * FROM $expired;`, before)
+	if err != nil {
+		return deleted, fmt.Errorf("очистка updates-log: %w", err)
+	}
+	return deleted, nil
+}
+
+// PurgeBefore удаляет записи об обновлениях, полученных раньше before
+func (p *YDBProcessedUpdates) PurgeBefore(ctx context.Context, before time.Time) (uint64, error) {
+	ctx, span := tracer.Open(ctx, tracer.Named("YDBProcessedUpdates::PurgeBefore"))
+	defer span.Close()
+	deleted, err := purgeInBatches(ctx, p.db, `DECLARE $before AS Timestamp;
+DECLARE $limit AS Uint64;
+$expired = (SELECT update_id FROM processed_update WHERE received_at < $before LIMIT $limit);
+SELECT COUNT(*) AS deleted FROM $expired;
+DELETE FROM processed_update ON SELECT * FROM $expired;`, before)
+	if err != nil {
+		return deleted, fmt.Errorf("очистка processed_update: %w", err)
+	}
+	return deleted, nil
+}
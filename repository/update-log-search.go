@@ -0,0 +1,258 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mikhailche/botcomod/lib/tracer.v2"
+	"strings"
+	"time"
+
+	"github.com/mikhailche/telebot"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/result/named"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/types"
+	"go.uber.org/zap"
+)
+
+// updateLogScanBatch сколько строк updates-log читается за один запрос. YDB обрезает выдачу на 1000 строках.
+const updateLogScanBatch = 1000
+
+// UpdateLogFilter условия поиска по журналу обновлений. Пустые поля не фильтруют.
+// Окно времени [From, To) обязательно: журнал большой, без него поиск читал бы таблицу целиком.
+type UpdateLogFilter struct {
+	UserID int64
+	ChatID int64
+	From   time.Time
+	To     time.Time
+	// Type тип обновления как в Bot API: message, callback_query, edited_message и т.д.
+	Type string
+	// Text подстрока текста, подписи, данных кнопки или inline запроса без учёта регистра
+	Text string
+}
+
+// LoggedUpdate запись журнала обновлений
+type LoggedUpdate struct {
+	ID        uint64
+	Timestamp time.Time
+	Raw       string
+	Update    telebot.Update
+}
+
+func newLoggedUpdate(id uint64, timestamp time.Time, raw string) (LoggedUpdate, error) {
+	u := LoggedUpdate{ID: id, Timestamp: timestamp, Raw: raw}
+	if err := json.Unmarshal([]byte(raw), &u.Update); err != nil {
+		return u, fmt.Errorf("парсинг обновления %d: %w", id, err)
+	}
+	return u, nil
+}
+
+// Type тип обновления: первое поле верхнего уровня кроме update_id
+func (u LoggedUpdate) Type() string {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(u.Raw), &fields); err != nil {
+		return ""
+	}
+	for name := range fields {
+		if name != "update_id" {
+			return name
+		}
+	}
+	return ""
+}
+
+func (u LoggedUpdate) message() *telebot.Message {
+	switch upd := u.Update; {
+	case upd.Message != nil:
+		return upd.Message
+	case upd.EditedMessage != nil:
+		return upd.EditedMessage
+	case upd.ChannelPost != nil:
+		return upd.ChannelPost
+	case upd.EditedChannelPost != nil:
+		return upd.EditedChannelPost
+	case upd.Callback != nil:
+		return upd.Callback.Message
+	}
+	return nil
+}
+
+// SenderID пользователь, от которого пришло обновление, или 0
+func (u LoggedUpdate) SenderID() int64 {
+	var sender *telebot.User
+	switch upd := u.Update; {
+	case upd.Callback != nil:
+		sender = upd.Callback.Sender
+	case upd.Query != nil:
+		sender = upd.Query.Sender
+	case upd.InlineResult != nil:
+		sender = upd.InlineResult.Sender
+	case upd.MyChatMember != nil:
+		sender = upd.MyChatMember.Sender
+	case upd.ChatMember != nil:
+		sender = upd.ChatMember.Sender
+	case upd.ChatJoinRequest != nil:
+		sender = upd.ChatJoinRequest.Sender
+	case u.message() != nil:
+		sender = u.message().Sender
+	}
+	if sender == nil {
+		return 0
+	}
+	return sender.ID
+}
+
+// ChatID чат, в котором произошло обновление, или 0
+func (u LoggedUpdate) ChatID() int64 {
+	var chat *telebot.Chat
+	switch upd := u.Update; {
+	case upd.MyChatMember != nil:
+		chat = upd.MyChatMember.Chat
+	case upd.ChatMember != nil:
+		chat = upd.ChatMember.Chat
+	case upd.ChatJoinRequest != nil:
+		chat = upd.ChatJoinRequest.Chat
+	case u.message() != nil:
+		chat = u.message().Chat
+	}
+	if chat == nil {
+		return 0
+	}
+	return chat.ID
+}
+
+// Text всё, что пользователь написал или нажал в этом обновлении
+func (u LoggedUpdate) Text() string {
+	var parts []string
+	if m := u.message(); m != nil && u.Update.Callback == nil {
+		parts = append(parts, m.Text, m.Caption)
+	}
+	if u.Update.Callback != nil {
+		parts = append(parts, u.Update.Callback.Data)
+	}
+	if u.Update.Query != nil {
+		parts = append(parts, u.Update.Query.Text)
+	}
+	return strings.TrimSpace(strings.Join(parts, " "))
+}
+
+func (f UpdateLogFilter) matches(u LoggedUpdate) bool {
+	if !f.From.IsZero() && u.Timestamp.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !u.Timestamp.Before(f.To) {
+		return false
+	}
+	if f.UserID != 0 && u.SenderID() != f.UserID {
+		return false
+	}
+	if f.ChatID != 0 && u.ChatID() != f.ChatID {
+		return false
+	}
+	if f.Type != "" && u.Type() != f.Type {
+		return false
+	}
+	if f.Text != "" && !strings.Contains(strings.ToLower(u.Text()), strings.ToLower(f.Text)) {
+		return false
+	}
+	return true
+}
+
+func (f UpdateLogFilter) validate() error {
+	if f.From.IsZero() || f.To.IsZero() {
+		return fmt.Errorf("не задано окно времени поиска")
+	}
+	if !f.From.Before(f.To) {
+		return fmt.Errorf("начало окна %s не раньше конца %s", f.From, f.To)
+	}
+	return nil
+}
+
+// SearchUpdates обновления из журнала по фильтру, от новых к старым.
+// Возвращает limit записей после пропуска offset и признак, что есть следующая страница.
+func (l *UpdateLogger) SearchUpdates(ctx context.Context, filter UpdateLogFilter, offset, limit int) ([]LoggedUpdate, bool, error) {
+	ctx, span := tracer.Open(ctx, tracer.Named("UpdateLogger::SearchUpdates"))
+	defer span.Close()
+	if err := filter.validate(); err != nil {
+		return nil, false, err
+	}
+	var found []LoggedUpdate
+	cursor := LoggedUpdate{Timestamp: filter.To}
+	for {
+		batch, err := l.selectUpdatesBefore(ctx, filter.From, cursor)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, u := range batch {
+			if filter.matches(u) {
+				found = append(found, u)
+			}
+		}
+		if len(found) > offset+limit || len(batch) < updateLogScanBatch {
+			break
+		}
+		cursor = batch[len(batch)-1]
+	}
+	return paginate(found, offset, limit)
+}
+
+// selectUpdatesBefore пачка записей из окна [from, cursor) по убыванию (timestamp, id).
+// Для первой пачки cursor.ID = 0, и граница берётся только по времени.
+func (l *UpdateLogger) selectUpdatesBefore(ctx context.Context, from time.Time, cursor LoggedUpdate) ([]LoggedUpdate, error) {
+	ctx, span := tracer.Open(ctx, tracer.Named("UpdateLogger::selectUpdatesBefore"))
+	defer span.Close()
+	var updates []LoggedUpdate
+	err := (*l.db).Table().Do(ctx, func(ctx context.Context, s table.Session) error {
+		updates = nil
+		_, res, err := s.Execute(ctx, table.OnlineReadOnlyTxControl(),
+			`DECLARE $from AS Timestamp;
+DECLARE $cursor_ts AS Timestamp;
+DECLARE $cursor_id AS Uint64;
+DECLARE $limit AS Uint64;
+SELECT timestamp, id, update FROM `+"`updates-log`"+` VIEW updates_log_by_time
+WHERE timestamp >= $from AND (timestamp < $cursor_ts OR (timestamp = $cursor_ts AND id < $cursor_id))
+ORDER BY timestamp DESC, id DESC
+LIMIT $limit;`,
+			table.NewQueryParameters(
+				table.ValueParam("$from", types.TimestampValueFromTime(from)),
+				table.ValueParam("$cursor_ts", types.TimestampValueFromTime(cursor.Timestamp)),
+				table.ValueParam("$cursor_id", types.Uint64Value(cursor.ID)),
+				table.ValueParam("$limit", types.Uint64Value(updateLogScanBatch)),
+			),
+		)
+		if err != nil {
+			return fmt.Errorf("поиск по updates-log: %w", err)
+		}
+		defer res.Close()
+		if !res.NextResultSet(ctx) {
+			return fmt.Errorf("не нашел result set для поиска по журналу обновлений")
+		}
+		for res.NextRow() {
+			var id uint64
+			var timestamp time.Time
+			var raw string
+			if err := res.ScanNamed(
+				named.Required("id", &id),
+				named.OptionalWithDefault("timestamp", &timestamp),
+				named.OptionalWithDefault("update", &raw),
+			); err != nil {
+				return fmt.Errorf("скан записи журнала обновлений: %w", err)
+			}
+			u, err := newLoggedUpdate(id, timestamp, raw)
+			if err != nil {
+				l.log.Error("Битая запись журнала обновлений", zap.Error(err))
+			}
+			updates = append(updates, u)
+		}
+		return res.Err()
+	}, table.WithIdempotent())
+	return updates, err
+}
+
+func paginate(found []LoggedUpdate, offset, limit int) ([]LoggedUpdate, bool, error) {
+	if offset >= len(found) {
+		return nil, false, nil
+	}
+	end := min(offset+limit, len(found))
+	return found[offset:end], end < len(found), nil
+}
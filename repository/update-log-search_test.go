@@ -0,0 +1,85 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func logRaw(t *testing.T, m *MemoryUpdateLog, id int, raw string) {
+	t.Helper()
+	m.LogUpdate(context.Background(), map[string]any{"update_id": float64(id)}, raw)
+}
+
+func TestSearchUpdatesFilters(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryUpdateLog(zap.NewNop())
+	clock := time.Date(2023, 5, 1, 14, 0, 0, 0, time.UTC)
+	m.now = func() time.Time { return clock }
+	logRaw(t, m, 1, `{"update_id":1,"message":{"message_id":1,"from":{"id":10},"chat":{"id":10},"text":"Привет, бот"}}`)
+	clock = clock.Add(time.Minute)
+	logRaw(t, m, 2, `{"update_id":2,"callback_query":{"id":"q","from":{"id":10},"message":{"message_id":5,"chat":{"id":-100}},"data":"\fadmin-approve-registration|42"}}`)
+	clock = clock.Add(time.Minute)
+	logRaw(t, m, 3, `{"update_id":3,"message":{"message_id":2,"from":{"id":20},"chat":{"id":-100},"caption":"квитанция за май"}}`)
+
+	window := UpdateLogFilter{From: clock.Add(-time.Hour), To: clock.Add(time.Second)}
+	ids := func(filter UpdateLogFilter) []uint64 {
+		found, _, err := m.SearchUpdates(ctx, filter, 0, 10)
+		require.NoError(t, err)
+		var ids []uint64
+		for _, u := range found {
+			ids = append(ids, u.ID)
+		}
+		return ids
+	}
+	assert.Equal(t, []uint64{3, 2, 1}, ids(window))
+
+	byUser := window
+	byUser.UserID = 10
+	assert.Equal(t, []uint64{2, 1}, ids(byUser))
+
+	byChat := window
+	byChat.ChatID = -100
+	assert.Equal(t, []uint64{3, 2}, ids(byChat))
+
+	byType := window
+	byType.Type = "callback_query"
+	assert.Equal(t, []uint64{2}, ids(byType))
+
+	byText := window
+	byText.Text = "КВИТАНЦИЯ"
+	assert.Equal(t, []uint64{3}, ids(byText))
+
+	early := window
+	early.To = clock.Add(-time.Minute)
+	assert.Equal(t, []uint64{1}, ids(early))
+
+	_, _, err := m.SearchUpdates(ctx, UpdateLogFilter{UserID: 10}, 0, 10)
+	assert.Error(t, err, "без окна времени искать нельзя")
+}
+
+func TestSearchUpdatesPagination(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryUpdateLog(zap.NewNop())
+	clock := time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC)
+	m.now = func() time.Time { return clock }
+	for id := 1; id <= 5; id++ {
+		clock = clock.Add(time.Second)
+		logRaw(t, m, id, fmt.Sprintf(`{"update_id":%d}`, id))
+	}
+	filter := UpdateLogFilter{From: clock.Add(-time.Hour), To: clock.Add(time.Hour)}
+	page, more, err := m.SearchUpdates(ctx, filter, 0, 2)
+	require.NoError(t, err)
+	assert.True(t, more)
+	assert.Equal(t, uint64(5), page[0].ID)
+	page, more, err = m.SearchUpdates(ctx, filter, 4, 2)
+	require.NoError(t, err)
+	assert.False(t, more)
+	require.Len(t, page, 1)
+	assert.Equal(t, uint64(1), page[0].ID)
+}
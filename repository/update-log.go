@@ -1,11 +1,15 @@
 package repository
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"mikhailche/botcomod/lib/errors"
 	"mikhailche/botcomod/lib/tracer.v2"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/mikhailche/telebot"
@@ -32,16 +36,50 @@ func (u *YDBUpdateLogEntry) Scan(ctx context.Context, res result.Result) error {
 	)
 }
 
+const (
+	// updateLogBatchSize сколько обновлений пишется одним запросом
+	updateLogBatchSize = 100
+	// updateLogMaxPending больше этого обновления в памяти не копятся и считаются потерянными
+	updateLogMaxPending = 1000
+)
+
+// updateLogEntry обновление в очереди на запись. В таком же виде хранится в файле сброса.
+type updateLogEntry struct {
+	ID        uint64    `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	Update    string    `json:"update"`
+}
+
+// UpdateLogStats счётчики журнала обновлений с момента запуска
+type UpdateLogStats struct {
+	Written  uint64
+	Dropped  uint64
+	Failed   uint64
+	Spilled  uint64
+	Replayed uint64
+}
+
+// UpdateLogger пишет обновления в updates-log пачками.
+// LogUpdate только ставит обновление в очередь, запись происходит в Flush.
+// Если YDB недоступна, обновления сбрасываются в локальный файл и дописываются при следующем Flush.
 type UpdateLogger struct {
-	db      *ydb.Driver
-	log     *zap.Logger
-	entries chan YDBUpdateLogEntry
+	db        *ydb.Driver
+	log       *zap.Logger
+	spillFile string
+	// writeBatch пишет пачку обновлений, в тестах подменяется
+	writeBatch func(ctx context.Context, entries []updateLogEntry) error
+
+	// flushMu не даёт двум Flush одновременно работать с файлом сброса
+	flushMu sync.Mutex
+	mu      sync.Mutex
+	pending []updateLogEntry
+	stats   UpdateLogStats
 }
 
-func NewUpdateLogger(db *ydb.Driver, logger *zap.Logger) *UpdateLogger {
-	upLogger := &UpdateLogger{db: db, log: logger, entries: make(chan YDBUpdateLogEntry, 8)}
-	upLogger.runYDBWorker()
-	return upLogger
+func NewUpdateLogger(db *ydb.Driver, logger *zap.Logger, spillFile string) *UpdateLogger {
+	l := &UpdateLogger{db: db, log: logger, spillFile: spillFile}
+	l.writeBatch = l.ydbLogUpdatesNow
+	return l
 }
 
 func (l *UpdateLogger) LogUpdate(ctx context.Context, upd map[string]any, rawUpdate string) {
@@ -49,77 +87,200 @@ func (l *UpdateLogger) LogUpdate(ctx context.Context, upd map[string]any, rawUpd
 	defer span.Close()
 
 	l.log.Info("Обновление от телеги", zap.Any("update", upd))
-	select {
-	case l.entries <- YDBUpdateLogEntry{(uint64)(upd["update_id"].(float64)), rawUpdate, ctx}:
-		break
-	case <-time.After(time.Second):
-		l.log.Error("Не получилось записать обновление в очередь за секунду")
-		break
+	id, ok := upd["update_id"].(float64)
+	if !ok {
+		l.log.Error("В обновлении нет update_id")
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.pending) >= updateLogMaxPending {
+		l.stats.Dropped++
+		l.log.Error("Очередь журнала обновлений переполнена, обновление потеряно", zap.Uint64("updateID", uint64(id)))
+		return
 	}
+	l.pending = append(l.pending, updateLogEntry{ID: uint64(id), Timestamp: time.Now(), Update: rawUpdate})
 }
 
-type tRetryCount int8
-
-const times tRetryCount = 1
+// Stats счётчики записанных, потерянных и не записанных в YDB обновлений
+func (l *UpdateLogger) Stats() UpdateLogStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stats
+}
 
-func withRetry(ctx context.Context, f func(context.Context) error, retryCount tRetryCount, retryDelay time.Duration) error {
-	ctx, span := tracer.Open(ctx, tracer.Named("withRetry"))
+// Flush записывает накопленные обновления и обновления из файла сброса.
+// То, что не удалось записать, уходит в файл сброса. Ошибка означает, что обновления потеряны совсем.
+func (l *UpdateLogger) Flush(ctx context.Context) error {
+	ctx, span := tracer.Open(ctx, tracer.Named("UpdateLogger::Flush"))
 	defer span.Close()
-	var allErrors []error
-	for ; retryCount > 0; retryCount-- {
-		err := f(ctx)
-		if err == nil {
-			return nil
+	l.flushMu.Lock()
+	defer l.flushMu.Unlock()
+	spilled, err := l.readSpill()
+	// непрочитанный файл сброса не переписываем: в нём обновления, которых больше нигде нет
+	spillReadable := err == nil
+	if !spillReadable {
+		l.log.Error("Не удалось прочитать файл сброса журнала обновлений, новые сбросы допишу в конец",
+			zap.String("file", l.spillFile), zap.Error(err))
+		spilled = nil
+	}
+	l.mu.Lock()
+	entries := append(spilled, l.pending...)
+	l.pending = nil
+	l.mu.Unlock()
+	if len(entries) == 0 {
+		return nil
+	}
+	var stats UpdateLogStats
+	defer func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.stats.Written += stats.Written
+		l.stats.Dropped += stats.Dropped
+		l.stats.Failed += stats.Failed
+		l.stats.Spilled += stats.Spilled
+		l.stats.Replayed += stats.Replayed
+	}()
+	var unwritten []updateLogEntry
+	var writeErrs []error
+	for start := 0; start < len(entries); start += updateLogBatchSize {
+		batch := entries[start:min(start+updateLogBatchSize, len(entries))]
+		if err := l.writeBatch(ctx, batch); err != nil {
+			writeErrs = append(writeErrs, err)
+			unwritten = append(unwritten, batch...)
+			continue
 		}
-		allErrors = append(allErrors, err)
-		time.Sleep(retryDelay)
+		stats.Written += uint64(len(batch))
+		// обновления из файла сброса идут в начале entries
+		stats.Replayed += uint64(max(0, min(start+len(batch), len(spilled))-start))
+	}
+	if len(unwritten) > 0 {
+		stats.Failed += uint64(len(unwritten))
+		l.log.Error("Не удалось записать обновления в YDB", zap.Int("count", len(unwritten)), zap.Error(errors.Join(writeErrs...)))
 	}
-	return errors.Join(allErrors...)
+	writeSpill := l.writeSpill
+	if !spillReadable {
+		writeSpill = l.appendSpill
+	}
+	if err := writeSpill(unwritten); err != nil {
+		stats.Dropped += uint64(len(unwritten))
+		return fmt.Errorf("сброс %d обновлений в файл %s: %w", len(unwritten), l.spillFile, err)
+	}
+	stats.Spilled += uint64(len(unwritten))
+	return nil
 }
 
-func (l *UpdateLogger) runYDBWorker() {
-	globalCtx := context.Background()
-	go func() {
-		for entry := range l.entries {
-			_, span := tracer.Open(entry.LocalCtx, tracer.WithNewTid)
-			entryWriterCtx := tracer.WithSpan(globalCtx, span)
-			if err := withRetry(entryWriterCtx, func(ctx context.Context) error {
-				ctx, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
-				defer cancel()
-				return l.ydbLogUpdateNow(ctx, entry.ID, entry.Update)
-			}, 3*times, time.Second); err != nil {
-				l.log.Error("Не удалось записать обновление", zap.Error(err))
-			}
-			span.Close()
+// readSpill читает обновления, сброшенные прошлыми вызовами
+func (l *UpdateLogger) readSpill() ([]updateLogEntry, error) {
+	if l.spillFile == "" {
+		return nil, nil
+	}
+	f, err := os.Open(l.spillFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []updateLogEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry updateLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			l.log.Error("Битая строка в файле сброса журнала обновлений", zap.ByteString("line", scanner.Bytes()), zap.Error(err))
+			continue
 		}
-	}()
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// writeSpill заменяет содержимое файла сброса. Пустой список удаляет файл.
+func (l *UpdateLogger) writeSpill(entries []updateLogEntry) error {
+	if l.spillFile == "" {
+		if len(entries) > 0 {
+			return fmt.Errorf("файл сброса не настроен")
+		}
+		return nil
+	}
+	if len(entries) == 0 {
+		if err := os.Remove(l.spillFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+	tmp := l.spillFile + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.spillFile)
+}
+
+// appendSpill дописывает обновления в конец файла сброса, не трогая того, что в нём уже есть
+func (l *UpdateLogger) appendSpill(entries []updateLogEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	if l.spillFile == "" {
+		return fmt.Errorf("файл сброса не настроен")
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(l.spillFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
 
-func (l *UpdateLogger) ydbLogUpdateNow(ctx context.Context, ID uint64, update string) error {
-	ctx, span := tracer.Open(ctx, tracer.Named("LogUpdate"))
+var updateLogEntryType = types.Struct(
+	types.StructField("timestamp", types.TypeTimestamp),
+	types.StructField("id", types.TypeUint64),
+	types.StructField("update", types.TypeJSONDocument),
+)
+
+func (l *UpdateLogger) ydbLogUpdatesNow(ctx context.Context, entries []updateLogEntry) error {
+	ctx, span := tracer.Open(ctx, tracer.Named("LogUpdates"))
 	defer span.Close()
+	var rows []types.Value
+	for _, entry := range entries {
+		rows = append(rows, types.StructValue(
+			types.StructFieldValue("timestamp", types.TimestampValueFromTime(entry.Timestamp)),
+			types.StructFieldValue("id", types.Uint64Value(entry.ID)),
+			types.StructFieldValue("update", types.JSONDocumentValue(entry.Update)),
+		))
+	}
 	return (*l.db).Table().Do(ctx, func(ctx context.Context, s table.Session) error {
 		ctx, span := tracer.Open(ctx, tracer.Named("Do upsert updates-log"))
 		defer span.Close()
 		_, res, err := s.Execute(ctx,
 			table.DefaultTxControl(),
-			"DECLARE $timestamp AS Timestamp; "+
-				"DECLARE $id AS Uint64; "+
-				"DECLARE $update AS JsonDocument; "+
-				"UPSERT INTO `updates-log` "+
-				"(timestamp, id, update) "+
-				"VALUES ($timestamp, $id, $update);",
-			table.NewQueryParameters(
-				table.ValueParam("$timestamp", types.TimestampValueFromTime(time.Now())),
-				table.ValueParam("$id", types.Uint64Value(ID)),
-				table.ValueParam("$update", types.JSONDocumentValue(update)),
-			),
+			"DECLARE $updates AS List<Struct<timestamp:Timestamp, id:Uint64, update:JsonDocument>>; "+
+				"UPSERT INTO `updates-log` SELECT * FROM AS_TABLE($updates);",
+			table.NewQueryParameters(table.ValueParam("$updates", types.ListValue(rows...))),
 		)
 		if res != nil {
 			_ = res.Close()
 		}
 		if err != nil {
-			return fmt.Errorf("upser update-log %d: %w", ID, err)
+			return fmt.Errorf("upsert updates-log [%d шт]: %w", len(entries), err)
 		}
 		return nil
 	}, table.WithIdempotent())
@@ -148,7 +309,7 @@ func (l *UpdateLogger) GetByUpdateId(ctx context.Context, updateID uint64) (*tel
 			return fmt.Errorf("не нашел result set для логов обновлений")
 		}
 		if !res.NextRow() {
-			return fmt.Errorf("обновление не найдено")
+			return fmt.Errorf("обновление %d: %w", updateID, ErrNotFound)
 		}
 		if err := update.Scan(ctx, res); err != nil {
 			return fmt.Errorf("скан события обновления %v: %w", res, err)
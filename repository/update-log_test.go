@@ -0,0 +1,83 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestUpdateLogSpillRoundTrip(t *testing.T) {
+	l := NewUpdateLogger(nil, zap.NewNop(), filepath.Join(t.TempDir(), "spill.jsonl"))
+	entries := []updateLogEntry{
+		{ID: 1, Timestamp: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), Update: `{"update_id":1}`},
+		{ID: 2, Timestamp: time.Date(2023, 1, 1, 0, 0, 1, 0, time.UTC), Update: `{"update_id":2,"message":{"text":"привет\nмир"}}`},
+	}
+	require.NoError(t, l.writeSpill(entries))
+	read, err := l.readSpill()
+	require.NoError(t, err)
+	assert.Equal(t, entries, read)
+
+	require.NoError(t, l.writeSpill(nil))
+	read, err = l.readSpill()
+	require.NoError(t, err)
+	assert.Empty(t, read)
+}
+
+func TestUpdateLogDropsWhenQueueIsFull(t *testing.T) {
+	l := NewUpdateLogger(nil, zap.NewNop(), "")
+	for i := 0; i < updateLogMaxPending+3; i++ {
+		l.LogUpdate(context.Background(), map[string]any{"update_id": float64(i)}, "{}")
+	}
+	assert.Len(t, l.pending, updateLogMaxPending)
+	assert.Equal(t, uint64(3), l.Stats().Dropped)
+}
+
+func TestUpdateLogFlushKeepsUnreadableSpill(t *testing.T) {
+	spillFile := filepath.Join(t.TempDir(), "spill.jsonl")
+	// строка длиннее буфера чтения: файл не прочитать, но и терять его нельзя
+	unreadable := append(bytes.Repeat([]byte("x"), 17*1024*1024), '\n')
+	require.NoError(t, os.WriteFile(spillFile, unreadable, 0o600))
+	l := NewUpdateLogger(nil, zap.NewNop(), spillFile)
+	l.writeBatch = func(context.Context, []updateLogEntry) error { return errors.New("ydb недоступна") }
+	l.LogUpdate(context.Background(), map[string]any{"update_id": float64(7)}, `{"update_id":7}`)
+
+	require.NoError(t, l.Flush(context.Background()))
+	content, err := os.ReadFile(spillFile)
+	require.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(content, unreadable), "непрочитанные обновления остались в файле")
+	assert.Contains(t, string(content[len(unreadable):]), `"id":7`)
+	assert.Equal(t, uint64(1), l.Stats().Spilled)
+	assert.Zero(t, l.Stats().Replayed)
+}
+
+func TestUpdateLogFlushCountsOnlyWrittenReplays(t *testing.T) {
+	l := NewUpdateLogger(nil, zap.NewNop(), filepath.Join(t.TempDir(), "spill.jsonl"))
+	var spilled []updateLogEntry
+	for i := 0; i < updateLogBatchSize+1; i++ {
+		spilled = append(spilled, updateLogEntry{ID: uint64(i), Update: "{}"})
+	}
+	require.NoError(t, l.writeSpill(spilled))
+	// первая пачка записывается, вторая нет
+	batches := 0
+	l.writeBatch = func(context.Context, []updateLogEntry) error {
+		batches++
+		if batches > 1 {
+			return errors.New("ydb недоступна")
+		}
+		return nil
+	}
+
+	require.NoError(t, l.Flush(context.Background()))
+	assert.Equal(t, uint64(updateLogBatchSize), l.Stats().Replayed)
+	read, err := l.readSpill()
+	require.NoError(t, err)
+	assert.Len(t, read, 1)
+}
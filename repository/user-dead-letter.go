@@ -0,0 +1,266 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mikhailche/botcomod/lib/tracer.v2"
+	"time"
+
+	"github.com/ydb-platform/ydb-go-sdk/v3/table"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/result/named"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/types"
+	"go.uber.org/zap"
+)
+
+// CorruptEventError событие из user_event нельзя прочитать текущим кодом:
+// неизвестный тип, битый json или версия без апкастера
+type CorruptEventError struct {
+	Record  UserEventRecord
+	Payload []byte
+	Reason  error
+}
+
+func (e *CorruptEventError) Error() string {
+	return fmt.Sprintf("событие %s [%s] пользователя %d не читается: %v", e.Record.ID, e.Record.Type, e.Record.User, e.Reason)
+}
+
+func (e *CorruptEventError) Unwrap() error {
+	return e.Reason
+}
+
+func (e *CorruptEventError) deadLetter(detectedAt time.Time) DeadLetter {
+	return DeadLetter{
+		User:       e.Record.User,
+		Timestamp:  e.Record.Timestamp,
+		ID:         e.Record.ID,
+		Type:       e.Record.Type,
+		Version:    e.Record.Version,
+		Event:      string(e.Payload),
+		Reason:     e.Reason.Error(),
+		DetectedAt: detectedAt,
+	}
+}
+
+// DeadLetter карантин для нечитаемого события. Само событие остаётся в user_event и пропускается при проигрывании,
+// пока администратор его не исправит или не удалит.
+type DeadLetter struct {
+	User       int64
+	Timestamp  time.Time
+	ID         string
+	Type       string
+	Version    uint32
+	Event      string
+	Reason     string
+	DetectedAt time.Time
+}
+
+// DeadLetterStorage управление событиями в карантине
+type DeadLetterStorage interface {
+	ListDeadLetters(ctx context.Context, limit int) ([]DeadLetter, error)
+	GetDeadLetter(ctx context.Context, eventID string) (*DeadLetter, error)
+	// FixDeadLetter заменяет тип и json события. Новый json должен соответствовать текущей версии типа.
+	FixDeadLetter(ctx context.Context, eventID string, eventType string, payload []byte) error
+	// DropDeadLetter удаляет событие из истории пользователя насовсем
+	DropDeadLetter(ctx context.Context, eventID string) error
+}
+
+// validateFixedEvent проверяет, что исправленное событие читается текущим кодом
+func validateFixedEvent(ctx context.Context, eventType string, payload []byte) (uint32, error) {
+	event := SelectType(ctx, eventType)
+	if event == nil {
+		return 0, fmt.Errorf("не удалось найти тип для %s", eventType)
+	}
+	version := eventVersionOf(event)
+	if _, err := decodeUserEvent(ctx, eventType, version, payload); err != nil {
+		return 0, fmt.Errorf("исправленное событие не читается: %w", err)
+	}
+	return version, nil
+}
+
+func (r *YDBUserStorage) quarantine(ctx context.Context, s table.Session, corrupt []*CorruptEventError) {
+	ctx, span := tracer.Open(ctx, tracer.Named("YDBUserStorage::quarantine"))
+	defer span.Close()
+	now := time.Now()
+	for _, c := range corrupt {
+		r.log.Error("Событие пользователя отправлено в карантин", zap.Error(c))
+		dl := c.deadLetter(now)
+		_, _, err := s.Execute(ctx, table.DefaultTxControl(),
+			`DECLARE $user AS Int64;
+DECLARE $timestamp AS Timestamp;
+DECLARE $id AS String;
+DECLARE $type AS String;
+DECLARE $version AS Uint32;
+DECLARE $event AS String;
+DECLARE $reason AS Utf8;
+DECLARE $detected_at AS Timestamp;
+UPSERT INTO user_event_dead_letter (user, timestamp, id, type, version, event, reason, detected_at)
+VALUES ($user, $timestamp, $id, $type, $version, $event, $reason, $detected_at);`,
+			table.NewQueryParameters(
+				table.ValueParam("$user", types.Int64Value(dl.User)),
+				table.ValueParam("$timestamp", types.TimestampValueFromTime(dl.Timestamp)),
+				table.ValueParam("$id", types.StringValueFromString(dl.ID)),
+				table.ValueParam("$type", types.StringValueFromString(dl.Type)),
+				table.ValueParam("$version", types.Uint32Value(dl.Version)),
+				table.ValueParam("$event", types.StringValueFromString(dl.Event)),
+				table.ValueParam("$reason", types.UTF8Value(dl.Reason)),
+				table.ValueParam("$detected_at", types.TimestampValueFromTime(dl.DetectedAt)),
+			),
+		)
+		if err != nil {
+			r.log.Error("Не удалось записать событие в карантин", zap.String("id", dl.ID), zap.Error(err))
+		}
+	}
+}
+
+const selectDeadLettersColumns = `user, timestamp, id, type, version, event, reason, detected_at`
+
+func (r *YDBUserStorage) selectDeadLetters(ctx context.Context, s table.Session, query string, params *table.QueryParameters) ([]DeadLetter, error) {
+	_, res, err := s.Execute(ctx, table.DefaultTxControl(), query, params)
+	if err != nil {
+		return nil, fmt.Errorf("SELECT user_event_dead_letter: %w", err)
+	}
+	defer res.Close()
+	if !res.NextResultSet(ctx) {
+		return nil, fmt.Errorf("не нашел result set для карантина событий")
+	}
+	var letters []DeadLetter
+	for res.NextRow() {
+		var dl DeadLetter
+		if err := res.ScanNamed(
+			named.OptionalWithDefault("user", &dl.User),
+			named.OptionalWithDefault("timestamp", &dl.Timestamp),
+			named.OptionalWithDefault("id", &dl.ID),
+			named.OptionalWithDefault("type", &dl.Type),
+			named.OptionalWithDefault("version", &dl.Version),
+			named.OptionalWithDefault("event", &dl.Event),
+			named.OptionalWithDefault("reason", &dl.Reason),
+			named.OptionalWithDefault("detected_at", &dl.DetectedAt),
+		); err != nil {
+			return nil, fmt.Errorf("скан user_event_dead_letter: %w", err)
+		}
+		letters = append(letters, dl)
+	}
+	return letters, res.Err()
+}
+
+func (r *YDBUserStorage) ListDeadLetters(ctx context.Context, limit int) ([]DeadLetter, error) {
+	ctx, span := tracer.Open(ctx, tracer.Named("YDBUserStorage::ListDeadLetters"))
+	defer span.Close()
+	var letters []DeadLetter
+	err := r.smartExecute(ctx, func(ctx context.Context, s table.Session) error {
+		var err error
+		letters, err = r.selectDeadLetters(ctx, s,
+			`DECLARE $limit AS Uint64;
+SELECT `+selectDeadLettersColumns+` FROM user_event_dead_letter ORDER BY detected_at DESC LIMIT $limit;`,
+			table.NewQueryParameters(table.ValueParam("$limit", types.Uint64Value(uint64(limit)))),
+		)
+		return err
+	})
+	return letters, err
+}
+
+func (r *YDBUserStorage) getDeadLetter(ctx context.Context, s table.Session, eventID string) (*DeadLetter, error) {
+	letters, err := r.selectDeadLetters(ctx, s,
+		`DECLARE $id AS String;
+SELECT `+selectDeadLettersColumns+` FROM user_event_dead_letter WHERE id = $id;`,
+		table.NewQueryParameters(table.ValueParam("$id", types.StringValueFromString(eventID))),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(letters) == 0 {
+		return nil, fmt.Errorf("событие %s в карантине: %w", eventID, ErrNotFound)
+	}
+	return &letters[0], nil
+}
+
+func (r *YDBUserStorage) GetDeadLetter(ctx context.Context, eventID string) (*DeadLetter, error) {
+	ctx, span := tracer.Open(ctx, tracer.Named("YDBUserStorage::GetDeadLetter"))
+	defer span.Close()
+	var dl *DeadLetter
+	err := r.smartExecute(ctx, func(ctx context.Context, s table.Session) error {
+		var err error
+		dl, err = r.getDeadLetter(ctx, s, eventID)
+		return err
+	})
+	return dl, err
+}
+
+func (r *YDBUserStorage) FixDeadLetter(ctx context.Context, eventID string, eventType string, payload []byte) error {
+	ctx, span := tracer.Open(ctx, tracer.Named("YDBUserStorage::FixDeadLetter"))
+	defer span.Close()
+	version, err := validateFixedEvent(ctx, eventType, payload)
+	if err != nil {
+		return err
+	}
+	return r.resolveDeadLetter(ctx, eventID,
+		`DECLARE $user AS Int64;
+DECLARE $timestamp AS Timestamp;
+DECLARE $id AS String;
+DECLARE $type AS String;
+DECLARE $version AS Uint32;
+DECLARE $event AS JsonDocument;
+UPSERT INTO user_event (user, timestamp, id, type, version, event) VALUES ($user, $timestamp, $id, $type, $version, $event);
+DELETE FROM user_event_dead_letter WHERE user = $user AND timestamp = $timestamp AND id = $id;`,
+		table.ValueParam("$type", types.StringValueFromString(eventType)),
+		table.ValueParam("$version", types.Uint32Value(version)),
+		table.ValueParam("$event", types.JSONDocumentValueFromBytes(payload)),
+	)
+}
+
+func (r *YDBUserStorage) DropDeadLetter(ctx context.Context, eventID string) error {
+	ctx, span := tracer.Open(ctx, tracer.Named("YDBUserStorage::DropDeadLetter"))
+	defer span.Close()
+	return r.resolveDeadLetter(ctx, eventID,
+		`DECLARE $user AS Int64;
+DECLARE $timestamp AS Timestamp;
+DECLARE $id AS String;
+DELETE FROM user_event WHERE user = $user AND timestamp = $timestamp AND id = $id;
+DELETE FROM user_event_dead_letter WHERE user = $user AND timestamp = $timestamp AND id = $id;`,
+	)
+}
+
+// resolveDeadLetter меняет историю пользователя и пересобирает всё, что из неё выведено: снапшот и справочники
+func (r *YDBUserStorage) resolveDeadLetter(ctx context.Context, eventID string, query string, params ...table.ParameterOption) error {
+	return r.smartExecute(ctx, func(ctx context.Context, s table.Session) error {
+		dl, err := r.getDeadLetter(ctx, s, eventID)
+		if err != nil {
+			return err
+		}
+		queryParams := table.NewQueryParameters(
+			table.ValueParam("$user", types.Int64Value(dl.User)),
+			table.ValueParam("$timestamp", types.TimestampValueFromTime(dl.Timestamp)),
+			table.ValueParam("$id", types.StringValueFromString(dl.ID)),
+		)
+		queryParams.Add(params...)
+		if _, _, err := s.Execute(ctx, table.DefaultTxControl(), query, queryParams); err != nil {
+			return fmt.Errorf("исправление события %s: %w", eventID, err)
+		}
+		if err := r.deleteSnapshot(ctx, s, dl.User); err != nil {
+			return err
+		}
+		return r.resetLookups(ctx, s, dl.User)
+	})
+}
+
+// resetLookups заново записывает справочники пользователя по его текущему состоянию
+func (r *YDBUserStorage) resetLookups(ctx context.Context, s table.Session, userID int64) error {
+	user, err := r.byIDUncached(userID)(ctx, s)
+	if errors.Is(err, ErrNotFound) {
+		return r.clearLookups(ctx, s, userID)
+	}
+	if err != nil {
+		return fmt.Errorf("состояние пользователя после исправления: %w", err)
+	}
+	if err := r.clearLookups(ctx, s, userID); err != nil {
+		return err
+	}
+	return r.updateLookups(ctx, s, lookupsOf(user), userLookups{})
+}
+
+func asCorruptEvent(err error) (*CorruptEventError, bool) {
+	var corrupt *CorruptEventError
+	ok := errors.As(err, &corrupt)
+	return corrupt, ok
+}
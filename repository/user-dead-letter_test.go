@@ -0,0 +1,76 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func memoryStorageWithCorruptEvent(t *testing.T) *MemoryUserStorage {
+	ctx := context.Background()
+	storage := NewMemoryUserStorage()
+	storage.UpsertUsername(ctx, 1, "resident")
+	require.NoError(t, storage.LogEvent(ctx, 1, &RegisterCarLicensePlateEvent{LicensePlate: "А001АА"}))
+	storage.events[1] = append(storage.events[1], memoryEventRecord{
+		Timestamp: time.Now().Add(time.Hour),
+		ID:        "broken",
+		Type:      (*RegisterCarLicensePlateEvent)(nil).FQDN(),
+		Event:     []byte(`{"LicensePlate": 42}`),
+	})
+	return storage
+}
+
+func TestCorruptEventIsQuarantined(t *testing.T) {
+	ctx := context.Background()
+	storage := memoryStorageWithCorruptEvent(t)
+
+	user, err := storage.GetUser(ctx, UserQuery{ID: 1})
+	require.NoError(t, err, "битое событие не должно ломать чтение пользователя")
+	assert.Len(t, user.Cars, 1)
+
+	users, err := storage.GetAllUsers(ctx)
+	require.NoError(t, err)
+	assert.Len(t, users, 1)
+
+	letters, err := storage.ListDeadLetters(ctx, 10)
+	require.NoError(t, err)
+	require.Len(t, letters, 1)
+	assert.Equal(t, "broken", letters[0].ID)
+	assert.NotEmpty(t, letters[0].Reason)
+}
+
+func TestFixDeadLetter(t *testing.T) {
+	ctx := context.Background()
+	storage := memoryStorageWithCorruptEvent(t)
+	_, err := storage.GetUser(ctx, UserQuery{ID: 1})
+	require.NoError(t, err)
+
+	eventType := (*RegisterCarLicensePlateEvent)(nil).FQDN()
+	assert.Error(t, storage.FixDeadLetter(ctx, "broken", eventType, []byte(`{"LicensePlate": 43}`)), "невалидное исправление")
+	require.NoError(t, storage.FixDeadLetter(ctx, "broken", eventType, []byte(`{"LicensePlate": "В002ВВ"}`)))
+
+	user, err := storage.GetUser(ctx, UserQuery{ID: 1})
+	require.NoError(t, err)
+	assert.Len(t, user.Cars, 2)
+	_, err = storage.GetDeadLetter(ctx, "broken")
+	assert.True(t, errors.Is(err, ErrNotFound))
+}
+
+func TestDropDeadLetter(t *testing.T) {
+	ctx := context.Background()
+	storage := memoryStorageWithCorruptEvent(t)
+	_, err := storage.GetUser(ctx, UserQuery{ID: 1})
+	require.NoError(t, err)
+
+	require.NoError(t, storage.DropDeadLetter(ctx, "broken"))
+	user, err := storage.GetUser(ctx, UserQuery{ID: 1})
+	require.NoError(t, err)
+	assert.Len(t, user.Events, 1)
+	letters, err := storage.ListDeadLetters(ctx, 10)
+	require.NoError(t, err)
+	assert.Empty(t, letters)
+}
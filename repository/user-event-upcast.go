@@ -0,0 +1,77 @@
+package repository
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// versionedEvent событие может объявить версию своей json схемы.
+// Версию увеличивают при любом несовместимом изменении полей и добавляют апкастер с предыдущей версии.
+// События без этого метода считаются версии 1.
+type versionedEvent interface {
+	EventVersion() uint32
+}
+
+func eventVersionOf(event UserEvent) uint32 {
+	if v, ok := event.(versionedEvent); ok {
+		return v.EventVersion()
+	}
+	return 1
+}
+
+// upcaster переводит json события из версии N в N+1 на месте
+type upcaster func(fields map[string]json.RawMessage) error
+
+// userEventUpcasters цепочки апкастеров по типу события и исходной версии.
+// Исторические записи в user_event не переписываются, их поднимают до текущей версии при чтении.
+var userEventUpcasters = map[string]map[uint32]upcaster{
+	(*StartRegistrationEvent)(nil).FQDN(): {
+		// v1 писал квартиру под ключом с опечаткой
+		1: renameField("Appartment", "Apartment"),
+	},
+}
+
+func renameField(from, to string) upcaster {
+	return func(fields map[string]json.RawMessage) error {
+		value, ok := fields[from]
+		if !ok {
+			return nil
+		}
+		delete(fields, from)
+		if _, exists := fields[to]; !exists {
+			fields[to] = value
+		}
+		return nil
+	}
+}
+
+// upcastUserEvent поднимает json события с версии version до target.
+// Версия 0 означает запись, сделанную до появления колонки version, то есть версию 1.
+func upcastUserEvent(eventType string, version, target uint32, payload []byte) ([]byte, error) {
+	if version == 0 {
+		version = 1
+	}
+	if version == target {
+		return payload, nil
+	}
+	if version > target {
+		return nil, fmt.Errorf("событие %s версии %d новее, чем поддерживает код (%d)", eventType, version, target)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return nil, fmt.Errorf("разбор события %s версии %d: %w", eventType, version, err)
+	}
+	if fields == nil {
+		fields = make(map[string]json.RawMessage)
+	}
+	for ; version < target; version++ {
+		up, ok := userEventUpcasters[eventType][version]
+		if !ok {
+			return nil, fmt.Errorf("нет апкастера для %s с версии %d", eventType, version)
+		}
+		if err := up(fields); err != nil {
+			return nil, fmt.Errorf("апкаст %s с версии %d: %w", eventType, version, err)
+		}
+	}
+	return json.Marshal(fields)
+}
@@ -0,0 +1,40 @@
+package repository
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEveryEventVersionHasUpcasters(t *testing.T) {
+	for _, event := range knownUserEventTypes {
+		for version := uint32(1); version < eventVersionOf(event); version++ {
+			_, ok := userEventUpcasters[event.FQDN()][version]
+			assert.True(t, ok, "нет апкастера для %s с версии %d", event.FQDN(), version)
+		}
+	}
+}
+
+func TestDecodeHistoricalStartRegistrationEvent(t *testing.T) {
+	ctx := context.Background()
+	historical := []byte(`{"UpdateID":1,"HouseNumber":"8","HouseID":3,"Appartment":"117","ApproveCode":"AB12C"}`)
+	for _, version := range []uint32{0, 1} {
+		event, err := decodeUserEvent(ctx, (*StartRegistrationEvent)(nil).FQDN(), version, historical)
+		require.NoError(t, err)
+		start := event.(*StartRegistrationEvent)
+		assert.Equal(t, "117", start.Apartment)
+		assert.Equal(t, uint64(3), start.HouseID)
+	}
+
+	current := []byte(`{"UpdateID":1,"HouseNumber":"8","HouseID":3,"Apartment":"118"}`)
+	event, err := decodeUserEvent(ctx, (*StartRegistrationEvent)(nil).FQDN(), 2, current)
+	require.NoError(t, err)
+	assert.Equal(t, "118", event.(*StartRegistrationEvent).Apartment)
+}
+
+func TestDecodeRejectsFutureVersion(t *testing.T) {
+	_, err := decodeUserEvent(context.Background(), (*StartRegistrationEvent)(nil).FQDN(), 3, []byte(`{}`))
+	assert.Error(t, err)
+}
@@ -0,0 +1,302 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"mikhailche/botcomod/lib/tracer.v2"
+	"time"
+
+	"github.com/ydb-platform/ydb-go-sdk/v3/table"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/result/named"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/types"
+	"go.uber.org/zap"
+)
+
+// Таблицы-справочники user_by_plate и user_by_apartment нужны для поиска резидентов без полного чтения user и user_event.
+// Поддерживаются в актуальном состоянии в LogEvent, пересобираются командой repository/cmd/backfill-lookups.
+
+type plateLookup struct {
+	Plate  string
+	UserID int64
+}
+
+type apartmentLookup struct {
+	House     string
+	Apartment string
+	UserID    int64
+}
+
+// userLookups ключи, по которым пользователя можно найти в справочниках
+type userLookups struct {
+	Plates     []plateLookup
+	Apartments []apartmentLookup
+}
+
+func lookupsOf(user *User) userLookups {
+	var l userLookups
+	if user == nil {
+		return l
+	}
+	for _, car := range user.Cars {
+		l.Plates = append(l.Plates, plateLookup{Plate: car.LicensePlate, UserID: user.ID})
+	}
+	// истечение аренды индекс не отследит, поэтому в нём все подтверждённые квартиры, а сроки проверяет поиск
+	for _, apartment := range user.approvedApartments(func(tPrivatePropertyItem) bool { return true }) {
+		l.Apartments = append(l.Apartments, apartmentLookup{
+			House:     apartment.HouseNumber,
+			Apartment: apartment.ApartmentNumber,
+			UserID:    user.ID,
+		})
+	}
+	return l
+}
+
+// diff возвращает ключи, которые нужно добавить и удалить, чтобы из before получить after
+func (after userLookups) diff(before userLookups) (added, removed userLookups) {
+	plates := make(map[plateLookup]bool)
+	for _, p := range before.Plates {
+		plates[p] = true
+	}
+	for _, p := range after.Plates {
+		if !plates[p] {
+			added.Plates = append(added.Plates, p)
+		}
+		delete(plates, p)
+	}
+	for p := range plates {
+		removed.Plates = append(removed.Plates, p)
+	}
+
+	apartments := make(map[apartmentLookup]bool)
+	for _, a := range before.Apartments {
+		apartments[a] = true
+	}
+	for _, a := range after.Apartments {
+		if !apartments[a] {
+			added.Apartments = append(added.Apartments, a)
+		}
+		delete(apartments, a)
+	}
+	for a := range apartments {
+		removed.Apartments = append(removed.Apartments, a)
+	}
+	return added, removed
+}
+
+func (l userLookups) IsEmpty() bool {
+	return len(l.Plates) == 0 && len(l.Apartments) == 0
+}
+
+var plateLookupType = types.Struct(
+	types.StructField("plate", types.TypeUTF8),
+	types.StructField("user_id", types.TypeInt64),
+)
+
+var apartmentLookupType = types.Struct(
+	types.StructField("house", types.TypeUTF8),
+	types.StructField("apartment", types.TypeUTF8),
+	types.StructField("user_id", types.TypeInt64),
+)
+
+func (l userLookups) platesValue() types.Value {
+	if len(l.Plates) == 0 {
+		return types.ZeroValue(types.List(plateLookupType))
+	}
+	var values []types.Value
+	for _, p := range l.Plates {
+		values = append(values, types.StructValue(
+			types.StructFieldValue("plate", types.UTF8Value(p.Plate)),
+			types.StructFieldValue("user_id", types.Int64Value(p.UserID)),
+		))
+	}
+	return types.ListValue(values...)
+}
+
+func (l userLookups) apartmentsValue() types.Value {
+	if len(l.Apartments) == 0 {
+		return types.ZeroValue(types.List(apartmentLookupType))
+	}
+	var values []types.Value
+	for _, a := range l.Apartments {
+		values = append(values, types.StructValue(
+			types.StructFieldValue("house", types.UTF8Value(a.House)),
+			types.StructFieldValue("apartment", types.UTF8Value(a.Apartment)),
+			types.StructFieldValue("user_id", types.Int64Value(a.UserID)),
+		))
+	}
+	return types.ListValue(values...)
+}
+
+const updateUserLookupsQuery = `
+DECLARE $added_plates AS List<Struct<plate:Utf8, user_id:Int64>>;
+DECLARE $removed_plates AS List<Struct<plate:Utf8, user_id:Int64>>;
+DECLARE $added_apartments AS List<Struct<house:Utf8, apartment:Utf8, user_id:Int64>>;
+DECLARE $removed_apartments AS List<Struct<house:Utf8, apartment:Utf8, user_id:Int64>>;
+
+DELETE FROM user_by_plate ON SELECT * FROM AS_TABLE($removed_plates);
+DELETE FROM user_by_apartment ON SELECT * FROM AS_TABLE($removed_apartments);
+UPSERT INTO user_by_plate SELECT * FROM AS_TABLE($added_plates);
+UPSERT INTO user_by_apartment SELECT * FROM AS_TABLE($added_apartments);
+`
+
+func (r *YDBUserStorage) updateLookups(ctx context.Context, s table.Session, added, removed userLookups) error {
+	ctx, span := tracer.Open(ctx, tracer.Named("YDBUserStorage::updateLookups"))
+	defer span.Close()
+	if added.IsEmpty() && removed.IsEmpty() {
+		return nil
+	}
+	_, _, err := s.Execute(ctx, table.DefaultTxControl(), updateUserLookupsQuery,
+		table.NewQueryParameters(
+			table.ValueParam("$added_plates", added.platesValue()),
+			table.ValueParam("$removed_plates", removed.platesValue()),
+			table.ValueParam("$added_apartments", added.apartmentsValue()),
+			table.ValueParam("$removed_apartments", removed.apartmentsValue()),
+		),
+	)
+	if err != nil {
+		return fmt.Errorf("обновление справочников пользователя: %w", err)
+	}
+	return nil
+}
+
+func (r *YDBUserStorage) clearLookups(ctx context.Context, s table.Session, userID int64) error {
+	ctx, span := tracer.Open(ctx, tracer.Named("YDBUserStorage::clearLookups"))
+	defer span.Close()
+	_, _, err := s.Execute(ctx, table.DefaultTxControl(),
+		`DECLARE $id AS Int64;
+DELETE FROM user_by_plate WHERE user_id = $id;
+DELETE FROM user_by_apartment WHERE user_id = $id;`,
+		table.NewQueryParameters(table.ValueParam("$id", types.Int64Value(userID))),
+	)
+	if err != nil {
+		return fmt.Errorf("очистка справочников пользователя [id=%d]: %w", userID, err)
+	}
+	return nil
+}
+
+func (r *YDBUserStorage) selectLookupUserIDs(ctx context.Context, query string, params *table.QueryParameters) ([]int64, error) {
+	ctx, span := tracer.Open(ctx, tracer.Named("YDBUserStorage::selectLookupUserIDs"))
+	defer span.Close()
+	var ids []int64
+	if err := r.smartExecute(ctx, func(ctx context.Context, s table.Session) error {
+		_, res, err := s.Execute(ctx, table.DefaultTxControl(), query, params)
+		if err != nil {
+			return fmt.Errorf("поиск по справочнику: %w", err)
+		}
+		defer res.Close()
+		if !res.NextResultSet(ctx) {
+			return fmt.Errorf("не нашел result set при поиске по справочнику")
+		}
+		for res.NextRow() {
+			var id int64
+			if err := res.ScanNamed(named.Required("user_id", &id)); err != nil {
+				return fmt.Errorf("скан user_id из справочника: %w", err)
+			}
+			ids = append(ids, id)
+		}
+		return res.Err()
+	}); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// firstMatchingUser достаёт пользователей по идентификаторам из справочника и возвращает первого,
+// для которого подтвердился match. Справочник может отставать от событий, поэтому ему не доверяем.
+func (r *YDBUserStorage) firstMatchingUser(ctx context.Context, ids []int64, match func(*User) bool) (*User, error) {
+	ctx, span := tracer.Open(ctx, tracer.Named("YDBUserStorage::firstMatchingUser"))
+	defer span.Close()
+	for _, id := range ids {
+		user, err := r.GetUser(ctx, UserQuery{ID: id})
+		if err != nil {
+			r.log.Error("Пользователь из справочника не найден", zap.Int64("id", id), zap.Error(err))
+			continue
+		}
+		if match(user) {
+			return user, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// RebuildLookups полностью пересобирает справочники из user_event
+func (r *YDBUserStorage) RebuildLookups(ctx context.Context) error {
+	ctx, span := tracer.Open(ctx, tracer.Named("YDBUserStorage::RebuildLookups"))
+	defer span.Close()
+	users, err := r.GetAllUsers(ctx)
+	if err != nil {
+		return fmt.Errorf("чтение пользователей для справочников: %w", err)
+	}
+	var all userLookups
+	for _, user := range users {
+		l := lookupsOf(user)
+		all.Plates = append(all.Plates, l.Plates...)
+		all.Apartments = append(all.Apartments, l.Apartments...)
+	}
+	r.log.Info("Пересобираю справочники",
+		zap.Int("users", len(users)),
+		zap.Int("plates", len(all.Plates)),
+		zap.Int("apartments", len(all.Apartments)),
+	)
+	return r.DB.Table().Do(ctx, func(ctx context.Context, s table.Session) error {
+		if _, _, err := s.Execute(ctx, table.DefaultTxControl(),
+			`DELETE FROM user_by_plate; DELETE FROM user_by_apartment;`,
+			table.NewQueryParameters(),
+		); err != nil {
+			return fmt.Errorf("очистка справочников: %w", err)
+		}
+		return r.updateLookups(ctx, s, all, userLookups{})
+	}, table.WithIdempotent())
+}
+
+// RawUserEvent строка user_event как она лежит в таблице, событие ещё не декодировано
+type RawUserEvent struct {
+	User      int64
+	Timestamp time.Time
+	ID        string
+	Type      string
+	// Version версия схемы события, 0 - записано до появления версий
+	Version uint32
+	Event   []byte
+}
+
+// LookupsBackfillParams параметры $plates и $apartments для заполнения user_by_plate и user_by_apartment
+// по строкам user_event, упорядоченным по пользователю и времени. Нужна миграциям: они читают user_event
+// своим запросом, привязанным к схеме своей версии, а не через хранилище, которое читает колонки новых миграций.
+// Недекодируемые события пропускаются, их количество возвращается в skipped.
+func LookupsBackfillParams(ctx context.Context, events []RawUserEvent) (params *table.QueryParameters, skipped int) {
+	ctx, span := tracer.Open(ctx, tracer.Named("LookupsBackfillParams"))
+	defer span.Close()
+	all, skipped := lookupsFromEvents(ctx, events)
+	return table.NewQueryParameters(
+		table.ValueParam("$plates", all.platesValue()),
+		table.ValueParam("$apartments", all.apartmentsValue()),
+	), skipped
+}
+
+func lookupsFromEvents(ctx context.Context, events []RawUserEvent) (all userLookups, skipped int) {
+	var user *User
+	flush := func() {
+		l := lookupsOf(user)
+		all.Plates = append(all.Plates, l.Plates...)
+		all.Apartments = append(all.Apartments, l.Apartments...)
+	}
+	for _, raw := range events {
+		if user != nil && user.ID != raw.User {
+			flush()
+			user = nil
+		}
+		if user == nil {
+			user = &User{ID: raw.User}
+		}
+		event, err := decodeUserEvent(ctx, raw.Type, raw.Version, raw.Event)
+		if err != nil {
+			skipped++
+			continue
+		}
+		record := UserEventRecord{User: raw.User, Timestamp: raw.Timestamp, ID: raw.ID, Type: raw.Type, Version: raw.Version, Event: event}
+		record.apply(ctx, user)
+	}
+	flush()
+	return all, skipped
+}
@@ -0,0 +1,62 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestUserLookupsDiff(t *testing.T) {
+	ctx := context.Background()
+	user := &User{ID: 42}
+	before := lookupsOf(user)
+	for _, event := range []UserEvent{
+		&RegisterCarLicensePlateEvent{LicensePlate: "X703BX96"},
+		&StartRegistrationEvent{HouseNumber: "108Г", HouseID: 4, Apartment: "3"},
+		&ConfirmRegistrationEvent{WithCode: "квитанция"},
+	} {
+		event.Apply(ctx, user)
+	}
+	added, removed := lookupsOf(user).diff(before)
+	if !removed.IsEmpty() {
+		t.Fatalf("expected nothing to be removed, got %#v", removed)
+	}
+	if len(added.Plates) != 1 || added.Plates[0] != (plateLookup{Plate: "X703BX96", UserID: 42}) {
+		t.Fatalf("expected plate lookup to be added, got %#v", added.Plates)
+	}
+	if len(added.Apartments) != 1 || added.Apartments[0] != (apartmentLookup{House: "108Г", Apartment: "3", UserID: 42}) {
+		t.Fatalf("expected apartment lookup to be added, got %#v", added.Apartments)
+	}
+
+	unchangedAdded, unchangedRemoved := lookupsOf(user).diff(lookupsOf(user))
+	if !unchangedAdded.IsEmpty() || !unchangedRemoved.IsEmpty() {
+		t.Fatalf("expected no changes for the same user, got +%#v -%#v", unchangedAdded, unchangedRemoved)
+	}
+
+	_, removedAll := userLookups{}.diff(lookupsOf(user))
+	if len(removedAll.Plates) != 1 || len(removedAll.Apartments) != 1 {
+		t.Fatalf("expected all lookups to be removed, got %#v", removedAll)
+	}
+}
+
+func TestLookupsFromRawEvents(t *testing.T) {
+	ctx := context.Background()
+	at := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	// строки без версии, как в user_event до миграции 5
+	events := []RawUserEvent{
+		{User: 1, Timestamp: at, ID: "a", Type: (*RegisterCarLicensePlateEvent)(nil).FQDN(), Event: []byte(`{"LicensePlate": "X703BX96"}`)},
+		{User: 1, Timestamp: at.Add(time.Second), ID: "b", Type: (*RegisterCarLicensePlateEvent)(nil).FQDN(), Event: []byte(`{"LicensePlate": 42}`)},
+		{User: 2, Timestamp: at, ID: "c", Type: (*StartRegistrationEvent)(nil).FQDN(), Event: []byte(`{"HouseNumber": "108Г", "HouseID": 4, "Apartment": "3"}`)},
+		{User: 2, Timestamp: at.Add(time.Second), ID: "d", Type: (*ConfirmRegistrationEvent)(nil).FQDN(), Event: []byte(`{"WithCode": "квитанция"}`)},
+	}
+	all, skipped := lookupsFromEvents(ctx, events)
+	if skipped != 1 {
+		t.Fatalf("expected the corrupt event to be skipped, got %d", skipped)
+	}
+	if len(all.Plates) != 1 || all.Plates[0] != (plateLookup{Plate: "X703BX96", UserID: 1}) {
+		t.Fatalf("expected plate lookup of the first user, got %#v", all.Plates)
+	}
+	if len(all.Apartments) != 1 || all.Apartments[0] != (apartmentLookup{House: "108Г", Apartment: "3", UserID: 2}) {
+		t.Fatalf("expected apartment lookup of the second user, got %#v", all.Apartments)
+	}
+}
@@ -0,0 +1,340 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"mikhailche/botcomod/lib/tracer.v2"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var ErrNotFound = fmt.Errorf("not found")
+
+// AnyStreamVersion отключает проверку версии потока при записи события
+const AnyStreamVersion int64 = -1
+
+// ErrStreamConflict поток событий пользователя изменился с момента чтения. Проверяется через errors.Is.
+var ErrStreamConflict = fmt.Errorf("stream version conflict")
+
+// StreamConflictError событие не записано: в потоке пользователя Actual событий, а ожидалось Expected
+type StreamConflictError struct {
+	UserID   int64
+	Expected int64
+	Actual   int64
+}
+
+func (e *StreamConflictError) Error() string {
+	return fmt.Sprintf("конфликт версий потока пользователя %d: ожидалась %d, сейчас %d", e.UserID, e.Expected, e.Actual)
+}
+
+func (e *StreamConflictError) Is(target error) bool {
+	return target == ErrStreamConflict
+}
+
+// UserStorage хранилище пользователей и их событий.
+// Реализации: YDBUserStorage и MemoryUserStorage. Обе возвращают ErrNotFound, если пользователя нет,
+// и применяют события в порядке (timestamp, id).
+type UserStorage interface {
+	GetUser(ctx context.Context, query UserQuery) (*User, error)
+	GetAllUsers(ctx context.Context) ([]*User, error)
+	// LogEvent дописывает событие без проверки версии потока
+	LogEvent(ctx context.Context, userID int64, event UserEvent) error
+	// AppendEvent дописывает событие, только если в потоке ровно expectedVersion событий,
+	// иначе возвращает *StreamConflictError. AnyStreamVersion отключает проверку.
+	AppendEvent(ctx context.Context, userID int64, expectedVersion int64, event UserEvent) error
+	ClearEvents(ctx context.Context, userID int64) error
+	// EventHistory все события пользователя в порядке применения. [User.Events] после снапшота
+	// содержит только события после него, полная история нужна для разбора.
+	EventHistory(ctx context.Context, userID int64) ([]UserEventRecord, error)
+	FindByVehicleLicensePlate(ctx context.Context, vehicleLicensePlate string) (*User, error)
+	FindByAppartment(ctx context.Context, house string, appartment string) (*User, error)
+	UpsertUsername(ctx context.Context, userID int64, username string)
+	DeadLetterStorage
+}
+
+// UserQuery условие поиска одного пользователя: по ID или, если задан, по Username
+type UserQuery struct {
+	ID       int64
+	Username string
+}
+
+func (q UserQuery) matches(user *User) bool {
+	if q.Username != "" {
+		return user.Username == q.Username
+	}
+	return user.ID == q.ID
+}
+
+// UserRepository пользователи поверх выбранного хранилища
+type UserRepository struct {
+	UserStorage
+	log         *zap.Logger
+	developerID int64
+}
+
+func NewUserRepository(ctx context.Context, storage UserStorage, log *zap.Logger, developerID int64) (*UserRepository, error) {
+	ctx, span := tracer.Open(ctx, tracer.Named("NewUserRepository"))
+	defer span.Close()
+	return &UserRepository{UserStorage: storage, log: log, developerID: developerID}, nil
+}
+
+func (r *UserRepository) ByID(userID int64) UserQuery {
+	return UserQuery{ID: userID}
+}
+
+func (r *UserRepository) ByUsername(username string) UserQuery {
+	return UserQuery{Username: username}
+}
+
+// GetUser возвращает пользователя из контекста, если это он, иначе идёт в хранилище
+func (r *UserRepository) GetUser(ctx context.Context, query UserQuery) (*User, error) {
+	ctx, span := tracer.Open(ctx, tracer.Named("UserRepository::GetUser"))
+	defer span.Close()
+	if user := CurrentUserFromContext(ctx); user != nil && query.matches(user) {
+		return user, nil
+	}
+	return r.UserStorage.GetUser(ctx, query)
+}
+
+type currentUserInContextKeyType int
+
+var currentUserInContextKey currentUserInContextKeyType
+
+func CurrentUserFromContext(ctx context.Context) *User {
+	u, _ := ctx.Value(currentUserInContextKey).(*User)
+	return u
+}
+
+func PutCurrentUserToContext(ctx context.Context, user *User) context.Context {
+	return context.WithValue(ctx, currentUserInContextKey, user)
+}
+
+// IsResident есть ли у пользователя действующее резидентство. Резидентство арендатора пропадает с окончанием аренды.
+func (r *UserRepository) IsResident(ctx context.Context, userID int64) bool {
+	ctx, span := tracer.Open(ctx, tracer.Named("UserRepository::IsResident"))
+	defer span.Close()
+	return len(r.ResidenciesOf(ctx, userID)) > 0
+}
+
+// ResidenciesOf действующие виды резидентства пользователя, см. [User.Residencies]
+func (r *UserRepository) ResidenciesOf(ctx context.Context, userID int64) []Residency {
+	ctx, span := tracer.Open(ctx, tracer.Named("UserRepository::ResidenciesOf"))
+	defer span.Close()
+	user, err := r.GetUser(ctx, r.ByID(userID))
+	if err != nil {
+		r.log.Error("Проблема определения резидентности", zap.Error(err))
+		return nil
+	}
+	return user.Residencies(time.Now())
+}
+
+// RolesOf роли пользователя. Разработчик из конфигурации всегда имеет роль разработчика,
+// иначе некому было бы выдать первую роль.
+func (r *UserRepository) RolesOf(user *User) UserRoles {
+	if user.ID == r.developerID && !user.Roles.Has(RoleDeveloper) {
+		return append(UserRoles{RoleDeveloper}, user.Roles...)
+	}
+	return user.Roles
+}
+
+// HasPermission есть ли у пользователя право хотя бы через одну из ролей
+func (r *UserRepository) HasPermission(ctx context.Context, userID int64, permission Permission) bool {
+	ctx, span := tracer.Open(ctx, tracer.Named("UserRepository::HasPermission"))
+	defer span.Close()
+	if userID == r.developerID {
+		return true
+	}
+	user, err := r.GetUser(ctx, r.ByID(userID))
+	if errors.Is(err, ErrNotFound) {
+		return false
+	}
+	if err != nil {
+		r.log.Error("Проблема проверки прав пользователя", zap.Int64("userID", userID), zap.Error(err))
+		return false
+	}
+	return r.RolesOf(user).Permits(permission)
+}
+
+func GenerateApproveCode(ctx context.Context, length int) string {
+	_, span := tracer.Open(ctx, tracer.Named("GenerateApproveCode"))
+	defer span.Close()
+	alphabet := []rune("123456789ABCEHKMOPTX")
+	var code []rune
+	for i := 0; i < length; i++ {
+		code = append(code, alphabet[rand.Intn(len(alphabet))])
+	}
+	return string(code)
+}
+
+func (r *UserRepository) StartRegistration(ctx context.Context, userID int64, updateID int64, houseID uint64, houseNumber string, apartment string) (string, error) {
+	ctx, span := tracer.Open(ctx)
+	defer span.Close()
+	const CodeLength = 5
+	approveCode := GenerateApproveCode(ctx, CodeLength)
+	var invalidCodes []string
+	for i := 0; i < 5; i++ {
+		invalidCodes = append(invalidCodes, GenerateApproveCode(ctx, CodeLength))
+	}
+	if err := r.LogEvent(ctx, userID, &StartRegistrationEvent{
+		UpdateID:         updateID,
+		HouseID:          houseID,
+		HouseNumber:      houseNumber,
+		Apartment:        apartment,
+		ApproveCode:      approveCode,
+		InvalidCodes:     invalidCodes,
+		DocumentRequired: true,
+	}); err != nil {
+		return "", fmt.Errorf("регистрация пользователя: %w", err)
+	}
+	return approveCode, nil
+}
+
+func (r *UserRepository) ConfirmRegistration(ctx context.Context, userID int64, expectedVersion int64, event ConfirmRegistrationEvent) error {
+	ctx, span := tracer.Open(ctx)
+	defer span.Close()
+	if err := r.AppendEvent(ctx, userID, expectedVersion, &event); err != nil {
+		return fmt.Errorf("подтверждение регистрации: %w", err)
+	}
+	return nil
+}
+
+func (r *UserRepository) FailRegistration(ctx context.Context, userID int64, expectedVersion int64, event FailRegistrationEvent) error {
+	ctx, span := tracer.Open(ctx)
+	defer span.Close()
+	if err := r.AppendEvent(ctx, userID, expectedVersion, &event); err != nil {
+		return fmt.Errorf("проваленная регистрация: %w", err)
+	}
+	return nil
+}
+
+// AddApartment заявка на квартиру или парковочное место. Заявки независимы: каждую проверяют отдельно.
+func (r *UserRepository) AddApartment(ctx context.Context, userID int64, expectedVersion int64, event AddApartmentEventV2) error {
+	ctx, span := tracer.Open(ctx)
+	defer span.Close()
+	if err := r.AppendEvent(ctx, userID, expectedVersion, &event); err != nil {
+		return fmt.Errorf("заявка на собственность: %w", err)
+	}
+	return nil
+}
+
+func (r *UserRepository) ConfirmApartment(ctx context.Context, userID int64, expectedVersion int64, event AdminConfirmedAddApartmentEventV2) error {
+	ctx, span := tracer.Open(ctx)
+	defer span.Close()
+	if err := r.AppendEvent(ctx, userID, expectedVersion, &event); err != nil {
+		return fmt.Errorf("подтверждение собственности: %w", err)
+	}
+	return nil
+}
+
+func (r *UserRepository) DeclineApartment(ctx context.Context, userID int64, expectedVersion int64, event AdminDeclinedAddApartmentEventV2) error {
+	ctx, span := tracer.Open(ctx)
+	defer span.Close()
+	if err := r.AppendEvent(ctx, userID, expectedVersion, &event); err != nil {
+		return fmt.Errorf("отклонение собственности: %w", err)
+	}
+	return nil
+}
+
+func (r *UserRepository) GrantRole(ctx context.Context, userID int64, event GrantRoleEvent) error {
+	ctx, span := tracer.Open(ctx)
+	defer span.Close()
+	if err := r.LogEvent(ctx, userID, &event); err != nil {
+		return fmt.Errorf("выдача роли %s: %w", event.Role, err)
+	}
+	return nil
+}
+
+func (r *UserRepository) RevokeRole(ctx context.Context, userID int64, event RevokeRoleEvent) error {
+	ctx, span := tracer.Open(ctx)
+	defer span.Close()
+	if err := r.LogEvent(ctx, userID, &event); err != nil {
+		return fmt.Errorf("отзыв роли %s: %w", event.Role, err)
+	}
+	return nil
+}
+
+func (r *UserRepository) RequestNewRegistrationPhoto(ctx context.Context, userID int64, expectedVersion int64, event RequestNewRegistrationPhotoEvent) error {
+	ctx, span := tracer.Open(ctx)
+	defer span.Close()
+	if err := r.AppendEvent(ctx, userID, expectedVersion, &event); err != nil {
+		return fmt.Errorf("запрос нового фото для регистрации: %w", err)
+	}
+	return nil
+}
+
+func (r *UserRepository) SubmitRegistrationDocument(ctx context.Context, userID int64, expectedVersion int64, event SubmitRegistrationDocumentEvent) error {
+	ctx, span := tracer.Open(ctx)
+	defer span.Close()
+	if err := r.AppendEvent(ctx, userID, expectedVersion, &event); err != nil {
+		return fmt.Errorf("документ для регистрации: %w", err)
+	}
+	return nil
+}
+
+func (r *UserRepository) CreateHouseholdInvite(ctx context.Context, userID int64, expectedVersion int64, event CreateHouseholdInviteEvent) error {
+	ctx, span := tracer.Open(ctx)
+	defer span.Close()
+	if err := r.AppendEvent(ctx, userID, expectedVersion, &event); err != nil {
+		return fmt.Errorf("приглашение домочадца: %w", err)
+	}
+	return nil
+}
+
+// AcceptHouseholdInvite отмечает приглашение использованным. Версия потока пригласившего не даёт
+// вступить по одной ссылке дважды: второе вступление получит [StreamConflictError].
+func (r *UserRepository) AcceptHouseholdInvite(ctx context.Context, inviterID int64, expectedVersion int64, event AcceptHouseholdInviteEvent) error {
+	ctx, span := tracer.Open(ctx)
+	defer span.Close()
+	if err := r.AppendEvent(ctx, inviterID, expectedVersion, &event); err != nil {
+		return fmt.Errorf("вступление по приглашению: %w", err)
+	}
+	return nil
+}
+
+func (r *UserRepository) RenewHousehold(ctx context.Context, userID int64, event RenewHouseholdEvent) error {
+	ctx, span := tracer.Open(ctx)
+	defer span.Close()
+	if err := r.LogEvent(ctx, userID, &event); err != nil {
+		return fmt.Errorf("продление доступа домочадца: %w", err)
+	}
+	return nil
+}
+
+func (r *UserRepository) JoinHousehold(ctx context.Context, userID int64, event JoinHouseholdEvent) error {
+	ctx, span := tracer.Open(ctx)
+	defer span.Close()
+	if err := r.LogEvent(ctx, userID, &event); err != nil {
+		return fmt.Errorf("вступление в квартиру домочадцем: %w", err)
+	}
+	return nil
+}
+
+func (r *UserRepository) RevokeHouseholdMember(ctx context.Context, userID int64, expectedVersion int64, event RevokeHouseholdMemberEvent) error {
+	ctx, span := tracer.Open(ctx)
+	defer span.Close()
+	if err := r.AppendEvent(ctx, userID, expectedVersion, &event); err != nil {
+		return fmt.Errorf("исключение домочадца: %w", err)
+	}
+	return nil
+}
+
+func (r *UserRepository) LeaveHousehold(ctx context.Context, userID int64, event LeaveHouseholdEvent) error {
+	ctx, span := tracer.Open(ctx)
+	defer span.Close()
+	if err := r.LogEvent(ctx, userID, &event); err != nil {
+		return fmt.Errorf("выход из квартиры домочадца: %w", err)
+	}
+	return nil
+}
+
+func (r *UserRepository) RegisterCarLicensePlate(ctx context.Context, userID int64, event RegisterCarLicensePlateEvent) error {
+	ctx, span := tracer.Open(ctx)
+	defer span.Close()
+	if err := r.LogEvent(ctx, userID, &event); err != nil {
+		return fmt.Errorf("провалена регистрация авто: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package repository
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mikhailche/botcomod/lib/tracer.v2"
+	"sort"
+	"time"
+
+	"github.com/ydb-platform/ydb-go-sdk/v3/table"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/result/named"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/types"
+	"go.uber.org/zap"
+)
+
+// userProjectionSchema версия структуры снапшота. Увеличивать при изменении userSnapshotState.
+const userProjectionSchema = 10
+
+// versionedApply событие может объявить версию своего Apply.
+// Её нужно увеличивать при любом изменении логики Apply, чтобы снапшоты пересобрались.
+// События без этого метода считаются версии 1.
+type versionedApply interface {
+	ApplyVersion() int
+}
+
+func applyVersionOf(event UserEvent) int {
+	if v, ok := event.(versionedApply); ok {
+		return v.ApplyVersion()
+	}
+	return 1
+}
+
+func projectionVersionOf(events []UserEvent) string {
+	var parts []string
+	for _, event := range events {
+		parts = append(parts, fmt.Sprintf("%s:%d", event.FQDN(), applyVersionOf(event)))
+	}
+	sort.Strings(parts)
+	hash := sha256.New()
+	_, _ = fmt.Fprintf(hash, "schema:%d\n", userProjectionSchema)
+	for _, part := range parts {
+		_, _ = fmt.Fprintln(hash, part)
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:16]
+}
+
+// userProjectionVersion версия проекции пользователя для текущего набора событий.
+// Снапшоты с другой версией игнорируются и пересобираются из полной истории.
+var userProjectionVersion = projectionVersionOf(knownUserEventTypes[:])
+
+// userEventPosition позиция события в потоке пользователя. События упорядочены по (timestamp, id).
+type userEventPosition struct {
+	Timestamp time.Time
+	ID        string
+}
+
+// userSnapshotState сохраняемая часть проекции пользователя
+type userSnapshotState struct {
+	Apartments         UserApartments
+	Cars               Cars
+	IsApprovedResident bool
+	Registration       *tRegistration
+	PrivateProperty    tPrivatePropertySet
+	Roles              UserRoles
+	Household          tHousehold
+}
+
+func snapshotStateOf(u *User) userSnapshotState {
+	return userSnapshotState{
+		Apartments:         u.Apartments,
+		Cars:               u.Cars,
+		IsApprovedResident: u.IsApprovedResident,
+		Registration:       u.Registration,
+		PrivateProperty:    u.PrivateProperty,
+		Roles:              u.Roles,
+		Household:          u.Household,
+	}
+}
+
+func (s userSnapshotState) restore(u *User) {
+	u.Apartments = s.Apartments
+	u.Cars = s.Cars
+	u.IsApprovedResident = s.IsApprovedResident
+	u.Registration = s.Registration
+	u.PrivateProperty = s.PrivateProperty
+	u.Roles = s.Roles
+	u.Household = s.Household
+	if u.PrivateProperty.Items == nil {
+		u.PrivateProperty.Items = make(map[string]tPrivatePropertyItem)
+	}
+}
+
+type userSnapshot struct {
+	Position      userEventPosition
+	StreamVersion int64
+	State         userSnapshotState
+}
+
+func (r *YDBUserStorage) loadSnapshot(ctx context.Context, s table.Session, userID int64) (*userSnapshot, error) {
+	ctx, span := tracer.Open(ctx, tracer.Named("YDBUserStorage::loadSnapshot"))
+	defer span.Close()
+	_, res, err := s.Execute(ctx, table.DefaultTxControl(),
+		`DECLARE $id AS Int64;
+DECLARE $version AS Utf8;
+SELECT event_timestamp, event_id, stream_version, state FROM user_snapshot WHERE user_id = $id AND projection_version = $version;`,
+		table.NewQueryParameters(
+			table.ValueParam("$id", types.Int64Value(userID)),
+			table.ValueParam("$version", types.UTF8Value(userProjectionVersion)),
+		),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("SELECT user_snapshot [id=%d]: %w", userID, err)
+	}
+	defer res.Close()
+	if !res.NextResultSet(ctx) || !res.NextRow() {
+		return nil, res.Err()
+	}
+	var snapshot userSnapshot
+	var state []byte
+	if err := res.ScanNamed(
+		named.OptionalWithDefault("event_timestamp", &snapshot.Position.Timestamp),
+		named.OptionalWithDefault("event_id", &snapshot.Position.ID),
+		named.OptionalWithDefault("stream_version", &snapshot.StreamVersion),
+		named.OptionalWithDefault("state", &state),
+	); err != nil {
+		return nil, fmt.Errorf("скан снапшота пользователя [id=%d]: %w", userID, err)
+	}
+	if err := json.Unmarshal(state, &snapshot.State); err != nil {
+		return nil, fmt.Errorf("парсинг снапшота пользователя [id=%d]: %w", userID, err)
+	}
+	return &snapshot, nil
+}
+
+func (r *YDBUserStorage) saveSnapshot(ctx context.Context, s table.Session, user *User, position userEventPosition) error {
+	ctx, span := tracer.Open(ctx, tracer.Named("YDBUserStorage::saveSnapshot"))
+	defer span.Close()
+	state, err := json.Marshal(snapshotStateOf(user))
+	if err != nil {
+		return fmt.Errorf("сериализация снапшота пользователя [id=%d]: %w", user.ID, err)
+	}
+	_, _, err = s.Execute(ctx, table.DefaultTxControl(),
+		`DECLARE $id AS Int64;
+DECLARE $version AS Utf8;
+DECLARE $event_timestamp AS Timestamp;
+DECLARE $event_id AS String;
+DECLARE $stream_version AS Int64;
+DECLARE $state AS JsonDocument;
+DECLARE $updated_at AS Timestamp;
+UPSERT INTO user_snapshot (user_id, projection_version, event_timestamp, event_id, stream_version, state, updated_at)
+VALUES ($id, $version, $event_timestamp, $event_id, $stream_version, $state, $updated_at);`,
+		table.NewQueryParameters(
+			table.ValueParam("$id", types.Int64Value(user.ID)),
+			table.ValueParam("$version", types.UTF8Value(userProjectionVersion)),
+			table.ValueParam("$event_timestamp", types.TimestampValueFromTime(position.Timestamp)),
+			table.ValueParam("$event_id", types.StringValueFromString(position.ID)),
+			table.ValueParam("$stream_version", types.Int64Value(user.StreamVersion)),
+			table.ValueParam("$state", types.JSONDocumentValueFromBytes(state)),
+			table.ValueParam("$updated_at", types.TimestampValueFromTime(time.Now())),
+		),
+	)
+	if err != nil {
+		return fmt.Errorf("UPSERT user_snapshot [id=%d]: %w", user.ID, err)
+	}
+	return nil
+}
+
+func (r *YDBUserStorage) deleteSnapshot(ctx context.Context, s table.Session, userID int64) error {
+	ctx, span := tracer.Open(ctx, tracer.Named("YDBUserStorage::deleteSnapshot"))
+	defer span.Close()
+	_, _, err := s.Execute(ctx, table.DefaultTxControl(),
+		`DECLARE $id AS Int64;
+DELETE FROM user_snapshot WHERE user_id = $id;`,
+		table.NewQueryParameters(table.ValueParam("$id", types.Int64Value(userID))),
+	)
+	if err != nil {
+		return fmt.Errorf("DELETE user_snapshot [id=%d]: %w", userID, err)
+	}
+	return nil
+}
+
+func (r *YDBUserStorage) logSnapshotError(err error, userID int64) {
+	if err != nil {
+		r.log.Error("Ошибка работы со снапшотом пользователя", zap.Int64("id", userID), zap.Error(err))
+	}
+}
@@ -0,0 +1,65 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+type reappliedStartRegistrationEvent struct {
+	StartRegistrationEvent
+}
+
+func (e *reappliedStartRegistrationEvent) ApplyVersion() int {
+	return e.StartRegistrationEvent.ApplyVersion() + 1
+}
+
+func TestProjectionVersionChanges(t *testing.T) {
+	base := projectionVersionOf(knownUserEventTypes[:])
+	if base != userProjectionVersion {
+		t.Fatalf("expected projection version to be computed from known events, got %s and %s", base, userProjectionVersion)
+	}
+	if reordered := projectionVersionOf([]UserEvent{knownUserEventTypes[1], knownUserEventTypes[0]}); reordered != projectionVersionOf(knownUserEventTypes[:2]) {
+		t.Fatalf("expected projection version not to depend on order of events")
+	}
+	if fewer := projectionVersionOf(knownUserEventTypes[1:]); fewer == base {
+		t.Fatalf("expected projection version to change when list of events changes")
+	}
+	bumped := append([]UserEvent{&reappliedStartRegistrationEvent{}}, knownUserEventTypes[1:]...)
+	if projectionVersionOf(bumped) == base {
+		t.Fatalf("expected projection version to change when Apply version changes")
+	}
+}
+
+func TestSnapshotStateRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	var user User
+	for _, event := range []UserEvent{
+		&RegisterCarLicensePlateEvent{LicensePlate: "X703BX96"},
+		&StartRegistrationEvent{HouseNumber: "108Г", HouseID: 4, Apartment: "3", ApproveCode: "3А2СХ"},
+		&AddApartmentEventV2{HouseID: 5, Apartment: "12"},
+		&AdminConfirmedAddApartmentEventV2{HouseID: 5, Apartment: "12"},
+		&GrantRoleEvent{AdminUserID: 1, Role: RoleRegistrar},
+	} {
+		event.Apply(ctx, &user)
+	}
+	bb, err := json.Marshal(snapshotStateOf(&user))
+	if err != nil {
+		t.Fatalf("cannot marshal snapshot: %v", err)
+	}
+	var state userSnapshotState
+	if err := json.Unmarshal(bb, &state); err != nil {
+		t.Fatalf("cannot unmarshal snapshot: %v", err)
+	}
+	var restored User
+	state.restore(&restored)
+	if !reflect.DeepEqual(snapshotStateOf(&user), snapshotStateOf(&restored)) {
+		t.Fatalf("restored user differs:\nwant %#v\ngot  %#v", snapshotStateOf(&user), snapshotStateOf(&restored))
+	}
+
+	(&ConfirmRegistrationEvent{WithCode: "квитанция"}).Apply(ctx, &restored)
+	if !restored.IsApprovedResident || len(restored.Apartments) != 1 {
+		t.Fatalf("expected events to apply on top of restored snapshot, got %#v", restored)
+	}
+}
@@ -3,6 +3,7 @@ package repository
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"go.uber.org/zap"
@@ -12,6 +13,7 @@ import (
 	"time"
 
 	"github.com/ydb-platform/ydb-go-sdk/v3/table"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/result/named"
 	"github.com/ydb-platform/ydb-go-sdk/v3/table/types"
 )
 
@@ -24,19 +26,68 @@ type StartRegistrationEvent struct {
 	UpdateID     int64
 	HouseNumber  string
 	HouseID      uint64
-	Apartment    string `json:"Appartment"`
+	Apartment    string
 	ApproveCode  string
 	InvalidCodes []string
+	// DocumentRequired заявка ждёт документ, см. SubmitRegistrationDocumentEvent.
+	// Пусто в событиях до появления отметки о документе: документ по ним мог прийти раньше и нигде не записан.
+	DocumentRequired bool `json:",omitempty"`
+}
+
+// EventVersion 2: квартира хранится под ключом Apartment вместо Appartment
+func (e *StartRegistrationEvent) EventVersion() uint32 {
+	return 2
+}
+
+// ApplyVersion 2: запоминает время заявки, 3: запоминает номер дома в собственности, 4: резидентство собственника,
+// 5: ждёт ли заявка документ
+func (e *StartRegistrationEvent) ApplyVersion() int {
+	return 5
+}
+
+// RegistrationDecision решение регистратора по заявке
+type RegistrationDecision string
+
+const (
+	RegistrationApproved         RegistrationDecision = "approved"
+	RegistrationNewPhotoRequired RegistrationDecision = "new_photo"
+	RegistrationFailed           RegistrationDecision = "failed"
+)
+
+// RegistrationReview кто, как и почему решил заявку на регистрацию.
+// Пусто в событиях до появления проверки регистраторами и при подтверждении кодом из почты.
+type RegistrationReview struct {
+	ReviewerID int64                `json:",omitempty"`
+	Decision   RegistrationDecision `json:",omitempty"`
+	Reason     string               `json:",omitempty"`
 }
 
 type ConfirmRegistrationEvent struct {
 	UpdateID int64
 	WithCode string
+	RegistrationReview
 }
 
 type FailRegistrationEvent struct {
 	UpdateID int64
 	WithCode string
+	RegistrationReview
+}
+
+// RequestNewRegistrationPhotoEvent регистратор попросил прислать фото заново. Заявка остаётся на проверке.
+// Дом и номер заполнены у заявок из [AddApartmentEventV2], у старой регистрации заявка одна.
+type RequestNewRegistrationPhotoEvent struct {
+	UpdateID  int64
+	HouseID   uint64       `json:",omitempty"`
+	Apartment string       `json:",omitempty"`
+	Kind      PropertyKind `json:",omitempty"`
+	RegistrationReview
+}
+
+// SubmitRegistrationDocumentEvent пользователь прислал фото документа. Оно уходит регистраторам
+// по всем заявкам, для которых документа ещё не было.
+type SubmitRegistrationDocumentEvent struct {
+	UpdateID int64
 }
 
 type RegisterCarLicensePlateEvent struct {
@@ -55,6 +106,17 @@ type AddApartmentEventV2 struct {
 	Apartment    string
 	ApproveCode  string
 	InvalidCodes []string
+	// Kind квартира или парковочное место, тогда Apartment - номер места
+	Kind PropertyKind `json:",omitempty"`
+	// HouseNumber номер дома, по нему резидента ищут соседи
+	HouseNumber string `json:",omitempty"`
+	// Residency кем пользователь приходится квартире или месту. Пусто - собственник.
+	Residency Residency `json:",omitempty"`
+	// ExpiresAt окончание аренды, после него доступ резидента пропадает. Пусто - бессрочно.
+	ExpiresAt time.Time `json:",omitempty"`
+	// DocumentRequired заявка ждёт документ, см. SubmitRegistrationDocumentEvent.
+	// Пусто в событиях до появления отметки о документе: документ по ним мог прийти раньше и нигде не записан.
+	DocumentRequired bool `json:",omitempty"`
 }
 
 // AdminConfirmedAddApartmentEventV2 Событие означает, что администратор подтвердил резиденство от [AddApartmentEventV2]
@@ -62,6 +124,9 @@ type AdminConfirmedAddApartmentEventV2 struct {
 	AdminUserID int64
 	HouseID     uint64
 	Apartment   string
+	Kind        PropertyKind `json:",omitempty"`
+	// ExpiresAt срок аренды по договору, который поставил регистратор. Пусто - остаётся срок из заявки.
+	ExpiresAt time.Time `json:",omitempty"`
 }
 
 // AdminDeclinedAddApartmentEventV2 Событие означает, что администратор отверг запрос на резиденство от [AddApartmentEventV2]
@@ -70,6 +135,7 @@ type AdminDeclinedAddApartmentEventV2 struct {
 	HouseID     uint64
 	Apartment   string
 	Reason      string
+	Kind        PropertyKind `json:",omitempty"`
 }
 
 func (e *StartRegistrationEvent) Apply(ctx context.Context, u *User) {
@@ -78,7 +144,14 @@ func (e *StartRegistrationEvent) Apply(ctx context.Context, u *User) {
 	u.Registration = &tRegistration{
 		Events: tRegistrationEvents{Start: e},
 	}
-	u.PrivateProperty.Add(e.HouseID, e.Apartment)
+	u.PrivateProperty.Add(tPrivatePropertyItem{
+		HouseID:          e.HouseID,
+		HouseNumber:      e.HouseNumber,
+		ApartmentNumber:  e.Apartment,
+		RequestedAt:      eventTime(ctx),
+		Residency:        ResidencyOwner,
+		DocumentRequired: e.DocumentRequired,
+	})
 }
 
 func (e *ConfirmRegistrationEvent) Apply(ctx context.Context, u *User) {
@@ -88,7 +161,7 @@ func (e *ConfirmRegistrationEvent) Apply(ctx context.Context, u *User) {
 		// skipping bad event, like a duplicate
 		return
 	}
-	u.PrivateProperty.Approve(u.Registration.Events.Start.HouseID, u.Registration.Events.Start.Apartment)
+	u.PrivateProperty.Approve(PropertyApartment, u.Registration.Events.Start.HouseID, u.Registration.Events.Start.Apartment)
 	u.Apartments = append(u.Apartments, Apartment{
 		HouseNumber:     u.Registration.Events.Start.HouseNumber,
 		HouseID:         u.Registration.Events.Start.HouseID,
@@ -103,11 +176,37 @@ func (e *FailRegistrationEvent) Apply(ctx context.Context, u *User) {
 	ctx, span := tracer.Open(ctx, tracer.Named("failRegistrationEvent::Apply"))
 	defer span.Close()
 	if u.Registration != nil {
-		u.PrivateProperty.RemoveIfNotApproved(u.Registration.Events.Start.HouseID, u.Registration.Events.Start.Apartment)
+		u.PrivateProperty.RemoveIfNotApproved(PropertyApartment, u.Registration.Events.Start.HouseID, u.Registration.Events.Start.Apartment)
 		u.Registration = nil
 	}
 }
 
+// ApplyVersion 2: снимает отметку о присланном документе, 3: и старая заявка тоже начинает ждать документ
+func (e *RequestNewRegistrationPhotoEvent) ApplyVersion() int {
+	return 3
+}
+
+func (e *RequestNewRegistrationPhotoEvent) Apply(ctx context.Context, u *User) {
+	ctx, span := tracer.Open(ctx, tracer.Named("requestNewRegistrationPhotoEvent::Apply"))
+	defer span.Close()
+	// заявка остаётся на проверке, но ждёт нового фото
+	if e.HouseID == 0 && e.Apartment == "" && u.Registration != nil && u.Registration.Events.Start != nil {
+		u.PrivateProperty.SetSubmitted(PropertyApartment, u.Registration.Events.Start.HouseID, u.Registration.Events.Start.Apartment, time.Time{})
+		return
+	}
+	u.PrivateProperty.SetSubmitted(e.Kind, e.HouseID, e.Apartment, time.Time{})
+}
+
+func (e *SubmitRegistrationDocumentEvent) Apply(ctx context.Context, u *User) {
+	ctx, span := tracer.Open(ctx, tracer.Named("submitRegistrationDocumentEvent::Apply"))
+	defer span.Close()
+	for _, item := range u.PrivateProperty.List() {
+		if !item.Approved && item.SubmittedAt.IsZero() {
+			u.PrivateProperty.SetSubmitted(item.Kind, item.HouseID, item.ApartmentNumber, eventTime(ctx))
+		}
+	}
+}
+
 func (e *RegisterCarLicensePlateEvent) Apply(ctx context.Context, u *User) {
 	ctx, span := tracer.Open(ctx, tracer.Named("registerCarLicensePlateEvent::Apply"))
 	defer span.Close()
@@ -119,22 +218,49 @@ func (e *RegisterCarLicensePlateEvent) Apply(ctx context.Context, u *User) {
 	u.Cars = append(u.Cars, Car{LicensePlate: e.LicensePlate})
 }
 
+// ApplyVersion 2: запоминает время заявки, 3: вид собственности и номер дома, 4: вид резидентства и срок аренды,
+// 5: ждёт ли заявка документ
+func (a *AddApartmentEventV2) ApplyVersion() int {
+	return 5
+}
+
 func (a *AddApartmentEventV2) Apply(ctx context.Context, user *User) {
 	ctx, span := tracer.Open(ctx)
 	defer span.Close()
-	user.PrivateProperty.Add(a.HouseID, a.Apartment)
+	user.PrivateProperty.Add(tPrivatePropertyItem{
+		Kind:             a.Kind,
+		HouseID:          a.HouseID,
+		HouseNumber:      a.HouseNumber,
+		ApartmentNumber:  a.Apartment,
+		RequestedAt:      eventTime(ctx),
+		Residency:        a.Residency.orOwner(),
+		ExpiresAt:        a.ExpiresAt,
+		DocumentRequired: a.DocumentRequired,
+	})
+}
+
+// ApplyVersion 2: подтверждённая собственность делает пользователя резидентом, 3: срок аренды от регистратора
+func (a *AdminConfirmedAddApartmentEventV2) ApplyVersion() int {
+	return 3
 }
 
 func (a *AdminConfirmedAddApartmentEventV2) Apply(ctx context.Context, user *User) {
 	ctx, span := tracer.Open(ctx)
 	defer span.Close()
-	user.PrivateProperty.Approve(a.HouseID, a.Apartment)
+	if !user.PrivateProperty.Approve(a.Kind, a.HouseID, a.Apartment) {
+		return
+	}
+	user.IsApprovedResident = true
+	if ppi, _ := user.PrivateProperty.Find(a.Kind, a.HouseID, a.Apartment); !a.ExpiresAt.IsZero() {
+		ppi.ExpiresAt = a.ExpiresAt
+		user.PrivateProperty.Add(ppi)
+	}
 }
 
 func (a *AdminDeclinedAddApartmentEventV2) Apply(ctx context.Context, user *User) {
 	ctx, span := tracer.Open(ctx)
 	defer span.Close()
-	user.PrivateProperty.RemoveIfNotApproved(a.HouseID, a.Apartment)
+	user.PrivateProperty.RemoveIfNotApproved(a.Kind, a.HouseID, a.Apartment)
 }
 
 func (e *StartRegistrationEvent) FQDN() string {
@@ -146,6 +272,12 @@ func (e *ConfirmRegistrationEvent) FQDN() string {
 func (e *FailRegistrationEvent) FQDN() string {
 	return "*bot.failRegistrationEvent"
 }
+func (e *RequestNewRegistrationPhotoEvent) FQDN() string {
+	return "RequestNewRegistrationPhotoEvent"
+}
+func (e *SubmitRegistrationDocumentEvent) FQDN() string {
+	return "SubmitRegistrationDocumentEvent"
+}
 func (e *RegisterCarLicensePlateEvent) FQDN() string {
 	return "*bot.registerCarLicensePlateEvent"
 }
@@ -167,6 +299,16 @@ var knownUserEventTypes = [...]UserEvent{
 	(*AddApartmentEventV2)(nil),
 	(*AdminConfirmedAddApartmentEventV2)(nil),
 	(*AdminDeclinedAddApartmentEventV2)(nil),
+	(*GrantRoleEvent)(nil),
+	(*RequestNewRegistrationPhotoEvent)(nil),
+	(*RevokeRoleEvent)(nil),
+	(*CreateHouseholdInviteEvent)(nil),
+	(*AcceptHouseholdInviteEvent)(nil),
+	(*JoinHouseholdEvent)(nil),
+	(*RevokeHouseholdMemberEvent)(nil),
+	(*LeaveHouseholdEvent)(nil),
+	(*SubmitRegistrationDocumentEvent)(nil),
+	(*RenewHouseholdEvent)(nil),
 }
 
 func SelectType(ctx context.Context, typeName string) UserEvent {
@@ -186,8 +328,33 @@ type logEventParameters struct {
 	DryRun bool
 }
 
-func (r *UserRepository) LogEvent(ctx context.Context, userID int64, event UserEvent) error {
-	ctx, span := tracer.Open(ctx, tracer.Named("UserRepository::LogEvent"))
+func (r *YDBUserStorage) LogEvent(ctx context.Context, userID int64, event UserEvent) error {
+	return r.AppendEvent(ctx, userID, AnyStreamVersion, event)
+}
+
+// appendUserEventQuery пишет событие, только если в потоке ровно $expected событий (или $expected < 0).
+// Проверка и запись в одном запросе, поэтому выполняются в одной serializable транзакции.
+const appendUserEventQuery = `
+DECLARE $user AS Int64;
+DECLARE $timestamp AS Timestamp;
+DECLARE $id AS String;
+DECLARE $type AS String;
+DECLARE $version AS Uint32;
+DECLARE $event AS JsonDocument;
+DECLARE $expected AS Int64;
+
+$current = (SELECT CAST(COUNT(*) AS Int64) FROM user_event WHERE user = $user);
+
+UPSERT INTO user_event (user, timestamp, id, type, version, event)
+SELECT $user AS user, $timestamp AS timestamp, $id AS id, $type AS type, $version AS version, $event AS event
+FROM AS_TABLE(AsList(AsStruct(1 AS one)))
+WHERE $expected < 0 OR $current = $expected;
+
+SELECT $current AS current;
+`
+
+func (r *YDBUserStorage) AppendEvent(ctx context.Context, userID int64, expectedVersion int64, event UserEvent) error {
+	ctx, span := tracer.Open(ctx, tracer.Named("YDBUserStorage::AppendEvent"))
 	defer span.Close()
 	var params logEventParameters
 	params.Now = time.Now()
@@ -196,34 +363,54 @@ func (r *UserRepository) LogEvent(ctx context.Context, userID int64, event UserE
 	if err != nil {
 		return fmt.Errorf("сериализация события %v: %w", event, err)
 	}
-	r.log.Debug("LogEvent", zap.Any("event", event), zap.Any("params", params))
+	r.log.Debug("AppendEvent", zap.Any("event", event), zap.Any("params", params), zap.Int64("expectedVersion", expectedVersion))
 	if params.DryRun {
 		return nil
 	}
 
 	upsertOperation := func(ctx context.Context, s table.Session) error {
-		_, _, err := s.Execute(
+		user, err := r.byIDUncached(userID)(ctx, s)
+		if errors.Is(err, ErrNotFound) {
+			user = &User{ID: userID}
+		} else if err != nil {
+			return fmt.Errorf("состояние пользователя до события: %w", err)
+		}
+		if expectedVersion != AnyStreamVersion && user.StreamVersion != expectedVersion {
+			return &StreamConflictError{UserID: userID, Expected: expectedVersion, Actual: user.StreamVersion}
+		}
+		lookupsBefore := lookupsOf(user)
+		event.Apply(withEventTime(ctx, params.Now), user)
+		added, removed := lookupsOf(user).diff(lookupsBefore)
+
+		_, res, err := s.Execute(
 			ctx,
 			table.DefaultTxControl(),
-			"DECLARE $user AS Int64;"+
-				"DECLARE $timestamp AS Timestamp;"+
-				"DECLARE $id AS String;"+
-				"DECLARE $type AS String;"+
-				"DECLARE $event AS JsonDocument;"+
-				"UPSERT INTO `user_event` (user, timestamp, id, type, event)"+
-				"VALUES ($user, $timestamp, $id, $type, $event);",
+			appendUserEventQuery,
 			table.NewQueryParameters(
 				table.ValueParam("$user", types.Int64Value(userID)),
 				table.ValueParam("$timestamp", types.TimestampValueFromTime(params.Now)),
 				table.ValueParam("$id", types.StringValueFromString(params.UUID)),
 				table.ValueParam("$type", types.StringValueFromString(event.FQDN())),
+				table.ValueParam("$version", types.Uint32Value(eventVersionOf(event))),
 				table.ValueParam("$event", types.JSONDocumentValueFromBytes(eventBytes)),
+				table.ValueParam("$expected", types.Int64Value(expectedVersion)),
 			),
 		)
 		if err != nil {
 			return fmt.Errorf("upsert user_event: %w", err)
 		}
-		return nil
+		defer res.Close()
+		var current int64
+		if !res.NextResultSet(ctx) || !res.NextRow() {
+			return fmt.Errorf("upsert user_event: не вернулась версия потока: %w", res.Err())
+		}
+		if err := res.ScanNamed(named.OptionalWithDefault("current", &current)); err != nil {
+			return fmt.Errorf("upsert user_event: скан версии потока: %w", err)
+		}
+		if expectedVersion != AnyStreamVersion && current != expectedVersion {
+			return &StreamConflictError{UserID: userID, Expected: expectedVersion, Actual: current}
+		}
+		return r.updateLookups(ctx, s, added, removed)
 	}
 	if sess := ydbctx.YdbSessionFromContext(ctx); sess != nil {
 		return upsertOperation(ctx, sess)
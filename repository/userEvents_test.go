@@ -2,7 +2,9 @@ package repository
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -350,6 +352,43 @@ func TestApplyUserEvents(t *testing.T) {
 				return nil
 			},
 		},
+		"ApartmentAndParkingReviewedIndependentlyV2": {
+			args: args{events: []UserEvent{&AddApartmentEventV2{
+				HouseID:     4,
+				HouseNumber: "108Г",
+				Apartment:   "3",
+			}, &AddApartmentEventV2{
+				HouseID:     4,
+				HouseNumber: "108Г",
+				Apartment:   "3",
+				Kind:        PropertyParking,
+			}, &AdminConfirmedAddApartmentEventV2{
+				AdminUserID: 78225,
+				HouseID:     4,
+				Apartment:   "3",
+			}, &AdminDeclinedAddApartmentEventV2{
+				AdminUserID: 78225,
+				HouseID:     4,
+				Apartment:   "3",
+				Kind:        PropertyParking,
+			}}},
+			validator: func(u User) error {
+				if len(u.PrivateProperty.Items) != 1 {
+					return fmt.Errorf("ожидалась только подтверждённая квартира, получил %#v", u.PrivateProperty.Items)
+				}
+				if item, ok := u.PrivateProperty.Find(PropertyApartment, 4, "3"); !ok || !item.Approved {
+					return fmt.Errorf("квартира должна быть подтверждена, получил %#v", u.PrivateProperty.Items)
+				}
+				if !u.IsApprovedResident {
+					return fmt.Errorf("подтверждённая квартира делает резидентом")
+				}
+				expected := []Apartment{{HouseNumber: "108Г", HouseID: 4, ApartmentNumber: "3"}}
+				if got := u.ResidentApartments(time.Now()); !reflect.DeepEqual(got, expected) {
+					return fmt.Errorf("ожидал квартиры резидента %#v, получил %#v", expected, got)
+				}
+				return nil
+			},
+		},
 	}
 
 	for name, subtest := range subtests {
@@ -368,3 +407,20 @@ func TestApplyUserEvents(t *testing.T) {
 		}(subtest))
 	}
 }
+
+func TestRegistrationReviewIsBackwardCompatible(t *testing.T) {
+	var old ConfirmRegistrationEvent
+	if err := json.Unmarshal([]byte(`{"UpdateID":7,"WithCode":"квитанция"}`), &old); err != nil {
+		t.Fatalf("old event: %v", err)
+	}
+	if old.WithCode != "квитанция" || old.RegistrationReview != (RegistrationReview{}) {
+		t.Fatalf("old event decoded as %#v", old)
+	}
+	bb, err := json.Marshal(&FailRegistrationEvent{UpdateID: 8, RegistrationReview: RegistrationReview{ReviewerID: 5, Decision: RegistrationFailed, Reason: "r"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"UpdateID":8,"WithCode":"","ReviewerID":5,"Decision":"failed","Reason":"r"}`; string(bb) != want {
+		t.Fatalf("review fields must be stored flat next to event fields:\nwant %s\ngot  %s", want, bb)
+	}
+}
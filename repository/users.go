@@ -4,10 +4,10 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"math/rand"
 	"mikhailche/botcomod/handlers/middleware/ydbctx"
-	"mikhailche/botcomod/lib/devbotsender"
 	"mikhailche/botcomod/lib/tracer.v2"
+	"slices"
+	"sort"
 	"time"
 
 	"mikhailche/botcomod/lib/errors"
@@ -68,51 +68,135 @@ type tRegistration struct {
 	Events tRegistrationEvents
 }
 
+// PropertyKind вид частной собственности
+type PropertyKind string
+
+const (
+	// PropertyApartment квартира. Пустая строка, как во всех событиях до появления парковок.
+	PropertyApartment PropertyKind = ""
+	// PropertyParking парковочное место
+	PropertyParking PropertyKind = "parking"
+)
+
 type tPrivatePropertyItem struct {
 	HouseID         uint64
 	ApartmentNumber string
 	Approved        bool
+	// RequestedAt когда резидентство запросили. Пусто у заявок из снапшотов до появления поля.
+	RequestedAt time.Time `json:",omitempty"`
+	// Kind квартира или парковочное место
+	Kind PropertyKind `json:",omitempty"`
+	// HouseNumber номер дома для поиска резидентов по квартире. Пусто у заявок из снапшотов до появления поля.
+	HouseNumber string `json:",omitempty"`
+	// Residency собственник, арендатор или член семьи собственника
+	Residency Residency `json:",omitempty"`
+	// ExpiresAt до какого момента действует резидентство арендатора. Пусто - бессрочно.
+	ExpiresAt time.Time `json:",omitempty"`
+	// SubmittedAt когда прислали документ по заявке. Пусто - документ ещё не прислан или регистратор попросил новый.
+	SubmittedAt time.Time `json:",omitempty"`
+	// DocumentRequired без документа заявка не ждёт регистратора. Пусто у заявок до появления отметки о документе.
+	DocumentRequired bool `json:",omitempty"`
+	// InvitedBy основной резидент, пригласивший в квартиру домочадцем. 0 - квартира подтверждена документами.
+	InvitedBy int64 `json:",omitempty"`
+}
+
+// WaitingReviewSince с какого момента заявка ждёт регистратора: с присланного документа,
+// а заявки до появления отметки о документе - с момента запроса. ok=false, если ждать нечего.
+func (ppi tPrivatePropertyItem) WaitingReviewSince() (since time.Time, ok bool) {
+	switch {
+	case ppi.Approved:
+		return time.Time{}, false
+	case !ppi.SubmittedAt.IsZero():
+		return ppi.SubmittedAt, true
+	case ppi.DocumentRequired:
+		return time.Time{}, false
+	}
+	return ppi.RequestedAt, true
 }
 
 func (ppi tPrivatePropertyItem) Key() string {
-	return fmt.Sprintf("%d:%s", ppi.HouseID, ppi.ApartmentNumber)
+	if ppi.Kind == PropertyApartment {
+		return fmt.Sprintf("%d:%s", ppi.HouseID, ppi.ApartmentNumber)
+	}
+	return fmt.Sprintf("%d:%s:%s", ppi.HouseID, ppi.Kind, ppi.ApartmentNumber)
 }
 
 type tPrivatePropertySet struct {
 	Items map[string]tPrivatePropertyItem
 }
 
-func (p *tPrivatePropertySet) Add(HouseID uint64, ApartmentNumber string) {
+func (p *tPrivatePropertySet) Add(ppi tPrivatePropertyItem) {
 	if p.Items == nil {
 		p.Items = make(map[string]tPrivatePropertyItem)
 	}
-	ppi := tPrivatePropertyItem{HouseID: HouseID, ApartmentNumber: ApartmentNumber}
 	p.Items[ppi.Key()] = ppi
 }
 
-func (p *tPrivatePropertySet) Approve(id uint64, apartment string) {
+func (p *tPrivatePropertySet) Approve(kind PropertyKind, id uint64, apartment string) bool {
 	if p.Items == nil {
 		p.Items = make(map[string]tPrivatePropertyItem)
 	}
-	ppi, ok := p.Items[tPrivatePropertyItem{HouseID: id, ApartmentNumber: apartment}.Key()]
+	ppi, ok := p.Items[tPrivatePropertyItem{Kind: kind, HouseID: id, ApartmentNumber: apartment}.Key()]
 	if !ok {
-		return
+		return false
 	}
 	ppi.Approved = true
 	p.Items[ppi.Key()] = ppi
+	return true
 }
 
-func (p *tPrivatePropertySet) RemoveIfNotApproved(id uint64, apartment string) {
+func (p *tPrivatePropertySet) RemoveIfNotApproved(kind PropertyKind, id uint64, apartment string) {
 	if p.Items == nil {
 		p.Items = make(map[string]tPrivatePropertyItem)
 	}
-	ppi := p.Items[tPrivatePropertyItem{HouseID: id, ApartmentNumber: apartment}.Key()]
+	ppi := p.Items[tPrivatePropertyItem{Kind: kind, HouseID: id, ApartmentNumber: apartment}.Key()]
 	if ppi.Approved {
 		return
 	}
 	delete(p.Items, ppi.Key())
 }
 
+// SetSubmitted отмечает, когда по заявке прислали документ. Пустое время снимает отметку, и заявка ждёт новый документ.
+func (p *tPrivatePropertySet) SetSubmitted(kind PropertyKind, id uint64, apartment string, at time.Time) {
+	ppi, ok := p.Items[tPrivatePropertyItem{Kind: kind, HouseID: id, ApartmentNumber: apartment}.Key()]
+	if !ok || ppi.Approved {
+		return
+	}
+	ppi.SubmittedAt = at
+	if at.IsZero() {
+		ppi.DocumentRequired = true
+	}
+	p.Items[ppi.Key()] = ppi
+}
+
+// Find квартира или место по дому и номеру
+func (p tPrivatePropertySet) Find(kind PropertyKind, id uint64, apartment string) (tPrivatePropertyItem, bool) {
+	ppi, ok := p.Items[tPrivatePropertyItem{Kind: kind, HouseID: id, ApartmentNumber: apartment}.Key()]
+	return ppi, ok
+}
+
+// List вся собственность по порядку: дом, квартиры перед парковками, номер
+func (p tPrivatePropertySet) List() []tPrivatePropertyItem {
+	items := make([]tPrivatePropertyItem, 0, len(p.Items))
+	for _, ppi := range p.Items {
+		items = append(items, ppi)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		a, b := items[i], items[j]
+		if a.HouseID != b.HouseID {
+			return a.HouseID < b.HouseID
+		}
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		if len(a.ApartmentNumber) != len(b.ApartmentNumber) {
+			return len(a.ApartmentNumber) < len(b.ApartmentNumber)
+		}
+		return a.ApartmentNumber < b.ApartmentNumber
+	})
+	return items
+}
+
 type User struct {
 	ID                 int64
 	Username           string
@@ -121,7 +205,14 @@ type User struct {
 	IsApprovedResident bool
 	Registration       *tRegistration `json:"-"`
 	PrivateProperty    tPrivatePropertySet
-	Events             []any `json:"-"`
+	// Roles роли, выданные событиями. Разработчик из конфигурации учитывается в [UserRepository.RolesOf].
+	Roles UserRoles `json:",omitempty"`
+	// Household приглашения и домочадцы в квартирах пользователя
+	Household tHousehold `json:",omitempty"`
+	Events    []any      `json:"-"`
+	// StreamVersion количество событий в потоке пользователя на момент чтения.
+	// Передаётся в AppendEvent, чтобы не записать событие поверх чужого.
+	StreamVersion int64 `json:"-"`
 }
 
 func (u *User) Scan(ctx context.Context, res result.Result) error {
@@ -137,6 +228,35 @@ func (u *User) Scan(ctx context.Context, res result.Result) error {
 	)
 }
 
+// Title пользователь для сообщений администраторам: @username и идентификатор
+func (u *User) Title() string {
+	if u.Username != "" {
+		return fmt.Sprintf("@%s (%d)", u.Username, u.ID)
+	}
+	return fmt.Sprint(u.ID)
+}
+
+// ResidentApartments подтверждённые квартиры, резидентство в которых не истекло к now:
+// из старой регистрации и из подтверждённых заявок на квартиры
+func (u *User) ResidentApartments(now time.Time) []Apartment {
+	return u.approvedApartments(func(ppi tPrivatePropertyItem) bool { return !ppi.Expired(now) })
+}
+
+// approvedApartments подтверждённые квартиры, в том числе с истёкшей арендой, для которых keep истинно
+func (u *User) approvedApartments(keep func(tPrivatePropertyItem) bool) []Apartment {
+	apartments := append([]Apartment(nil), u.Apartments...)
+	for _, ppi := range u.PrivateProperty.List() {
+		if !ppi.Approved || ppi.Kind != PropertyApartment || ppi.HouseNumber == "" || !keep(ppi) {
+			continue
+		}
+		apartment := Apartment{HouseNumber: ppi.HouseNumber, HouseID: ppi.HouseID, ApartmentNumber: ppi.ApartmentNumber}
+		if !slices.Contains(apartments, apartment) {
+			apartments = append(apartments, apartment)
+		}
+	}
+	return apartments
+}
+
 func (u *User) HavePendingRegistration() bool {
 	for _, v := range u.PrivateProperty.Items {
 		if v.Approved == false {
@@ -151,9 +271,30 @@ type UserEventRecord struct {
 	Timestamp time.Time
 	ID        string
 	Type      string
+	Version   uint32
 	Event     UserEvent
 }
 
+// apply применяет событие, передавая в Apply время его записи
+func (u *UserEventRecord) apply(ctx context.Context, user *User) {
+	u.Event.Apply(withEventTime(ctx, u.Timestamp), user)
+}
+
+type eventTimeKeyType int
+
+var eventTimeKey eventTimeKeyType
+
+// withEventTime время записи события для Apply: сами события время не хранят, оно есть только в записи потока
+func withEventTime(ctx context.Context, t time.Time) context.Context {
+	return context.WithValue(ctx, eventTimeKey, t)
+}
+
+// eventTime время записи применяемого события. Пусто, если событие применяют не из потока.
+func eventTime(ctx context.Context) time.Time {
+	t, _ := ctx.Value(eventTimeKey).(time.Time)
+	return t
+}
+
 func (u *UserEventRecord) Scan(ctx context.Context, res result.Result) error {
 	ctx, span := tracer.Open(ctx, tracer.Named("UserEventRecord::Scan"))
 	defer span.Close()
@@ -163,53 +304,69 @@ func (u *UserEventRecord) Scan(ctx context.Context, res result.Result) error {
 		named.OptionalWithDefault("timestamp", &u.Timestamp),
 		named.OptionalWithDefault("id", &u.ID),
 		named.OptionalWithDefault("type", &u.Type),
+		named.OptionalWithDefault("version", &u.Version),
 		named.OptionalWithDefault("event", &eventBytes),
 	); err != nil {
 		return fmt.Errorf("скан UserEventRecord: %w", err)
 	}
-	var event = SelectType(ctx, u.Type)
+	event, err := decodeUserEvent(ctx, u.Type, u.Version, eventBytes)
+	if err != nil {
+		return &CorruptEventError{Record: *u, Payload: eventBytes, Reason: err}
+	}
+	u.Event = event
+	return nil
+}
+
+// decodeUserEvent восстанавливает событие по типу, версии схемы и сохранённому json.
+// Старые версии поднимаются апкастерами до текущей. Общий путь для всех хранилищ.
+func decodeUserEvent(ctx context.Context, eventType string, version uint32, eventBytes []byte) (UserEvent, error) {
+	var event = SelectType(ctx, eventType)
 	if event == nil {
-		return fmt.Errorf("не удалось найти тип для %s", u.Type)
+		return nil, fmt.Errorf("не удалось найти тип для %s", eventType)
+	}
+	eventBytes, err := upcastUserEvent(eventType, version, eventVersionOf(event), eventBytes)
+	if err != nil {
+		return nil, err
 	}
 	if err := json.Unmarshal(eventBytes, &event); err != nil {
-		return fmt.Errorf("парсинг события %s [%s]: %w", u.Type, string(eventBytes), err)
+		return nil, fmt.Errorf("парсинг события %s [%s]: %w", eventType, string(eventBytes), err)
 	}
-	u.Event = event
-	return nil
+	return event, nil
 }
 
 type ydbDriver interface {
 	Table() table.Client
+	Name() string
 }
 
-type UserRepository struct {
+// YDBUserStorage хранилище пользователей в YDB: таблицы user, user_event, справочники и снапшоты
+type YDBUserStorage struct {
 	DB  ydbDriver
 	log *zap.Logger
 }
 
-func NewUserRepository(ctx context.Context, ydb *ydb.Driver, log *zap.Logger) (*UserRepository, error) {
-	ctx, span := tracer.Open(ctx, tracer.Named("NewUserRepository"))
-	defer span.Close()
-	return &UserRepository{DB: ydb, log: log}, nil
+func NewYDBUserStorage(ydb *ydb.Driver, log *zap.Logger) *YDBUserStorage {
+	return &YDBUserStorage{DB: ydb, log: log}
 }
 
 // SELECT USER by USERNAME AND ID
 
-type getUserOption = func(ctx context.Context, s table.Session) (*User, error)
-
-func (r *UserRepository) postGetUserOptionToUserScanner(ctx context.Context, s table.Session, res result.Result, err error) (*User, error) {
+func (r *YDBUserStorage) postGetUserOptionToUserScanner(ctx context.Context, s table.Session, res result.Result, err error) (*User, error) {
 	ctx, span := tracer.Open(ctx)
 	defer span.Close()
 	defer r.log.Debug("Закончил доставать пользователя из базы")
 	if err != nil {
-		return nil, fmt.Errorf("UserRepository::postGetUserOptionToUserScanner: %w", err)
+		return nil, fmt.Errorf("YDBUserStorage::postGetUserOptionToUserScanner: %w", err)
 	}
 	defer res.Close()
 	if !res.NextResultSet(ctx) {
 		return nil, fmt.Errorf("не нашел result set для пользователя")
 	}
 	if !res.NextRow() {
-		return nil, fmt.Errorf("postGetUserOptionToUserScanner: пользователь не найден: %w", res.Err())
+		if err := res.Err(); err != nil {
+			return nil, fmt.Errorf("postGetUserOptionToUserScanner: %w", err)
+		}
+		return nil, fmt.Errorf("postGetUserOptionToUserScanner: пользователь: %w", ErrNotFound)
 	}
 	var user User
 	if err := user.Scan(ctx, res); err != nil {
@@ -221,13 +378,10 @@ func (r *UserRepository) postGetUserOptionToUserScanner(ctx context.Context, s t
 	return &user, nil
 }
 
-func (r *UserRepository) ByID(userID int64) func(ctx context.Context, s table.Session) (*User, error) {
+func (r *YDBUserStorage) byIDUncached(userID int64) func(ctx context.Context, s table.Session) (*User, error) {
 	return func(ctx context.Context, s table.Session) (*User, error) {
 		ctx, span := tracer.Open(ctx)
 		defer span.Close()
-		if user := CurrentUserFromContext(ctx); user != nil && user.ID == userID {
-			return user, nil
-		}
 		_, res, err := s.Execute(ctx, table.DefaultTxControl(),
 			`DECLARE $id AS Int64;
 SELECT * FROM user WHERE id = $id LIMIT 1;`,
@@ -237,13 +391,10 @@ SELECT * FROM user WHERE id = $id LIMIT 1;`,
 	}
 }
 
-func (r *UserRepository) ByUsername(username string) func(ctx context.Context, s table.Session) (*User, error) {
+func (r *YDBUserStorage) byUsername(username string) func(ctx context.Context, s table.Session) (*User, error) {
 	return func(ctx context.Context, s table.Session) (*User, error) {
 		ctx, span := tracer.Open(ctx)
 		defer span.Close()
-		if user := CurrentUserFromContext(ctx); user != nil && user.Username == username {
-			return user, nil
-		}
 		_, res, err := s.Execute(ctx, table.DefaultTxControl(),
 			`DECLARE $username AS Utf8;
 SELECT * FROM user WHERE username = $username LIMIT 1;`,
@@ -253,15 +404,36 @@ SELECT * FROM user WHERE username = $username LIMIT 1;`,
 	}
 }
 
-func (r *UserRepository) applyEvents(ctx context.Context, s table.Session, user *User) error {
-	ctx, span := tracer.Open(ctx, tracer.Named("UserRepository::applyEvents"))
+func (r *YDBUserStorage) applyEvents(ctx context.Context, s table.Session, user *User) error {
+	ctx, span := tracer.Open(ctx, tracer.Named("YDBUserStorage::applyEvents"))
 	defer span.Close()
 	defer r.log.Debug("Закончил применять события")
-	_, res, err := s.Execute(ctx, table.DefaultTxControl(),
-		`DECLARE $id AS Int64;
-SELECT * FROM user_event WHERE user = $id ORDER BY user, timestamp, id;`,
-		table.NewQueryParameters(table.ValueParam("$id", types.Int64Value(user.ID))),
-	)
+	snapshot, err := r.loadSnapshot(ctx, s, user.ID)
+	if err != nil {
+		// без снапшота просто проиграем всю историю
+		r.logSnapshotError(err, user.ID)
+		snapshot = nil
+	}
+	query := `DECLARE $id AS Int64;
+SELECT * FROM user_event WHERE user = $id ORDER BY user, timestamp, id;`
+	params := table.NewQueryParameters(table.ValueParam("$id", types.Int64Value(user.ID)))
+	var position userEventPosition
+	if snapshot != nil {
+		snapshot.State.restore(user)
+		position = snapshot.Position
+		user.StreamVersion = snapshot.StreamVersion
+		query = `DECLARE $id AS Int64;
+DECLARE $timestamp AS Timestamp;
+DECLARE $event_id AS String;
+SELECT * FROM user_event
+WHERE user = $id AND (timestamp > $timestamp OR (timestamp = $timestamp AND id > $event_id))
+ORDER BY user, timestamp, id;`
+		params.Add(
+			table.ValueParam("$timestamp", types.TimestampValueFromTime(position.Timestamp)),
+			table.ValueParam("$event_id", types.StringValueFromString(position.ID)),
+		)
+	}
+	_, res, err := s.Execute(ctx, table.DefaultTxControl(), query, params)
 	if err != nil {
 		return fmt.Errorf("SELECT user_event [id=%d]: %w", user.ID, err)
 	}
@@ -269,19 +441,72 @@ SELECT * FROM user_event WHERE user = $id ORDER BY user, timestamp, id;`,
 	if !res.NextResultSet(ctx) {
 		return fmt.Errorf("не нашел result set для событий пользователя; возможно невалидный запрос")
 	}
+	var applied int
+	var corrupt []*CorruptEventError
 	for res.NextRow() {
+		user.StreamVersion++
 		var event UserEventRecord
 		if err := event.Scan(ctx, res); err != nil {
+			if c, ok := asCorruptEvent(err); ok {
+				corrupt = append(corrupt, c)
+				continue
+			}
 			return fmt.Errorf("не смог события пользователя: %w", err)
 		}
 		r.log.Debug("Применяю собятие", zap.Any("event", event))
-		event.Event.Apply(ctx, user)
+		event.apply(ctx, user)
 		user.Events = append(user.Events, event)
+		position = userEventPosition{Timestamp: event.Timestamp, ID: event.ID}
+		applied++
+	}
+	if err := res.Err(); err != nil {
+		return errors.ErrorfOrNil(err, "applyEvents [id=%d]", user.ID)
+	}
+	r.quarantine(ctx, s, corrupt)
+	// снапшот после пропущенного события зафиксировал бы состояние без него, а событие ещё могут исправить
+	if applied > 0 && len(corrupt) == 0 {
+		r.logSnapshotError(r.saveSnapshot(ctx, s, user, position), user.ID)
+	}
+	return nil
+}
+
+func (r *YDBUserStorage) EventHistory(ctx context.Context, userID int64) ([]UserEventRecord, error) {
+	ctx, span := tracer.Open(ctx)
+	defer span.Close()
+	var history []UserEventRecord
+	err := r.smartExecute(ctx, func(ctx context.Context, s table.Session) error {
+		history = nil
+		_, res, err := s.Execute(ctx, table.DefaultTxControl(), `DECLARE $id AS Int64;
+SELECT * FROM user_event WHERE user = $id ORDER BY user, timestamp, id;`,
+			table.NewQueryParameters(table.ValueParam("$id", types.Int64Value(userID))),
+		)
+		if err != nil {
+			return err
+		}
+		defer res.Close()
+		if !res.NextResultSet(ctx) {
+			return fmt.Errorf("не нашел result set для событий пользователя; возможно невалидный запрос")
+		}
+		for res.NextRow() {
+			var event UserEventRecord
+			if err := event.Scan(ctx, res); err != nil {
+				if _, ok := asCorruptEvent(err); ok {
+					// испорченные события разбирает карантин
+					continue
+				}
+				return fmt.Errorf("не смог события пользователя: %w", err)
+			}
+			history = append(history, event)
+		}
+		return res.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("история событий [id=%d]: %w", userID, err)
 	}
-	return errors.ErrorfOrNil(res.Err(), "applyEvents [id=%d]", user.ID)
+	return history, nil
 }
 
-func (r *UserRepository) ClearEvents(ctx context.Context, userID int64) error {
+func (r *YDBUserStorage) ClearEvents(ctx context.Context, userID int64) error {
 	ctx, span := tracer.Open(ctx)
 	defer span.Close()
 	return r.smartExecute(ctx, func(ctx context.Context, s table.Session) error {
@@ -293,30 +518,27 @@ func (r *UserRepository) ClearEvents(ctx context.Context, userID int64) error {
 			"DECLARE $id AS Int64; DELETE FROM user_event WHERE user = $id;",
 			table.NewQueryParameters(table.ValueParam("$id", types.Int64Value(userID))),
 		)
-		return err
+		if err != nil {
+			return err
+		}
+		if err := r.deleteSnapshot(ctx, s, userID); err != nil {
+			return err
+		}
+		return r.clearLookups(ctx, s, userID)
 	})
 }
 
-type currentUserInContextKeyType int
-
-var currentUserInContextKey currentUserInContextKeyType
-
-func CurrentUserFromContext(ctx context.Context) *User {
-	u, _ := ctx.Value(currentUserInContextKey).(*User)
-	return u
-}
-
-func PutCurrentUserToContext(ctx context.Context, user *User) context.Context {
-	return context.WithValue(ctx, currentUserInContextKey, user)
-}
-
-func (r *UserRepository) GetUser(ctx context.Context, userQueryExecutor getUserOption) (*User, error) {
+func (r *YDBUserStorage) GetUser(ctx context.Context, query UserQuery) (*User, error) {
 	ctx, span := tracer.Open(ctx)
 	defer span.Close()
-	defer r.log.Debug("Закончил UserRepository::GetUser")
+	defer r.log.Debug("Закончил YDBUserStorage::GetUser")
+	userQueryExecutor := r.byIDUncached(query.ID)
+	if query.Username != "" {
+		userQueryExecutor = r.byUsername(query.Username)
+	}
 	var user *User
 	if err := r.smartExecute(ctx, func(ctx context.Context, s table.Session) error {
-		ctx, span := tracer.Open(ctx, tracer.Named("UserRepository::getUser::Do"))
+		ctx, span := tracer.Open(ctx, tracer.Named("YDBUserStorage::getUser::Do"))
 		defer span.Close()
 		var err error
 		user, err = userQueryExecutor(ctx, s)
@@ -330,20 +552,21 @@ func (r *UserRepository) GetUser(ctx context.Context, userQueryExecutor getUserO
 	return user, nil
 }
 
-func (r *UserRepository) smartExecute(ctx context.Context, fn func(ctx context.Context, s table.Session) error) error {
+func (r *YDBUserStorage) smartExecute(ctx context.Context, fn func(ctx context.Context, s table.Session) error) error {
 	if sess := ydbctx.YdbSessionFromContext(ctx); sess != nil {
 		return fn(ctx, sess)
 	}
 	return r.DB.Table().Do(ctx, fn, table.WithIdempotent())
 }
 
-func (r *UserRepository) GetAllUsers(ctx context.Context) ([]*User, error) {
+func (r *YDBUserStorage) GetAllUsers(ctx context.Context) ([]*User, error) {
 	ctx, span := tracer.Open(ctx)
 	defer span.Close()
 	var users []*User
 	var events []*UserEventRecord
+	var corrupt []*CorruptEventError
 	executeSelectAllUsers := func(ctx context.Context, s table.Session) error {
-		ctx, span := tracer.Open(ctx, tracer.Named("UserRepository::GetAllUsers::executeSelectAllUsers"))
+		ctx, span := tracer.Open(ctx, tracer.Named("YDBUserStorage::GetAllUsers::executeSelectAllUsers"))
 		defer span.Close()
 		var err error
 		query := `SELECT * FROM user ORDER BY id;
@@ -365,16 +588,35 @@ func (r *UserRepository) GetAllUsers(ctx context.Context) ([]*User, error) {
 		for res.NextRow() {
 			var userEvent = new(UserEventRecord)
 			if err := userEvent.Scan(ctx, res); err != nil {
+				if c, ok := asCorruptEvent(err); ok {
+					corrupt = append(corrupt, c)
+					continue
+				}
 				return fmt.Errorf("скан userevent: %w", err)
 			}
 			events = append(events, userEvent)
 		}
-		return res.Err()
+		if err := res.Err(); err != nil {
+			return err
+		}
+		r.quarantine(ctx, s, corrupt)
+		return nil
 	}
 	if err := r.smartExecute(ctx, executeSelectAllUsers); err != nil {
 		return nil, err
 	}
 
+	streamVersions := make(map[int64]int64)
+	for _, e := range events {
+		streamVersions[e.User]++
+	}
+	for _, c := range corrupt {
+		streamVersions[c.Record.User]++
+	}
+	for _, u := range users {
+		u.StreamVersion = streamVersions[u.ID]
+	}
+
 	var i, j int
 	for i < len(users) && j < len(events) {
 		u := users[i]
@@ -392,52 +634,62 @@ func (r *UserRepository) GetAllUsers(ctx context.Context) ([]*User, error) {
 		if e.User != u.ID {
 			return nil, fmt.Errorf("something wrong with this logic")
 		}
-		e.Event.Apply(ctx, u)
+		e.apply(ctx, u)
 		j++
 	}
 
 	return users, nil
 }
 
-var ErrNotFound = fmt.Errorf("not found")
-
 // FindByVehicleLicensePlate implements bot.UserByVehicleLicensePlateRepository.
-func (r *UserRepository) FindByVehicleLicensePlate(ctx context.Context, vehicleLicensePlate string) (*User, error) {
-	ctx, span := tracer.Open(ctx, tracer.Named("UserRepository::FindByVehicleLicensePlate"))
+func (r *YDBUserStorage) FindByVehicleLicensePlate(ctx context.Context, vehicleLicensePlate string) (*User, error) {
+	ctx, span := tracer.Open(ctx, tracer.Named("YDBUserStorage::FindByVehicleLicensePlate"))
 	defer span.Close()
-	users, err := r.GetAllUsers(ctx)
+	ids, err := r.selectLookupUserIDs(ctx,
+		`DECLARE $plate AS Utf8;
+SELECT user_id FROM user_by_plate WHERE plate = $plate;`,
+		table.NewQueryParameters(table.ValueParam("$plate", types.UTF8Value(vehicleLicensePlate))),
+	)
 	if err != nil {
 		return nil, err
 	}
-	for _, user := range users {
+	return r.firstMatchingUser(ctx, ids, func(user *User) bool {
 		for _, car := range user.Cars {
 			if car.LicensePlate == vehicleLicensePlate {
-				return user, nil
+				return true
 			}
 		}
-	}
-	return nil, ErrNotFound
+		return false
+	})
 }
 
-func (r *UserRepository) FindByAppartment(ctx context.Context, house string, appartment string) (*User, error) {
-	ctx, span := tracer.Open(ctx, tracer.Named("UserRepository::FindByAppartment"))
+func (r *YDBUserStorage) FindByAppartment(ctx context.Context, house string, appartment string) (*User, error) {
+	ctx, span := tracer.Open(ctx, tracer.Named("YDBUserStorage::FindByAppartment"))
 	defer span.Close()
-	users, err := r.GetAllUsers(ctx)
+	ids, err := r.selectLookupUserIDs(ctx,
+		`DECLARE $house AS Utf8;
+DECLARE $apartment AS Utf8;
+SELECT user_id FROM user_by_apartment WHERE house = $house AND apartment = $apartment;`,
+		table.NewQueryParameters(
+			table.ValueParam("$house", types.UTF8Value(house)),
+			table.ValueParam("$apartment", types.UTF8Value(appartment)),
+		),
+	)
 	if err != nil {
 		return nil, err
 	}
-	for _, user := range users {
-		for _, appart := range user.Apartments {
+	return r.firstMatchingUser(ctx, ids, func(user *User) bool {
+		for _, appart := range user.ResidentApartments(time.Now()) {
 			if appart.HouseNumber == house && appart.ApartmentNumber == appartment {
-				return user, nil
+				return true
 			}
 		}
-	}
-	return nil, ErrNotFound
+		return false
+	})
 }
 
-func (r *UserRepository) UpsertUsername(ctx context.Context, userID int64, username string) {
-	ctx, span := tracer.Open(ctx, tracer.Named("UserRepository::UpsertUsername"))
+func (r *YDBUserStorage) UpsertUsername(ctx context.Context, userID int64, username string) {
+	ctx, span := tracer.Open(ctx, tracer.Named("YDBUserStorage::UpsertUsername"))
 	defer span.Close()
 	if err := r.smartExecute(ctx, func(ctx context.Context, s table.Session) error {
 		ctx, span := tracer.Open(ctx, tracer.Named("Do Upsert user"))
@@ -463,83 +715,6 @@ func (r *UserRepository) UpsertUsername(ctx context.Context, userID int64, usern
 	}
 }
 
-func (r *UserRepository) IsResident(ctx context.Context, userID int64) bool {
-	ctx, span := tracer.Open(ctx, tracer.Named("UserRepository::IsResident"))
-	defer span.Close()
-	user, err := r.GetUser(ctx, r.ByID(userID))
-	if err != nil {
-		r.log.Error("Проблема определения резидентности", zap.Error(err))
-		return false
-	}
-	return user.IsApprovedResident
-}
-
-func (r *UserRepository) IsAdmin(ctx context.Context, userID int64) bool {
-	_, span := tracer.Open(ctx, tracer.Named("UserRepository::IsAdmin"))
-	defer span.Close()
-	return userID == devbotsender.DeveloperID
-}
-
-func GenerateApproveCode(ctx context.Context, length int) string {
-	_, span := tracer.Open(ctx, tracer.Named("GenerateApproveCode"))
-	defer span.Close()
-	alphabet := []rune("123456789ABCEHKMOPTX")
-	var code []rune
-	for i := 0; i < length; i++ {
-		code = append(code, alphabet[rand.Intn(len(alphabet))])
-	}
-	return string(code)
-}
-
-func (r *UserRepository) StartRegistration(ctx context.Context, userID int64, updateID int64, houseID uint64, houseNumber string, apartment string) (string, error) {
-	ctx, span := tracer.Open(ctx)
-	defer span.Close()
-	const CodeLength = 5
-	approveCode := GenerateApproveCode(ctx, CodeLength)
-	var invalidCodes []string
-	for i := 0; i < 5; i++ {
-		invalidCodes = append(invalidCodes, GenerateApproveCode(ctx, CodeLength))
-	}
-	if err := r.LogEvent(ctx, userID, &StartRegistrationEvent{
-		UpdateID:     updateID,
-		HouseID:      houseID,
-		HouseNumber:  houseNumber,
-		Apartment:    apartment,
-		ApproveCode:  approveCode,
-		InvalidCodes: invalidCodes,
-	}); err != nil {
-		return "", fmt.Errorf("регистрация пользователя: %w", err)
-	}
-	return approveCode, nil
-}
-
-func (r *UserRepository) ConfirmRegistration(ctx context.Context, userID int64, event ConfirmRegistrationEvent) error {
-	ctx, span := tracer.Open(ctx)
-	defer span.Close()
-	if err := r.LogEvent(ctx, userID, &event); err != nil {
-		return fmt.Errorf("подтверждение регистрации: %w", err)
-	}
-	return nil
-}
-
-func (r *UserRepository) FailRegistration(ctx context.Context, userID int64, event FailRegistrationEvent) error {
-	ctx, span := tracer.Open(ctx)
-	defer span.Close()
-	if err := r.LogEvent(ctx, userID, &event); err != nil {
-		return fmt.Errorf("проваленная регистрация: %w", err)
-	}
-	return nil
-}
-
-func (r *UserRepository) RegisterCarLicensePlate(ctx context.Context, userID int64, event RegisterCarLicensePlateEvent) error {
-	ctx, span := tracer.Open(ctx)
-	defer span.Close()
-	if err := r.LogEvent(ctx, userID, &event); err != nil {
-		return fmt.Errorf("провалена регистрация авто: %w", err)
-	}
-	return nil
-}
-
 type UserRegistrationApproveToken struct {
 	UserID      int64
 	ApproveCode string